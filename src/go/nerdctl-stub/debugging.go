@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strings"
 )
 
 // describeCommands is a debugging function that prints out all commands.
@@ -45,7 +46,8 @@ func describeCommands() {
 	sort.Strings(paths)
 	for _, path := range paths {
 		command := commands[path]
-		log.Printf("%-20s %v", path, command.handler) //nolint:govet,printf
+		name := strings.ReplaceAll(path, commandKeySeparator, " ")
+		log.Printf("%-20s %v", name, command.handler) //nolint:govet,printf
 		var optionNames []string
 		for optionName := range command.options {
 			optionNames = append(optionNames, optionName)
@@ -2,11 +2,14 @@ module github.com/rancher-sandbox/rancher-desktop/src/go/nerdctl-stub/generate
 
 go 1.22.0
 
-require github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af
+require (
+	github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af
+	github.com/stretchr/testify v1.10.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,20 +1,29 @@
 // package main produces stubs for the nerdctl subcommands (and their
 // options); this is expected to be overridden for options that involve paths.
-// All options generated this will have their values ignored.
+// All options generated this will have their values ignored, unless a handler
+// is given for them in the overrides file.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/format"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 )
@@ -22,16 +31,56 @@ import (
 // nerdctl contains the path to the nerdctl binary to run.
 var nerdctl = "/usr/local/bin/nerdctl"
 
+// nerdctlExec, if set, is the command (and leading arguments) used to run
+// nerdctl instead of running the binary directly; for example, this can be
+// used to run nerdctl inside a container.
+var nerdctlExec []string
+
+// helpTimeout is the maximum time to wait for nerdctl to print help for a
+// single subcommand.
+var helpTimeout = 30 * time.Second
+
+// skipErrors causes subcommands where we fail to get help to be skipped
+// (with a warning), rather than aborting generation.
+var skipErrors bool
+
+// excludeDeprecated causes subcommands and options that nerdctl describes as
+// deprecated to be left out, as they may be removed.
+var excludeDeprecated bool
+
+// hoistInherited causes options that appear identically in every subcommand of
+// a command to be moved to that command, as they are most likely inherited.
+var hoistInherited bool
+
+// overrides maps the space-separated path of a command to the options whose
+// values should be handled by the named handler instead of ignoredArgHandler.
+var overrides map[string]map[string]string
+
 // outputPath is the file we should generate.
 var outputPath = "../nerdctl_commands_generated.go"
 
+// manifestPath, if set, is where to write the manifest of the generated
+// commands.
+var manifestPath string
+
+// commandsPerChunk is the maximum number of commands in each of the map
+// literals that make up the commands map, to avoid one huge literal that is
+// slow to compile.
+var commandsPerChunk = 32
+
 type helpData struct {
-	// Commands lists the subcommands available
+	// Commands lists the subcommands available; this only includes the
+	// canonical name of each subcommand.
 	Commands []string
+	// Aliases maps alternative names of subcommands to their canonical names.
+	Aliases map[string]string
 	// options available for this command; the key is the long option
 	// (`--version`) or the short option (`-v`), and the value is whether the
 	// option takes an argument.
 	Options map[string]bool
+	// Descriptions of options, as given in the help text; the key is the same
+	// as in Options.
+	Descriptions map[string]string
 	// mergedOptions includes local options plus inherited options.
 	mergedOptions map[string]struct{}
 }
@@ -42,29 +91,165 @@ const prologueTemplate = `
 
 // package main implements a stub for nerdctl
 package main
+`
+
+// chunkPrologueTemplate describes the start of each chunk of commands.
+const chunkPrologueTemplate = `
+// {{ . }} is part of commands.
+var {{ . }} = map[string]commandDefinition {
+`
 
-// commands supported by nerdctl; the key here is a space-separated subcommand
-// path to reach the given subcommand (where the root command is empty).
-var commands = map[string]commandDefinition {
+// chunkEpilogueTemplate describes the end of each chunk of commands.
+const chunkEpilogueTemplate = `
+}
 `
 
 // epilogueTemplate describes the file trailer for the generated file.
 const epilogueTemplate = `
+// commands supported by nerdctl; the key here is the commandKey of the
+// subcommand path to reach the given subcommand (where the root command has an
+// empty path).
+var commands = mergeCommands(
+	{{- range .chunks }}
+	{{ . }},
+	{{- end }}
+)
+
+// knownCommands lists the top-level nerdctl subcommands, sorted.
+var knownCommands = []string {
+	{{- range .commands }}
+	{{ printf "%q" . }},
+	{{- end }}
 }
 `
 
 func main() {
 	verbose := flag.Bool("verbose", false, "extra logging")
+	flag.DurationVar(&helpTimeout, "timeout", helpTimeout, "maximum time to wait for help for each subcommand")
+	flag.BoolVar(&skipErrors, "skip-errors", false, "skip subcommands where help could not be retrieved")
+	flag.BoolVar(&excludeDeprecated, "exclude-deprecated", false, "skip subcommands and options described as deprecated")
+	flag.BoolVar(&hoistInherited, "hoist-inherited", false, "move options found in every subcommand of a command to that command")
+	check := flag.Bool("check", false, "check that the existing output is up to date, without overwriting it")
+	execPrefix := flag.String("exec", "", `command used to run nerdctl, e.g. "docker run --rm image nerdctl"`)
+	jsonOutput := flag.Bool("json", false, "write the commands as JSON to standard output, instead of generating Go code")
+	overridesPath := flag.String("overrides", "", "JSON file mapping command paths to options to the handlers to use for them")
+	flag.StringVar(&manifestPath, "manifest", "", "also write a JSON manifest of the generated commands to this file")
 	flag.Parse()
 	if *verbose {
 		logrus.SetLevel(logrus.TraceLevel)
 	}
+	var err error
+	if nerdctlExec, err = splitCommandLine(*execPrefix); err != nil {
+		logrus.WithError(err).Fatal("could not parse -exec")
+	}
+	if *overridesPath != "" {
+		if overrides, err = loadOverrides(*overridesPath); err != nil {
+			logrus.WithError(err).Fatal("could not load overrides")
+		}
+	}
+
+	if *jsonOutput {
+		if err := generateJSON(context.Background(), os.Stdout); err != nil {
+			logrus.WithError(err).Fatal("could not generate JSON")
+		}
+		return
+	}
+
+	if *check {
+		var buf bytes.Buffer
+		if err := generate(context.Background(), &buf); err != nil {
+			logrus.WithError(err).Fatal("could not generate stubs")
+		}
+		if err := checkOutput(outputPath, buf.Bytes()); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
 
 	output, err := os.Create(outputPath)
 	if err != nil {
 		logrus.WithError(err).WithField("path", outputPath).Fatal("error creating output")
 	}
 	defer output.Close()
+	if err := generate(context.Background(), output); err != nil {
+		logrus.WithError(err).Fatal("could not generate stubs")
+	}
+}
+
+// splitCommandLine splits a command line into arguments on whitespace, roughly
+// as a POSIX shell would: single quotes preserve everything up to the next
+// single quote, and in double quotes or unquoted text a backslash escapes the
+// next character.  This allows executables with spaces in their paths.
+func splitCommandLine(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, char := range line {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case quote == '\'':
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '\'' || char == '"':
+			quote = char
+			inArg = true
+		case unicode.IsSpace(char):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", line)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, line)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// loadOverrides reads the overrides file at the given path; it is a JSON object
+// keyed by the space-separated command path (as in the JSON output), where each
+// value maps an option to the name of its handler, e.g.
+// `{"run": {"-v": "argHandlers.volumeArgHandler"}}`.
+func loadOverrides(path string) (map[string]map[string]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var result map[string]map[string]string
+	if err := json.Unmarshal(buf, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return result, nil
+}
+
+// generate writes the complete generated file to the given writer.
+func generate(ctx context.Context, writer io.Writer) error {
 	//nolint:dogsled // we only require the file name; we can also ignore `ok`, as
 	// on failure we just have no useful file name.
 	_, filename, _, _ := runtime.Caller(0)
@@ -74,68 +259,395 @@ func main() {
 	if buildInfo, ok := debug.ReadBuildInfo(); ok {
 		data["package"] = buildInfo.Main.Path
 	}
-	err = template.Must(template.New("").Parse(prologueTemplate)).Execute(output, data)
+	err := template.Must(template.New("").Parse(prologueTemplate)).Execute(writer, data)
+	if err != nil {
+		return fmt.Errorf("could not execute prologue: %w", err)
+	}
+	commandWriter := newCommandWriter(writer)
+	var emitter commandEmitter = commandWriter
+	var manifest *manifestEmitter
+	if manifestPath != "" {
+		manifest = &manifestEmitter{commandEmitter: commandWriter}
+		emitter = manifest
+	}
+	root, err := buildCommands(ctx, emitter)
+	if err != nil {
+		return fmt.Errorf("could not build subcommands: %w", err)
+	}
+	if err = commandWriter.Close(); err != nil {
+		return fmt.Errorf("could not finish commands: %w", err)
+	}
+	if manifest != nil {
+		if err = manifest.write(manifestPath); err != nil {
+			return fmt.Errorf("could not write manifest: %w", err)
+		}
+	}
+	data["chunks"] = commandWriter.chunks
+	data["commands"] = root.Commands
+	err = template.Must(template.New("").Parse(epilogueTemplate)).Execute(writer, data)
 	if err != nil {
-		logrus.WithError(err).Fatal("could not execute prologue")
+		return fmt.Errorf("could not execute epilogue: %w", err)
+	}
+	return nil
+}
+
+// jsonCommand is the JSON representation of a single subcommand.
+type jsonCommand struct {
+	// Subcommands lists the canonical names of the subcommands.
+	Subcommands []string `json:"subcommands"`
+	// Aliases maps alternative names of subcommands to their canonical names.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Options maps each option to whether it takes an argument.
+	Options map[string]bool `json:"options"`
+}
+
+// jsonEmitter is a commandEmitter that collects commands to output as JSON.
+type jsonEmitter struct {
+	// commands is keyed by the space-separated subcommand path.
+	commands map[string]jsonCommand
+}
+
+func (e *jsonEmitter) Emit(args []string, data helpData) error {
+	command := jsonCommand{
+		Subcommands: data.Commands,
+		Aliases:     data.Aliases,
+		Options:     data.Options,
+	}
+	if command.Subcommands == nil {
+		command.Subcommands = []string{}
 	}
-	err = buildSubcommand([]string{}, helpData{}, output)
+	if command.Options == nil {
+		command.Options = map[string]bool{}
+	}
+	e.commands[strings.Join(args, " ")] = command
+	return nil
+}
+
+// generateJSON writes the commands as JSON to the given writer.  This uses the
+// same data as the generated Go code, for consumption by other tools.
+func generateJSON(ctx context.Context, writer io.Writer) error {
+	emitter := &jsonEmitter{commands: make(map[string]jsonCommand)}
+	if _, err := buildCommands(ctx, emitter); err != nil {
+		return fmt.Errorf("could not build subcommands: %w", err)
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{"commands": emitter.commands}); err != nil {
+		return fmt.Errorf("could not write JSON: %w", err)
+	}
+	return nil
+}
+
+// manifestCommand is the manifest entry for a single generated subcommand.
+type manifestCommand struct {
+	// Path is the subcommand path to reach the command.
+	Path []string `json:"path"`
+	// Options lists all the options of the command, sorted.
+	Options []string `json:"options"`
+	// ArgOptions lists the options that take an argument, sorted.
+	ArgOptions []string `json:"argOptions"`
+}
+
+// manifestEmitter is a commandEmitter that records each command for the
+// manifest, before passing it on to the wrapped emitter.
+type manifestEmitter struct {
+	commandEmitter
+	commands []manifestCommand
+}
+
+func (e *manifestEmitter) Emit(args []string, data helpData) error {
+	command := manifestCommand{
+		Path:       append([]string{}, args...),
+		Options:    []string{},
+		ArgOptions: []string{},
+	}
+	for option, hasArg := range data.Options {
+		command.Options = append(command.Options, option)
+		if hasArg {
+			command.ArgOptions = append(command.ArgOptions, option)
+		}
+	}
+	slices.Sort(command.Options)
+	slices.Sort(command.ArgOptions)
+	e.commands = append(e.commands, command)
+	return e.commandEmitter.Emit(args, data)
+}
+
+// write writes the manifest, as JSON, to the file at the given path.
+func (e *manifestEmitter) write(path string) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"commands": e.commands}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// checkOutput compares the generated code against the existing file at the
+// given path, returning an error describing the differences if they do not
+// match.  Both are formatted first, so differences in `go fmt` are ignored.
+func checkOutput(path string, generated []byte) error {
+	existing, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	existing, err = format.Source(existing)
+	if err != nil {
+		return fmt.Errorf("failed to format %s: %w", path, err)
+	}
+	generated, err = format.Source(generated)
 	if err != nil {
-		logrus.WithError(err).Fatal("could not build subcommands")
+		return fmt.Errorf("failed to format generated code: %w", err)
+	}
+	if bytes.Equal(existing, generated) {
+		return nil
+	}
+	return fmt.Errorf("%s is out of date:\n%s", path, strings.Join(diffSummary(string(existing), string(generated)), "\n"))
+}
+
+// commandEntryPattern matches the first line of an entry in the commands map
+// of (formatted) generated code.
+var commandEntryPattern = regexp.MustCompile(`^\tcommandKey\(([^)]*)\): \{$`)
+
+// splitEntries splits formatted generated code into the entries of the
+// commands map (keyed by the quoted elements of the command path), plus
+// everything else.
+func splitEntries(source string) (map[string]string, string) {
+	entries := make(map[string]string)
+	var other strings.Builder
+	var key string
+	var entry strings.Builder
+	for _, line := range strings.SplitAfter(source, "\n") {
+		if key == "" {
+			if match := commandEntryPattern.FindStringSubmatch(strings.TrimRight(line, "\n")); match != nil {
+				key = match[1]
+				entry.Reset()
+			} else {
+				other.WriteString(line)
+				continue
+			}
+		}
+		entry.WriteString(line)
+		if line == "\t},\n" {
+			entries[key] = entry.String()
+			key = ""
+		}
+	}
+	return entries, other.String()
+}
+
+// diffSummary describes the differences between the existing and generated
+// code, one command per line.
+func diffSummary(existing, generated string) []string {
+	existingEntries, existingOther := splitEntries(existing)
+	generatedEntries, generatedOther := splitEntries(generated)
+	var result []string
+	for key, entry := range generatedEntries {
+		if existingEntry, ok := existingEntries[key]; !ok {
+			result = append(result, fmt.Sprintf("added command %s", key))
+		} else if existingEntry != entry {
+			result = append(result, fmt.Sprintf("changed command %s", key))
+		}
+	}
+	for key := range existingEntries {
+		if _, ok := generatedEntries[key]; !ok {
+			result = append(result, fmt.Sprintf("removed command %s", key))
+		}
 	}
-	err = template.Must(template.New("").Parse(epilogueTemplate)).Execute(output, data)
+	sort.Strings(result)
+	if existingOther != generatedOther {
+		result = append(result, "changed code outside of commands")
+	}
+	return result
+}
+
+// recordedCommand is a single command kept by commandRecorder.
+type recordedCommand struct {
+	args []string
+	data helpData
+}
+
+// commandRecorder is a commandEmitter that keeps every command, in order, so
+// that the whole tree can be checked before anything is emitted.
+type commandRecorder struct {
+	commands []recordedCommand
+}
+
+func (r *commandRecorder) Emit(args []string, data helpData) error {
+	r.commands = append(r.commands, recordedCommand{args: slices.Clone(args), data: data})
+	return nil
+}
+
+// buildCommands builds the whole command tree, checks it for inherited options
+// that were not recognized as such (moving them if hoistInherited is set), and
+// then passes each command, in order, to the given emitter.  The parsed help
+// for the root command is returned.
+func buildCommands(ctx context.Context, writer commandEmitter) (helpData, error) {
+	recorder := &commandRecorder{}
+	root, err := buildSubcommand(ctx, []string{}, helpData{}, recorder)
 	if err != nil {
-		logrus.WithError(err).Fatal("could not execute epilogue")
+		return helpData{}, err
+	}
+	for _, found := range checkInheritedOptions(recorder.commands, hoistInherited) {
+		entry := logrus.WithField("args", found.Parent)
+		if hoistInherited {
+			entry.Infof("moved option %s, found in every subcommand, to the parent command", found.Option)
+		} else {
+			entry.Warnf("option %s is in every subcommand, so it is probably inherited; pass -hoist-inherited to move it", found.Option)
+		}
 	}
+	for _, command := range recorder.commands {
+		if err = writer.Emit(command.args, command.data); err != nil {
+			return helpData{}, err
+		}
+	}
+	return root, nil
+}
+
+// inheritedOption is an option found by checkInheritedOptions.
+type inheritedOption struct {
+	// Parent is the path of the command whose subcommands all have the option.
+	Parent []string
+	// Option is the option, as in helpData.Options.
+	Option string
+}
+
+// checkInheritedOptions looks for options listed identically (with the same
+// description, and taking an argument or not) by every subcommand of a command
+// with more than one of them.  Such options are most likely inherited, but
+// were not deduplicated by parseHelp, e.g. because the parent command formats
+// them differently.  If hoist is set, they are moved to the parent command;
+// since options are also looked up in parent commands, the subcommands still
+// accept them.  Deeper commands are checked first, so that options can be
+// moved up more than one level.
+func checkInheritedOptions(commands []recordedCommand, hoist bool) []inheritedOption {
+	var result []inheritedOption
+	for i := len(commands) - 1; i >= 0; i-- {
+		parent := commands[i]
+		var children []helpData
+		for _, command := range commands {
+			if len(command.args) == len(parent.args)+1 && slices.Equal(command.args[:len(parent.args)], parent.args) {
+				children = append(children, command.data)
+			}
+		}
+		if len(children) < 2 {
+			continue
+		}
+		var options []string
+		for option, hasArg := range children[0].Options {
+			description := children[0].Descriptions[option]
+			inherited := true
+			for _, child := range children[1:] {
+				childHasArg, ok := child.Options[option]
+				if !ok || childHasArg != hasArg || child.Descriptions[option] != description {
+					inherited = false
+					break
+				}
+			}
+			if inherited {
+				options = append(options, option)
+			}
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			result = append(result, inheritedOption{Parent: parent.args, Option: option})
+			if !hoist {
+				continue
+			}
+			if _, ok := parent.data.Options[option]; !ok {
+				parent.data.Options[option] = children[0].Options[option]
+				if description := children[0].Descriptions[option]; description != "" {
+					parent.data.Descriptions[option] = description
+				}
+			}
+			for _, child := range children {
+				delete(child.Options, option)
+				delete(child.Descriptions, option)
+			}
+		}
+	}
+	return result
 }
 
 // buildSubcommand generates the option parser data for a given subcommand.
 // args provides the list of arguments to get to the subcommand; the last
 // element in the slice is the name of the subcommand.
-// writer is the file to write to for the result; it is expected that `go fmt`
-// will be run on it eventually.
-func buildSubcommand(args []string, parentData helpData, writer io.Writer) error {
+// writer receives the result for this subcommand and each of its descendants.
+// The parsed help for the subcommand is returned.
+func buildSubcommand(ctx context.Context, args []string, parentData helpData, writer commandEmitter) (helpData, error) {
 	logrus.WithField("args", args).Trace("building subcommand")
-	help, err := getHelp(args)
+	help, err := getHelp(ctx, args)
 	if err != nil {
-		return fmt.Errorf("Error getting help for %v: %w", args, err)
+		if skipErrors && len(args) > 0 && ctx.Err() == nil {
+			logrus.WithError(err).WithField("args", args).Warn("skipping subcommand")
+			return helpData{}, nil
+		}
+		return helpData{}, fmt.Errorf("Error getting help for %v: %w", args, err)
 	}
 	subcommands, err := parseHelp(args, help, parentData)
 	if err != nil {
-		return fmt.Errorf("Error parsing help for %v: %w", args, err)
+		return helpData{}, fmt.Errorf("Error parsing help for %v: %w", args, err)
 	}
 
-	err = emitCommand(args, subcommands, writer)
+	err = writer.Emit(args, subcommands)
 	if err != nil {
-		return err
+		return helpData{}, err
 	}
 
 	for _, subcommand := range subcommands.Commands {
 		newArgs := make([]string, 0, len(args))
 		newArgs = append(newArgs, args...)
 		newArgs = append(newArgs, subcommand)
-		err := buildSubcommand(newArgs, subcommands, writer)
+		_, err := buildSubcommand(ctx, newArgs, subcommands, writer)
 		if err != nil {
-			return err
+			return helpData{}, err
 		}
 	}
 
-	return nil
+	return subcommands, nil
 }
 
-// getHelp runs `nerdctl <args...> -help` and returns the result.
-func getHelp(args []string) (string, error) {
-	newArgs := make([]string, 0, len(args)+1)
-	newArgs = append(newArgs, args...)
-	newArgs = append(newArgs, "--help")
-	cmd := exec.Command(nerdctl, newArgs...)
+// getHelp runs `nerdctl <args...> -help` and returns the result.  The command
+// is aborted if it does not complete within helpTimeout.
+func getHelp(ctx context.Context, args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, helpTimeout)
+	defer cancel()
+	cmd := helpCommand(ctx, args)
 	cmd.Stderr = os.Stderr
+	// Don't wait forever for any grandchildren holding on to stdout.
+	cmd.WaitDelay = time.Second
 	result, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s: %w", helpTimeout, ctx.Err())
+	}
 	if err != nil {
 		return "", err
 	}
 	return string(result), nil
 }
 
+// helpCommand returns the command to run `nerdctl <args...> --help`, taking
+// into account any nerdctlExec prefix.
+func helpCommand(ctx context.Context, args []string) *exec.Cmd {
+	command := []string{nerdctl}
+	if len(nerdctlExec) > 0 {
+		command = nerdctlExec
+	}
+	newArgs := make([]string, 0, len(command)+len(args))
+	newArgs = append(newArgs, command[1:]...)
+	newArgs = append(newArgs, args...)
+	newArgs = append(newArgs, "--help")
+	return exec.CommandContext(ctx, command[0], newArgs...)
+}
+
+// negatedFlagPattern matches the negated form of a boolean flag (e.g.
+// `--no-foo`) mentioned in a flag description.
+var negatedFlagPattern = regexp.MustCompile(`--no-[A-Za-z0-9][-A-Za-z0-9]*`)
+
+// deprecatedPattern matches a description that marks a subcommand or option as
+// deprecated, e.g. `(deprecated)`, `[DEPRECATED] ...` or `Deprecated: ...`;
+// merely mentioning something else that is deprecated does not count.
+var deprecatedPattern = regexp.MustCompile(`(?i)(^|[(\[])deprecated\b`)
+
 const (
 	STATE_OTHER = iota
 	STATE_COMMANDS
@@ -143,9 +655,17 @@ const (
 )
 
 // parseHelp consumes the output of `nerdctl help` (possibly for a subcommand)
-// and returns the available subcommands and options.
+// and returns the available subcommands and options.  For the root command
+// (with empty args), the options are nerdctl's global flags, which may appear
+// before the subcommand; subcommands list them again as "Global Flags", and
+// those are skipped as they are already handled by the parent.
 func parseHelp(args []string, help string, parentData helpData) (helpData, error) {
-	result := helpData{Options: make(map[string]bool), mergedOptions: make(map[string]struct{})}
+	result := helpData{
+		Aliases:       make(map[string]string),
+		Options:       make(map[string]bool),
+		Descriptions:  make(map[string]string),
+		mergedOptions: make(map[string]struct{}),
+	}
 	for k := range parentData.mergedOptions {
 		result.mergedOptions[k] = struct{}{}
 	}
@@ -174,8 +694,17 @@ func parseHelp(args []string, help string, parentData helpData) (helpData, error
 				// This line does not contain a command.
 				continue
 			}
+			if excludeDeprecated && deprecatedPattern.MatchString(strings.TrimSpace(parts[1])) {
+				logrus.WithField("args", args).Debugf("skipping deprecated subcommand %s", strings.TrimSpace(parts[0]))
+				continue
+			}
+			// Commands may be listed with aliases, e.g. `rm, remove`; the first
+			// name is the canonical one.
 			words := strings.Split(strings.TrimSpace(parts[0]), ", ")
-			result.Commands = append(result.Commands, words...)
+			result.Commands = append(result.Commands, words[0])
+			for _, alias := range words[1:] {
+				result.Aliases[alias] = words[0]
+			}
 		} else if state == STATE_OPTIONS {
 			parts := strings.SplitN(line, "  ", 2)
 			if len(parts) < 2 {
@@ -193,18 +722,44 @@ func parseHelp(args []string, help string, parentData helpData) (helpData, error
 					hasOptions = true
 					word = word[:spaceIndex]
 				}
-				words = append(words, word)
+				if strings.Contains(word, "=") && !strings.Contains(word, "[=") {
+					// `--foo=VALUE`; the value is required.
+					hasOptions = true
+				}
+				option, ok := normalizeOption(word)
+				if !ok {
+					logrus.WithField("args", args).Debugf("skipping unexpected option %q", word)
+					continue
+				}
+				words = append(words, option)
 			}
 			// We may find an inherited flag; skip if the long option exists in
 			// the parent
 			if len(words) < 1 {
 				continue
 			}
+			description := strings.TrimSpace(parts[1])
+			if excludeDeprecated && deprecatedPattern.MatchString(description) {
+				logrus.WithField("args", args).Debugf("skipping deprecated option %s", strings.Join(words, ", "))
+				continue
+			}
 			if _, ok := parentData.mergedOptions[words[len(words)-1]]; !ok {
 				for _, word := range words {
 					result.Options[word] = hasOptions
+					if description != "" {
+						result.Descriptions[word] = description
+					}
 					result.mergedOptions[word] = struct{}{}
 				}
+				if !hasOptions {
+					for _, negated := range negatedFlags(words, description) {
+						if _, ok := result.Options[negated]; !ok {
+							result.Options[negated] = false
+							result.Descriptions[negated] = description
+							result.mergedOptions[negated] = struct{}{}
+						}
+					}
+				}
 			}
 		}
 	}
@@ -212,18 +767,70 @@ func parseHelp(args []string, help string, parentData helpData) (helpData, error
 	return result, nil
 }
 
+// optionDashes are characters that look like hyphens, which can end up at the
+// start of an option in formatted help text.  The stub replaces them the same
+// way at runtime.
+const optionDashes = "\u2010\u2011\u2012\u2013\u2014\u2212"
+
+// optionNamePattern matches the name of an option, without leading dashes.
+var optionNamePattern = regexp.MustCompile(`^[A-Za-z0-9?][-_.A-Za-z0-9]*$`)
+
+// normalizeOption converts an option as written in the help text into the
+// form used as a key in the generated options: lookalike dashes are replaced
+// with hyphens, and any value placeholder (`--foo=VALUE`, `--foo[=VALUE]`) is
+// dropped.  Long options keep two hyphens (nerdctl has some single character
+// ones, such as `--H`), and a single hyphen is only kept for single character
+// options.  If the word does not look like an option at all, false is returned.
+func normalizeOption(word string) (string, bool) {
+	word = strings.TrimSuffix(strings.TrimSpace(word), ",")
+	if index := strings.IndexAny(word, "[="); index > -1 {
+		word = word[:index]
+	}
+	name := strings.TrimLeft(word, "-"+optionDashes)
+	dashes := utf8.RuneCountInString(word[:len(word)-len(name)])
+	if dashes < 1 || dashes > 2 || !optionNamePattern.MatchString(name) {
+		return "", false
+	}
+	if dashes == 1 && len(name) == 1 {
+		return "-" + name, true
+	}
+	return "--" + name, true
+}
+
+// negatedFlags returns the negated forms of the given boolean flags that are
+// mentioned in its description; some flags accept e.g. `--no-foo` to turn off
+// `--foo`, but only document it in the description of `--foo`.
+func negatedFlags(words []string, description string) []string {
+	var result []string
+	for _, mention := range negatedFlagPattern.FindAllString(description, -1) {
+		if slices.Contains(words, "--"+strings.TrimPrefix(mention, "--no-")) && !slices.Contains(result, mention) {
+			result = append(result, mention)
+		}
+	}
+	return result
+}
+
 // commandTemplate is the text/template template for a single subcommand.
 const commandTemplate = `
-	{{ printf "%q" .Args }}: {
-		commandPath: {{ printf "%q" .Args }},
+	{{- define "path" }}{{ range $i, $arg := . }}{{ if $i }}, {{ end }}{{ printf "%q" $arg }}{{ end }}{{ end }}
+	commandKey({{ template "path" .Args }}): {
+		commandPath: []string{ {{- template "path" .Args -}} },
 		subcommands: map[string]struct{} {
 			{{- range .Data.Commands }}
 				{{ printf "%q" . }}: {},
 			{{- end }}
 		},
+		{{- if .Data.Aliases }}
+		aliases: map[string]string {
+			{{- range $k, $v := .Data.Aliases }}
+				{{ printf "%q" $k }}: {{ printf "%q" $v }},
+			{{- end }}
+		},
+		{{- end }}
 		options: map[string]argHandler {
 			{{ range $k, $v := .Data.Options }}
-				{{- printf "%q" $k -}}: {{ if $v -}} ignoredArgHandler {{- else -}} nil {{- end -}},
+				{{- printf "%q" $k -}}: {{ if $v -}} {{ index $.Handlers $k }} {{- else -}} nil {{- end -}},
+				{{- with index $.Data.Descriptions $k }} // {{ . }}{{ end }}
 			{{ end }}
 		},
 	},
@@ -231,16 +838,32 @@ const commandTemplate = `
 
 // commandTemplateInput describes the data that will be fed to commandTemplate.
 type commandTemplateInput struct {
-	Args string
+	Args []string
 	Data helpData
+	// Handlers is the name of the handler for each option taking an argument.
+	Handlers map[string]string
 }
 
 // emitCommand outputs the golang code to the given writer.  args indicates the
 // arguments to reach this subcommand, and data is the parsed help output.
 func emitCommand(args []string, data helpData, writer io.Writer) error {
 	templateData := commandTemplateInput{
-		Args: strings.Join(args, " "),
-		Data: data,
+		Args:     args,
+		Data:     data,
+		Handlers: make(map[string]string),
+	}
+	commandOverrides := overrides[strings.Join(args, " ")]
+	for option, hasArg := range data.Options {
+		if hasArg {
+			templateData.Handlers[option] = "ignoredArgHandler"
+		}
+	}
+	for option, handler := range commandOverrides {
+		if !data.Options[option] {
+			logrus.Warnf("Ignoring override for %q of %q: it does not take an argument", option, strings.Join(args, " "))
+			continue
+		}
+		templateData.Handlers[option] = handler
 	}
 
 	tmpl := template.Must(template.New("").Parse(commandTemplate))
@@ -250,3 +873,50 @@ func emitCommand(args []string, data helpData, writer io.Writer) error {
 	}
 	return nil
 }
+
+// commandEmitter receives each subcommand as its help is parsed.
+type commandEmitter interface {
+	// Emit outputs a single subcommand; args is the arguments to reach it.
+	Emit(args []string, data helpData) error
+}
+
+// commandWriter writes commands, splitting them into chunks of at most
+// commandsPerChunk commands each.
+type commandWriter struct {
+	writer io.Writer
+	// count is the number of commands written to the current chunk.
+	count int
+	// chunks lists the names of the variables for each chunk started so far.
+	chunks []string
+}
+
+func newCommandWriter(writer io.Writer) *commandWriter {
+	return &commandWriter{writer: writer}
+}
+
+// Emit outputs a single command, starting a new chunk if needed.
+func (w *commandWriter) Emit(args []string, data helpData) error {
+	if len(w.chunks) == 0 || w.count >= commandsPerChunk {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("commands%d", len(w.chunks))
+		err := template.Must(template.New("").Parse(chunkPrologueTemplate)).Execute(w.writer, name)
+		if err != nil {
+			return fmt.Errorf("could not start chunk %s: %w", name, err)
+		}
+		w.chunks = append(w.chunks, name)
+	}
+	w.count++
+	return emitCommand(args, data, w.writer)
+}
+
+// Close ends the current chunk, if any.
+func (w *commandWriter) Close() error {
+	if w.count == 0 {
+		return nil
+	}
+	w.count = 0
+	_, err := io.WriteString(w.writer, chunkEpilogueTemplate)
+	return err
+}
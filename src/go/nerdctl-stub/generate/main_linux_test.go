@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useFakeNerdctl replaces nerdctl with the given shell script for the
+// duration of the test.
+func useFakeNerdctl(t *testing.T, script string) {
+	fakeNerdctl := filepath.Join(t.TempDir(), "nerdctl")
+	require.NoError(t, os.WriteFile(fakeNerdctl, []byte(script), 0o755))
+	savedNerdctl := nerdctl
+	nerdctl = fakeNerdctl
+	t.Cleanup(func() { nerdctl = savedNerdctl })
+}
+
+func TestParseHelpAliases(t *testing.T) {
+	help := `
+Usage: nerdctl container [flags]
+
+Commands:
+  ls, list, ps     List containers
+  rm, remove       Remove one or more containers
+  run              Run a command in a new container
+
+Flags:
+  -h, --help   help for container
+`
+	result, err := parseHelp([]string{"container"}, help, helpData{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ls", "rm", "run"}, result.Commands)
+	assert.Equal(t, map[string]string{"list": "ls", "ps": "ls", "remove": "rm"}, result.Aliases)
+}
+
+func TestBuildSubcommandAliases(t *testing.T) {
+	// Use a fake nerdctl that only knows about `rm, remove`.
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  rm, remove   Remove things\n\nFlags:\n  -h, --help   help\n';;
+"rm --help")
+	printf 'Flags:\n  -f, --force   Force removal\n';;
+*)
+	echo "unexpected arguments: $*" >&2
+	exit 1;;
+esac
+`
+	useFakeNerdctl(t, script)
+
+	var buf bytes.Buffer
+	_, err := buildSubcommand(context.Background(), []string{}, helpData{}, newCommandWriter(&buf))
+	require.NoError(t, err)
+	output := buf.String()
+	assert.Equal(t, 1, strings.Count(output, `commandPath: []string{"rm"}`))
+	assert.NotContains(t, output, `commandPath: []string{"remove"}`)
+	assert.Contains(t, output, `"remove": "rm",`)
+}
+
+func TestHelpCommand(t *testing.T) {
+	t.Run("direct", func(t *testing.T) {
+		cmd := helpCommand(context.Background(), []string{"container", "run"})
+		assert.Equal(t, nerdctl, cmd.Path)
+		assert.Equal(t, []string{nerdctl, "container", "run", "--help"}, cmd.Args)
+	})
+	t.Run("with exec prefix", func(t *testing.T) {
+		savedExec := nerdctlExec
+		var err error
+		nerdctlExec, err = splitCommandLine("  /bin/true  run --rm   image nerdctl ")
+		require.NoError(t, err)
+		t.Cleanup(func() { nerdctlExec = savedExec })
+		cmd := helpCommand(context.Background(), []string{"container", "run"})
+		assert.Equal(t, "/bin/true", cmd.Path)
+		assert.Equal(t, []string{"/bin/true", "run", "--rm", "image", "nerdctl", "container", "run", "--help"}, cmd.Args)
+	})
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"  docker run  --rm image nerdctl ", []string{"docker", "run", "--rm", "image", "nerdctl"}},
+		{`"/opt/my tools/nerdctl" --debug`, []string{"/opt/my tools/nerdctl", "--debug"}},
+		{`'/opt/my tools/nerdctl'`, []string{"/opt/my tools/nerdctl"}},
+		{`/opt/my\ tools/nerdctl`, []string{"/opt/my tools/nerdctl"}},
+		{`a"b c"d 'it'\''s' ""`, []string{"ab cd", "it's", ""}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			actual, err := splitCommandLine(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+	for _, input := range []string{`"unterminated`, `'unterminated`, `trailing\`} {
+		t.Run(input, func(t *testing.T) {
+			_, err := splitCommandLine(input)
+			assert.Error(t, err)
+		})
+	}
+	t.Run("exec prefix with spaces", func(t *testing.T) {
+		savedExec := nerdctlExec
+		var err error
+		nerdctlExec, err = splitCommandLine(`"/opt/my tools/nerdctl"`)
+		require.NoError(t, err)
+		t.Cleanup(func() { nerdctlExec = savedExec })
+		cmd := helpCommand(context.Background(), []string{"run"})
+		assert.Equal(t, []string{"/opt/my tools/nerdctl", "run", "--help"}, cmd.Args)
+	})
+}
+
+func TestBuildSubcommandTimeout(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  hang   Never finishes\n  ok     Finishes\n';;
+"hang --help")
+	exec sleep 60;;
+*)
+	printf 'Flags:\n  -h, --help   help\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	savedTimeout := helpTimeout
+	helpTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { helpTimeout = savedTimeout })
+
+	t.Run("aborts", func(t *testing.T) {
+		start := time.Now()
+		_, err := buildSubcommand(context.Background(), []string{}, helpData{}, newCommandWriter(io.Discard))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+	t.Run("skip errors", func(t *testing.T) {
+		skipErrors = true
+		t.Cleanup(func() { skipErrors = false })
+		var buf bytes.Buffer
+		_, err := buildSubcommand(context.Background(), []string{}, helpData{}, newCommandWriter(&buf))
+		require.NoError(t, err)
+		assert.NotContains(t, buf.String(), `commandPath: []string{"hang"}`)
+		assert.Contains(t, buf.String(), `commandPath: []string{"ok"}`)
+	})
+}
+
+func TestEmitCommandDescriptions(t *testing.T) {
+	help := `
+Flags:
+  -f, --force            Force the removal of a running container
+      --volumes string   Remove volumes
+`
+	data, err := parseHelp([]string{"rm"}, help, helpData{})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, emitCommand([]string{"rm"}, data, &buf))
+	source := "package main\nvar commands = map[string]commandDefinition{\n" + buf.String() + "}\n"
+	formatted, err := format.Source([]byte(source))
+	require.NoError(t, err, "generated code should be valid:\n%s", source)
+	reformatted, err := format.Source(formatted)
+	require.NoError(t, err)
+	assert.Equal(t, string(formatted), string(reformatted), "go fmt should be idempotent")
+	output := string(formatted)
+	assert.Regexp(t, `"--force": +nil, +// Force the removal of a running container\n`, output)
+	assert.Regexp(t, `"-f": +nil, +// Force the removal of a running container\n`, output)
+	assert.Regexp(t, `"--volumes": +ignoredArgHandler, +// Remove volumes\n`, output)
+}
+
+func TestEmitCommandOverrides(t *testing.T) {
+	help := `
+Flags:
+  -v, --volume stringArray   Bind mount a volume
+      --name string          Assign a name to the container
+  -d, --detach               Run container in background
+`
+	data, err := parseHelp([]string{"run"}, help, helpData{})
+	require.NoError(t, err)
+	overridesPath := filepath.Join(t.TempDir(), "overrides.json")
+	require.NoError(t, os.WriteFile(overridesPath, []byte(`{
+		"run": {"-v": "argHandlers.volumeArgHandler", "--detach": "argHandlers.filePathArgHandler"},
+		"build": {"--name": "argHandlers.filePathArgHandler"}
+	}`), 0o644))
+	overrides, err = loadOverrides(overridesPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { overrides = nil })
+	var buf bytes.Buffer
+	require.NoError(t, emitCommand([]string{"run"}, data, &buf))
+	output := buf.String()
+	assert.Regexp(t, `"-v": *argHandlers\.volumeArgHandler,`, output)
+	assert.Regexp(t, `"--volume": *ignoredArgHandler,`, output)
+	assert.Regexp(t, `"--name": *ignoredArgHandler,`, output, "overrides for other commands should not apply")
+	assert.Regexp(t, `"--detach": *nil,`, output, "options without arguments should not be overridden")
+}
+
+func TestCheckOutput(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  rm   Remove things\n  run  Run things\n';;
+"rm --help")
+	printf 'Flags:\n  -f, --force   Force removal\n';;
+*)
+	printf 'Flags:\n  -h, --help   help\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	var buf bytes.Buffer
+	require.NoError(t, generate(context.Background(), &buf))
+	generated, err := format.Source(buf.Bytes())
+	require.NoError(t, err)
+
+	t.Run("up to date", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "generated.go")
+		require.NoError(t, os.WriteFile(path, generated, 0o644))
+		assert.NoError(t, checkOutput(path, buf.Bytes()))
+	})
+	t.Run("stale", func(t *testing.T) {
+		stale := strings.Replace(string(generated), `"--force"`, `"--forced"`, 1)
+		stale = strings.Replace(stale, "\tcommandKey(\"run\"): {\n", "\tcommandKey(\"walk\"): {\n", 1)
+		path := filepath.Join(t.TempDir(), "generated.go")
+		require.NoError(t, os.WriteFile(path, []byte(stale), 0o644))
+		before, err := os.ReadFile(path)
+		require.NoError(t, err)
+		err = checkOutput(path, buf.Bytes())
+		if assert.Error(t, err) {
+			assert.Equal(t, path+" is out of date:\n"+
+				`added command "run"`+"\n"+
+				`changed command "rm"`+"\n"+
+				`removed command "walk"`, err.Error())
+		}
+		after, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "check should not modify the file")
+	})
+}
+
+func TestParseHelpGlobalFlags(t *testing.T) {
+	rootHelp := `nerdctl is a command line interface for containerd
+
+Usage: nerdctl [flags]
+
+Management commands:
+  container  Manage containers
+
+Commands:
+  run        Run a command in a new container
+
+Flags:
+  -H, --H string                 Alias of --address (default "/run/containerd/containerd.sock")
+      --address string           containerd address, optionally with "unix://" prefix [$CONTAINERD_ADDRESS] (default "/run/containerd/containerd.sock")
+      --debug                    debug mode
+  -h, --help                     help for nerdctl
+  -n, --n string                 Alias of --namespace (default "default")
+      --namespace string         containerd namespace, such as "moby" for Docker, "k8s.io" for Kubernetes [$CONTAINERD_NAMESPACE] (default "default")
+  -v, --version                  version for nerdctl
+`
+	root, err := parseHelp([]string{}, rootHelp, helpData{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container", "run"}, root.Commands)
+	assert.Equal(t, map[string]bool{
+		"-H":          true,
+		"--H":         true,
+		"--address":   true,
+		"--debug":     false,
+		"-h":          false,
+		"--help":      false,
+		"-n":          true,
+		"--n":         true,
+		"--namespace": true,
+		"-v":          false,
+		"--version":   false,
+	}, root.Options)
+
+	var buf bytes.Buffer
+	require.NoError(t, emitCommand([]string{}, root, &buf))
+	assert.Regexp(t, `"--namespace": ignoredArgHandler,`, buf.String())
+	assert.Regexp(t, `"-n": ignoredArgHandler,`, buf.String())
+	assert.Regexp(t, `"--debug": nil,`, buf.String())
+
+	// Subcommands list the global flags again; they should not be repeated.
+	runHelp := `Usage: nerdctl run [flags] IMAGE [COMMAND] [ARG...]
+
+Flags:
+  -d, --detach   Run container in background and print container ID
+
+Global Flags:
+      --address string     containerd address (default "/run/containerd/containerd.sock")
+      --debug              debug mode
+  -n, --namespace string   containerd namespace (default "default")
+`
+	run, err := parseHelp([]string{"run"}, runHelp, root)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"-d": false, "--detach": false}, run.Options)
+}
+
+func TestParseHelpNegatableFlags(t *testing.T) {
+	help := `Usage: nerdctl build [flags] PATH
+
+Flags:
+      --cache             Use the build cache; disable with --no-cache (default true)
+      --label string      Set metadata; see also --no-label-defaults
+      --pull              Always pull images (use --no-pull to skip, or --no-such-flag)
+      --no-pull           Never pull images
+  -q, --quiet             Suppress the build output
+`
+	result, err := parseHelp([]string{"build"}, help, helpData{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"--cache":    false,
+		"--no-cache": false,
+		"--label":    true,
+		"--pull":     false,
+		"--no-pull":  false,
+		"-q":         false,
+		"--quiet":    false,
+	}, result.Options)
+	assert.Equal(t, "Use the build cache; disable with --no-cache (default true)", result.Descriptions["--no-cache"])
+	assert.Equal(t, "Never pull images", result.Descriptions["--no-pull"])
+
+	var buf bytes.Buffer
+	require.NoError(t, emitCommand([]string{"build"}, result, &buf))
+	assert.Regexp(t, `"--cache": nil,`, buf.String())
+	assert.Regexp(t, `"--no-cache": nil,`, buf.String())
+}
+
+func TestNormalizeOption(t *testing.T) {
+	testCases := map[string]string{
+		"--foo":           "--foo",
+		"-f":              "-f",
+		"--H":             "--H",
+		"-foo":            "--foo",
+		"--foo,":          "--foo",
+		" --foo ":         "--foo",
+		"--foo=VALUE":     "--foo",
+		"--foo[=VALUE]":   "--foo",
+		"\u2013\u2013foo": "--foo",
+		"\u2014foo":       "--foo",
+		"\u2212f":         "-f",
+		"--log-level_x.y": "--log-level_x.y",
+		"foo":             "",
+		"---foo":          "",
+		"--":              "",
+		"-":               "",
+		"--[=VALUE]":      "",
+		"--foo!":          "",
+	}
+	for input, expected := range testCases {
+		t.Run(input, func(t *testing.T) {
+			actual, ok := normalizeOption(input)
+			assert.Equal(t, expected, actual)
+			assert.Equal(t, expected != "", ok)
+		})
+	}
+}
+
+func TestParseHelpOddOptions(t *testing.T) {
+	help := "Usage: nerdctl thing [flags]\n" +
+		"\n" +
+		"Flags:\n" +
+		"  \u2013a, \u2013\u2013all          Show all\n" +
+		"      --format=FORMAT     Format the output\n" +
+		"      --color[=WHEN]      Colorize the output\n" +
+		"  -verbose                Be verbose\n" +
+		"  ???, --quiet            Be quiet\n"
+	result, err := parseHelp([]string{"thing"}, help, helpData{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"-a":        false,
+		"--all":     false,
+		"--format":  true,
+		"--color":   false,
+		"--verbose": false,
+		"--quiet":   false,
+	}, result.Options)
+	assert.Equal(t, "Show all", result.Descriptions["--all"])
+}
+
+func TestCheckInheritedOptions(t *testing.T) {
+	// newCommand returns a command with the given options (mapped to whether
+	// they take an argument); each is described by its name, except for
+	// --help which is described by the command.
+	newCommand := func(args []string, options map[string]bool) recordedCommand {
+		data := helpData{Options: options, Descriptions: make(map[string]string)}
+		for option := range options {
+			data.Descriptions[option] = option
+		}
+		if _, ok := options["--help"]; ok {
+			data.Descriptions["--help"] = "help for " + strings.Join(args, " ")
+		}
+		return recordedCommand{args: args, data: data}
+	}
+	tree := func() []recordedCommand {
+		return []recordedCommand{
+			newCommand([]string{}, map[string]bool{"--help": false}),
+			newCommand([]string{"image"}, map[string]bool{"--help": false, "--namespace": true}),
+			newCommand([]string{"image", "ls"}, map[string]bool{"--help": false, "--namespace": true, "--all": false}),
+			newCommand([]string{"image", "rm"}, map[string]bool{"--help": false, "--namespace": true, "--all": false, "--force": false}),
+			newCommand([]string{"run"}, map[string]bool{"--help": false, "--namespace": true, "--all": false}),
+			// --quiet takes an argument here, but not in the other command.
+			newCommand([]string{"volume"}, map[string]bool{"--help": false, "--namespace": true, "--quiet": true}),
+			newCommand([]string{"volume", "ls"}, map[string]bool{"--help": false, "--quiet": false}),
+			newCommand([]string{"volume", "rm"}, map[string]bool{"--help": false, "--quiet": true}),
+		}
+	}
+	expected := []inheritedOption{
+		{Parent: []string{"image"}, Option: "--all"},
+		{Parent: []string{"image"}, Option: "--namespace"},
+		{Parent: []string{}, Option: "--namespace"},
+	}
+
+	t.Run("detects inherited options", func(t *testing.T) {
+		commands := tree()
+		assert.Equal(t, expected, checkInheritedOptions(commands, false))
+		assert.Equal(t, tree(), commands, "commands should not be modified")
+	})
+	t.Run("hoists inherited options", func(t *testing.T) {
+		commands := tree()
+		assert.Equal(t, expected, checkInheritedOptions(commands, true))
+		options := make(map[string]map[string]bool)
+		for _, command := range commands {
+			options[strings.Join(command.args, " ")] = command.data.Options
+		}
+		assert.Equal(t, map[string]map[string]bool{
+			"":          {"--help": false, "--namespace": true},
+			"image":     {"--help": false, "--all": false},
+			"image ls":  {"--help": false},
+			"image rm":  {"--help": false, "--force": false},
+			"run":       {"--help": false, "--all": false},
+			"volume":    {"--help": false, "--quiet": true},
+			"volume ls": {"--help": false, "--quiet": false},
+			"volume rm": {"--help": false, "--quiet": true},
+		}, options)
+		assert.Equal(t, "--namespace", commands[0].data.Descriptions["--namespace"])
+	})
+	t.Run("single subcommand", func(t *testing.T) {
+		commands := []recordedCommand{
+			newCommand([]string{}, map[string]bool{}),
+			newCommand([]string{"run"}, map[string]bool{"--all": false}),
+		}
+		assert.Empty(t, checkInheritedOptions(commands, true))
+		assert.Contains(t, commands[1].data.Options, "--all")
+	})
+}
+
+func TestParseHelpExcludeDeprecated(t *testing.T) {
+	help := `Usage: nerdctl image [flags]
+
+Commands:
+  ls, list    List images
+  convert     (deprecated) Convert an image format
+  legacy      [DEPRECATED] Use "nerdctl image ls" instead
+
+Flags:
+      --all               Show all images
+      --digests           Deprecated: digests are always shown
+      --format string     Format the output (deprecated, use --output)
+      --quiet             Only show IDs; replaces the deprecated --short
+`
+	parse := func(t *testing.T) helpData {
+		result, err := parseHelp([]string{"image"}, help, helpData{})
+		require.NoError(t, err)
+		return result
+	}
+	t.Run("included by default", func(t *testing.T) {
+		result := parse(t)
+		assert.Equal(t, []string{"convert", "legacy", "ls"}, result.Commands)
+		assert.Equal(t, map[string]bool{
+			"--all":     false,
+			"--digests": false,
+			"--format":  true,
+			"--quiet":   false,
+		}, result.Options)
+	})
+	t.Run("excluded", func(t *testing.T) {
+		excludeDeprecated = true
+		t.Cleanup(func() { excludeDeprecated = false })
+		result := parse(t)
+		assert.Equal(t, []string{"ls"}, result.Commands)
+		assert.Equal(t, map[string]string{"list": "ls"}, result.Aliases)
+		// Mentioning something deprecated does not make --quiet deprecated.
+		assert.Equal(t, map[string]bool{"--all": false, "--quiet": false}, result.Options)
+		assert.NotContains(t, result.Descriptions, "--format")
+	})
+}
+
+func TestKnownCommands(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Management commands:\n  container   Manage containers\n\nCommands:\n  run   Run\n  build  Build\n';;
+*)
+	printf 'Flags:\n  -h, --help   help\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	var buf bytes.Buffer
+	require.NoError(t, generate(context.Background(), &buf))
+	formatted, err := format.Source(buf.Bytes())
+	require.NoError(t, err)
+	assert.Contains(t, string(formatted), `var knownCommands = []string{
+	"build",
+	"container",
+	"run",
+}
+`)
+}
+
+// generatedRuntimeStub declares the parts of the nerdctl stub that the
+// generated code depends on, so that the generated code can be type checked.
+const generatedRuntimeStub = `package main
+
+type argHandler func(string) (string, []func() error, error)
+
+var ignoredArgHandler argHandler
+
+func commandKey(path ...string) string {
+	return ""
+}
+
+type commandDefinition struct {
+	commandPath []string
+	subcommands map[string]struct{}
+	aliases     map[string]string
+	options     map[string]argHandler
+}
+
+func mergeCommands(chunks ...map[string]commandDefinition) map[string]commandDefinition {
+	return nil
+}
+`
+
+func TestGenerateChunks(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  build  Build things\n  rm     Remove things\n  run    Run things\n';;
+*)
+	printf 'Flags:\n  -h, --help   help\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	savedCommandsPerChunk := commandsPerChunk
+	commandsPerChunk = 3
+	t.Cleanup(func() { commandsPerChunk = savedCommandsPerChunk })
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(context.Background(), &buf))
+	formatted, err := format.Source(buf.Bytes())
+	require.NoError(t, err, "generated code should be valid:\n%s", buf.String())
+	output := string(formatted)
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for name, source := range map[string]string{"generated.go": output, "stub.go": generatedRuntimeStub} {
+		file, err := parser.ParseFile(fset, name, source, 0)
+		require.NoError(t, err)
+		files = append(files, file)
+	}
+	_, err = (&types.Config{}).Check("main", fset, files, nil)
+	require.NoError(t, err, "generated code should compile:\n%s", output)
+
+	// The root command plus three subcommands should be split into chunks
+	// of three commands each.
+	assert.Contains(t, output, "var commands = mergeCommands(\n\tcommands0,\n\tcommands1,\n)\n")
+	assert.Equal(t, 3, strings.Count(output[strings.Index(output, "var commands0"):strings.Index(output, "var commands1")], "commandPath:"))
+	assert.Contains(t, output[strings.Index(output, "var commands1"):], `commandPath: []string{"run"}`)
+}
+
+func TestGenerateNestedPaths(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  container   Manage containers\n';;
+"container --help")
+	printf 'Commands:\n  run   Run a container\n';;
+*)
+	printf 'Flags:\n  -d, --detach   Detach\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	var buf bytes.Buffer
+	require.NoError(t, generate(context.Background(), &buf))
+	formatted, err := format.Source(buf.Bytes())
+	require.NoError(t, err)
+	output := string(formatted)
+	assert.Contains(t, output, "\tcommandKey(): {\n\t\tcommandPath: []string{},\n")
+	assert.Contains(t, output, "\tcommandKey(\"container\", \"run\"): {\n\t\tcommandPath: []string{\"container\", \"run\"},\n")
+
+	// The nested path should survive the round trip through the check.
+	entries, _ := splitEntries(output)
+	assert.Contains(t, entries, `"container", "run"`)
+	path := filepath.Join(t.TempDir(), "generated.go")
+	stale := strings.Replace(output, `"--detach": nil,`, `"--detached": nil,`, 1)
+	require.NoError(t, os.WriteFile(path, []byte(stale), 0o644))
+	assert.EqualError(t, checkOutput(path, buf.Bytes()), path+` is out of date:
+changed command "container", "run"`)
+}
+
+func TestGenerateJSON(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  rm, remove   Remove things\n\nFlags:\n  -h, --help   help\n';;
+"rm --help")
+	printf 'Flags:\n  -f, --force          Force removal\n      --time string    Time to wait\n';;
+*)
+	echo "unexpected arguments: $*" >&2
+	exit 1;;
+esac
+`
+	useFakeNerdctl(t, script)
+	var buf bytes.Buffer
+	require.NoError(t, generateJSON(context.Background(), &buf))
+	var result struct {
+		Commands map[string]jsonCommand `json:"commands"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &result), "output should be valid JSON:\n%s", buf.String())
+	require.Contains(t, result.Commands, "")
+	assert.Equal(t, []string{"rm"}, result.Commands[""].Subcommands)
+	assert.Equal(t, map[string]string{"remove": "rm"}, result.Commands[""].Aliases)
+	require.Contains(t, result.Commands, "rm")
+	assert.Equal(t, []string{}, result.Commands["rm"].Subcommands)
+	assert.False(t, result.Commands["rm"].Options["--force"])
+	assert.True(t, result.Commands["rm"].Options["--time"])
+	assert.Len(t, result.Commands, 2)
+}
+
+func TestGenerateManifest(t *testing.T) {
+	script := `#!/bin/sh
+case "$*" in
+--help)
+	printf 'Commands:\n  container   Manage containers\n  rm          Remove things\n';;
+"container --help")
+	printf 'Commands:\n  run   Run a container\n';;
+"container run --help")
+	printf 'Flags:\n  -d, --detach        Detach\n      --name string   Name\n';;
+"rm --help")
+	printf 'Flags:\n  -f, --force          Force removal\n      --time string    Time to wait\n';;
+*)
+	printf 'Flags:\n  -h, --help   help\n';;
+esac
+`
+	useFakeNerdctl(t, script)
+	savedManifestPath := manifestPath
+	manifestPath = filepath.Join(t.TempDir(), "manifest.json")
+	t.Cleanup(func() { manifestPath = savedManifestPath })
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(context.Background(), &buf))
+	formatted, err := format.Source(buf.Bytes())
+	require.NoError(t, err)
+	entries, _ := splitEntries(string(formatted))
+
+	contents, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	var manifest struct {
+		Commands []manifestCommand `json:"commands"`
+	}
+	require.NoError(t, json.Unmarshal(contents, &manifest), "manifest should be valid JSON:\n%s", contents)
+
+	// Every command in the generated code should be in the manifest, with the
+	// same options; the root command isn't split out as an entry.
+	optionPattern := regexp.MustCompile(`(?m)^\t\t\t("[^"]*"):\s+(\w+),`)
+	require.NotEmpty(t, manifest.Commands)
+	assert.Equal(t, manifestCommand{Path: []string{}, Options: []string{}, ArgOptions: []string{}}, manifest.Commands[0])
+	require.Len(t, manifest.Commands[1:], len(entries))
+	for _, command := range manifest.Commands[1:] {
+		quoted := make([]string, 0, len(command.Path))
+		for _, element := range command.Path {
+			quoted = append(quoted, strconv.Quote(element))
+		}
+		key := strings.Join(quoted, ", ")
+		require.Contains(t, entries, key)
+		generated := make(map[string]string)
+		for _, match := range optionPattern.FindAllStringSubmatch(entries[key], -1) {
+			generated[match[1]] = match[2]
+		}
+		expected := make(map[string]string)
+		for _, option := range command.Options {
+			expected[strconv.Quote(option)] = "nil"
+		}
+		for _, option := range command.ArgOptions {
+			expected[strconv.Quote(option)] = "ignoredArgHandler"
+		}
+		assert.Equal(t, expected, generated, "options of %s", key)
+	}
+	assert.Contains(t, manifest.Commands, manifestCommand{
+		Path:       []string{"container", "run"},
+		Options:    []string{"--detach", "--name", "-d"},
+		ArgOptions: []string{"--name"},
+	})
+	assert.Contains(t, manifest.Commands, manifestCommand{
+		Path:       []string{"rm"},
+		Options:    []string{"--force", "--time", "-f"},
+		ArgOptions: []string{"--time"},
+	})
+}
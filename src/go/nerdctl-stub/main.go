@@ -1,10 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 )
 
+// dryRunEnv is the environment variable that, when set, makes the stub print
+// the arguments it would run nerdctl with instead of running it.
+const dryRunEnv = "RD_NERDCTL_DRY_RUN"
+
 type spawnOptions struct {
 	// distro is the name of the WSL distribution for rancher-desktop.
 	distro string
@@ -31,7 +39,18 @@ func main() {
 		opts.containerdSocket = "/run/k3s/containerd/containerd.sock"
 
 		args, err := parseArgs()
-		if err == nil {
+		defer func() {
+			// Clean up even if parsing failed; this keeps any earlier error,
+			// which the top-level function handles.
+			if cleanupErr := cleanupParseArgs(); err == nil {
+				err = cleanupErr
+			}
+		}()
+		if errors.Is(err, errUnknownOption) {
+			// nerdctl would reject this anyway; do so before passing along
+			// arguments that may not have been converted.
+			return err
+		} else if err == nil {
 			opts.args = args
 		} else {
 			// If we fail to parse, display an error but still run nerdctl
@@ -39,10 +58,10 @@ func main() {
 			opts.args = &parsedArgs{args: os.Args[1:]}
 		}
 
-		defer func() {
-			err = cleanupParseArgs()
-			// The top-level function handles the error
-		}()
+		if os.Getenv(dryRunEnv) != "" {
+			printArgs(os.Stdout, opts)
+			return runCleanups(opts.args.cleanup)
+		}
 
 		err = spawn(opts)
 		if err != nil {
@@ -54,3 +73,14 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// printArgs writes the arguments nerdctl would be run with, each quoted, on a
+// single line.
+func printArgs(w io.Writer, opts spawnOptions) {
+	args := append([]string{opts.nerdctl, "--address", opts.containerdSocket}, opts.args.args...)
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, fmt.Sprintf("%q", arg))
+	}
+	_, _ = fmt.Fprintln(w, strings.Join(quoted, " "))
+}
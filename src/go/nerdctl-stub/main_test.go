@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintArgs(t *testing.T) {
+	t.Parallel()
+	args, err := commands[commandKey()].parse([]string{
+		"--namespace", "k8s.io", "run", "--rm", "--name=test", "-e", "A=B C", "alpine", "echo", "hi",
+	})
+	require.NoError(t, err)
+	opts := spawnOptions{
+		nerdctl:          "/usr/local/bin/nerdctl",
+		containerdSocket: "/run/containerd.sock",
+		args:             args,
+	}
+	var buf bytes.Buffer
+	printArgs(&buf, opts)
+	expected := `"/usr/local/bin/nerdctl" "--address" "/run/containerd.sock" ` +
+		`"--namespace" "k8s.io" "run" "--rm" "--name" "test" "-e" "A=B C" "alpine" "echo" "hi"` + "\n"
+	assert.Equal(t, expected, buf.String())
+}
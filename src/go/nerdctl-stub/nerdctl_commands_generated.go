@@ -3,12 +3,11 @@
 // package main implements a stub for nerdctl
 package main
 
-// commands supported by nerdctl; the key here is a space-separated subcommand
-// path to reach the given subcommand (where the root command is empty).
-var commands = map[string]commandDefinition{
+// commands0 is part of commands.
+var commands0 = map[string]commandDefinition{
 
-	"": {
-		commandPath: "",
+	commandKey(): {
+		commandPath: []string{},
 		subcommands: map[string]struct{}{
 			"apparmor":   {},
 			"attach":     {},
@@ -90,8 +89,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"apparmor": {
-		commandPath: "apparmor",
+	commandKey("apparmor"): {
+		commandPath: []string{"apparmor"},
 		subcommands: map[string]struct{}{
 			"inspect": {},
 			"load":    {},
@@ -101,20 +100,20 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"apparmor inspect": {
-		commandPath: "apparmor inspect",
+	commandKey("apparmor", "inspect"): {
+		commandPath: []string{"apparmor", "inspect"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"apparmor load": {
-		commandPath: "apparmor load",
+	commandKey("apparmor", "load"): {
+		commandPath: []string{"apparmor", "load"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"apparmor ls": {
-		commandPath: "apparmor ls",
+	commandKey("apparmor", "ls"): {
+		commandPath: []string{"apparmor", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -123,22 +122,22 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"apparmor unload": {
-		commandPath: "apparmor unload",
+	commandKey("apparmor", "unload"): {
+		commandPath: []string{"apparmor", "unload"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"attach": {
-		commandPath: "attach",
+	commandKey("attach"): {
+		commandPath: []string{"attach"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--detach-keys": ignoredArgHandler,
 		},
 	},
 
-	"build": {
-		commandPath: "build",
+	commandKey("build"): {
+		commandPath: []string{"build"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--allow":         ignoredArgHandler,
@@ -172,8 +171,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"builder": {
-		commandPath: "builder",
+	commandKey("builder"): {
+		commandPath: []string{"builder"},
 		subcommands: map[string]struct{}{
 			"build": {},
 			"debug": {},
@@ -182,8 +181,8 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"builder build": {
-		commandPath: "builder build",
+	commandKey("builder", "build"): {
+		commandPath: []string{"builder", "build"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--allow":         ignoredArgHandler,
@@ -217,8 +216,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"builder debug": {
-		commandPath: "builder debug",
+	commandKey("builder", "debug"): {
+		commandPath: []string{"builder", "debug"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--build-arg": ignoredArgHandler,
@@ -231,8 +230,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"builder prune": {
-		commandPath: "builder prune",
+	commandKey("builder", "prune"): {
+		commandPath: []string{"builder", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":           nil,
@@ -243,8 +242,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"commit": {
-		commandPath: "commit",
+	commandKey("commit"): {
+		commandPath: []string{"commit"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--author":  ignoredArgHandler,
@@ -258,8 +257,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"completion": {
-		commandPath: "completion",
+	commandKey("completion"): {
+		commandPath: []string{"completion"},
 		subcommands: map[string]struct{}{
 			"bash":       {},
 			"fish":       {},
@@ -269,40 +268,40 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"completion bash": {
-		commandPath: "completion bash",
+	commandKey("completion", "bash"): {
+		commandPath: []string{"completion", "bash"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--no-descriptions": nil,
 		},
 	},
 
-	"completion fish": {
-		commandPath: "completion fish",
+	commandKey("completion", "fish"): {
+		commandPath: []string{"completion", "fish"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--no-descriptions": nil,
 		},
 	},
 
-	"completion powershell": {
-		commandPath: "completion powershell",
+	commandKey("completion", "powershell"): {
+		commandPath: []string{"completion", "powershell"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--no-descriptions": nil,
 		},
 	},
 
-	"completion zsh": {
-		commandPath: "completion zsh",
+	commandKey("completion", "zsh"): {
+		commandPath: []string{"completion", "zsh"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--no-descriptions": nil,
 		},
 	},
 
-	"compose": {
-		commandPath: "compose",
+	commandKey("compose"): {
+		commandPath: []string{"compose"},
 		subcommands: map[string]struct{}{
 			"build":   {},
 			"config":  {},
@@ -341,8 +340,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose build": {
-		commandPath: "compose build",
+	commandKey("compose", "build"): {
+		commandPath: []string{"compose", "build"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--build-arg": ignoredArgHandler,
@@ -351,8 +350,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose config": {
-		commandPath: "compose config",
+	commandKey("compose", "config"): {
+		commandPath: []string{"compose", "config"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--hash":     ignoredArgHandler,
@@ -363,8 +362,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose cp": {
-		commandPath: "compose cp",
+	commandKey("compose", "cp"): {
+		commandPath: []string{"compose", "cp"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--dry-run":     nil,
@@ -374,8 +373,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose create": {
-		commandPath: "compose create",
+	commandKey("compose", "create"): {
+		commandPath: []string{"compose", "create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--build":          nil,
@@ -386,8 +385,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose down": {
-		commandPath: "compose down",
+	commandKey("compose", "down"): {
+		commandPath: []string{"compose", "down"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--remove-orphans": nil,
@@ -396,8 +395,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose exec": {
-		commandPath: "compose exec",
+	commandKey("compose", "exec"): {
+		commandPath: []string{"compose", "exec"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--detach":     nil,
@@ -415,8 +414,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose images": {
-		commandPath: "compose images",
+	commandKey("compose", "images"): {
+		commandPath: []string{"compose", "images"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -425,8 +424,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose kill": {
-		commandPath: "compose kill",
+	commandKey("compose", "kill"): {
+		commandPath: []string{"compose", "kill"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--signal": ignoredArgHandler,
@@ -434,8 +433,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose logs": {
-		commandPath: "compose logs",
+	commandKey("compose", "logs"): {
+		commandPath: []string{"compose", "logs"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--follow":        nil,
@@ -448,14 +447,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose pause": {
-		commandPath: "compose pause",
+	commandKey("compose", "pause"): {
+		commandPath: []string{"compose", "pause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"compose port": {
-		commandPath: "compose port",
+	commandKey("compose", "port"): {
+		commandPath: []string{"compose", "port"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--index":    ignoredArgHandler,
@@ -463,8 +462,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose ps": {
-		commandPath: "compose ps",
+	commandKey("compose", "ps"): {
+		commandPath: []string{"compose", "ps"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":      nil,
@@ -478,23 +477,27 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose pull": {
-		commandPath: "compose pull",
+	commandKey("compose", "pull"): {
+		commandPath: []string{"compose", "pull"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--quiet": nil,
 			"-q":      nil,
 		},
 	},
+}
+
+// commands1 is part of commands.
+var commands1 = map[string]commandDefinition{
 
-	"compose push": {
-		commandPath: "compose push",
+	commandKey("compose", "push"): {
+		commandPath: []string{"compose", "push"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"compose restart": {
-		commandPath: "compose restart",
+	commandKey("compose", "restart"): {
+		commandPath: []string{"compose", "restart"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--timeout": ignoredArgHandler,
@@ -502,8 +505,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose rm": {
-		commandPath: "compose rm",
+	commandKey("compose", "rm"): {
+		commandPath: []string{"compose", "rm"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force":   nil,
@@ -515,8 +518,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose run": {
-		commandPath: "compose run",
+	commandKey("compose", "run"): {
+		commandPath: []string{"compose", "run"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--build":          nil,
@@ -548,14 +551,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose start": {
-		commandPath: "compose start",
+	commandKey("compose", "start"): {
+		commandPath: []string{"compose", "start"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"compose stop": {
-		commandPath: "compose stop",
+	commandKey("compose", "stop"): {
+		commandPath: []string{"compose", "stop"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--timeout": ignoredArgHandler,
@@ -563,20 +566,20 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose top": {
-		commandPath: "compose top",
+	commandKey("compose", "top"): {
+		commandPath: []string{"compose", "top"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"compose unpause": {
-		commandPath: "compose unpause",
+	commandKey("compose", "unpause"): {
+		commandPath: []string{"compose", "unpause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"compose up": {
-		commandPath: "compose up",
+	commandKey("compose", "up"): {
+		commandPath: []string{"compose", "up"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--abort-on-container-exit": nil,
@@ -595,8 +598,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"compose version": {
-		commandPath: "compose version",
+	commandKey("compose", "version"): {
+		commandPath: []string{"compose", "version"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -605,8 +608,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container": {
-		commandPath: "container",
+	commandKey("container"): {
+		commandPath: []string{"container"},
 		subcommands: map[string]struct{}{
 			"attach":  {},
 			"commit":  {},
@@ -635,16 +638,16 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"container attach": {
-		commandPath: "container attach",
+	commandKey("container", "attach"): {
+		commandPath: []string{"container", "attach"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--detach-keys": ignoredArgHandler,
 		},
 	},
 
-	"container commit": {
-		commandPath: "container commit",
+	commandKey("container", "commit"): {
+		commandPath: []string{"container", "commit"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--author":  ignoredArgHandler,
@@ -658,8 +661,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container cp": {
-		commandPath: "container cp",
+	commandKey("container", "cp"): {
+		commandPath: []string{"container", "cp"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--follow-link": nil,
@@ -667,8 +670,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container create": {
-		commandPath: "container create",
+	commandKey("container", "create"): {
+		commandPath: []string{"container", "create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--add-host":                              ignoredArgHandler,
@@ -772,14 +775,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container diff": {
-		commandPath: "container diff",
+	commandKey("container", "diff"): {
+		commandPath: []string{"container", "diff"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"container exec": {
-		commandPath: "container exec",
+	commandKey("container", "exec"): {
+		commandPath: []string{"container", "exec"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--detach":      nil,
@@ -799,8 +802,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container inspect": {
-		commandPath: "container inspect",
+	commandKey("container", "inspect"): {
+		commandPath: []string{"container", "inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -811,8 +814,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container kill": {
-		commandPath: "container kill",
+	commandKey("container", "kill"): {
+		commandPath: []string{"container", "kill"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--signal": ignoredArgHandler,
@@ -820,8 +823,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container logs": {
-		commandPath: "container logs",
+	commandKey("container", "logs"): {
+		commandPath: []string{"container", "logs"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--follow":     nil,
@@ -835,8 +838,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container ls": {
-		commandPath: "container ls",
+	commandKey("container", "ls"): {
+		commandPath: []string{"container", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":      nil,
@@ -856,20 +859,20 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container pause": {
-		commandPath: "container pause",
+	commandKey("container", "pause"): {
+		commandPath: []string{"container", "pause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"container port": {
-		commandPath: "container port",
+	commandKey("container", "port"): {
+		commandPath: []string{"container", "port"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"container prune": {
-		commandPath: "container prune",
+	commandKey("container", "prune"): {
+		commandPath: []string{"container", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force": nil,
@@ -877,14 +880,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container rename": {
-		commandPath: "container rename",
+	commandKey("container", "rename"): {
+		commandPath: []string{"container", "rename"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"container restart": {
-		commandPath: "container restart",
+	commandKey("container", "restart"): {
+		commandPath: []string{"container", "restart"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--time": ignoredArgHandler,
@@ -892,8 +895,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container rm": {
-		commandPath: "container rm",
+	commandKey("container", "rm"): {
+		commandPath: []string{"container", "rm"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force":   nil,
@@ -903,8 +906,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container run": {
-		commandPath: "container run",
+	commandKey("container", "run"): {
+		commandPath: []string{"container", "run"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--add-host":                           ignoredArgHandler,
@@ -1012,8 +1015,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container start": {
-		commandPath: "container start",
+	commandKey("container", "start"): {
+		commandPath: []string{"container", "start"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--attach":      nil,
@@ -1022,8 +1025,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container stats": {
-		commandPath: "container stats",
+	commandKey("container", "stats"): {
+		commandPath: []string{"container", "stats"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":       nil,
@@ -1034,8 +1037,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container stop": {
-		commandPath: "container stop",
+	commandKey("container", "stop"): {
+		commandPath: []string{"container", "stop"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--time": ignoredArgHandler,
@@ -1043,14 +1046,18 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container unpause": {
-		commandPath: "container unpause",
+	commandKey("container", "unpause"): {
+		commandPath: []string{"container", "unpause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
+}
 
-	"container update": {
-		commandPath: "container update",
+// commands2 is part of commands.
+var commands2 = map[string]commandDefinition{
+
+	commandKey("container", "update"): {
+		commandPath: []string{"container", "update"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--blkio-weight":       ignoredArgHandler,
@@ -1070,14 +1077,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"container wait": {
-		commandPath: "container wait",
+	commandKey("container", "wait"): {
+		commandPath: []string{"container", "wait"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"cp": {
-		commandPath: "cp",
+	commandKey("cp"): {
+		commandPath: []string{"cp"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--follow-link": nil,
@@ -1085,8 +1092,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"create": {
-		commandPath: "create",
+	commandKey("create"): {
+		commandPath: []string{"create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--add-host":                              ignoredArgHandler,
@@ -1190,14 +1197,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"diff": {
-		commandPath: "diff",
+	commandKey("diff"): {
+		commandPath: []string{"diff"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"events": {
-		commandPath: "events",
+	commandKey("events"): {
+		commandPath: []string{"events"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--filter": ignoredArgHandler,
@@ -1206,8 +1213,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"exec": {
-		commandPath: "exec",
+	commandKey("exec"): {
+		commandPath: []string{"exec"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--detach":      nil,
@@ -1227,14 +1234,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"help": {
-		commandPath: "help",
+	commandKey("help"): {
+		commandPath: []string{"help"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"history": {
-		commandPath: "history",
+	commandKey("history"): {
+		commandPath: []string{"history"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format":   ignoredArgHandler,
@@ -1247,8 +1254,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image": {
-		commandPath: "image",
+	commandKey("image"): {
+		commandPath: []string{"image"},
 		subcommands: map[string]struct{}{
 			"build":   {},
 			"convert": {},
@@ -1268,8 +1275,8 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"image build": {
-		commandPath: "image build",
+	commandKey("image", "build"): {
+		commandPath: []string{"image", "build"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--allow":         ignoredArgHandler,
@@ -1303,8 +1310,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image convert": {
-		commandPath: "image convert",
+	commandKey("image", "convert"): {
+		commandPath: []string{"image", "convert"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms":                 nil,
@@ -1336,8 +1343,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image decrypt": {
-		commandPath: "image decrypt",
+	commandKey("image", "decrypt"): {
+		commandPath: []string{"image", "decrypt"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1349,8 +1356,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image encrypt": {
-		commandPath: "image encrypt",
+	commandKey("image", "encrypt"): {
+		commandPath: []string{"image", "encrypt"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1363,8 +1370,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image history": {
-		commandPath: "image history",
+	commandKey("image", "history"): {
+		commandPath: []string{"image", "history"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format":   ignoredArgHandler,
@@ -1377,8 +1384,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image inspect": {
-		commandPath: "image inspect",
+	commandKey("image", "inspect"): {
+		commandPath: []string{"image", "inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format":   ignoredArgHandler,
@@ -1388,8 +1395,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image load": {
-		commandPath: "image load",
+	commandKey("image", "load"): {
+		commandPath: []string{"image", "load"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1401,8 +1408,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image ls": {
-		commandPath: "image ls",
+	commandKey("image", "ls"): {
+		commandPath: []string{"image", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":      nil,
@@ -1418,8 +1425,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image prune": {
-		commandPath: "image prune",
+	commandKey("image", "prune"): {
+		commandPath: []string{"image", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":    nil,
@@ -1430,8 +1437,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image pull": {
-		commandPath: "image pull",
+	commandKey("image", "pull"): {
+		commandPath: []string{"image", "pull"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms":                         nil,
@@ -1450,8 +1457,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image push": {
-		commandPath: "image push",
+	commandKey("image", "push"): {
+		commandPath: []string{"image", "push"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms":                    nil,
@@ -1470,8 +1477,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image rm": {
-		commandPath: "image rm",
+	commandKey("image", "rm"): {
+		commandPath: []string{"image", "rm"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--async": nil,
@@ -1480,8 +1487,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image save": {
-		commandPath: "image save",
+	commandKey("image", "save"): {
+		commandPath: []string{"image", "save"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1491,14 +1498,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"image tag": {
-		commandPath: "image tag",
+	commandKey("image", "tag"): {
+		commandPath: []string{"image", "tag"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"images": {
-		commandPath: "images",
+	commandKey("images"): {
+		commandPath: []string{"images"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":      nil,
@@ -1514,8 +1521,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"info": {
-		commandPath: "info",
+	commandKey("info"): {
+		commandPath: []string{"info"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -1524,8 +1531,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"inspect": {
-		commandPath: "inspect",
+	commandKey("inspect"): {
+		commandPath: []string{"inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -1537,24 +1544,24 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"ipfs": {
-		commandPath: "ipfs",
+	commandKey("ipfs"): {
+		commandPath: []string{"ipfs"},
 		subcommands: map[string]struct{}{
 			"registry": {},
 		},
 		options: map[string]argHandler{},
 	},
 
-	"ipfs registry": {
-		commandPath: "ipfs registry",
+	commandKey("ipfs", "registry"): {
+		commandPath: []string{"ipfs", "registry"},
 		subcommands: map[string]struct{}{
 			"serve": {},
 		},
 		options: map[string]argHandler{},
 	},
 
-	"ipfs registry serve": {
-		commandPath: "ipfs registry serve",
+	commandKey("ipfs", "registry", "serve"): {
+		commandPath: []string{"ipfs", "registry", "serve"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--ipfs-address":    ignoredArgHandler,
@@ -1564,8 +1571,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"kill": {
-		commandPath: "kill",
+	commandKey("kill"): {
+		commandPath: []string{"kill"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--signal": ignoredArgHandler,
@@ -1573,8 +1580,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"load": {
-		commandPath: "load",
+	commandKey("load"): {
+		commandPath: []string{"load"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1585,9 +1592,13 @@ var commands = map[string]commandDefinition{
 			"-q":              nil,
 		},
 	},
+}
 
-	"login": {
-		commandPath: "login",
+// commands3 is part of commands.
+var commands3 = map[string]commandDefinition{
+
+	commandKey("login"): {
+		commandPath: []string{"login"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--password":       ignoredArgHandler,
@@ -1598,14 +1609,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"logout": {
-		commandPath: "logout",
+	commandKey("logout"): {
+		commandPath: []string{"logout"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"logs": {
-		commandPath: "logs",
+	commandKey("logs"): {
+		commandPath: []string{"logs"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--follow":     nil,
@@ -1619,8 +1630,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"namespace": {
-		commandPath: "namespace",
+	commandKey("namespace"): {
+		commandPath: []string{"namespace"},
 		subcommands: map[string]struct{}{
 			"create":  {},
 			"inspect": {},
@@ -1631,8 +1642,8 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"namespace create": {
-		commandPath: "namespace create",
+	commandKey("namespace", "create"): {
+		commandPath: []string{"namespace", "create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--label": ignoredArgHandler,
@@ -1640,8 +1651,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"namespace inspect": {
-		commandPath: "namespace inspect",
+	commandKey("namespace", "inspect"): {
+		commandPath: []string{"namespace", "inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -1649,8 +1660,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"namespace ls": {
-		commandPath: "namespace ls",
+	commandKey("namespace", "ls"): {
+		commandPath: []string{"namespace", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--quiet": nil,
@@ -1658,8 +1669,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"namespace remove": {
-		commandPath: "namespace remove",
+	commandKey("namespace", "remove"): {
+		commandPath: []string{"namespace", "remove"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--cgroup": nil,
@@ -1667,8 +1678,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"namespace update": {
-		commandPath: "namespace update",
+	commandKey("namespace", "update"): {
+		commandPath: []string{"namespace", "update"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--label": ignoredArgHandler,
@@ -1676,8 +1687,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"network": {
-		commandPath: "network",
+	commandKey("network"): {
+		commandPath: []string{"network"},
 		subcommands: map[string]struct{}{
 			"create":  {},
 			"inspect": {},
@@ -1688,8 +1699,8 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"network create": {
-		commandPath: "network create",
+	commandKey("network", "create"): {
+		commandPath: []string{"network", "create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--driver":      ignoredArgHandler,
@@ -1706,8 +1717,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"network inspect": {
-		commandPath: "network inspect",
+	commandKey("network", "inspect"): {
+		commandPath: []string{"network", "inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -1716,8 +1727,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"network ls": {
-		commandPath: "network ls",
+	commandKey("network", "ls"): {
+		commandPath: []string{"network", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--filter": ignoredArgHandler,
@@ -1728,8 +1739,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"network prune": {
-		commandPath: "network prune",
+	commandKey("network", "prune"): {
+		commandPath: []string{"network", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force": nil,
@@ -1737,26 +1748,26 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"network rm": {
-		commandPath: "network rm",
+	commandKey("network", "rm"): {
+		commandPath: []string{"network", "rm"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"pause": {
-		commandPath: "pause",
+	commandKey("pause"): {
+		commandPath: []string{"pause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"port": {
-		commandPath: "port",
+	commandKey("port"): {
+		commandPath: []string{"port"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"ps": {
-		commandPath: "ps",
+	commandKey("ps"): {
+		commandPath: []string{"ps"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":      nil,
@@ -1776,8 +1787,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"pull": {
-		commandPath: "pull",
+	commandKey("pull"): {
+		commandPath: []string{"pull"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms":                         nil,
@@ -1796,8 +1807,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"push": {
-		commandPath: "push",
+	commandKey("push"): {
+		commandPath: []string{"push"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms":                    nil,
@@ -1816,14 +1827,14 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"rename": {
-		commandPath: "rename",
+	commandKey("rename"): {
+		commandPath: []string{"rename"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"restart": {
-		commandPath: "restart",
+	commandKey("restart"): {
+		commandPath: []string{"restart"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--time": ignoredArgHandler,
@@ -1831,8 +1842,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"rm": {
-		commandPath: "rm",
+	commandKey("rm"): {
+		commandPath: []string{"rm"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force":   nil,
@@ -1842,8 +1853,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"rmi": {
-		commandPath: "rmi",
+	commandKey("rmi"): {
+		commandPath: []string{"rmi"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--async": nil,
@@ -1852,8 +1863,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"run": {
-		commandPath: "run",
+	commandKey("run"): {
+		commandPath: []string{"run"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--add-host":                           ignoredArgHandler,
@@ -1961,8 +1972,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"save": {
-		commandPath: "save",
+	commandKey("save"): {
+		commandPath: []string{"save"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all-platforms": nil,
@@ -1972,8 +1983,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"start": {
-		commandPath: "start",
+	commandKey("start"): {
+		commandPath: []string{"start"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--attach":      nil,
@@ -1982,8 +1993,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"stats": {
-		commandPath: "stats",
+	commandKey("stats"): {
+		commandPath: []string{"stats"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":       nil,
@@ -1994,8 +2005,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"stop": {
-		commandPath: "stop",
+	commandKey("stop"): {
+		commandPath: []string{"stop"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--time": ignoredArgHandler,
@@ -2003,8 +2014,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"system": {
-		commandPath: "system",
+	commandKey("system"): {
+		commandPath: []string{"system"},
 		subcommands: map[string]struct{}{
 			"events": {},
 			"info":   {},
@@ -2013,8 +2024,8 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"system events": {
-		commandPath: "system events",
+	commandKey("system", "events"): {
+		commandPath: []string{"system", "events"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--filter": ignoredArgHandler,
@@ -2023,8 +2034,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"system info": {
-		commandPath: "system info",
+	commandKey("system", "info"): {
+		commandPath: []string{"system", "info"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -2032,9 +2043,13 @@ var commands = map[string]commandDefinition{
 			"-f":       ignoredArgHandler,
 		},
 	},
+}
+
+// commands4 is part of commands.
+var commands4 = map[string]commandDefinition{
 
-	"system prune": {
-		commandPath: "system prune",
+	commandKey("system", "prune"): {
+		commandPath: []string{"system", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":     nil,
@@ -2045,26 +2060,26 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"tag": {
-		commandPath: "tag",
+	commandKey("tag"): {
+		commandPath: []string{"tag"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"top": {
-		commandPath: "top",
+	commandKey("top"): {
+		commandPath: []string{"top"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"unpause": {
-		commandPath: "unpause",
+	commandKey("unpause"): {
+		commandPath: []string{"unpause"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 
-	"update": {
-		commandPath: "update",
+	commandKey("update"): {
+		commandPath: []string{"update"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--blkio-weight":       ignoredArgHandler,
@@ -2084,8 +2099,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"version": {
-		commandPath: "version",
+	commandKey("version"): {
+		commandPath: []string{"version"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -2093,8 +2108,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"volume": {
-		commandPath: "volume",
+	commandKey("volume"): {
+		commandPath: []string{"volume"},
 		subcommands: map[string]struct{}{
 			"create":  {},
 			"inspect": {},
@@ -2105,16 +2120,16 @@ var commands = map[string]commandDefinition{
 		options: map[string]argHandler{},
 	},
 
-	"volume create": {
-		commandPath: "volume create",
+	commandKey("volume", "create"): {
+		commandPath: []string{"volume", "create"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--label": ignoredArgHandler,
 		},
 	},
 
-	"volume inspect": {
-		commandPath: "volume inspect",
+	commandKey("volume", "inspect"): {
+		commandPath: []string{"volume", "inspect"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--format": ignoredArgHandler,
@@ -2124,8 +2139,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"volume ls": {
-		commandPath: "volume ls",
+	commandKey("volume", "ls"): {
+		commandPath: []string{"volume", "ls"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--filter": ignoredArgHandler,
@@ -2138,8 +2153,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"volume prune": {
-		commandPath: "volume prune",
+	commandKey("volume", "prune"): {
+		commandPath: []string{"volume", "prune"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--all":   nil,
@@ -2149,8 +2164,8 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"volume rm": {
-		commandPath: "volume rm",
+	commandKey("volume", "rm"): {
+		commandPath: []string{"volume", "rm"},
 		subcommands: map[string]struct{}{},
 		options: map[string]argHandler{
 			"--force": nil,
@@ -2158,9 +2173,73 @@ var commands = map[string]commandDefinition{
 		},
 	},
 
-	"wait": {
-		commandPath: "wait",
+	commandKey("wait"): {
+		commandPath: []string{"wait"},
 		subcommands: map[string]struct{}{},
 		options:     map[string]argHandler{},
 	},
 }
+
+// commands supported by nerdctl; the key here is the commandKey of the
+// subcommand path to reach the given subcommand (where the root command has an
+// empty path).
+var commands = mergeCommands(
+	commands0,
+	commands1,
+	commands2,
+	commands3,
+	commands4,
+)
+
+// knownCommands lists the top-level nerdctl subcommands, sorted.
+var knownCommands = []string{
+	"apparmor",
+	"attach",
+	"build",
+	"builder",
+	"commit",
+	"completion",
+	"compose",
+	"container",
+	"cp",
+	"create",
+	"diff",
+	"events",
+	"exec",
+	"help",
+	"history",
+	"image",
+	"images",
+	"info",
+	"inspect",
+	"ipfs",
+	"kill",
+	"load",
+	"login",
+	"logout",
+	"logs",
+	"namespace",
+	"network",
+	"pause",
+	"port",
+	"ps",
+	"pull",
+	"push",
+	"rename",
+	"restart",
+	"rm",
+	"rmi",
+	"run",
+	"save",
+	"start",
+	"stats",
+	"stop",
+	"system",
+	"tag",
+	"top",
+	"unpause",
+	"update",
+	"version",
+	"volume",
+	"wait",
+}
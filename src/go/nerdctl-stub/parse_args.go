@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
 type cleanupFunc func() error
@@ -40,11 +44,19 @@ type commandDefinition struct {
 	// variable named "commands" is used instead.
 	commands *map[string]commandDefinition
 	// commandPath is the arguments needed to get to this command.
-	commandPath string
+	commandPath []string
+	// invokedPath is the arguments that were used to get to this command while
+	// parsing, if they differ from commandPath (i.e. via an alias); it is only
+	// used in messages.
+	invokedPath []string
 	// subcommands that can be spawned from this command.
 	subcommands map[string]struct{}
+	// aliases for subcommands; the key is the alias, and the value is the
+	// canonical name of the subcommand (as found in subcommands).
+	aliases map[string]string
 	// options for this (sub) command.  If the handler is null, the option does
-	// not take arguments.
+	// not take arguments.  Options not found here or in any parent command are
+	// rejected as unknown.
 	options map[string]argHandler
 	// handler for any positional arguments and subcommands.  This should not
 	// include the name of the subcommand itself.  If this is not given, all
@@ -108,18 +120,15 @@ func (c *commandDefinition) parseOption(arg, next string) ([]string, bool, []cle
 
 	// Check if we can resolve this with the parent command.
 	var extraCleanups []cleanupFunc
-	parentName := ""
-	if lastSpace := strings.LastIndex(c.commandPath, " "); lastSpace > -1 {
-		parentName = c.commandPath[:lastSpace]
-	}
-	if parentName != c.commandPath {
+	if len(c.commandPath) > 0 {
 		globalCommands := c.commands
 		if globalCommands == nil {
 			globalCommands = &commands
 		}
-		parent, ok := (*globalCommands)[parentName]
+		parentPath := c.commandPath[:len(c.commandPath)-1]
+		parent, ok := (*globalCommands)[commandKey(parentPath...)]
 		if !ok {
-			panic(fmt.Sprintf("command %q could not find parent %q", c.commandPath, parentName))
+			panic(fmt.Sprintf("command %q could not find parent %q", c.name(), strings.Join(parentPath, " ")))
 		}
 		parentResult, parentConsumed, parentCleanups, parentErr := parent.parseOption(arg, next)
 		if parentErr == nil {
@@ -127,7 +136,55 @@ func (c *commandDefinition) parseOption(arg, next string) ([]string, bool, []cle
 		}
 		extraCleanups = parentCleanups
 	}
-	return nil, false, extraCleanups, fmt.Errorf("command %q does not support option %s", c.commandPath, arg)
+	return nil, false, extraCleanups, fmt.Errorf("%w %s for %q", errUnknownOption, arg, strings.TrimSpace("nerdctl "+c.name()))
+}
+
+// optionDashes are characters that look like hyphens, which can end up at the
+// start of an option copied from formatted documentation.  The generator
+// replaces them the same way.
+const optionDashes = "\u2010\u2011\u2012\u2013\u2014\u2212"
+
+// normalizeOption replaces any lookalike dashes at the start of the argument
+// with hyphens, so that it is looked up (and passed on) as an option.  Anything
+// else is returned unchanged; in particular, the number of dashes is kept, so
+// that bundled short options (`-it`) still work.
+func normalizeOption(arg string) string {
+	rest := strings.TrimLeft(arg, "-"+optionDashes)
+	prefix := arg[:len(arg)-len(rest)]
+	if !strings.ContainsAny(prefix, optionDashes) {
+		return arg
+	}
+	return strings.Repeat("-", utf8.RuneCountInString(prefix)) + rest
+}
+
+// normalizedOptionPattern matches option names as the generator writes them
+// in the options of each command: a short option is a hyphen and a single
+// character, and a long option is two hyphens and a name.
+var normalizedOptionPattern = regexp.MustCompile(`^(-[A-Za-z0-9?]|--[A-Za-z0-9?][-_.A-Za-z0-9]*)$`)
+
+// isNormalizedOption checks if the option is named as normalizedOptionPattern
+// expects.
+func isNormalizedOption(option string) bool {
+	return normalizedOptionPattern.MatchString(option)
+}
+
+// errUnknownOption is returned when parsing an option that the command (and its
+// parents) do not have.
+var errUnknownOption = errors.New("unknown flag")
+
+// name returns the space-separated command path as it was invoked, for
+// messages.
+func (c *commandDefinition) name() string {
+	return strings.Join(c.path(), " ")
+}
+
+// path returns the arguments used to get to this command: invokedPath if it
+// was set while parsing, or commandPath otherwise.
+func (c *commandDefinition) path() []string {
+	if c.invokedPath != nil {
+		return c.invokedPath
+	}
+	return c.commandPath
 }
 
 // parse arguments for this command; this includes options (--long, -x) as well
@@ -135,8 +192,26 @@ func (c *commandDefinition) parseOption(arg, next string) ([]string, bool, []cle
 func (c commandDefinition) parse(args []string) (*parsedArgs, error) {
 	var result parsedArgs
 	for argIndex := 0; argIndex < len(args); argIndex++ {
-		arg := args[argIndex]
-		if strings.HasPrefix(arg, "-") {
+		arg := normalizeOption(args[argIndex])
+		if arg == "--" {
+			// Everything after `--` is an operand, even if it looks like an
+			// option; only the command handler (if any) looks at them.
+			result.args = append(result.args, arg)
+			operands := args[argIndex+1:]
+			if c.handler == nil {
+				result.args = append(result.args, operands...)
+				break
+			}
+			childResult, err := c.handler(&c, operands, argHandlers)
+			if err != nil {
+				return nil, err
+			}
+			result.args = append(result.args, childResult.args...)
+			result.cleanup = append(result.cleanup, childResult.cleanup...)
+			break
+		}
+		// A lone `-` (stdin or stdout) is an operand, not an option.
+		if strings.HasPrefix(arg, "-") && arg != "-" {
 			next := ""
 			if argIndex+1 < len(args) {
 				next = args[argIndex+1]
@@ -169,16 +244,18 @@ func (c commandDefinition) parse(args []string) (*parsedArgs, error) {
 				break
 			}
 			// No custom handler; look for subcommands.
-			subcommandPath := c.commandPath
-			if subcommandPath != "" {
-				subcommandPath += " "
+			subcommandName := arg
+			if canonical, ok := c.aliases[arg]; ok {
+				subcommandName = canonical
 			}
-			subcommandPath += arg
+			subcommandPath := append(slices.Clip(c.commandPath), subcommandName)
 			globalCommands := c.commands
 			if globalCommands == nil {
 				globalCommands = &commands
 			}
-			if subcommand, ok := (*globalCommands)[subcommandPath]; ok {
+			if subcommand, ok := (*globalCommands)[commandKey(subcommandPath...)]; ok {
+				// Name the subcommand as it was typed, not as it was resolved.
+				subcommand.invokedPath = append(slices.Clip(c.path()), arg)
 				childResult, err := subcommand.parse(args[argIndex+1:])
 				if err != nil {
 					return nil, err
@@ -196,6 +273,17 @@ func (c commandDefinition) parse(args []string) (*parsedArgs, error) {
 	return &result, nil
 }
 
+// commandKeySeparator separates the elements of a command path in its key in
+// the commands map.  Arguments cannot contain NUL characters, so this is
+// unambiguous.
+const commandKeySeparator = "\x00"
+
+// commandKey returns the key in the commands map for the command reached with
+// the given arguments; the root command has no arguments.
+func commandKey(path ...string) string {
+	return strings.Join(path, commandKeySeparator)
+}
+
 // parseArgs parses the process arguments (os.Args) and returns them with any
 // strings referring to paths replaced with replacements that will work with
 // nerdctl (i.e. inside the correct WSL container).
@@ -204,7 +292,7 @@ func parseArgs() (*parsedArgs, error) {
 	if err != nil {
 		return nil, err
 	}
-	result, err := commands[""].parse(os.Args[1:])
+	result, err := commands[commandKey()].parse(os.Args[1:])
 	if err != nil {
 		_ = cleanupParseArgs()
 		return nil, err
@@ -217,13 +305,33 @@ func ignoredArgHandler(input string) (string, []cleanupFunc, error) {
 	return input, nil, nil
 }
 
+// mergeCommands combines the chunks of the generated commands map.  This is
+// used to initialize the commands variable itself (rather than populating it
+// in init()), so that it is complete before any init() functions run.
+func mergeCommands(chunks ...map[string]commandDefinition) map[string]commandDefinition {
+	result := make(map[string]commandDefinition)
+	for _, chunk := range chunks {
+		for path, command := range chunk {
+			if _, ok := result[path]; ok {
+				panic(fmt.Sprintf("duplicate command %q", path))
+			}
+			result[path] = command
+		}
+	}
+	return result
+}
+
 // registerArgHandler sets option handlers.  This should be called from init()
-// to set up any option handlers that need to handle paths.
+// to set up any option handlers that need to handle paths.  The command is
+// given by its key (see commandKey).
 func registerArgHandler(command, option string, handler argHandler) {
 	// Do some extra checking to guard against typos.
 	if _, ok := commands[command]; !ok {
 		panic(fmt.Sprintf("unknown command %q", command))
 	}
+	if !isNormalizedOption(option) {
+		panic(fmt.Sprintf("command %q: option %q is not normalized", command, option))
+	}
 	if _, ok := commands[command].options[option]; !ok {
 		panic(fmt.Sprintf("command %q does not have option %q", command, option))
 	}
@@ -231,7 +339,7 @@ func registerArgHandler(command, option string, handler argHandler) {
 }
 
 // registerCommandHandler sets handlers for positional arguments.  This should
-// be called from init().
+// be called from init().  The command is given by its key (see commandKey).
 func registerCommandHandler(command string, handler commandHandlerType) {
 	// Do some extra checking to guard against typos.
 	if _, ok := commands[command]; !ok {
@@ -245,7 +353,8 @@ func registerCommandHandler(command string, handler commandHandlerType) {
 // aliasCommand sets up an alias to a different command.  Both the alias and the
 // target command must already exist and have the same options / subcommands (as
 // it should already be an alias).  This is normally not needed for the help
-// commands, as they do not take any arguments.
+// commands, as they do not take any arguments.  The commands are given by their
+// keys (see commandKey).
 func aliasCommand(alias, target string) {
 	aliasCommand, ok := commands[alias]
 	if !ok {
@@ -289,67 +398,67 @@ func aliasCommand(alias, target string) {
 
 func init() {
 	// Set up the argument handlers
-	registerArgHandler("builder build", "--build-context", argHandlers.buildContextArgHandler)
-	registerArgHandler("builder build", "--cache-from", argHandlers.builderCacheArgHandler)
-	registerArgHandler("builder build", "--cache-to", argHandlers.builderCacheArgHandler)
-	registerArgHandler("builder build", "--file", argHandlers.filePathArgHandler)
-	registerArgHandler("builder build", "-f", argHandlers.filePathArgHandler)
-	registerArgHandler("builder build", "--iidfile", argHandlers.outputPathArgHandler)
-	registerArgHandler("builder debug", "--file", argHandlers.filePathArgHandler)
-	registerArgHandler("builder debug", "-f", argHandlers.filePathArgHandler)
-	registerArgHandler("compose", "--file", argHandlers.filePathArgHandler)
-	registerArgHandler("compose", "-f", argHandlers.filePathArgHandler)
-	registerArgHandler("compose", "--project-directory", argHandlers.filePathArgHandler)
-	registerArgHandler("compose", "--env-file", argHandlers.filePathArgHandler)
-	registerArgHandler("compose run", "--volume", argHandlers.volumeArgHandler)
-	registerArgHandler("compose run", "-v", argHandlers.volumeArgHandler)
-	registerArgHandler("container create", "--cidfile", argHandlers.outputPathArgHandler)
-	registerArgHandler("container create", "--cosign-key", argHandlers.filePathArgHandler)
-	registerArgHandler("container create", "--env-file", argHandlers.filePathArgHandler)
-	registerArgHandler("container create", "--label-file", argHandlers.filePathArgHandler)
-	registerArgHandler("container create", "--mount", argHandlers.mountArgHandler)
-	registerArgHandler("container create", "--pidfile", argHandlers.outputPathArgHandler)
-	registerArgHandler("container create", "--volume", argHandlers.volumeArgHandler)
-	registerArgHandler("container create", "-v", argHandlers.volumeArgHandler)
-	registerArgHandler("container run", "--cidfile", argHandlers.outputPathArgHandler)
-	registerArgHandler("container run", "--cosign-key", argHandlers.filePathArgHandler)
-	registerArgHandler("container run", "--env-file", argHandlers.filePathArgHandler)
-	registerArgHandler("container run", "--label-file", argHandlers.filePathArgHandler)
-	registerArgHandler("container run", "--mount", argHandlers.mountArgHandler)
-	registerArgHandler("container run", "--pidfile", argHandlers.outputPathArgHandler)
-	registerArgHandler("container run", "--volume", argHandlers.volumeArgHandler)
-	registerArgHandler("container run", "-v", argHandlers.volumeArgHandler)
-	registerArgHandler("image convert", "--estargz-record-in", argHandlers.filePathArgHandler)
-	registerArgHandler("image load", "--input", argHandlers.filePathArgHandler)
-	registerArgHandler("image save", "--output", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "--build-context", argHandlers.buildContextArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "--cache-from", argHandlers.builderCacheArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "--cache-to", argHandlers.builderCacheArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "--file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "-f", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("builder", "build"), "--iidfile", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("builder", "debug"), "--file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("builder", "debug"), "-f", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("compose"), "--file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("compose"), "-f", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("compose"), "--project-directory", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("compose"), "--env-file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("compose", "run"), "--volume", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("compose", "run"), "-v", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--cidfile", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--cosign-key", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--env-file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--label-file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--mount", argHandlers.mountArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--pidfile", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("container", "create"), "--volume", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("container", "create"), "-v", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--cidfile", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--cosign-key", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--env-file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--label-file", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--mount", argHandlers.mountArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--pidfile", argHandlers.outputPathArgHandler)
+	registerArgHandler(commandKey("container", "run"), "--volume", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("container", "run"), "-v", argHandlers.volumeArgHandler)
+	registerArgHandler(commandKey("image", "convert"), "--estargz-record-in", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("image", "load"), "--input", argHandlers.filePathArgHandler)
+	registerArgHandler(commandKey("image", "save"), "--output", argHandlers.outputPathArgHandler)
 
 	// Set up command handlers
-	registerCommandHandler("builder build", builderBuildHandler)
-	registerCommandHandler("container cp", containerCopyHandler)
+	registerCommandHandler(commandKey("builder", "build"), builderBuildHandler)
+	registerCommandHandler(commandKey("container", "cp"), containerCopyHandler)
 
 	// Set up aliases
-	aliasCommand("commit", "container commit")
-	aliasCommand("cp", "container cp")
-	aliasCommand("create", "container create")
-	aliasCommand("exec", "container exec")
-	aliasCommand("kill", "container kill")
-	aliasCommand("image build", "builder build")
-	aliasCommand("logs", "container logs")
-	aliasCommand("pause", "container pause")
-	aliasCommand("port", "container port")
-	aliasCommand("rename", "container rename")
-	aliasCommand("rm", "container rm")
-	aliasCommand("run", "container run")
-	aliasCommand("start", "container start")
-	aliasCommand("stop", "container stop")
-	aliasCommand("unpause", "container unpause")
-	aliasCommand("wait", "container wait")
-	aliasCommand("build", "builder build")
-	aliasCommand("load", "image load")
-	aliasCommand("pull", "image pull")
-	aliasCommand("push", "image push")
-	aliasCommand("save", "image save")
-	aliasCommand("tag", "image tag")
+	aliasCommand(commandKey("commit"), commandKey("container", "commit"))
+	aliasCommand(commandKey("cp"), commandKey("container", "cp"))
+	aliasCommand(commandKey("create"), commandKey("container", "create"))
+	aliasCommand(commandKey("exec"), commandKey("container", "exec"))
+	aliasCommand(commandKey("kill"), commandKey("container", "kill"))
+	aliasCommand(commandKey("image", "build"), commandKey("builder", "build"))
+	aliasCommand(commandKey("logs"), commandKey("container", "logs"))
+	aliasCommand(commandKey("pause"), commandKey("container", "pause"))
+	aliasCommand(commandKey("port"), commandKey("container", "port"))
+	aliasCommand(commandKey("rename"), commandKey("container", "rename"))
+	aliasCommand(commandKey("rm"), commandKey("container", "rm"))
+	aliasCommand(commandKey("run"), commandKey("container", "run"))
+	aliasCommand(commandKey("start"), commandKey("container", "start"))
+	aliasCommand(commandKey("stop"), commandKey("container", "stop"))
+	aliasCommand(commandKey("unpause"), commandKey("container", "unpause"))
+	aliasCommand(commandKey("wait"), commandKey("container", "wait"))
+	aliasCommand(commandKey("build"), commandKey("builder", "build"))
+	aliasCommand(commandKey("load"), commandKey("image", "load"))
+	aliasCommand(commandKey("pull"), commandKey("image", "pull"))
+	aliasCommand(commandKey("push"), commandKey("image", "push"))
+	aliasCommand(commandKey("save"), commandKey("image", "save"))
+	aliasCommand(commandKey("tag"), commandKey("image", "tag"))
 
 	describeCommands()
 }
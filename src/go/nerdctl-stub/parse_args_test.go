@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var errExpected = fmt.Errorf("expected error")
@@ -37,7 +40,8 @@ func TestParseOptions(t *testing.T) {
 		t.Parallel()
 		c := commandDefinition{}
 		_, _, _, err := c.parseOption("-hello", "world")
-		assert.EqualError(t, err, `command "" does not support option -hello`)
+		assert.EqualError(t, err, `unknown flag -hello for "nerdctl"`)
+		assert.ErrorIs(t, err, errUnknownOption)
 	})
 	t.Run("option with no value", func(t *testing.T) {
 		t.Parallel()
@@ -126,22 +130,21 @@ func TestParseOptions(t *testing.T) {
 	t.Run("looks for options in parent commands", func(t *testing.T) {
 		t.Parallel()
 		localCommands := make(map[string]commandDefinition)
-		localCommands[""] = commandDefinition{
-			commands:    &localCommands,
-			commandPath: "",
-			options:     map[string]argHandler{"--hello": nil},
+		localCommands[commandKey()] = commandDefinition{
+			commands: &localCommands,
+			options:  map[string]argHandler{"--hello": nil},
 		}
-		localCommands["subcommand"] = commandDefinition{
+		localCommands[commandKey("subcommand")] = commandDefinition{
 			commands:    &localCommands,
-			commandPath: "subcommand",
+			commandPath: []string{"subcommand"},
 			options:     map[string]argHandler{"--world": nil},
 		}
-		localCommands["subcommand more"] = commandDefinition{
+		localCommands[commandKey("subcommand", "more")] = commandDefinition{
 			commands:    &localCommands,
-			commandPath: "subcommand more",
+			commandPath: []string{"subcommand", "more"},
 			options:     map[string]argHandler{"--foo": nil},
 		}
-		command := localCommands["subcommand more"]
+		command := localCommands[commandKey("subcommand", "more")]
 		args, _, _, err := command.parseOption("--hello", "")
 		if assert.NoError(t, err) {
 			assert.Equal(t, []string{"--hello"}, args)
@@ -170,6 +173,15 @@ func TestParse(t *testing.T) {
 			assert.Equal(t, expected, result)
 		}
 	})
+	t.Run("options with lookalike dashes", func(t *testing.T) {
+		t.Parallel()
+		c := commandDefinition{options: map[string]argHandler{"--option": nil, "-o": nil, "-p": nil}}
+		result, err := c.parse([]string{"\u2013\u2013option", "\u2212op", "x\u2013y"})
+		if assert.NoError(t, err) {
+			expected := &parsedArgs{args: []string{"--option", "-op", "x\u2013y"}}
+			assert.Equal(t, expected, result)
+		}
+	})
 	t.Run("options with parse error", func(t *testing.T) {
 		t.Parallel()
 		cleanupRun := false
@@ -224,4 +236,225 @@ func TestParse(t *testing.T) {
 		assert.NoError(t, err)
 		assert.True(t, run)
 	})
+	t.Run("global options before subcommand", func(t *testing.T) {
+		t.Parallel()
+		localCommands := make(map[string]commandDefinition)
+		localCommands[""] = commandDefinition{
+			commands:    &localCommands,
+			subcommands: map[string]struct{}{"run": {}},
+			options: map[string]argHandler{
+				"--namespace": ignoredArgHandler,
+				"-n":          ignoredArgHandler,
+				"--debug":     nil,
+			},
+		}
+		localCommands["run"] = commandDefinition{
+			commands:    &localCommands,
+			commandPath: []string{"run"},
+			options:     map[string]argHandler{"--detach": nil},
+		}
+		result, err := localCommands[""].parse([]string{"-n", "run", "--debug", "--namespace=x", "run", "--detach", "image"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"-n", "run", "--debug", "--namespace", "x", "run", "--detach", "image"}, result.args)
+		}
+	})
+	t.Run("nested subcommands", func(t *testing.T) {
+		t.Parallel()
+		localCommands := make(map[string]commandDefinition)
+		localCommands[commandKey()] = commandDefinition{
+			commands:    &localCommands,
+			subcommands: map[string]struct{}{"image": {}},
+			options:     map[string]argHandler{"--debug": nil},
+		}
+		localCommands[commandKey("image")] = commandDefinition{
+			commands:    &localCommands,
+			commandPath: []string{"image"},
+			subcommands: map[string]struct{}{"load": {}},
+			aliases:     map[string]string{"ld": "load"},
+		}
+		localCommands[commandKey("image", "load")] = commandDefinition{
+			commands:    &localCommands,
+			commandPath: []string{"image", "load"},
+			options: map[string]argHandler{
+				"--input": func(input string) (string, []cleanupFunc, error) {
+					return "converted " + input, nil, nil
+				},
+			},
+		}
+		// A command whose name contains a space must not be confused with
+		// the nested command.
+		localCommands[commandKey("image load")] = commandDefinition{
+			commands:    &localCommands,
+			commandPath: []string{"image load"},
+		}
+		result, err := localCommands[commandKey()].parse([]string{"image", "ld", "--input", "file", "--debug"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"image", "ld", "--input", "converted file", "--debug"}, result.args)
+		}
+		_, err = localCommands[commandKey("image")].parse([]string{"load", "--unknown"})
+		assert.EqualError(t, err, `unknown flag --unknown for "nerdctl image load"`)
+	})
+	t.Run("subcommand alias", func(t *testing.T) {
+		t.Parallel()
+		localCommands := make(map[string]commandDefinition)
+		localCommands[""] = commandDefinition{
+			commands:    &localCommands,
+			subcommands: map[string]struct{}{"remove": {}},
+			aliases:     map[string]string{"rm": "remove"},
+		}
+		localCommands["remove"] = commandDefinition{
+			commands:    &localCommands,
+			commandPath: []string{"remove"},
+			options:     map[string]argHandler{"--force": nil},
+		}
+		result, err := localCommands[""].parse([]string{"rm", "--force", "thing"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"rm", "--force", "thing"}, result.args)
+		}
+	})
+}
+
+func TestKnownCommands(t *testing.T) {
+	t.Parallel()
+	var rootCommands []string
+	for command := range commands[commandKey()].subcommands {
+		rootCommands = append(rootCommands, command)
+	}
+	assert.ElementsMatch(t, rootCommands, knownCommands)
+	assert.IsIncreasing(t, knownCommands)
+}
+
+func TestGeneratedCommands(t *testing.T) {
+	t.Parallel()
+	// The generated commands are split into chunks; check that they have all
+	// been merged before any init() runs.
+	if assert.Contains(t, commands, commandKey("container", "run")) {
+		assert.Contains(t, commands[commandKey("container", "run")].options, "--volume")
+		assert.NotNil(t, commands[commandKey("container", "run")].options["--volume"], "arg handler should be registered")
+	}
+	assert.Contains(t, commands, commandKey())
+	assert.Contains(t, commands, commandKey("wait"))
+}
+
+func TestNormalizeOption(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]string{
+		"--foo":                    "--foo",
+		"-f":                       "-f",
+		"-itp":                     "-itp",
+		"\u2013\u2013foo":          "--foo",
+		"\u2014foo":                "-foo",
+		"\u2010\u2011foo=a\u2013b": "--foo=a\u2013b",
+		"foo\u2013bar":             "foo\u2013bar",
+		"":                         "",
+	}
+	for input, expected := range testCases {
+		assert.Equal(t, expected, normalizeOption(input), "input %q", input)
+	}
+}
+
+func TestGeneratedOptionsNormalized(t *testing.T) {
+	t.Parallel()
+	for key, command := range commands {
+		for option := range command.options {
+			assert.True(t, isNormalizedOption(option), "command %q has option %q", key, option)
+		}
+	}
+	for _, option := range []string{"-", "--", "---foo", "-ab", "--foo=bar", "\u2013\u2013foo", "foo"} {
+		assert.False(t, isNormalizedOption(option), "option %q", option)
+	}
+}
+
+func TestGeneratedCommandsRejectUnknownOptions(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		args    []string
+		message string
+	}{
+		{
+			args:    []string{"--bogus", "ps"},
+			message: `unknown flag --bogus for "nerdctl"`,
+		},
+		{
+			args:    []string{"container", "run", "--bogus", "image"},
+			message: `unknown flag --bogus for "nerdctl container run"`,
+		},
+		{
+			// Aliases report the command as it was typed.
+			args:    []string{"run", "--rm", "--bogus=1", "image"},
+			message: `unknown flag --bogus=1 for "nerdctl run"`,
+		},
+		{
+			args:    []string{"build", "--bogus", "."},
+			message: `unknown flag --bogus for "nerdctl build"`,
+		},
+		{
+			args:    []string{"container", "run", "-itZ", "image"},
+			message: `unknown flag -itZ for "nerdctl container run"`,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(strings.Join(testCase.args, " "), func(t *testing.T) {
+			t.Parallel()
+			_, err := commands[commandKey()].parse(testCase.args)
+			assert.EqualError(t, err, testCase.message)
+			assert.ErrorIs(t, err, errUnknownOption)
+		})
+	}
+	t.Run("known options", func(t *testing.T) {
+		t.Parallel()
+		// Options of parent commands are accepted too.
+		_, err := commands[commandKey()].parse([]string{"container", "run", "--rm", "--debug", "-it", "image", "--bogus"})
+		assert.NoError(t, err, "options after the image belong to the container command")
+	})
+}
+
+func TestGeneratedCommandsAcceptDashOperands(t *testing.T) {
+	t.Parallel()
+	// A lone `-` and `--` are operands, not unknown options.
+	testCases := [][]string{
+		{"--"},
+		{"ps", "--", "--bogus"},
+		{"build", "-"},
+		{"builder", "build", "--", "-"},
+		{"container", "cp", "-", "container:/path"},
+	}
+	for _, args := range testCases {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			t.Parallel()
+			result, err := commands[commandKey()].parse(args)
+			require.NoError(t, err)
+			assert.Equal(t, args, result.args)
+		})
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "", commandKey())
+	assert.Equal(t, "run", commandKey("run"))
+	assert.NotEqual(t, commandKey("container run"), commandKey("container", "run"))
+	assert.NotEqual(t, commandKey("a", "b c"), commandKey("a b", "c"))
+	// Every generated command (other than aliases, which are copies of their
+	// targets) can be looked up by its path, as can each of its subcommands.
+	for key, command := range commands {
+		if key != commandKey(command.commandPath...) {
+			continue
+		}
+		for subcommand := range command.subcommands {
+			path := append(slices.Clip(command.commandPath), subcommand)
+			assert.Contains(t, commands, commandKey(path...))
+		}
+	}
+}
+
+func TestMergeCommands(t *testing.T) {
+	t.Parallel()
+	a := map[string]commandDefinition{"a": {commandPath: []string{"a"}}}
+	b := map[string]commandDefinition{"b": {commandPath: []string{"b"}}}
+	assert.Equal(t, map[string]commandDefinition{
+		"a": {commandPath: []string{"a"}},
+		"b": {commandPath: []string{"b"}},
+	}, mergeCommands(a, b))
+	assert.Panics(t, func() { mergeCommands(a, a) })
 }
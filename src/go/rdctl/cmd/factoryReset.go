@@ -17,15 +17,14 @@ limitations under the License.
 package cmd
 
 import (
-	"fmt"
-
-	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/factoryreset"
-	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
-	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/reset"
 	"github.com/spf13/cobra"
 )
 
-var removeKubernetesCache bool
+var removeKubernetesCache, keepVM bool
+var limaLogsDir string
+var limaSnapshotDir string
+var requireLimaSnapshot bool
 
 // Note that this command supports a `--remove-kubernetes-cache` flag,
 // but the server takes an optional flag meaning the opposite (as per issues
@@ -36,26 +35,35 @@ var factoryResetCmd = &cobra.Command{
 	Use:   "factory-reset",
 	Short: "Clear all the Rancher Desktop state and shut it down.",
 	Long: `Clear all the Rancher Desktop state and shut it down.
-Use the --remove-kubernetes-cache=BOOLEAN flag to also remove the cached Kubernetes images.`,
+Use the --remove-kubernetes-cache=BOOLEAN flag to also remove the cached Kubernetes images.
+Use the --keep-vm flag to stop the VM rather than deleting it, keeping it for the next start.
+Use the --snapshot-lima=DIR flag to save the VM into DIR before deleting it; with
+--require-snapshot, the reset is abandoned if that fails.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := cobra.NoArgs(cmd, args); err != nil {
 			return err
 		}
 		cmd.SilenceUsage = true
-		commonShutdownSettings.WaitForShutdown = false
-		_, err := doShutdown(cmd.Context(), &commonShutdownSettings, shutdown.FactoryReset)
-		if err != nil {
-			return err
-		}
-		paths, err := paths.GetPaths()
-		if err != nil {
-			return fmt.Errorf("failed to get paths: %w", err)
+		requestShutdown()
+		report, err := reset.FactoryReset(cmd.Context(), reset.Options{
+			RemoveKubernetesCache: removeKubernetesCache,
+			KeepVM:                keepVM,
+			LimaLogsDir:           limaLogsDir,
+			LimaSnapshotDir:       limaSnapshotDir,
+			RequireLimaSnapshot:   requireLimaSnapshot,
+		})
+		if report.ShutdownReport != nil {
+			logStageOutcomes(report.ShutdownReport, report.ShutdownError)
 		}
-		return factoryreset.DeleteData(cmd.Context(), paths, removeKubernetesCache)
+		return err
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(factoryResetCmd)
 	factoryResetCmd.Flags().BoolVar(&removeKubernetesCache, "remove-kubernetes-cache", false, "If specified, also removes the cached Kubernetes images.")
+	factoryResetCmd.Flags().BoolVar(&keepVM, "keep-vm", false, "If specified, stops the VM instead of deleting it.")
+	factoryResetCmd.Flags().StringVar(&limaLogsDir, "save-lima-logs", "", "Directory to save the VM logs to before deleting it.")
+	factoryResetCmd.Flags().StringVar(&limaSnapshotDir, "snapshot-lima", "", "Directory to save the VM to before deleting it.")
+	factoryResetCmd.Flags().BoolVar(&requireLimaSnapshot, "require-snapshot", false, "If specified, fails the reset if the VM could not be saved.")
 }
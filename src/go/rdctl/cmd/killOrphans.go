@@ -0,0 +1,64 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/spf13/cobra"
+)
+
+// killOrphansCmd represents the kill-orphans command
+var killOrphansCmd = &cobra.Command{
+	Use:   "kill-orphans",
+	Short: "Forcibly stop any leftover Rancher Desktop processes.",
+	Long: `Forcibly stops the lima VM, and kills any qemu and Rancher Desktop application
+processes, without waiting for them to exit gracefully.  This is intended to
+recover after a crash left processes running; use "rdctl shutdown" normally.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		killed, err := shutdown.KillOrphans(cmd.Context())
+		if killed != nil {
+			writeKilledProcesses(os.Stdout, killed)
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(killOrphansCmd)
+}
+
+func writeKilledProcesses(w io.Writer, killed *shutdown.KilledProcesses) {
+	if !killed.LimaStopped && len(killed.Qemu) == 0 && len(killed.App) == 0 {
+		fmt.Fprintln(w, "No Rancher Desktop processes were running.")
+		return
+	}
+	if killed.LimaStopped {
+		fmt.Fprintln(w, "Force-stopped the lima VM.")
+	}
+	for _, pid := range killed.Qemu {
+		fmt.Fprintf(w, "Killed qemu process %d.\n", pid)
+	}
+	for _, pid := range killed.App {
+		fmt.Fprintf(w, "Terminated Rancher Desktop process %d.\n", pid)
+	}
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteKilledProcesses(t *testing.T) {
+	t.Run("killed processes", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeKilledProcesses(&buf, &shutdown.KilledProcesses{LimaStopped: true, Qemu: []int{100}, App: []int{200, 201}})
+		assert.Equal(t, "Force-stopped the lima VM.\n"+
+			"Killed qemu process 100.\n"+
+			"Terminated Rancher Desktop process 200.\n"+
+			"Terminated Rancher Desktop process 201.\n", buf.String())
+	})
+	t.Run("nothing running", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeKilledProcesses(&buf, &shutdown.KilledProcesses{})
+		assert.Equal(t, "No Rancher Desktop processes were running.\n", buf.String())
+	})
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/spf13/cobra"
+)
+
+var psFormat string
+
+// psCmd represents the ps command
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "List running Rancher Desktop processes.",
+	Long: `Lists the state of the lima VM, and the qemu and main application processes
+that are currently running. This does not change anything, and is intended to
+help diagnose shutdown problems.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if psFormat != "table" && psFormat != "json" {
+			return fmt.Errorf(`invalid format %q; must be "table" or "json"`, psFormat)
+		}
+		cmd.SilenceUsage = true
+		status, err := shutdown.GetStatus(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if psFormat == "json" {
+			return writeStatusJSON(os.Stdout, status)
+		}
+		return writeStatusTable(os.Stdout, status)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(psCmd)
+	psCmd.Flags().StringVar(&psFormat, "format", "table", `output format ("table" or "json")`)
+}
+
+func writeStatusJSON(w io.Writer, status *shutdown.Status) error {
+	jsonBuffer, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(jsonBuffer))
+	return err
+}
+
+func writeStatusTable(w io.Writer, status *shutdown.Status) error {
+	limaState := status.Lima
+	if limaState == "" {
+		limaState = "unknown"
+	}
+	if _, err := fmt.Fprintf(w, "Lima VM: %s\n\n", limaState); err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(w, 0, 4, 4, ' ', 0)
+	fmt.Fprintf(writer, "COMPONENT\tPID\tEXECUTABLE\n")
+	for _, proc := range status.Qemu {
+		fmt.Fprintf(writer, "qemu\t%d\t%s\n", proc.Pid, proc.Executable)
+	}
+	for _, proc := range status.App {
+		fmt.Fprintf(writer, "app\t%d\t%s\n", proc.Pid, proc.Executable)
+	}
+	return writer.Flush()
+}
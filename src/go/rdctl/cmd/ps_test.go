@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStatus(t *testing.T) {
+	status := &shutdown.Status{
+		Lima: "Running",
+		Qemu: []shutdown.ProcessInfo{{Pid: 100, Executable: "/usr/bin/qemu-system-x86_64"}},
+		App: []shutdown.ProcessInfo{
+			{Pid: 200, Executable: "/opt/rancher-desktop/rancher-desktop"},
+			{Pid: 2001, Executable: "/opt/rancher-desktop/rancher-desktop"},
+		},
+	}
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeStatusTable(&buf, status))
+		assert.Equal(t, "Lima VM: Running\n\n"+
+			"COMPONENT    PID     EXECUTABLE\n"+
+			"qemu         100     /usr/bin/qemu-system-x86_64\n"+
+			"app          200     /opt/rancher-desktop/rancher-desktop\n"+
+			"app          2001    /opt/rancher-desktop/rancher-desktop\n",
+			buf.String())
+	})
+	t.Run("table without lima", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeStatusTable(&buf, &shutdown.Status{}))
+		assert.Equal(t, "Lima VM: unknown\n\nCOMPONENT    PID    EXECUTABLE\n", buf.String())
+	})
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeStatusJSON(&buf, status))
+		assert.JSONEq(t, `{
+			"lima": "Running",
+			"qemu": [{"pid": 100, "executable": "/usr/bin/qemu-system-x86_64"}],
+			"app": [
+				{"pid": 200, "executable": "/opt/rancher-desktop/rancher-desktop"},
+				{"pid": 2001, "executable": "/opt/rancher-desktop/rancher-desktop"}
+			]
+		}`, buf.String())
+	})
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var restartSettings struct {
+	// Strict fails the restart if anything could not be stopped.
+	Strict bool
+	// Timeout limits how long the shutdown may take; zero means no limit.
+	Timeout time.Duration
+	// ApplicationPath is the main executable to start.
+	ApplicationPath string
+}
+
+// restartCmd represents the restart command
+var restartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Shuts down Rancher Desktop and starts it again",
+	Long: `Shuts down the running Rancher Desktop application, waits for everything to
+exit, and then starts it again.  It is not started if the shutdown fails.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		shutdownSettings, err := restartShutdownSettings(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		shutdownFunc := func(ctx context.Context) error {
+			if shutdownSettings.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, shutdownSettings.Timeout)
+				defer cancel()
+			}
+			_, err := doShutdown(ctx, shutdownSettings, shutdown.Shutdown)
+			return err
+		}
+		startFunc := func(ctx context.Context) error {
+			applicationPath := restartSettings.ApplicationPath
+			if applicationPath == "" {
+				var err error
+				if applicationPath, err = paths.GetRDLaunchPath(ctx); err != nil {
+					return fmt.Errorf("failed to locate main Rancher Desktop executable: %w\nplease retry with the --path option", err)
+				}
+			}
+			return launchApp(applicationPath, nil)
+		}
+		return restart(cmd.Context(), os.Stdout, shutdownFunc, startFunc)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restartCmd)
+	restartCmd.Flags().BoolVar(&restartSettings.Strict, "strict", false, "do not start again if anything could not be stopped")
+	restartCmd.Flags().DurationVar(&restartSettings.Timeout, "timeout", 0, "maximum time to wait for the shutdown (e.g. 2m); 0 for no limit")
+	restartCmd.Flags().StringVarP(&restartSettings.ApplicationPath, "path", "p", "", "path to main executable")
+}
+
+// restartShutdownSettings returns the settings for the shutdown part of a
+// restart: the restart flags, with the shutdown config file filling in the
+// rest, as for `rdctl shutdown`.  A restart always waits for the shutdown,
+// whatever the config file says.
+func restartShutdownSettings(flags *pflag.FlagSet) (*shutdownSettingsStruct, error) {
+	settings := &shutdownSettingsStruct{
+		Strict:  restartSettings.Strict,
+		Timeout: restartSettings.Timeout,
+	}
+	defaults, err := config.GetShutdownDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if err = applyShutdownDefaults(flags, settings, defaults); err != nil {
+		return nil, err
+	}
+	// Starting again before everything has exited would race with it.
+	settings.WaitForShutdown = true
+	return settings, nil
+}
+
+// restart runs shutdownFunc, and then startFunc only if the shutdown
+// succeeded, writing the outcome to w.
+func restart(ctx context.Context, w io.Writer, shutdownFunc, startFunc func(context.Context) error) error {
+	if err := shutdownFunc(ctx); err != nil {
+		return fmt.Errorf("failed to shut down Rancher Desktop; not starting it again: %w", err)
+	}
+	fmt.Fprintln(w, "Rancher Desktop has shut down.")
+	if err := startFunc(ctx); err != nil {
+		return fmt.Errorf("shut down Rancher Desktop, but failed to start it again: %w", err)
+	}
+	fmt.Fprintln(w, "Rancher Desktop is starting.")
+	return nil
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestart(t *testing.T) {
+	t.Run("clean shutdown", func(t *testing.T) {
+		var calls []string
+		var buf bytes.Buffer
+		err := restart(context.Background(), &buf,
+			func(context.Context) error { calls = append(calls, "shutdown"); return nil },
+			func(context.Context) error { calls = append(calls, "start"); return nil })
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"shutdown", "start"}, calls)
+		assert.Equal(t, "Rancher Desktop has shut down.\nRancher Desktop is starting.\n", buf.String())
+	})
+	t.Run("shutdown fails", func(t *testing.T) {
+		errShutdown := errors.New("failed to force-stop lima")
+		started := false
+		var buf bytes.Buffer
+		err := restart(context.Background(), &buf,
+			func(context.Context) error { return errShutdown },
+			func(context.Context) error { started = true; return nil })
+		assert.ErrorIs(t, err, errShutdown)
+		assert.ErrorContains(t, err, "not starting it again")
+		assert.False(t, started)
+		assert.Empty(t, buf.String())
+	})
+	t.Run("start fails", func(t *testing.T) {
+		errStart := errors.New("no such file")
+		var buf bytes.Buffer
+		err := restart(context.Background(), &buf,
+			func(context.Context) error { return nil },
+			func(context.Context) error { return errStart })
+		assert.ErrorIs(t, err, errStart)
+		assert.ErrorContains(t, err, "shut down Rancher Desktop, but failed to start it again")
+		assert.Equal(t, "Rancher Desktop has shut down.\n", buf.String())
+	})
+}
+
+func TestRestartShutdownSettings(t *testing.T) {
+	writeShutdownConfig(t, `{"strict": true, "gracefulGuest": true, "timeout": "2m"}`)
+	t.Run("shutdown config file", func(t *testing.T) {
+		settings, err := restartShutdownSettings(pflag.NewFlagSet("restart", pflag.ContinueOnError))
+		require.NoError(t, err)
+		assert.Equal(t, &shutdownSettingsStruct{
+			WaitForShutdown: true,
+			Strict:          true,
+			GracefulGuest:   true,
+			Timeout:         2 * time.Minute,
+		}, settings)
+	})
+	t.Run("flags override the shutdown config file", func(t *testing.T) {
+		saved := restartSettings
+		t.Cleanup(func() { restartSettings = saved })
+		flags := pflag.NewFlagSet("restart", pflag.ContinueOnError)
+		flags.BoolVar(&restartSettings.Strict, "strict", false, "")
+		flags.DurationVar(&restartSettings.Timeout, "timeout", 0, "")
+		require.NoError(t, flags.Parse([]string{"--strict=false", "--timeout=30s"}))
+		settings, err := restartShutdownSettings(flags)
+		require.NoError(t, err)
+		assert.Equal(t, &shutdownSettingsStruct{
+			WaitForShutdown: true,
+			GracefulGuest:   true,
+			Timeout:         30 * time.Second,
+		}, settings)
+	})
+	t.Run("always waits", func(t *testing.T) {
+		writeShutdownConfig(t, `{"wait": false}`)
+		settings, err := restartShutdownSettings(pflag.NewFlagSet("restart", pflag.ContinueOnError))
+		require.NoError(t, err)
+		assert.True(t, settings.WaitForShutdown, "a restart must wait for the shutdown")
+	})
+}
@@ -18,17 +18,76 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/client"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/config"
+	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type shutdownSettingsStruct struct {
+	// WaitForShutdown waits for everything to exit before force-killing
+	// anything that does not; otherwise, it is force-killed without waiting.
 	WaitForShutdown bool
+	// NoWait only asks each process to stop, without waiting for it or
+	// force-killing anything.
+	NoWait        bool
+	GracefulGuest bool
+	// VMOnly stops lima and qemu, but leaves the application running.
+	VMOnly bool
+	// SkipLima, SkipQemu and SkipApp leave out the corresponding stages, for
+	// troubleshooting.  Unlike VMOnly, SkipApp still asks the app to quit.
+	SkipLima bool
+	SkipQemu bool
+	SkipApp  bool
+	// PreShutdownHook is an executable to run before stopping the VM.
+	PreShutdownHook string
+	// PreShutdownHookStrict aborts shutdown if the hook fails.
+	PreShutdownHookStrict bool
+	// Diagnostics records information about force-killed processes in the
+	// application logs directory.
+	Diagnostics bool
+	// Strict fails the command if anything could not be stopped.
+	Strict bool
+	// Timeout limits how long the whole shutdown may take; zero means no limit.
+	Timeout time.Duration
+	// PollJitter randomly varies poll intervals by up to this fraction; it
+	// can only be set from the shutdown config file.
+	PollJitter float64
+	// CleanupSockets removes the sockets forwarded from the VM once it stops.
+	CleanupSockets bool
+	// LogLevel raises the log level for this run (e.g. to debug); the global
+	// --verbose flag still raises it to trace.
+	LogLevel string
+	// Notify is a file (typically a FIFO) to write a line to once shutdown
+	// has finished.
+	Notify string
+	// JSON writes how each stage of the shutdown went to standard output, as
+	// JSON, instead of the usual output.
+	JSON bool
+	// Plan lists what shutdown would do, without doing it.
+	Plan bool
+	// Force kills anything still running once shutdown has finished.
+	Force bool
+	// LimaHome overrides the LIMA_HOME of the VM to stop.
+	LimaHome string
+	// LimactlArgs are extra arguments for limactl stop and delete.
+	LimactlArgs []string
+	// MatchAppByName finds the app by name if its executable is missing.
+	MatchAppByName bool
+	// TailLimaLog logs what the lima host agent logs while lima is stopping.
+	TailLimaLog bool
 }
 
 var commonShutdownSettings shutdownSettingsStruct
@@ -43,11 +102,40 @@ var shutdownCmd = &cobra.Command{
 			return err
 		}
 		cmd.SilenceUsage = true
-		result, err := doShutdown(cmd.Context(), &commonShutdownSettings, shutdown.Shutdown)
+		defaults, err := config.GetShutdownDefaults()
 		if err != nil {
 			return err
 		}
-		if result != nil {
+		if err = applyShutdownDefaults(cmd.Flags(), &commonShutdownSettings, defaults); err != nil {
+			return err
+		}
+		if err = checkSkippedStages(&commonShutdownSettings); err != nil {
+			return err
+		}
+		if err = checkLimaHome(commonShutdownSettings.LimaHome); err != nil {
+			return err
+		}
+		if err = applyLogLevel(commonShutdownSettings.LogLevel); err != nil {
+			return err
+		}
+		if commonShutdownSettings.Plan {
+			steps, err := shutdown.PlanShutdown(cmd.Context(), shutdownConfig(&commonShutdownSettings, shutdown.Shutdown))
+			if err != nil {
+				return err
+			}
+			return writePlanTable(os.Stdout, steps)
+		}
+		ctx := cmd.Context()
+		if commonShutdownSettings.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, commonShutdownSettings.Timeout)
+			defer cancel()
+		}
+		result, err := doShutdown(ctx, &commonShutdownSettings, shutdown.Shutdown)
+		if err != nil {
+			return err
+		}
+		if result != nil && !commonShutdownSettings.JSON {
 			fmt.Println(string(result))
 		}
 		return nil
@@ -56,10 +144,275 @@ var shutdownCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(shutdownCmd)
-	shutdownCmd.Flags().BoolVar(&commonShutdownSettings.WaitForShutdown, "wait", true, "wait for shutdown to be confirmed")
+	addShutdownFlags(shutdownCmd.Flags(), &commonShutdownSettings)
+	shutdownCmd.MarkFlagsMutuallyExclusive("wait", "no-wait")
+}
+
+func addShutdownFlags(flags *pflag.FlagSet, settings *shutdownSettingsStruct) {
+	flags.BoolVar(&settings.WaitForShutdown, "wait", true, "wait for shutdown to be confirmed")
+	flags.BoolVar(&settings.NoWait, "no-wait", false, "ask everything to stop and return immediately; nothing is force-killed")
+	flags.BoolVar(&settings.GracefulGuest, "graceful-guest", false, "power off the VM from inside the guest before stopping it")
+	flags.BoolVar(&settings.VMOnly, "vm-only", false, "only stop the VM, leaving the application running")
+	flags.BoolVar(&settings.SkipLima, "skip-lima", false, "do not stop lima (for troubleshooting)")
+	flags.BoolVar(&settings.SkipQemu, "skip-qemu", false, "do not stop qemu (for troubleshooting)")
+	flags.BoolVar(&settings.SkipApp, "skip-app", false, "do not terminate the application's processes (for troubleshooting)")
+	flags.StringVar(&settings.PreShutdownHook, "pre-shutdown-hook", "", "executable to run before stopping the VM")
+	flags.BoolVar(&settings.PreShutdownHookStrict, "pre-shutdown-hook-strict", false, "abort shutdown if the pre-shutdown hook fails")
+	flags.BoolVar(&settings.Diagnostics, "diagnostics", false, "log details of any processes that have to be force-killed")
+	flags.BoolVar(&settings.Strict, "strict", false, "exit with an error if anything could not be stopped")
+	flags.DurationVar(&settings.Timeout, "timeout", 0, "maximum time to wait for the whole shutdown (e.g. 2m); 0 for no limit")
+	flags.BoolVar(&settings.CleanupSockets, "cleanup-sockets", false, "remove stale sockets forwarded from the VM once it has stopped")
+	flags.StringVar(&settings.LogLevel, "log-level", "", "log level for this run (debug or trace); never lowers the level set by --verbose")
+	flags.StringVar(&settings.Notify, "notify", "", "file or FIFO to write a JSON line to once shutdown has finished")
+	flags.BoolVar(&settings.JSON, "json", false, "once shutdown has finished, write how each stage went as JSON")
+	flags.BoolVar(&settings.Force, "force", false, "once shutdown has finished, kill anything still running (risks losing data)")
+	flags.BoolVar(&settings.Plan, "plan", false, "list what shutdown would do to each stage, without stopping anything")
+	flags.StringVar(&settings.LimaHome, "lima-home", "", "LIMA_HOME of the VM to stop, instead of the one Rancher Desktop uses")
+	flags.StringArrayVar(&settings.LimactlArgs, "limactl-arg", nil, "extra argument for limactl when stopping the VM (e.g. --limactl-arg=--log-level=debug); may be repeated")
+	flags.BoolVar(&settings.MatchAppByName, "match-app-by-name", false, "if the application executable is missing (e.g. after an upgrade), stop processes with the same name instead")
+	flags.BoolVar(&settings.TailLimaLog, "tail-lima-log", false, "while waiting for the VM to stop, log what the lima host agent logs (shown with --log-level=debug)")
+}
+
+// applyShutdownDefaults fills in the settings from the shutdown config file,
+// except where they were given on the command line.
+func applyShutdownDefaults(flags *pflag.FlagSet, settings *shutdownSettingsStruct, defaults *config.ShutdownDefaults) error {
+	if defaults.Wait != nil && !flags.Changed("wait") && !flags.Changed("no-wait") {
+		settings.WaitForShutdown = *defaults.Wait
+	}
+	if defaults.Strict != nil && !flags.Changed("strict") {
+		settings.Strict = *defaults.Strict
+	}
+	if defaults.GracefulGuest != nil && !flags.Changed("graceful-guest") {
+		settings.GracefulGuest = *defaults.GracefulGuest
+	}
+	if defaults.Diagnostics != nil && !flags.Changed("diagnostics") {
+		settings.Diagnostics = *defaults.Diagnostics
+	}
+	if defaults.PollJitter != nil {
+		settings.PollJitter = *defaults.PollJitter
+	}
+	if defaults.Timeout != "" && !flags.Changed("timeout") {
+		timeout, err := time.ParseDuration(defaults.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid shutdown timeout %q in shutdown config file: %w", defaults.Timeout, err)
+		}
+		settings.Timeout = timeout
+	}
+	return nil
+}
+
+// checkSkippedStages makes sure the --skip-* flags leave at least one stage to
+// run.
+func checkSkippedStages(settings *shutdownSettingsStruct) error {
+	if settings.SkipLima && settings.SkipQemu && (settings.SkipApp || settings.VMOnly) {
+		return errors.New("cannot skip every shutdown stage: lima, qemu, and the app")
+	}
+	return nil
+}
+
+// checkLimaHome makes sure that the --lima-home directory, if given, exists.
+func checkLimaHome(limaHome string) error {
+	if limaHome == "" {
+		return nil
+	}
+	info, err := os.Stat(limaHome)
+	if err != nil {
+		return fmt.Errorf("invalid --lima-home: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid --lima-home: %s is not a directory", limaHome)
+	}
+	return nil
+}
+
+// applyLogLevel raises the log level to the one given with --log-level, if
+// any; the level is never lowered.
+func applyLogLevel(logLevel string) error {
+	if logLevel == "" {
+		return nil
+	}
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	if level > logrus.GetLevel() {
+		logrus.SetLevel(level)
+	}
+	return nil
 }
 
 func doShutdown(ctx context.Context, shutdownSettings *shutdownSettingsStruct, initiatingCommand shutdown.InitiatingCommand) ([]byte, error) {
+	var output []byte
+	if !shutdownSettings.VMOnly {
+		output = requestShutdown()
+	}
+	config := shutdownConfig(shutdownSettings, initiatingCommand)
+	onComplete := config.OnComplete
+	config.OnComplete = func(report *shutdown.ShutdownReport, err error) {
+		logStageOutcomes(report, err)
+		if onComplete != nil {
+			onComplete(report, err)
+		}
+	}
+	err := shutdown.FinishShutdownWithConfig(ctx, config)
+	return output, err
+}
+
+// logStageOutcomes logs how each stage of the shutdown finished, if any of them
+// had to be force-killed or the shutdown failed; otherwise, the report is only
+// of interest when debugging.
+func logStageOutcomes(report *shutdown.ShutdownReport, err error) {
+	if err == nil && !report.ForceKilled() {
+		return
+	}
+	for _, stage := range report.Stages {
+		entry := logrus.WithField("operation", stage.Operation)
+		if stage.Err != nil {
+			entry = entry.WithError(stage.Err)
+		}
+		entry.Infof("Stopping %s: %s after %s", stage.Operation, stage.Outcome, stage.Elapsed)
+	}
+}
+
+// shutdownConfig converts the command line settings into the shutdown config.
+func shutdownConfig(shutdownSettings *shutdownSettingsStruct, initiatingCommand shutdown.InitiatingCommand) shutdown.Config {
+	result := shutdown.Config{
+		WaitForShutdown:       shutdownSettings.WaitForShutdown && !shutdownSettings.NoWait,
+		AskOnly:               shutdownSettings.NoWait,
+		InitiatingCommand:     initiatingCommand,
+		GracefulGuest:         shutdownSettings.GracefulGuest,
+		SkipLima:              shutdownSettings.SkipLima,
+		SkipQemu:              shutdownSettings.SkipQemu,
+		SkipApp:               shutdownSettings.VMOnly || shutdownSettings.SkipApp,
+		Strict:                shutdownSettings.Strict,
+		PollJitter:            shutdownSettings.PollJitter,
+		CleanupSockets:        shutdownSettings.CleanupSockets,
+		KillRemaining:         shutdownSettings.Force,
+		PreShutdownHook:       shutdownSettings.PreShutdownHook,
+		PreShutdownHookStrict: shutdownSettings.PreShutdownHookStrict,
+		LimaHome:              shutdownSettings.LimaHome,
+		LimactlArgs:           shutdownSettings.LimactlArgs,
+		MatchAppByName:        shutdownSettings.MatchAppByName,
+		TailLimaLog:           shutdownSettings.TailLimaLog,
+	}
+	if shutdownSettings.Diagnostics {
+		if paths, err := p.GetPaths(); err != nil {
+			logrus.Errorf("Not writing shutdown diagnostics: failed to get application paths: %s", err)
+		} else {
+			result.DiagnosticsDir = paths.Logs
+		}
+	}
+	if shutdownSettings.Notify != "" || shutdownSettings.Force || shutdownSettings.JSON {
+		result.OnComplete = func(report *shutdown.ShutdownReport, err error) {
+			if shutdownSettings.JSON {
+				writeShutdownReportJSON(os.Stdout, report, err)
+			} else if report.Killed != nil {
+				writeKilledProcesses(os.Stdout, report.Killed)
+			}
+			if shutdownSettings.Notify != "" {
+				notifyShutdownComplete(shutdownSettings.Notify, report, err)
+			}
+		}
+	}
+	return result
+}
+
+// writePlanTable writes the shutdown plan as a table, in order.
+func writePlanTable(w io.Writer, steps []shutdown.PlanStep) error {
+	writer := tabwriter.NewWriter(w, 0, 4, 4, ' ', 0)
+	fmt.Fprintf(writer, "STAGE\tSTATUS\tACTION\n")
+	for _, step := range steps {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", step.Stage, step.Status, step.Action)
+	}
+	return writer.Flush()
+}
+
+// shutdownReportJSON is what --json writes once shutdown has finished.
+type shutdownReportJSON struct {
+	Stages      []stageReportJSON         `json:"stages"`
+	LimaStop    shutdown.LimaStopMethod   `json:"limaStop,omitempty"`
+	AppStop     shutdown.AppStopMethod    `json:"appStop,omitempty"`
+	ForceKilled bool                      `json:"forceKilled"`
+	Killed      *shutdown.KilledProcesses `json:"killed,omitempty"`
+	Error       string                    `json:"error,omitempty"`
+}
+
+// stageReportJSON is a single stage in shutdownReportJSON.
+type stageReportJSON struct {
+	Operation string                `json:"operation"`
+	Outcome   shutdown.StageOutcome `json:"outcome"`
+	Elapsed   string                `json:"elapsed"`
+	Error     string                `json:"error,omitempty"`
+}
+
+// writeShutdownReportJSON writes the report of the finished shutdown, and the
+// error it returned (if any), as a line of JSON.  Failures are only logged, as
+// the shutdown itself has already finished.
+func writeShutdownReportJSON(w io.Writer, report *shutdown.ShutdownReport, err error) {
+	output := shutdownReportJSON{
+		Stages:      []stageReportJSON{},
+		LimaStop:    report.LimaStop,
+		AppStop:     report.AppStop,
+		ForceKilled: report.ForceKilled(),
+		Killed:      report.Killed,
+	}
+	for _, stage := range report.Stages {
+		stageOutput := stageReportJSON{
+			Operation: stage.Operation,
+			Outcome:   stage.Outcome,
+			Elapsed:   stage.Elapsed.String(),
+		}
+		if stage.Err != nil {
+			stageOutput.Error = stage.Err.Error()
+		}
+		output.Stages = append(output.Stages, stageOutput)
+	}
+	if err != nil {
+		output.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(output)
+	if marshalErr != nil {
+		logrus.Errorf("Failed to encode the shutdown report: %s", marshalErr)
+		return
+	}
+	if _, writeErr := fmt.Fprintln(w, string(line)); writeErr != nil {
+		logrus.Errorf("Failed to write the shutdown report: %s", writeErr)
+	}
+}
+
+// shutdownNotification is the line written to the --notify file.
+type shutdownNotification struct {
+	ForceKilled bool   `json:"forceKilled"`
+	Error       string `json:"error,omitempty"`
+}
+
+// notifyShutdownComplete writes a JSON line describing the finished shutdown to
+// the given path.  A FIFO with no reader is not waited for, so a missing
+// listener never holds up shutdown; failures are only logged.
+func notifyShutdownComplete(path string, report *shutdown.ShutdownReport, err error) {
+	notification := shutdownNotification{ForceKilled: report.ForceKilled()}
+	if err != nil {
+		notification.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(notification)
+	if marshalErr != nil {
+		logrus.Errorf("Failed to encode shutdown notification: %s", marshalErr)
+		return
+	}
+	file, openErr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NONBLOCK, 0o600)
+	if openErr != nil {
+		logrus.Errorf("Failed to open %s to notify of shutdown: %s", path, openErr)
+		return
+	}
+	defer file.Close()
+	if _, writeErr := file.Write(append(line, '\n')); writeErr != nil {
+		logrus.Errorf("Failed to notify %s of shutdown: %s", path, writeErr)
+	}
+}
+
+// requestShutdown asks a running Rancher Desktop to shut itself down, returning
+// the server response.  Nothing is returned if the application isn't running.
+func requestShutdown() []byte {
 	var output []byte
 	connectionInfo, err := config.GetConnectionInfo(true)
 	if err == nil && connectionInfo != nil {
@@ -68,6 +421,5 @@ func doShutdown(ctx context.Context, shutdownSettings *shutdownSettingsStruct, i
 		output, _ = client.ProcessRequestForUtility(rdClient.DoRequest("PUT", command))
 		logrus.WithError(err).Trace("Shut down requested")
 	}
-	err = shutdown.FinishShutdown(ctx, shutdownSettings.WaitForShutdown, initiatingCommand)
-	return output, err
+	return output
 }
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyShutdownComplete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	notifyShutdownComplete(path, &shutdown.ShutdownReport{
+		Stages: []shutdown.StageReport{{Operation: "qemu", Outcome: shutdown.OutcomeForceKilled}},
+	}, nil)
+	notifyShutdownComplete(path, &shutdown.ShutdownReport{}, errors.New("failed to stop lima"))
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"forceKilled":true}`+"\n"+
+		`{"forceKilled":false,"error":"failed to stop lima"}`+"\n", string(contents))
+}
+
+func TestWriteShutdownReportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	writeShutdownReportJSON(&buf, &shutdown.ShutdownReport{
+		Stages: []shutdown.StageReport{
+			{Operation: "lima", Outcome: shutdown.OutcomeExited, Elapsed: 4 * time.Second},
+			{Operation: "the app", Outcome: shutdown.OutcomeError, Err: errors.New("kill failed")},
+		},
+		LimaStop: shutdown.LimaStoppedGracefully,
+	}, errors.New("failed to stop the app"))
+	writeShutdownReportJSON(&buf, &shutdown.ShutdownReport{
+		Stages:  []shutdown.StageReport{{Operation: "the app", Outcome: shutdown.OutcomeForceKilled, Elapsed: time.Second}},
+		AppStop: shutdown.AppStoppedWithForce,
+	}, nil)
+	assert.Equal(t, `{"stages":[{"operation":"lima","outcome":"exited","elapsed":"4s"},`+
+		`{"operation":"the app","outcome":"error","elapsed":"0s","error":"kill failed"}],`+
+		`"limaStop":"graceful","forceKilled":false,"error":"failed to stop the app"}`+"\n"+
+		`{"stages":[{"operation":"the app","outcome":"force-killed","elapsed":"1s"}],`+
+		`"appStop":"forced","forceKilled":true}`+"\n", buf.String())
+}
+
+func TestLogStageOutcomes(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	// messages returns the messages logged at info level, and forgets them.
+	messages := func() []string {
+		var result []string
+		for _, entry := range hook.AllEntries() {
+			assert.Equal(t, logrus.InfoLevel, entry.Level)
+			result = append(result, entry.Message)
+		}
+		hook.Reset()
+		return result
+	}
+	errKill := errors.New("failed to kill qemu")
+	report := &shutdown.ShutdownReport{Stages: []shutdown.StageReport{
+		{Operation: "lima", Outcome: shutdown.OutcomeExited, Elapsed: 4 * time.Second},
+		{Operation: "qemu", Outcome: shutdown.OutcomeForceKilled, Elapsed: 30 * time.Second},
+	}}
+	t.Run("force-killed", func(t *testing.T) {
+		logStageOutcomes(report, nil)
+		assert.Equal(t, []string{"Stopping lima: exited after 4s", "Stopping qemu: force-killed after 30s"}, messages())
+	})
+	t.Run("failed", func(t *testing.T) {
+		failed := &shutdown.ShutdownReport{Stages: []shutdown.StageReport{
+			{Operation: "qemu", Outcome: shutdown.OutcomeError, Err: errKill},
+		}}
+		logStageOutcomes(failed, errKill)
+		assert.Equal(t, []string{"Stopping qemu: error after 0s"}, messages())
+	})
+	t.Run("clean shutdown", func(t *testing.T) {
+		clean := &shutdown.ShutdownReport{Stages: []shutdown.StageReport{
+			{Operation: "lima", Outcome: shutdown.OutcomeExited, Elapsed: 4 * time.Second},
+		}}
+		logStageOutcomes(clean, nil)
+		assert.Empty(t, messages())
+	})
+}
+
+func TestApplyShutdownDefaults(t *testing.T) {
+	configFile := writeShutdownConfig(t, `{"wait": false, "strict": true, "gracefulGuest": true, "pollJitter": 0.1, "timeout": "2m"}`)
+	defaults, err := config.GetShutdownDefaults()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expected shutdownSettingsStruct
+	}{
+		{
+			name: "config file only",
+			expected: shutdownSettingsStruct{
+				GracefulGuest: true,
+				Strict:        true,
+				Timeout:       2 * time.Minute,
+				PollJitter:    0.1,
+			},
+		},
+		{
+			name: "flags override the config file",
+			args: []string{"--wait", "--strict=false", "--timeout=30s"},
+			expected: shutdownSettingsStruct{
+				WaitForShutdown: true,
+				GracefulGuest:   true,
+				Timeout:         30 * time.Second,
+				PollJitter:      0.1,
+			},
+		},
+		{
+			// --no-wait is handled later, but still overrides the config file.
+			name: "no-wait flag",
+			args: []string{"--no-wait=false"},
+			expected: shutdownSettingsStruct{
+				WaitForShutdown: true,
+				GracefulGuest:   true,
+				Strict:          true,
+				Timeout:         2 * time.Minute,
+				PollJitter:      0.1,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var settings shutdownSettingsStruct
+			flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+			addShutdownFlags(flags, &settings)
+			require.NoError(t, flags.Parse(tc.args))
+			require.NoError(t, applyShutdownDefaults(flags, &settings, defaults))
+			assert.Equal(t, tc.expected, settings)
+		})
+	}
+	t.Run("no shutdown config file", func(t *testing.T) {
+		require.NoError(t, os.Remove(configFile))
+		defaults, err := config.GetShutdownDefaults()
+		require.NoError(t, err)
+		var settings shutdownSettingsStruct
+		flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+		addShutdownFlags(flags, &settings)
+		require.NoError(t, applyShutdownDefaults(flags, &settings, defaults))
+		assert.Equal(t, shutdownSettingsStruct{WaitForShutdown: true}, settings)
+	})
+	t.Run("invalid timeout", func(t *testing.T) {
+		var settings shutdownSettingsStruct
+		flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+		addShutdownFlags(flags, &settings)
+		err := applyShutdownDefaults(flags, &settings, &config.ShutdownDefaults{Timeout: "soon"})
+		assert.ErrorContains(t, err, `invalid shutdown timeout "soon" in shutdown config file`)
+	})
+	t.Run("not read from the main config file", func(t *testing.T) {
+		// The application rewrites rd-engine.json, so it is not used.
+		engineConfig := filepath.Join(t.TempDir(), "rd-engine.json")
+		require.NoError(t, os.WriteFile(engineConfig, []byte(`{"user": "user", "shutdown": {"strict": true}}`), 0o600))
+		require.NoError(t, rootCmd.PersistentFlags().Set("config-path", engineConfig))
+		t.Cleanup(func() { _ = rootCmd.PersistentFlags().Set("config-path", "") })
+		defaults, err := config.GetShutdownDefaults()
+		require.NoError(t, err)
+		assert.Equal(t, &config.ShutdownDefaults{}, defaults)
+	})
+}
+
+// writeShutdownConfig writes the given shutdown config file, and makes it the
+// one that is used for the rest of the test.
+func writeShutdownConfig(t *testing.T, contents string) string {
+	configFile := filepath.Join(t.TempDir(), "rdctl-shutdown.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(contents), 0o600))
+	savedPath := config.ShutdownConfigPath
+	config.ShutdownConfigPath = configFile
+	t.Cleanup(func() { config.ShutdownConfigPath = savedPath })
+	return configFile
+}
+
+func TestSkipFlags(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected shutdown.Config
+	}{
+		{nil, shutdown.Config{}},
+		{[]string{"--skip-lima"}, shutdown.Config{SkipLima: true}},
+		{[]string{"--skip-qemu"}, shutdown.Config{SkipQemu: true}},
+		{[]string{"--skip-app"}, shutdown.Config{SkipApp: true}},
+		{[]string{"--vm-only"}, shutdown.Config{SkipApp: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v", tc.args), func(t *testing.T) {
+			var settings shutdownSettingsStruct
+			flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+			addShutdownFlags(flags, &settings)
+			require.NoError(t, flags.Parse(append([]string{"--wait=false"}, tc.args...)))
+			require.NoError(t, checkSkippedStages(&settings))
+			assert.Equal(t, tc.expected, shutdownConfig(&settings, ""))
+		})
+	}
+	t.Run("all stages skipped", func(t *testing.T) {
+		for _, appFlag := range []string{"--skip-app", "--vm-only"} {
+			var settings shutdownSettingsStruct
+			flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+			addShutdownFlags(flags, &settings)
+			require.NoError(t, flags.Parse([]string{"--skip-lima", "--skip-qemu", appFlag}))
+			assert.ErrorContains(t, checkSkippedStages(&settings), "cannot skip every shutdown stage")
+		}
+	})
+}
+
+func TestLimaHomeFlag(t *testing.T) {
+	limaHome := t.TempDir()
+	var settings shutdownSettingsStruct
+	flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+	addShutdownFlags(flags, &settings)
+	require.NoError(t, flags.Parse([]string{"--wait=false", "--lima-home", limaHome}))
+	require.NoError(t, checkLimaHome(settings.LimaHome))
+	assert.Equal(t, shutdown.Config{LimaHome: limaHome}, shutdownConfig(&settings, ""))
+
+	assert.NoError(t, checkLimaHome(""))
+	assert.ErrorContains(t, checkLimaHome(filepath.Join(limaHome, "missing")), "invalid --lima-home")
+	file := filepath.Join(limaHome, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	assert.ErrorContains(t, checkLimaHome(file), "is not a directory")
+}
+
+func TestLimactlArgFlag(t *testing.T) {
+	var settings shutdownSettingsStruct
+	flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+	addShutdownFlags(flags, &settings)
+	require.NoError(t, flags.Parse([]string{"--wait=false", "--limactl-arg=--log-level=debug", "--limactl-arg", "--tty=false"}))
+	assert.Equal(t, shutdown.Config{LimactlArgs: []string{"--log-level=debug", "--tty=false"}}, shutdownConfig(&settings, ""))
+}
+
+func TestNoWaitFlag(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected shutdown.Config
+	}{
+		{[]string{}, shutdown.Config{WaitForShutdown: true}},
+		// Not waiting still force-kills whatever is left.
+		{[]string{"--wait=false"}, shutdown.Config{}},
+		{[]string{"--no-wait"}, shutdown.Config{AskOnly: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v", tc.args), func(t *testing.T) {
+			var settings shutdownSettingsStruct
+			flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+			addShutdownFlags(flags, &settings)
+			require.NoError(t, flags.Parse(tc.args))
+			assert.Equal(t, tc.expected, shutdownConfig(&settings, ""))
+		})
+	}
+}
+
+func TestTailLimaLogFlag(t *testing.T) {
+	var settings shutdownSettingsStruct
+	flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+	addShutdownFlags(flags, &settings)
+	require.NoError(t, flags.Parse([]string{"--wait=false", "--tail-lima-log"}))
+	assert.Equal(t, shutdown.Config{TailLimaLog: true}, shutdownConfig(&settings, ""))
+}
+
+func TestWritePlanTable(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writePlanTable(&buf, []shutdown.PlanStep{
+		{Stage: "lima", Status: shutdown.PlanRunning, Action: shutdown.PlanStopOrForce},
+		{Stage: "qemu", Status: shutdown.PlanStopped, Action: shutdown.PlanNothing},
+		{Stage: "the app", Status: shutdown.PlanRunning, Action: shutdown.PlanSkip},
+	}))
+	assert.Equal(t, ""+
+		"STAGE      STATUS     ACTION\n"+
+		"lima       running    graceful stop, then force\n"+
+		"qemu       stopped    nothing\n"+
+		"the app    running    skip\n", buf.String())
+}
+
+func TestApplyLogLevel(t *testing.T) {
+	savedLevel := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(savedLevel) })
+	hook := logrustest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	testCases := []struct {
+		logLevel string
+		expected []logrus.Level
+	}{
+		{"", []logrus.Level{logrus.InfoLevel}},
+		{"debug", []logrus.Level{logrus.InfoLevel, logrus.DebugLevel}},
+		{"trace", []logrus.Level{logrus.InfoLevel, logrus.DebugLevel, logrus.TraceLevel}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("--log-level=%s", tc.logLevel), func(t *testing.T) {
+			logrus.SetLevel(logrus.InfoLevel)
+			hook.Reset()
+			require.NoError(t, applyLogLevel(tc.logLevel))
+			logrus.Info("stopping lima")
+			logrus.Debug("checking lima, still running")
+			logrus.Trace("sent signal")
+			var levels []logrus.Level
+			for _, entry := range hook.AllEntries() {
+				levels = append(levels, entry.Level)
+			}
+			assert.Equal(t, tc.expected, levels)
+		})
+	}
+	t.Run("never lowers the level", func(t *testing.T) {
+		logrus.SetLevel(logrus.TraceLevel)
+		require.NoError(t, applyLogLevel("debug"))
+		assert.Equal(t, logrus.TraceLevel, logrus.GetLevel())
+	})
+	t.Run("invalid level", func(t *testing.T) {
+		logrus.SetLevel(logrus.InfoLevel)
+		assert.ErrorContains(t, applyLogLevel("loud"), "invalid --log-level")
+		assert.Equal(t, logrus.InfoLevel, logrus.GetLevel())
+	})
+	t.Run("flag", func(t *testing.T) {
+		var settings shutdownSettingsStruct
+		flags := pflag.NewFlagSet("shutdown", pflag.ContinueOnError)
+		addShutdownFlags(flags, &settings)
+		require.NoError(t, flags.Parse([]string{"--log-level=trace"}))
+		assert.Equal(t, "trace", settings.LogLevel)
+		assert.Nil(t, flags.Lookup("verbose"), "the global --verbose should not be shadowed")
+	})
+}
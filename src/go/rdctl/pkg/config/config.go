@@ -42,6 +42,23 @@ type ConnectionInfo struct {
 	Port     int
 }
 
+// ShutdownDefaults stores the defaults for `rdctl shutdown` and `rdctl restart`,
+// from the shutdown config file.  Fields that are not set leave the built-in
+// defaults alone; command-line flags override all of them.
+type ShutdownDefaults struct {
+	// Wait is ignored by `rdctl restart`, which always waits.
+	Wait          *bool `json:"wait"`
+	Strict        *bool `json:"strict"`
+	GracefulGuest *bool `json:"gracefulGuest"`
+	Diagnostics   *bool `json:"diagnostics"`
+	// PollJitter varies the poll intervals.  The intervals themselves can't be
+	// set: each stage polls at its own interval, which its time limit is
+	// counted in.
+	PollJitter *float64 `json:"pollJitter"`
+	// Timeout is a duration, such as "2m".
+	Timeout string `json:"timeout"`
+}
+
 var (
 	connectionSettings ConnectionInfo
 	verbose            bool
@@ -49,6 +66,9 @@ var (
 	configPath string
 	// DefaultConfigPath - used to differentiate not being able to find a user-specified config file from the default
 	DefaultConfigPath string
+	// ShutdownConfigPath is the file holding the ShutdownDefaults.  It is kept
+	// apart from the config file, which the application rewrites on startup.
+	ShutdownConfigPath string
 )
 
 // DefineGlobalFlags sets up the global flags, available for all sub-commands
@@ -68,6 +88,7 @@ func DefineGlobalFlags(rootCmd *cobra.Command) {
 		configDir = appPaths.AppHome
 	}
 	DefaultConfigPath = filepath.Join(configDir, "rd-engine.json")
+	ShutdownConfigPath = filepath.Join(configDir, "rdctl-shutdown.json")
 	rootCmd.PersistentFlags().StringVar(&configPath, "config-path", "", fmt.Sprintf("config file (default %s)", DefaultConfigPath))
 	rootCmd.PersistentFlags().StringVar(&connectionSettings.User, "user", "", "overrides the user setting in the config file")
 	rootCmd.PersistentFlags().StringVar(&connectionSettings.Host, "host", "", "default is 127.0.0.1; most useful for WSL")
@@ -127,6 +148,23 @@ func GetConnectionInfo(mayBeMissing bool) (*ConnectionInfo, error) {
 	return &settings, nil
 }
 
+// GetShutdownDefaults returns the `rdctl shutdown` defaults from
+// ShutdownConfigPath, which need not exist.
+func GetShutdownDefaults() (*ShutdownDefaults, error) {
+	var defaults ShutdownDefaults
+	content, err := os.ReadFile(ShutdownConfigPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &defaults, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &defaults); err != nil {
+		return nil, fmt.Errorf("error parsing shutdown config file %q: %w", ShutdownConfigPath, err)
+	}
+	return &defaults, nil
+}
+
 // determines if we are running in a wsl linux distro
 // by checking for availability of wslpath and see if it's a symlink
 func isWSLDistro() bool {
@@ -23,10 +23,18 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/process"
+	"github.com/sirupsen/logrus"
 )
 
+// findFileHolders finds the processes using files in a directory; tests
+// replace it.
+var findFileHolders = process.FindFileHolders
+
 type dockerConfigType map[string]interface{}
 
 type PartialMeta struct {
@@ -86,3 +94,22 @@ func clearDockerContext() error {
 	}
 	return os.Rename(scratchFile.Name(), configFilePath)
 }
+
+// reportFileHolders logs the processes using files in the given directory,
+// which is likely why it could not be removed.  It returns a description of
+// each of those processes.
+func reportFileHolders(directory string) []string {
+	holders, err := findFileHolders(directory)
+	if err != nil {
+		logrus.Debugf("Failed to find processes using %s: %s", directory, err)
+		return nil
+	}
+	var descriptions []string
+	for _, holder := range holders {
+		descriptions = append(descriptions, fmt.Sprintf("%s (pid %d)", filepath.Base(holder.Executable), holder.Pid))
+	}
+	if len(descriptions) > 0 {
+		logrus.Errorf("%s is in use by: %s", directory, strings.Join(descriptions, ", "))
+	}
+	return descriptions
+}
@@ -11,7 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache bool) error {
+func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache, keepVM bool) error {
 	if err := autostart.EnsureAutostart(ctx, false); err != nil {
 		logrus.Errorf("Failed to remove autostart configuration: %s", err)
 	}
@@ -27,7 +27,7 @@ func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache
 		appPaths.ExtensionRoot,
 		appPaths.OldUserData,
 	}
-	pathList = append(pathList, appHomeDirectories(appPaths)...)
+	pathList = append(pathList, appHomeDirectories(appPaths, keepVM)...)
 
 	// Get path that electron-updater stores cache data in. Technically this
 	// is the wrong directory to use for cache data, but it is set by electron-updater.
@@ -44,5 +44,5 @@ func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache
 	} else {
 		pathList = append(pathList, filepath.Join(appPaths.Cache, "updater-longhorn.json"))
 	}
-	return deleteUnixLikeData(appPaths, pathList)
+	return deleteUnixLikeData(appPaths, pathList, keepVM)
 }
@@ -11,7 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache bool) error {
+func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache, keepVM bool) error {
 	if err := autostart.EnsureAutostart(ctx, false); err != nil {
 		logrus.Errorf("Failed to remove autostart configuration: %s", err)
 	}
@@ -47,6 +47,6 @@ func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache
 	} else {
 		pathList = append(pathList, filepath.Join(appPaths.Cache, "updater-longhorn.json"))
 	}
-	pathList = append(pathList, appHomeDirectories(appPaths)...)
-	return deleteUnixLikeData(appPaths, pathList)
+	pathList = append(pathList, appHomeDirectories(appPaths, keepVM)...)
+	return deleteUnixLikeData(appPaths, pathList, keepVM)
 }
@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package factoryreset
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/process"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportFileHolders(t *testing.T) {
+	dataDir := t.TempDir()
+	stubFileHolders := func(t *testing.T, holders []process.FileHolder, err error) {
+		original := findFileHolders
+		findFileHolders = func(directory string) ([]process.FileHolder, error) {
+			assert.Equal(t, dataDir, directory)
+			return holders, err
+		}
+		t.Cleanup(func() { findFileHolders = original })
+	}
+
+	t.Run("reports culprits", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		stubFileHolders(t, []process.FileHolder{
+			{Pid: 1234, Executable: filepath.Join("usr", "bin", "qemu-system-x86_64")},
+			{Pid: 5678, Executable: "limactl"},
+		}, nil)
+		descriptions := reportFileHolders(dataDir)
+		assert.Equal(t, []string{"qemu-system-x86_64 (pid 1234)", "limactl (pid 5678)"}, descriptions)
+		entry := hook.LastEntry()
+		require.NotNil(t, entry)
+		assert.Equal(t, logrus.ErrorLevel, entry.Level)
+		assert.Equal(t, dataDir+" is in use by: qemu-system-x86_64 (pid 1234), limactl (pid 5678)", entry.Message)
+	})
+	t.Run("nothing holding the directory", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		stubFileHolders(t, nil, nil)
+		assert.Empty(t, reportFileHolders(dataDir))
+		assert.Empty(t, hook.AllEntries())
+	})
+	t.Run("probe failure", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		logrus.SetLevel(logrus.DebugLevel)
+		t.Cleanup(func() { logrus.SetLevel(logrus.InfoLevel) })
+		stubFileHolders(t, nil, errors.New("lsof not found"))
+		assert.Empty(t, reportFileHolders(dataDir))
+		entry := hook.LastEntry()
+		require.NotNil(t, entry)
+		assert.Equal(t, logrus.DebugLevel, entry.Level)
+		assert.Contains(t, entry.Message, "lsof not found")
+	})
+}
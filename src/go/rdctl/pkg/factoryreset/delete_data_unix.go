@@ -40,13 +40,17 @@ import (
 // that need to be preserved across a factory reset, so if any of
 // those exist and are non-empty, then a list of all files/directories
 // that don't match the exclusion list will be returned instead.
-func appHomeDirectories(appPaths paths.Paths) []string {
+// If keepVM is set, the lima directory is preserved too.
+func appHomeDirectories(appPaths paths.Paths, keepVM bool) []string {
 	// Use lowercase names for comparison in case the user created the subdirectory manually
 	// with the wrong case on a case-preserving filesystem (default on macOS).
 	excludeDir := map[string]string{
 		strings.ToLower(appPaths.Snapshots):       appPaths.Snapshots,
 		strings.ToLower(appPaths.ContainerdShims): appPaths.ContainerdShims,
 	}
+	if keepVM {
+		excludeDir[strings.ToLower(appPaths.Lima)] = appPaths.Lima
+	}
 	haveExclusions := false
 	for _, dirname := range excludeDir {
 		files, err := os.ReadDir(dirname)
@@ -77,13 +81,17 @@ func appHomeDirectories(appPaths paths.Paths) []string {
 // because there isn't really a dependency graph here.
 // For example, if we can't delete the Lima VM, that doesn't mean we can't remove docker files
 // or pull the path settings out of the shell profile files.
-func deleteUnixLikeData(appPaths paths.Paths, pathList []string) error {
-	if err := deleteLimaVM(); err != nil {
+// If keepVM is set, the Lima VM is left alone.
+func deleteUnixLikeData(appPaths paths.Paths, pathList []string, keepVM bool) error {
+	if keepVM {
+		logrus.Debugf("Keeping the Lima VM in %s", appPaths.Lima)
+	} else if err := deleteLimaVM(); err != nil {
 		logrus.Errorf("Error trying to delete the Lima VM: %s\n", err)
 	}
 	for _, currentPath := range pathList {
 		if err := os.RemoveAll(currentPath); err != nil {
 			logrus.Errorf("Error trying to remove %s: %s", currentPath, err)
+			reportFileHolders(currentPath)
 		}
 	}
 	if err := clearDockerContext(); err != nil {
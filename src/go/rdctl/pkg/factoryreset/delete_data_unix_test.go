@@ -22,10 +22,13 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 /**
@@ -196,3 +199,24 @@ func TestRemoveManagedBlock(t *testing.T) {
 		verifyMgmtRemoved(t, dotFile)
 	}
 }
+
+func TestAppHomeDirectoriesKeepVM(t *testing.T) {
+	appHome := t.TempDir()
+	appPaths := paths.Paths{
+		AppHome:         appHome,
+		Lima:            filepath.Join(appHome, "lima"),
+		Snapshots:       filepath.Join(appHome, "snapshots"),
+		ContainerdShims: filepath.Join(appHome, "containerd-shims"),
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(appPaths.Lima, "0"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(appPaths.Lima, "0", "lima.yaml"), []byte{}, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(appHome, "cache"), 0755))
+
+	t.Run("without keeping the VM", func(t *testing.T) {
+		assert.Equal(t, []string{appHome}, appHomeDirectories(appPaths, false))
+	})
+	t.Run("keeping the VM", func(t *testing.T) {
+		// The returned paths are lower-cased.
+		assert.Equal(t, []string{strings.ToLower(filepath.Join(appHome, "cache"))}, appHomeDirectories(appPaths, true))
+	})
+}
@@ -10,7 +10,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache bool) error {
+// DeleteData removes the Rancher Desktop data.  keepVM is ignored, as there is
+// no lima VM on Windows.
+func DeleteData(ctx context.Context, appPaths paths.Paths, removeKubernetesCache, keepVM bool) error {
 	if err := autostart.EnsureAutostart(ctx, false); err != nil {
 		logrus.Errorf("Failed to remove autostart configuration: %s", err)
 	}
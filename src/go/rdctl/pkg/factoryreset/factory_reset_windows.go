@@ -86,6 +86,7 @@ func deleteWindowsData(keepSystemImages bool, appName string) error {
 		logrus.WithField("path", dir).Trace("Removing directory")
 		if err := os.RemoveAll(dir); err != nil {
 			logrus.Errorf("Problem trying to delete %s: %s\n", dir, err)
+			reportFileHolders(dir)
 		}
 	}
 	return nil
@@ -4,12 +4,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/utils"
 )
 
 const appName = "rancher-desktop"
 
+// ExecutableNotFoundError is returned by FindFirstExecutable when none of the
+// candidates is usable.
+type ExecutableNotFoundError struct {
+	// Candidates are the paths that were checked, in order.
+	Candidates []string
+}
+
+func (e *ExecutableNotFoundError) Error() string {
+	if len(e.Candidates) == 0 {
+		return "search location exhausted: no candidates"
+	}
+	return fmt.Sprintf("search location exhausted: none of %s is suitable", strings.Join(e.Candidates, ", "))
+}
+
 type Paths struct {
 	// Main location for application data.
 	AppHome string `json:"appHome"`
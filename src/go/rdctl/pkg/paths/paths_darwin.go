@@ -11,6 +11,10 @@ import (
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
 )
 
+// PrivilegedHelperPath is socket_vmnet, which runs as root to provide bridged
+// networking for the VM, and can outlive the application.
+const PrivilegedHelperPath = "/opt/rancher-desktop/bin/socket_vmnet"
+
 func GetPaths(getResourcesPathFuncs ...func() (string, error)) (Paths, error) {
 	var getResourcesPathFunc func() (string, error)
 	switch len(getResourcesPathFuncs) {
@@ -11,6 +11,9 @@ import (
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
 )
 
+// PrivilegedHelperPath is empty, as there is no privileged helper on Linux.
+const PrivilegedHelperPath = ""
+
 func GetPaths(getResourcesPathFuncs ...func() (string, error)) (Paths, error) {
 	var getResourcesPathFunc func() (string, error)
 	switch len(getResourcesPathFuncs) {
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const fakeResourcesPath = "fakePath"
@@ -22,3 +23,13 @@ func TestGetResourcesPath(t *testing.T) {
 		assert.Equal(t, filepath.Join(dir, "resources"), actual)
 	}
 }
+
+func TestFindFirstExecutableNotFound(t *testing.T) {
+	dir := t.TempDir()
+	candidates := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	_, err := FindFirstExecutable(candidates...)
+	var notFound *ExecutableNotFoundError
+	require.ErrorAs(t, err, &notFound)
+	assert.Equal(t, candidates, notFound.Candidates)
+	assert.EqualError(t, err, "search location exhausted: none of "+candidates[0]+", "+candidates[1]+" is suitable")
+}
@@ -8,10 +8,13 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/hashicorp/go-multierror"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
 )
 
+// PrivilegedHelperPath is empty; the privileged service on Windows is managed
+// by the service control manager rather than run as a helper process.
+const PrivilegedHelperPath = ""
+
 func GetPaths(getResourcesPathFuncs ...func() (string, error)) (Paths, error) {
 	var getResourcesPathFunc func() (string, error)
 	switch len(getResourcesPathFuncs) {
@@ -58,7 +61,6 @@ func GetPaths(getResourcesPathFuncs ...func() (string, error)) (Paths, error) {
 
 // Given a list of paths, return the first one that is a valid executable.
 func FindFirstExecutable(candidates ...string) (string, error) {
-	errs := multierror.Append(nil, errors.New("search location exhausted"))
 	for _, candidate := range candidates {
 		_, err := os.Stat(candidate)
 		if err == nil {
@@ -67,9 +69,8 @@ func FindFirstExecutable(candidates ...string) (string, error) {
 		if !errors.Is(err, fs.ErrNotExist) {
 			return "", fmt.Errorf("failed to check existence of %q: %w", candidate, err)
 		}
-		errs = multierror.Append(errs, fmt.Errorf("%s is not suitable", candidate))
 	}
-	return "", errs.ErrorOrNil()
+	return "", &ExecutableNotFoundError{Candidates: candidates}
 }
 
 // Return the path used to launch Rancher Desktop.
@@ -0,0 +1,26 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+// FileHolder is a process using files in a directory, as found by
+// FindFileHolders.
+type FileHolder struct {
+	Pid int
+	// Executable is the path to the executable of the process, or just its
+	// name where the path is not available.
+	Executable string
+}
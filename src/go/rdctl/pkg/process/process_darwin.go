@@ -17,17 +17,26 @@ limitations under the License.
 package process
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"os"
+	"os/exec"
 	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	CTL_KERN      = "kern"
-	KERN_PROCARGS = 38
+	CTL_KERN       = "kern"
+	KERN_PROCARGS  = 38
+	KERN_PROCARGS2 = 49
+	// SZOMB is the p_stat of a process that has exited but not been reaped.
+	SZOMB = 5
 )
 
 // Iterate over all processes, calling a callback function for each process
@@ -86,3 +95,112 @@ func WaitForProcess(pid int) error {
 	logrus.Tracef("got %d kqueue events: %+v", n, events[:n])
 	return nil
 }
+
+// Get the parent process id of the given process.
+func getParentPid(pid int) (int, error) {
+	info, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get information on process %d: %w", pid, err)
+	}
+	return int(info.Eproc.Ppid), nil
+}
+
+// GetExecutable returns the path to the executable of the given process.
+func GetExecutable(pid int) (string, error) {
+	buf, err := unix.SysctlRaw(CTL_KERN, KERN_PROCARGS, pid)
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable of process %d: %w", pid, err)
+	}
+	index := slices.Index(buf, 0)
+	if index < 0 {
+		return "", fmt.Errorf("unexpected executable for process %d", pid)
+	}
+	return string(buf[:index]), nil
+}
+
+// IsZombie checks if the given process has exited but not been reaped by its
+// parent yet.
+func IsZombie(pid int) (bool, error) {
+	proc, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return false, fmt.Errorf("failed to get status of process %d: %w", pid, err)
+	}
+	return proc.Proc.P_stat == SZOMB, nil
+}
+
+// GetCommandLine returns the command line arguments of the given process.
+func GetCommandLine(pid int) ([]string, error) {
+	buf, err := unix.SysctlRaw(CTL_KERN, KERN_PROCARGS2, pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get command line of process %d: %w", pid, err)
+	}
+	// The buffer starts with the argument count, followed by the null-terminated
+	// executable path, some null padding, and then the arguments.
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("unexpected command line for process %d", pid)
+	}
+	argc := int(binary.LittleEndian.Uint32(buf[:4]))
+	rest := buf[4:]
+	if index := bytes.IndexByte(rest, 0); index >= 0 {
+		rest = rest[index:]
+	}
+	rest = bytes.TrimLeft(rest, "\x00")
+	args := make([]string, 0, argc)
+	for len(args) < argc && len(rest) > 0 {
+		index := bytes.IndexByte(rest, 0)
+		if index < 0 {
+			args = append(args, string(rest))
+			break
+		}
+		args = append(args, string(rest[:index]))
+		rest = rest[index+1:]
+	}
+	return args, nil
+}
+
+// CountOpenFiles returns the number of open file descriptors of the given
+// process.
+func CountOpenFiles(pid int) (int, error) {
+	return 0, errors.New("CountOpenFiles is not implemented on macOS")
+}
+
+// FindFileHolders returns the processes (other than this one) that have files
+// in the given directory open, or are running in it, as reported by lsof.
+func FindFileHolders(directory string) ([]FileHolder, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("lsof", "-n", "-P", "-F", "pc", "+D", directory)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(output) == 0 && stderr.Len() == 0 {
+		// lsof fails if nothing has any files open.
+		return nil, nil
+	} else if err != nil && len(output) == 0 {
+		return nil, fmt.Errorf("failed to run lsof: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseLsofOutput(output), nil
+}
+
+// parseLsofOutput parses the output of `lsof -F pc`: a line `p<pid>` for each
+// process, followed by `c<command>`.
+func parseLsofOutput(output []byte) []FileHolder {
+	var holders []FileHolder
+	for _, line := range strings.Split(string(output), "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid, err := strconv.Atoi(line[1:])
+			if err != nil || pid == os.Getpid() {
+				continue
+			}
+			holders = append(holders, FileHolder{Pid: pid})
+		case 'c':
+			if len(holders) > 0 && holders[len(holders)-1].Executable == "" {
+				holders[len(holders)-1].Executable = line[1:]
+			}
+		}
+	}
+	return holders
+}
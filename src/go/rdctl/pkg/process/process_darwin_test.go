@@ -0,0 +1,16 @@
+package process
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLsofOutput(t *testing.T) {
+	output := "p100\ncqemu-system-aarch64\nf3\nf4\np101\ncRancher Desktop\nf10\n"
+	assert.Equal(t, []FileHolder{
+		{Pid: 100, Executable: "qemu-system-aarch64"},
+		{Pid: 101, Executable: "Rancher Desktop"},
+	}, parseLsofOutput([]byte(output)))
+	assert.Empty(t, parseLsofOutput(nil))
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -72,3 +73,131 @@ func WaitForProcess(pid int) error {
 	}
 	return nil
 }
+
+// readStat returns the fields of /proc/<pid>/stat after the command name,
+// starting with the process state.
+func readStat(pid int) ([]string, error) {
+	buf, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status of process %d: %w", pid, err)
+	}
+	// The format is `pid (comm) state ppid ...`; comm may contain spaces and
+	// parentheses, so look for the last closing parenthesis.
+	index := strings.LastIndex(string(buf), ")")
+	if index < 0 {
+		return nil, fmt.Errorf("failed to parse status of process %d", pid)
+	}
+	fields := strings.Fields(string(buf[index+1:]))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("failed to parse status of process %d", pid)
+	}
+	return fields, nil
+}
+
+// Get the parent process id of the given process.
+func getParentPid(pid int) (int, error) {
+	fields, err := readStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// IsZombie checks if the given process has exited but not been reaped by its
+// parent yet.
+func IsZombie(pid int) (bool, error) {
+	fields, err := readStat(pid)
+	if err != nil {
+		return false, err
+	}
+	return fields[0] == "Z", nil
+}
+
+// GetExecutable returns the path to the executable of the given process.
+func GetExecutable(pid int) (string, error) {
+	executable, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable of process %d: %w", pid, err)
+	}
+	return executable, nil
+}
+
+// GetCommandLine returns the command line arguments of the given process.
+func GetCommandLine(pid int) ([]string, error) {
+	buf, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command line of process %d: %w", pid, err)
+	}
+	return strings.Split(strings.TrimRight(string(buf), "\x00"), "\x00"), nil
+}
+
+// CountOpenFiles returns the number of open file descriptors of the given
+// process.
+func CountOpenFiles(pid int) (int, error) {
+	entries, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list open files of process %d: %w", pid, err)
+	}
+	return len(entries), nil
+}
+
+// FindFileHolders returns the processes (other than this one) that have files
+// in the given directory open, or are running in it.
+func FindFileHolders(directory string) ([]FileHolder, error) {
+	return findFileHolders("/proc", directory)
+}
+
+// findFileHolders implements FindFileHolders, looking for processes in the
+// given procfs.  Processes that can't be inspected (e.g. because they belong to
+// another user) are skipped.
+func findFileHolders(procRoot, directory string) ([]FileHolder, error) {
+	pidfds, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("error listing processes: %w", err)
+	}
+	var holders []FileHolder
+	for _, pidfd := range pidfds {
+		pid, err := strconv.Atoi(pidfd.Name())
+		if err != nil || !pidfd.IsDir() || pid == os.Getpid() {
+			continue
+		}
+		procDir := filepath.Join(procRoot, pidfd.Name())
+		if !holdsFileIn(procDir, directory) {
+			continue
+		}
+		executable, err := os.Readlink(filepath.Join(procDir, "exe"))
+		if err != nil {
+			// Fall back to the name of the process.
+			comm, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+			executable = strings.TrimSpace(string(comm))
+		}
+		holders = append(holders, FileHolder{Pid: pid, Executable: executable})
+	}
+	return holders, nil
+}
+
+// holdsFileIn checks if the process with the given procfs directory has a file
+// in the directory open, or is running in it.
+func holdsFileIn(procDir, directory string) bool {
+	if cwd, err := os.Readlink(filepath.Join(procDir, "cwd")); err == nil && isWithin(directory, cwd) {
+		return true
+	}
+	fdDir := filepath.Join(procDir, "fd")
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err == nil && isWithin(directory, strings.TrimSuffix(target, " (deleted)")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin checks if the path is the directory, or is inside it.
+func isWithin(directory, path string) bool {
+	relPath, err := filepath.Rel(directory, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, "../")
+}
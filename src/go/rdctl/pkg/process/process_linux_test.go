@@ -0,0 +1,76 @@
+package process
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindFileHolders(t *testing.T) {
+	t.Run("fake procfs", func(t *testing.T) {
+		procRoot := t.TempDir()
+		dataDir := filepath.Join(t.TempDir(), "data")
+		otherDir := t.TempDir()
+		// fakeProcess creates a process in the fake procfs, with the given
+		// executable (if any) and links (relative to the process directory).
+		fakeProcess := func(pid string, executable string, links map[string]string) {
+			procDir := filepath.Join(procRoot, pid)
+			require.NoError(t, os.MkdirAll(filepath.Join(procDir, "fd"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(procDir, "comm"), []byte("comm-"+pid+"\n"), 0o644))
+			if executable != "" {
+				links["exe"] = executable
+			}
+			for name, target := range links {
+				require.NoError(t, os.Symlink(target, filepath.Join(procDir, name)))
+			}
+		}
+		fakeProcess("100", "/usr/bin/holder", map[string]string{
+			"cwd":  otherDir,
+			"fd/0": "/dev/null",
+			"fd/3": filepath.Join(dataDir, "lima", "0", "diffdisk"),
+		})
+		fakeProcess("101", "/usr/bin/shell", map[string]string{"cwd": filepath.Join(dataDir, "logs")})
+		fakeProcess("102", "/usr/bin/unrelated", map[string]string{
+			"cwd":  otherDir,
+			"fd/3": dataDir + "-other/file",
+		})
+		fakeProcess("103", "", map[string]string{"fd/4": filepath.Join(dataDir, "removed") + " (deleted)"})
+		fakeProcess(strconv.Itoa(os.Getpid()), "/usr/bin/self", map[string]string{"cwd": dataDir})
+		require.NoError(t, os.Mkdir(filepath.Join(procRoot, "self"), 0o755))
+
+		holders, err := findFileHolders(procRoot, dataDir)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []FileHolder{
+			{Pid: 100, Executable: "/usr/bin/holder"},
+			{Pid: 101, Executable: "/usr/bin/shell"},
+			{Pid: 103, Executable: "comm-103"},
+		}, holders)
+	})
+	t.Run("real process", func(t *testing.T) {
+		dataDir := t.TempDir()
+		file := filepath.Join(dataDir, "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o644))
+		cmd := exec.Command("/bin/sh", "-c", `exec sleep 60 3<"$0"`, file)
+		require.NoError(t, cmd.Start())
+		t.Cleanup(func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		})
+		assert.Eventually(t, func() bool {
+			holders, err := FindFileHolders(dataDir)
+			require.NoError(t, err)
+			for _, holder := range holders {
+				if holder.Pid == cmd.Process.Pid {
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -16,3 +16,11 @@ func TestFindPidOfProcess(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, os.Getpid(), pid)
 }
+
+func TestFindPidsOfProcess(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	pids, err := process.FindPidsOfProcess(exe)
+	require.NoError(t, err)
+	assert.Contains(t, pids, os.Getpid())
+}
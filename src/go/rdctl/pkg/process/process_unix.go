@@ -19,21 +19,94 @@ limitations under the License.
 package process
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+// DefaultTerminateParallelism is the number of processes that
+// TerminateProcessInDirectory signals concurrently.
+const DefaultTerminateParallelism = 8
+
+// processEntry describes a process to be signalled.
+type processEntry struct {
+	pid        int
+	ppid       int
+	executable string
+}
+
 // TerminateProcessInDirectory terminates all processes where the executable
 // resides within the given directory, as gracefully as possible.  If `force` is
 // set, SIGKILL is used instead.
 func TerminateProcessInDirectory(directory string, force bool) error {
-	return iterProcesses(func(pid int, procPath string) error {
+	return TerminateProcessInDirectoryWithParallelism(directory, force, DefaultTerminateParallelism)
+}
+
+// TerminateProcessInDirectoryWithParallelism is TerminateProcessInDirectory,
+// but signals at most `parallelism` processes at once.  Parent processes are
+// signalled before their children.
+func TerminateProcessInDirectoryWithParallelism(directory string, force bool, parallelism int) error {
+	signal := unix.SIGTERM
+	if force {
+		signal = unix.SIGKILL
+	}
+	return terminateProcessInDirectory(directory, parallelism, iterProcesses, func(pid int) error {
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		return proc.Signal(signal)
+	})
+}
+
+// terminateProcessInDirectory implements TerminateProcessInDirectory, using the
+// given functions to enumerate and signal processes.  Processes that could not
+// be signalled may have been exiting at the time, so the directory is scanned
+// again, and any that are still present are retried once; only those that fail
+// again are reported.
+func terminateProcessInDirectory(directory string, parallelism int, iter func(func(int, string) error) error, kill func(int) error) error {
+	procs, err := listProcessesInDirectory(directory, iter)
+	if err != nil {
+		return err
+	}
+	failed := killProcesses(procs, parallelism, kill)
+	if len(failed) == 0 {
+		return nil
+	}
+	procs, err = listProcessesInDirectory(directory, iter)
+	if err != nil {
+		return fmt.Errorf("failed to check processes after terminating them: %w", err)
+	}
+	var retry []processEntry
+	for _, entry := range procs {
+		if _, ok := failed[entry.pid]; ok {
+			logrus.Debugf("Retrying termination of pid %d (%s)", entry.pid, entry.executable)
+			retry = append(retry, entry)
+		}
+	}
+	failed = killProcesses(retry, parallelism, kill)
+	var errs *multierror.Error
+	for _, entry := range retry {
+		if err, ok := failed[entry.pid]; ok {
+			errs = multierror.Append(errs, fmt.Errorf("failed to terminate pid %d (%s): %w", entry.pid, entry.executable, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// listProcessesInDirectory returns the processes (other than this one) whose
+// executables reside within the given directory.
+func listProcessesInDirectory(directory string, iter func(func(int, string) error) error) ([]processEntry, error) {
+	var procs []processEntry
+	err := iter(func(pid int, procPath string) error {
 		// Don't kill the current process
 		if pid == os.Getpid() {
 			return nil
@@ -42,26 +115,127 @@ func TerminateProcessInDirectory(directory string, force bool) error {
 		if err != nil || strings.HasPrefix(relPath, "../") {
 			return nil
 		}
-		proc, err := os.FindProcess(pid)
+		ppid, err := getParentPid(pid)
 		if err != nil {
-			return nil
+			logrus.Debugf("Failed to get parent of pid %d (%s): %s", pid, procPath, err)
 		}
-		if force {
-			err = proc.Signal(unix.SIGKILL)
+		procs = append(procs, processEntry{pid: pid, ppid: ppid, executable: procPath})
+		return nil
+	})
+	return procs, err
+}
+
+// killProcesses signals the given processes, returning the errors for those
+// that could not be signalled (other than because they have already exited).
+func killProcesses(procs []processEntry, parallelism int, kill func(int) error) map[int]error {
+	var mutex sync.Mutex
+	failed := make(map[int]error)
+	signalProcesses(procs, parallelism, func(entry processEntry) {
+		err := kill(entry.pid)
+		switch {
+		case err == nil:
+			logrus.Infof("Terminated process %d (%s)", entry.pid, entry.executable)
+		case errors.Is(err, os.ErrProcessDone), errors.Is(err, unix.ESRCH), errors.Is(err, unix.EINVAL):
+			logrus.Debugf("Not terminating pid %d (%s): %s", entry.pid, entry.executable, err)
+		default:
+			logrus.Infof("Failed to terminate pid %d (%s): %s", entry.pid, entry.executable, err)
+			mutex.Lock()
+			defer mutex.Unlock()
+			failed[entry.pid] = err
+		}
+	})
+	return failed
+}
+
+// signalProcesses calls the signal function for each of the given processes,
+// with at most `parallelism` calls in flight at once.  The processes are
+// handled in waves by depth in the process tree (considering only the given
+// processes), so that a parent is always signalled before its children.
+func signalProcesses(procs []processEntry, parallelism int, signal func(processEntry)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	// Work out the depth of each process once, walking down the tree from the
+	// roots (whose parents are not among the given processes).
+	pids := make(map[int]bool, len(procs))
+	for _, entry := range procs {
+		pids[entry.pid] = true
+	}
+	children := make(map[int][]int, len(procs))
+	depths := make(map[int]int, len(procs))
+	var queue []int
+	for _, entry := range procs {
+		if pids[entry.ppid] {
+			children[entry.ppid] = append(children[entry.ppid], entry.pid)
 		} else {
-			err = proc.Signal(unix.SIGTERM)
+			depths[entry.pid] = 0
+			queue = append(queue, entry.pid)
 		}
-		if err == nil {
-			logrus.Infof("Terminated process %d (%s)", pid, procPath)
-		} else if !errors.Is(err, unix.EINVAL) {
-			logrus.Infof("Ignoring failure to terminate pid %d (%s): %s", pid, procPath, err)
+	}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		for _, child := range children[pid] {
+			if _, seen := depths[child]; !seen {
+				depths[child] = depths[pid] + 1
+				queue = append(queue, child)
+			}
 		}
-		return nil
-	})
+	}
+
+	var waves [][]processEntry
+	var cycles []processEntry
+	for _, entry := range procs {
+		depth, ok := depths[entry.pid]
+		if !ok {
+			// Processes in a (pid reuse induced) cycle are not reached from
+			// any root; they are signalled last.
+			cycles = append(cycles, entry)
+			continue
+		}
+		for len(waves) <= depth {
+			waves = append(waves, nil)
+		}
+		waves[depth] = append(waves[depth], entry)
+	}
+	if len(cycles) > 0 {
+		waves = append(waves, cycles)
+	}
+
+	for _, wave := range waves {
+		var wg sync.WaitGroup
+		work := make(chan processEntry)
+		for i := 0; i < min(parallelism, len(wave)); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for entry := range work {
+					signal(entry)
+				}
+			}()
+		}
+		for _, entry := range wave {
+			work <- entry
+		}
+		close(work)
+		wg.Wait()
+	}
 }
 
 // Find some pid running the given executable.  If not found, return 0.
 func FindPidOfProcess(executable string) (int, error) {
+	return FindPidOfProcessContext(context.Background(), executable)
+}
+
+// FindPidOfProcessContext is FindPidOfProcess, but stops enumerating processes
+// (returning an error) once the context is canceled or its deadline passes.
+func FindPidOfProcessContext(ctx context.Context, executable string) (int, error) {
+	return findPidOfProcess(ctx, executable, iterProcesses)
+}
+
+// findPidOfProcess implements FindPidOfProcessContext, using the given function
+// to enumerate processes.
+func findPidOfProcess(ctx context.Context, executable string, iter func(func(int, string) error) error) (int, error) {
 	targetInfo, err := os.Stat(executable)
 	if err != nil {
 		return 0, fmt.Errorf("failed to determine %s info: %w", executable, err)
@@ -70,7 +244,10 @@ func FindPidOfProcess(executable string) (int, error) {
 	var mainPid int
 	// errFound is a sentinel error so we can break out of the loop early.
 	errFound := fmt.Errorf("found executable process")
-	err = iterProcesses(func(pid int, executable string) error {
+	err = iter(func(pid int, executable string) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped listing processes: %w", err)
+		}
 		info, err := os.Stat(executable)
 		if err != nil {
 			// Maybe the executable has been deleted since.
@@ -89,6 +266,68 @@ func FindPidOfProcess(executable string) (int, error) {
 	return mainPid, nil
 }
 
+// FindPidsOfProcess returns the pids of all processes running the given
+// executable.
+func FindPidsOfProcess(executable string) ([]int, error) {
+	targetInfo, err := os.Stat(executable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine %s info: %w", executable, err)
+	}
+
+	var pids []int
+	err = iterProcesses(func(pid int, executable string) error {
+		info, err := os.Stat(executable)
+		if err != nil {
+			// Maybe the executable has been deleted since.
+			logrus.Debugf("failed to look up executable for pid %d: %s", pid, err)
+			return nil
+		}
+		if os.SameFile(targetInfo, info) {
+			pids = append(pids, pid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pids, nil
+}
+
+// FindPidsByName returns the pids of all processes running an executable with
+// the given file name, wherever it is.  This still matches processes whose
+// executable has since been moved or deleted (e.g. by an upgrade), unlike
+// FindPidsOfProcess.
+func FindPidsByName(name string) ([]int, error) {
+	return findPidsByName(name, iterProcesses)
+}
+
+// findPidsByName implements FindPidsByName, using the given function to
+// enumerate processes.
+func findPidsByName(name string, iter func(func(int, string) error) error) ([]int, error) {
+	var pids []int
+	err := iter(func(pid int, executable string) error {
+		// Linux marks executables that have been deleted.
+		executable = strings.TrimSuffix(executable, " (deleted)")
+		if filepath.Base(executable) == name {
+			pids = append(pids, pid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pids, nil
+}
+
+// GetProcessGroup returns the process group id of the given process.
+func GetProcessGroup(pid int) (int, error) {
+	pgid, err := unix.Getpgid(pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get process group id for %d: %w", pid, err)
+	}
+	return pgid, nil
+}
+
 // Kill the process group the given process belongs to.  If wait is set, block
 // until the target process exits first before doing so.
 func KillProcessGroup(pid int, wait bool) error {
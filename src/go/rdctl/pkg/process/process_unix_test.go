@@ -0,0 +1,262 @@
+//go:build unix
+
+package process
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// syntheticProcessTree returns a process tree of the given size, where each
+// process has up to `fanout` children.  The result is in reverse pid order so
+// that children are listed before their parents.
+func syntheticProcessTree(size, fanout int) []processEntry {
+	procs := make([]processEntry, size)
+	for i := range procs {
+		pid := size - i + 1000
+		ppid := 1
+		if pid > 1000+1 {
+			ppid = (pid-1001-1)/fanout + 1001
+		}
+		procs[i] = processEntry{pid: pid, ppid: ppid, executable: "/opt/rd/helper"}
+	}
+	return procs
+}
+
+func TestGetParentPid(t *testing.T) {
+	ppid, err := getParentPid(os.Getpid())
+	require.NoError(t, err)
+	assert.Equal(t, os.Getppid(), ppid)
+}
+
+func TestGetProcessGroup(t *testing.T) {
+	pgid, err := GetProcessGroup(os.Getpid())
+	require.NoError(t, err)
+	assert.Equal(t, unix.Getpgrp(), pgid)
+}
+
+func TestGetExecutable(t *testing.T) {
+	executable, err := GetExecutable(os.Getpid())
+	require.NoError(t, err)
+	expected, err := os.Executable()
+	require.NoError(t, err)
+	actualInfo, err := os.Stat(executable)
+	require.NoError(t, err)
+	expectedInfo, err := os.Stat(expected)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(expectedInfo, actualInfo), "expected %s, got %s", expected, executable)
+}
+
+func TestGetCommandLine(t *testing.T) {
+	args, err := GetCommandLine(os.Getpid())
+	require.NoError(t, err)
+	assert.Equal(t, os.Args, args)
+}
+
+func TestIsZombie(t *testing.T) {
+	zombie, err := IsZombie(os.Getpid())
+	require.NoError(t, err)
+	assert.False(t, zombie)
+
+	// The child process stays a zombie until it is waited for.
+	cmd := exec.Command("/bin/sh", "-c", "exit 0")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	assert.Eventually(t, func() bool {
+		zombie, err := IsZombie(cmd.Process.Pid)
+		return err == nil && zombie
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCountOpenFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CountOpenFiles is only implemented on Linux")
+	}
+	before, err := CountOpenFiles(os.Getpid())
+	require.NoError(t, err)
+	file, err := os.Open(os.Args[0])
+	require.NoError(t, err)
+	defer file.Close()
+	after, err := CountOpenFiles(os.Getpid())
+	require.NoError(t, err)
+	assert.Equal(t, before+1, after)
+}
+
+func TestFindPidOfProcessContext(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	// fakeProcesses lists many processes that are not the target, followed by
+	// the target; it cancels the context after listing a few processes.
+	fakeProcesses := func(cancel context.CancelFunc, listed *int) func(func(int, string) error) error {
+		return func(callback func(int, string) error) error {
+			for pid := 1000; pid < 2000; pid++ {
+				if *listed == 3 {
+					cancel()
+				}
+				*listed++
+				if err := callback(pid, "/does/not/exist"); err != nil {
+					return err
+				}
+			}
+			return callback(os.Getpid(), exe)
+		}
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		var listed int
+		pid, err := findPidOfProcess(context.Background(), exe, fakeProcesses(func() {}, &listed))
+		require.NoError(t, err)
+		assert.Equal(t, os.Getpid(), pid)
+		assert.Equal(t, 1000, listed)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var listed int
+		pid, err := findPidOfProcess(ctx, exe, fakeProcesses(cancel, &listed))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Zero(t, pid)
+		assert.Equal(t, 4, listed, "enumeration did not stop after cancellation")
+	})
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		var listed int
+		pid, err := findPidOfProcess(ctx, exe, fakeProcesses(func() {}, &listed))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Zero(t, pid)
+		assert.Equal(t, 1, listed)
+	})
+}
+
+func TestFindPidsByName(t *testing.T) {
+	processes := func(callback func(int, string) error) error {
+		for pid, executable := range map[int]string{
+			1001: "/Applications/Rancher Desktop.app/Contents/MacOS/Rancher Desktop",
+			1002: "/opt/rancher-desktop/rancher-desktop (deleted)",
+			1003: "/opt/rancher-desktop/rancher-desktop-helper",
+			1004: "/usr/bin/rancher-desktop",
+		} {
+			if err := callback(pid, executable); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pids, err := findPidsByName("rancher-desktop", processes)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1002, 1004}, pids)
+	pids, err = findPidsByName("Rancher Desktop", processes)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1001}, pids)
+}
+
+func TestTerminateProcessInDirectory(t *testing.T) {
+	// running maps the pids of the fake processes to their executables.
+	running := map[int]string{
+		101: "/opt/rd/exiting",
+		102: "/opt/rd/stuck",
+		103: "/opt/rd/busy",
+		104: "/opt/rd/gone",
+		105: "/opt/rd/fine",
+		200: "/usr/bin/other",
+	}
+	iter := func(callback func(int, string) error) error {
+		for pid, executable := range running {
+			if err := callback(pid, executable); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var mutex sync.Mutex
+	attempts := make(map[int]int)
+	kill := func(pid int) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[pid]++
+		switch pid {
+		case 101:
+			// The process fails to be signalled as it is exiting, and is
+			// gone by the time of the retry.
+			delete(running, pid)
+			return unix.EPERM
+		case 102:
+			return unix.EPERM
+		case 103:
+			if attempts[pid] == 1 {
+				return unix.EBUSY
+			}
+		case 104:
+			return os.ErrProcessDone
+		}
+		return nil
+	}
+	err := terminateProcessInDirectory("/opt/rd", 2, iter, kill)
+	assert.EqualError(t, err, "1 error occurred:\n\t* failed to terminate pid 102 (/opt/rd/stuck): operation not permitted\n\n")
+	assert.ErrorIs(t, err, unix.EPERM)
+	assert.Equal(t, map[int]int{101: 1, 102: 2, 103: 2, 104: 1, 105: 1}, attempts)
+}
+
+func TestSignalProcesses(t *testing.T) {
+	const parallelism = 8
+	procs := syntheticProcessTree(2000, 4)
+	var mutex sync.Mutex
+	var inFlight, maxInFlight atomic.Int32
+	signalled := make(map[int]bool)
+	signalProcesses(procs, parallelism, func(entry processEntry) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if entry.ppid != 1 {
+			assert.True(t, signalled[entry.ppid], "pid %d signalled before parent %d", entry.pid, entry.ppid)
+		}
+		assert.False(t, signalled[entry.pid], "pid %d signalled twice", entry.pid)
+		signalled[entry.pid] = true
+	})
+	assert.Len(t, signalled, len(procs))
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(parallelism))
+}
+
+func TestSignalProcessesWaves(t *testing.T) {
+	procs := []processEntry{
+		{pid: 12, ppid: 11},
+		{pid: 10, ppid: 1},
+		{pid: 11, ppid: 10},
+		{pid: 13, ppid: 10},
+		// A cycle, as can happen with pid reuse.
+		{pid: 20, ppid: 21},
+		{pid: 21, ppid: 20},
+	}
+	var order []int
+	signalProcesses(procs, 1, func(entry processEntry) {
+		order = append(order, entry.pid)
+	})
+	assert.Equal(t, []int{10, 11, 13, 12, 20, 21}, order)
+}
+
+func BenchmarkSignalProcesses(b *testing.B) {
+	procs := syntheticProcessTree(2000, 4)
+	for i := 0; i < b.N; i++ {
+		signalProcesses(procs, DefaultTerminateParallelism, func(processEntry) {})
+	}
+}
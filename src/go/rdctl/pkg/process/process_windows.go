@@ -17,11 +17,14 @@ limitations under the License.
 package process
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"unsafe"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
@@ -75,6 +78,12 @@ var (
 	getProcessHeap            = hKernel32.NewProc("GetProcessHeap")
 	heapAlloc                 = hKernel32.NewProc("HeapAlloc")
 	heapFree                  = hKernel32.NewProc("HeapFree")
+
+	hRstrtMgr           = windows.NewLazySystemDLL("rstrtmgr")
+	rmStartSession      = hRstrtMgr.NewProc("RmStartSession")
+	rmEndSession        = hRstrtMgr.NewProc("RmEndSession")
+	rmRegisterResources = hRstrtMgr.NewProc("RmRegisterResources")
+	rmGetList           = hRstrtMgr.NewProc("RmGetList")
 )
 
 // buildCommandLine convert a slice of arguments into a properly formatted
@@ -381,6 +390,12 @@ func iterProcesses(callback func(proc windows.Handle, executable string) error)
 
 // Find some pid running the given executable.  If not found, return 0.
 func FindPidOfProcess(executable string) (int, error) {
+	return FindPidOfProcessContext(context.Background(), executable)
+}
+
+// FindPidOfProcessContext is FindPidOfProcess, but stops enumerating processes
+// (returning an error) once the context is canceled or its deadline passes.
+func FindPidOfProcessContext(ctx context.Context, executable string) (int, error) {
 	targetInfo, err := os.Stat(executable)
 	if err != nil {
 		return 0, fmt.Errorf("failed to determine %s info: %w", executable, err)
@@ -390,6 +405,9 @@ func FindPidOfProcess(executable string) (int, error) {
 	// errFound is a sentinel error so we can break out of the loop early.
 	errFound := fmt.Errorf("found Rancher Desktop process")
 	err = iterProcesses(func(proc windows.Handle, executable string) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped listing processes: %w", err)
+		}
 		pid, err := windows.GetProcessId(proc)
 		if err != nil {
 			return fmt.Errorf("failed to get pid of process %s", executable)
@@ -412,6 +430,87 @@ func FindPidOfProcess(executable string) (int, error) {
 	return mainPid, nil
 }
 
+// FindPidsOfProcess returns the pids of all processes running the given
+// executable.
+func FindPidsOfProcess(executable string) ([]int, error) {
+	targetInfo, err := os.Stat(executable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine %s info: %w", executable, err)
+	}
+
+	var pids []int
+	err = iterProcesses(func(proc windows.Handle, executable string) error {
+		pid, err := windows.GetProcessId(proc)
+		if err != nil {
+			return fmt.Errorf("failed to get pid of process %s", executable)
+		}
+		info, err := os.Stat(executable)
+		if err != nil {
+			// Maybe the executable has been deleted since.
+			logrus.Debugf("failed to look up executable for pid %d: %s", pid, err)
+			return nil
+		}
+		if os.SameFile(targetInfo, info) {
+			pids = append(pids, int(pid))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pids, nil
+}
+
+// FindPidsByName returns the pids of all processes running an executable with
+// the given file name (ignoring case), wherever it is.  This still matches
+// processes whose executable has since been moved (e.g. by an upgrade), unlike
+// FindPidsOfProcess.
+func FindPidsByName(name string) ([]int, error) {
+	var pids []int
+	err := iterProcesses(func(proc windows.Handle, executable string) error {
+		if !strings.EqualFold(filepath.Base(executable), name) {
+			return nil
+		}
+		pid, err := windows.GetProcessId(proc)
+		if err != nil {
+			return fmt.Errorf("failed to get pid of process %s", executable)
+		}
+		pids = append(pids, int(pid))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pids, nil
+}
+
+// GetExecutable returns the path to the executable of the given process.
+func GetExecutable(pid int) (string, error) {
+	return "", errors.New("GetExecutable is not implemented on Windows")
+}
+
+// GetCommandLine returns the command line arguments of the given process.
+func GetCommandLine(pid int) ([]string, error) {
+	return nil, errors.New("GetCommandLine is not implemented on Windows")
+}
+
+// GetProcessGroup returns the process group id of the given process.
+func GetProcessGroup(pid int) (int, error) {
+	return 0, errors.New("GetProcessGroup is not implemented on Windows")
+}
+
+// IsZombie always returns false; processes on Windows don't linger after
+// exiting the way they do on Unix.
+func IsZombie(pid int) (bool, error) {
+	return false, nil
+}
+
+// CountOpenFiles returns the number of open file descriptors of the given
+// process.
+func CountOpenFiles(pid int) (int, error) {
+	return 0, errors.New("CountOpenFiles is not implemented on Windows")
+}
+
 // Kill the process group the given process belongs to.  If wait is set, block
 // until the target process exits first before doing so.
 func KillProcessGroup(pid int, wait bool) error {
@@ -450,3 +549,192 @@ func TerminateProcessInDirectory(directory string, force bool) error {
 		return nil
 	})
 }
+
+// GetProcessTree returns the given pid, followed by the pids of all of its
+// descendants.
+func GetProcessTree(pid int) ([]int, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot processes: %w", err)
+	}
+	defer func() {
+		_ = windows.CloseHandle(snapshot)
+	}()
+
+	children := make(map[uint32][]uint32)
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		if entry.ProcessID != entry.ParentProcessID {
+			children[entry.ParentProcessID] = append(children[entry.ParentProcessID], entry.ProcessID)
+		}
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return nil, fmt.Errorf("failed to enumerate processes: %w", err)
+	}
+
+	// Parent pids may have been reused, so guard against cycles.
+	seen := map[uint32]bool{uint32(pid): true}
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		for _, child := range children[uint32(tree[i])] {
+			if !seen[child] {
+				seen[child] = true
+				tree = append(tree, int(child))
+			}
+		}
+	}
+	return tree, nil
+}
+
+// Job is an anonymous Windows job object, used to terminate a set of processes
+// all at once.
+type Job struct {
+	handle windows.Handle
+}
+
+// CreateJob creates a new, empty job object.  The caller must close it.
+func CreateJob() (*Job, error) {
+	handle, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+	return &Job{handle: handle}, nil
+}
+
+// Assign adds the given process to the job.
+func (j *Job) Assign(pid int) error {
+	proc, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		return fmt.Errorf("failed to open process %d: %w", pid, err)
+	}
+	defer func() {
+		_ = windows.CloseHandle(proc)
+	}()
+	if err = windows.AssignProcessToJobObject(j.handle, proc); err != nil {
+		return fmt.Errorf("failed to assign process %d to job: %w", pid, err)
+	}
+	return nil
+}
+
+// Terminate kills all processes in the job.
+func (j *Job) Terminate() error {
+	if err := windows.TerminateJobObject(j.handle, 1); err != nil {
+		return fmt.Errorf("failed to terminate job: %w", err)
+	}
+	return nil
+}
+
+// Close releases the job handle.
+func (j *Job) Close() error {
+	return windows.CloseHandle(j.handle)
+}
+
+// RM_UNIQUE_PROCESS identifies a process for the restart manager.
+type RM_UNIQUE_PROCESS struct {
+	ProcessId        uint32
+	ProcessStartTime windows.Filetime
+}
+
+// RM_PROCESS_INFO describes a process using a resource registered with the
+// restart manager.
+type RM_PROCESS_INFO struct {
+	Process          RM_UNIQUE_PROCESS
+	AppName          [CCH_RM_MAX_APP_NAME + 1]uint16
+	ServiceShortName [CCH_RM_MAX_SVC_NAME + 1]uint16
+	ApplicationType  uint32
+	AppStatus        uint32
+	TSSessionId      uint32
+	Restartable      int32
+}
+
+const (
+	CCH_RM_SESSION_KEY  = 32
+	CCH_RM_MAX_APP_NAME = 255
+	CCH_RM_MAX_SVC_NAME = 63
+)
+
+// maxFileHolderFiles limits how many files FindFileHolders asks about, as the
+// restart manager checks each of them individually.
+const maxFileHolderFiles = 1000
+
+// FindFileHolders returns the processes that have files in the given directory
+// open, as reported by the restart manager.  Only the first maxFileHolderFiles
+// files are checked.
+func FindFileHolders(directory string) ([]FileHolder, error) {
+	var files []*uint16
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			// Skip anything we can't read; it can't be checked anyway.
+			return nil
+		}
+		if len(files) >= maxFileHolderFiles {
+			return filepath.SkipAll
+		}
+		name, err := windows.UTF16PtrFromString(path)
+		if err == nil {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files in %s: %w", directory, err)
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	var session uint32
+	var sessionKey [CCH_RM_SESSION_KEY + 1]uint16
+	rc, _, _ := rmStartSession.Call(
+		uintptr(unsafe.Pointer(&session)),
+		0,
+		uintptr(unsafe.Pointer(&sessionKey[0])))
+	if rc != 0 {
+		return nil, fmt.Errorf("failed to start restart manager session: %w", syscall.Errno(rc))
+	}
+	defer func() {
+		_, _, _ = rmEndSession.Call(uintptr(session))
+	}()
+	rc, _, _ = rmRegisterResources.Call(
+		uintptr(session),
+		uintptr(len(files)),
+		uintptr(unsafe.Pointer(&files[0])),
+		0, 0, 0, 0)
+	if rc != 0 {
+		return nil, fmt.Errorf("failed to register files with the restart manager: %w", syscall.Errno(rc))
+	}
+
+	var infos []RM_PROCESS_INFO
+	var count uint32
+	for {
+		var needed, reasons uint32
+		var infosPtr uintptr
+		count = uint32(len(infos))
+		if count > 0 {
+			infosPtr = uintptr(unsafe.Pointer(&infos[0]))
+		}
+		rc, _, _ = rmGetList.Call(
+			uintptr(session),
+			uintptr(unsafe.Pointer(&needed)),
+			uintptr(unsafe.Pointer(&count)),
+			infosPtr,
+			uintptr(unsafe.Pointer(&reasons)))
+		if syscall.Errno(rc) == windows.ERROR_MORE_DATA {
+			// More processes may have started using the files since.
+			infos = make([]RM_PROCESS_INFO, needed+4)
+			continue
+		}
+		if rc != 0 {
+			return nil, fmt.Errorf("failed to get processes from the restart manager: %w", syscall.Errno(rc))
+		}
+		break
+	}
+	holders := make([]FileHolder, 0, count)
+	for _, info := range infos[:count] {
+		holders = append(holders, FileHolder{
+			Pid:        int(info.Process.ProcessId),
+			Executable: windows.UTF16ToString(info.AppName[:]),
+		})
+	}
+	return holders, nil
+}
@@ -1,6 +1,8 @@
 package process
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -32,3 +34,17 @@ func TestBuildCommandLine(t *testing.T) {
 		})
 	}
 }
+
+func TestFindFileHolders(t *testing.T) {
+	dataDir := t.TempDir()
+	file, err := os.Create(filepath.Join(dataDir, "file"))
+	require.NoError(t, err)
+	defer file.Close()
+	holders, err := FindFileHolders(dataDir)
+	require.NoError(t, err)
+	pids := make([]int, 0, len(holders))
+	for _, holder := range holders {
+		pids = append(pids, holder.Pid)
+	}
+	assert.Contains(t, pids, os.Getpid())
+}
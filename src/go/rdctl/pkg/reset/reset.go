@@ -0,0 +1,129 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reset implements `rdctl factory-reset`: it shuts down Rancher
+// Desktop, and then removes all of its data.
+package reset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/factoryreset"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/sirupsen/logrus"
+)
+
+// Options controls the behaviour of FactoryReset.
+type Options struct {
+	// WaitForShutdown is passed on to the shutdown; if unset, the
+	// processes are killed without waiting for them to exit on their own.
+	WaitForShutdown bool
+	// RemoveKubernetesCache also removes the cached Kubernetes images.
+	RemoveKubernetesCache bool
+	// KeepDisk stops the VM instead of deleting it, leaving its disk in place.
+	KeepDisk bool
+	// KeepVM stops the VM instead of deleting it, and leaves the whole lima
+	// instance in place when deleting the data.  It is not supported on
+	// Windows.
+	KeepVM bool
+	// LimaLogsDir, if set, is where to save the logs of the lima instance
+	// before it is deleted.
+	LimaLogsDir string
+	// LimaSnapshotDir, if set, is where to archive the lima instance before
+	// it is deleted.
+	LimaSnapshotDir string
+	// RequireLimaSnapshot makes the factory reset fail, without deleting
+	// anything, if the lima instance could not be archived.
+	RequireLimaSnapshot bool
+}
+
+// Report describes the outcome of each stage of a factory reset.  A stage that
+// did not run has a nil error and its Ran field unset.
+type Report struct {
+	// ShutdownReport is how each stage of the shutdown went; it is nil if the
+	// shutdown did not run.
+	*shutdown.ShutdownReport
+	ShutdownRan   bool
+	ShutdownError error
+	DeleteRan     bool
+	DeleteError   error
+}
+
+// The stages are variables so that tests can replace them.
+var (
+	findLimactl    = shutdown.FindLimactl
+	finishShutdown = shutdown.FinishShutdownWithConfigReport
+	getPaths       = func() (paths.Paths, error) { return paths.GetPaths() }
+	deleteData     = factoryreset.DeleteData
+)
+
+// FactoryReset ensures that Rancher Desktop is no longer running, and then
+// deletes its data.  The data is never touched unless the shutdown succeeded.
+// The returned error is the first stage failure, if any; the report has the
+// details for each stage.
+func FactoryReset(ctx context.Context, opts Options) (*Report, error) {
+	report := &Report{}
+
+	if opts.KeepVM && runtime.GOOS == "windows" {
+		return report, errors.New("keeping the VM is not supported on Windows")
+	}
+
+	if opts.RequireLimaSnapshot && opts.LimaSnapshotDir == "" {
+		return report, errors.New("requiring a lima snapshot needs a directory to save it to")
+	}
+	shutdownConfig := shutdown.Config{
+		WaitForShutdown:      opts.WaitForShutdown,
+		InitiatingCommand:    shutdown.FactoryReset,
+		KeepDisk:             opts.KeepDisk,
+		KeepVM:               opts.KeepVM,
+		LimaLogsDir:          opts.LimaLogsDir,
+		LimaSnapshotDir:      opts.LimaSnapshotDir,
+		LimaSnapshotRequired: opts.RequireLimaSnapshot,
+	}
+	if runtime.GOOS != "windows" {
+		// Look up limactl before anything else, so that the VM can still be
+		// deleted even if limactl goes missing along the way.
+		if limactl, limaHome, err := findLimactl(); err != nil {
+			logrus.Debugf("Failed to find limactl before shutting down: %s", err)
+		} else {
+			shutdownConfig.Limactl = limactl
+			shutdownConfig.LimaHome = limaHome
+		}
+	}
+
+	report.ShutdownRan = true
+	report.ShutdownReport, report.ShutdownError = finishShutdown(ctx, shutdownConfig)
+	if report.ShutdownError != nil {
+		return report, report.ShutdownError
+	}
+
+	appPaths, err := getPaths()
+	if err != nil {
+		return report, fmt.Errorf("failed to get paths: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		// WSL keeps files open while the distributions are running, which
+		// would make deleting them fail.
+		releaseWSLData(appPaths)
+	}
+	report.DeleteRan = true
+	report.DeleteError = deleteData(ctx, appPaths, opts.RemoveKubernetesCache, opts.KeepVM)
+	return report, report.DeleteError
+}
@@ -0,0 +1,189 @@
+package reset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/shutdown"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStages replaces the factory reset stages with fakes that record the
+// order they were called in.
+func fakeStages(t *testing.T, shutdownErr, deleteErr error) *[]string {
+	var calls []string
+	oldFindLimactl, oldFinishShutdown, oldGetPaths, oldReleaseWSLData, oldDeleteData := findLimactl, finishShutdown, getPaths, releaseWSLData, deleteData
+	t.Cleanup(func() {
+		findLimactl, finishShutdown, getPaths, releaseWSLData, deleteData = oldFindLimactl, oldFinishShutdown, oldGetPaths, oldReleaseWSLData, oldDeleteData
+	})
+	findLimactl = func() (string, string, error) {
+		return "/limactl", "/lima", nil
+	}
+	finishShutdown = func(ctx context.Context, config shutdown.Config) (*shutdown.ShutdownReport, error) {
+		assert.Equal(t, shutdown.FactoryReset, config.InitiatingCommand)
+		calls = append(calls, "shutdown")
+		return &shutdown.ShutdownReport{LimaStop: shutdown.LimaStoppedGracefully}, shutdownErr
+	}
+	getPaths = func() (paths.Paths, error) {
+		return paths.Paths{AppHome: t.TempDir()}, nil
+	}
+	releaseWSLData = func(appPaths paths.Paths) {}
+	deleteData = func(ctx context.Context, appPaths paths.Paths, removeKubernetesCache, keepVM bool) error {
+		calls = append(calls, "delete")
+		return deleteErr
+	}
+	return &calls
+}
+
+func TestFactoryReset(t *testing.T) {
+	t.Run("shutdown runs before delete", func(t *testing.T) {
+		calls := fakeStages(t, nil, nil)
+		report, err := FactoryReset(context.Background(), Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"shutdown", "delete"}, *calls)
+		assert.True(t, report.ShutdownRan)
+		assert.Equal(t, shutdown.LimaStoppedGracefully, report.LimaStop, "the shutdown report should be included")
+		assert.True(t, report.DeleteRan)
+	})
+	t.Run("shutdown failure skips delete", func(t *testing.T) {
+		expected := errors.New("shutdown failed")
+		calls := fakeStages(t, expected, nil)
+		report, err := FactoryReset(context.Background(), Options{})
+		assert.ErrorIs(t, err, expected)
+		assert.Equal(t, []string{"shutdown"}, *calls)
+		assert.ErrorIs(t, report.ShutdownError, expected)
+		assert.False(t, report.DeleteRan)
+	})
+	t.Run("requiring a snapshot needs a directory", func(t *testing.T) {
+		calls := fakeStages(t, nil, nil)
+		report, err := FactoryReset(context.Background(), Options{RequireLimaSnapshot: true})
+		assert.Error(t, err)
+		assert.Empty(t, *calls)
+		assert.False(t, report.ShutdownRan)
+		assert.Nil(t, report.ShutdownReport)
+	})
+	t.Run("delete failure is reported", func(t *testing.T) {
+		expected := errors.New("delete failed")
+		calls := fakeStages(t, nil, expected)
+		report, err := FactoryReset(context.Background(), Options{})
+		assert.ErrorIs(t, err, expected)
+		assert.Equal(t, []string{"shutdown", "delete"}, *calls)
+		assert.NoError(t, report.ShutdownError)
+		assert.ErrorIs(t, report.DeleteError, expected)
+	})
+}
+
+func TestFactoryResetReleasesWSL(t *testing.T) {
+	calls := fakeStages(t, nil, nil)
+	releaseWSLData = func(appPaths paths.Paths) {
+		*calls = append(*calls, "release wsl")
+	}
+	_, err := FactoryReset(context.Background(), Options{})
+	require.NoError(t, err)
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, []string{"shutdown", "release wsl", "delete"}, *calls)
+	} else {
+		assert.Equal(t, []string{"shutdown", "delete"}, *calls)
+	}
+}
+
+func TestFactoryResetFindsLimactlFirst(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	// recordShutdown makes the shutdown record its config, after the calls
+	// so far.
+	recordShutdown := func(calls *[]string) *shutdown.Config {
+		var result shutdown.Config
+		finishShutdown = func(ctx context.Context, config shutdown.Config) (*shutdown.ShutdownReport, error) {
+			*calls = append(*calls, "shutdown")
+			result = config
+			return &shutdown.ShutdownReport{}, nil
+		}
+		return &result
+	}
+	t.Run("found", func(t *testing.T) {
+		calls := fakeStages(t, nil, nil)
+		findLimactl = func() (string, string, error) {
+			*calls = append(*calls, "find limactl")
+			return "/limactl", "/lima", nil
+		}
+		config := recordShutdown(calls)
+		_, err := FactoryReset(context.Background(), Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"find limactl", "shutdown", "delete"}, *calls)
+		assert.Equal(t, "/limactl", config.Limactl, "the cached limactl should be passed to shutdown")
+		assert.Equal(t, "/lima", config.LimaHome)
+	})
+	t.Run("not found", func(t *testing.T) {
+		calls := fakeStages(t, nil, nil)
+		findLimactl = func() (string, string, error) {
+			*calls = append(*calls, "find limactl")
+			return "", "", errors.New("no limactl")
+		}
+		config := recordShutdown(calls)
+		_, err := FactoryReset(context.Background(), Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"find limactl", "shutdown", "delete"}, *calls)
+		assert.Empty(t, config.Limactl, "shutdown should look up limactl itself")
+		assert.Empty(t, config.LimaHome)
+	})
+}
+
+func TestFactoryResetShutdownConfig(t *testing.T) {
+	var config shutdown.Config
+	fakeStages(t, nil, nil)
+	finishShutdown = func(ctx context.Context, c shutdown.Config) (*shutdown.ShutdownReport, error) {
+		config = c
+		return &shutdown.ShutdownReport{}, nil
+	}
+	findLimactl = func() (string, string, error) {
+		return "", "", errors.New("no limactl")
+	}
+	_, err := FactoryReset(context.Background(), Options{
+		WaitForShutdown:     true,
+		KeepDisk:            true,
+		LimaLogsDir:         "/logs",
+		LimaSnapshotDir:     "/snapshots",
+		RequireLimaSnapshot: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, shutdown.Config{
+		WaitForShutdown:      true,
+		InitiatingCommand:    shutdown.FactoryReset,
+		KeepDisk:             true,
+		LimaLogsDir:          "/logs",
+		LimaSnapshotDir:      "/snapshots",
+		LimaSnapshotRequired: true,
+	}, config)
+}
+
+func TestFactoryResetKeepVM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Run("unsupported", func(t *testing.T) {
+			calls := fakeStages(t, nil, nil)
+			_, err := FactoryReset(context.Background(), Options{KeepVM: true})
+			assert.Error(t, err)
+			assert.Empty(t, *calls)
+		})
+		return
+	}
+	for _, keepVM := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%t", keepVM), func(t *testing.T) {
+			fakeStages(t, nil, nil)
+			var deleteKeptVM bool
+			deleteData = func(ctx context.Context, appPaths paths.Paths, removeKubernetesCache, keepVM bool) error {
+				deleteKeptVM = keepVM
+				return nil
+			}
+			_, err := FactoryReset(context.Background(), Options{KeepVM: keepVM})
+			require.NoError(t, err)
+			assert.Equal(t, keepVM, deleteKeptVM)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reset
+
+import (
+	"path/filepath"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/wsl"
+	"github.com/sirupsen/logrus"
+)
+
+// wslDistros are the WSL distributions that Rancher Desktop runs.
+var wslDistros = []string{"rancher-desktop", "rancher-desktop-data"}
+
+// releaseWSLData releases the WSL distributions and their disks, so that WSL
+// no longer holds files that factory reset needs to delete.
+var releaseWSLData = func(appPaths paths.Paths) {
+	releaseWSLDataWith(wsl.WSLImpl{}, appPaths)
+}
+
+// releaseWSLDataWith terminates the Rancher Desktop WSL distributions and then
+// unmounts the data disk.  The distributions may not be running, and the disk
+// may not be mounted, so failures are only logged.
+func releaseWSLDataWith(w wsl.WSL, appPaths paths.Paths) {
+	for _, distro := range wslDistros {
+		if err := w.TerminateDistro(distro); err != nil {
+			logrus.Debugf("Ignoring error terminating %s: %s", distro, err)
+		}
+	}
+	disk := filepath.Join(appPaths.WslDistroData, "ext4.vhdx")
+	if err := w.UnmountDisk(disk); err != nil {
+		logrus.Debugf("Ignoring error unmounting %s: %s", disk, err)
+	}
+}
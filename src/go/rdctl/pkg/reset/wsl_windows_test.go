@@ -0,0 +1,66 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reset
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingWSL is a wsl.WSL that records the commands it is asked to run.
+type recordingWSL struct {
+	calls []string
+}
+
+func (w *recordingWSL) UnregisterDistros() error {
+	w.calls = append(w.calls, "unregister")
+	return nil
+}
+
+func (w *recordingWSL) ExportDistro(distroName, fileName string) error {
+	w.calls = append(w.calls, "export "+distroName)
+	return nil
+}
+
+func (w *recordingWSL) ImportDistro(distroName, installLocation, fileName string) error {
+	w.calls = append(w.calls, "import "+distroName)
+	return nil
+}
+
+func (w *recordingWSL) TerminateDistro(distroName string) error {
+	w.calls = append(w.calls, "terminate "+distroName)
+	return nil
+}
+
+func (w *recordingWSL) UnmountDisk(diskPath string) error {
+	w.calls = append(w.calls, "unmount "+diskPath)
+	return nil
+}
+
+func TestReleaseWSLDataWith(t *testing.T) {
+	dataDir := t.TempDir()
+	w := &recordingWSL{}
+	releaseWSLDataWith(w, paths.Paths{WslDistroData: dataDir})
+	assert.Equal(t, []string{
+		"terminate rancher-desktop",
+		"terminate rancher-desktop-data",
+		"unmount " + filepath.Join(dataDir, "ext4.vhdx"),
+	}, w.calls)
+}
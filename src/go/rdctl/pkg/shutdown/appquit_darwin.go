@@ -0,0 +1,45 @@
+//go:build darwin
+
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// quitAppScript is the AppleScript asking Rancher Desktop to quit.
+const quitAppScript = `quit app "Rancher Desktop"`
+
+// quitRancherDesktop asks Rancher Desktop to quit, as if Quit had been chosen
+// from its menu, so that it runs its own teardown.
+func quitRancherDesktop(ctx context.Context) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "osascript", "-e", quitAppScript)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("osascript failed: %w: %s", err, message)
+		}
+		return fmt.Errorf("osascript failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"time"
+)
+
+// Config describes a whole shutdown, for FinishShutdownWithConfig.  Each field
+// corresponds to an Option; the zero value of each field is the same as not
+// passing that option.
+type Config struct {
+	// WaitForShutdown makes shutdown wait for each process to exit before
+	// killing it forcibly; otherwise, each is killed without waiting.
+	WaitForShutdown bool
+	// AskOnly only asks each process to stop, without killing anything.
+	AskOnly bool
+	// InitiatingCommand is the command shutdown is being run for.
+	InitiatingCommand InitiatingCommand
+	// KeepDisk and KeepVM control what factory reset keeps; see the options
+	// of the same names.
+	KeepDisk bool
+	KeepVM   bool
+	// Limactl is the limactl to use; if empty, it is looked up.
+	Limactl string
+	// LimaHome is the LIMA_HOME to use; if empty, it is the one in the
+	// application directory.
+	LimaHome string
+	// LimactlArgs are extra arguments for limactl when stopping or deleting
+	// lima instances.
+	LimactlArgs []string
+	// GracefulGuest asks the guest to power off before lima is stopped.
+	GracefulGuest bool
+	// TailLimaLog writes the lima host agent log to the debug log while
+	// waiting for lima to stop.
+	TailLimaLog bool
+	// SkipLima, SkipQemu and SkipApp leave out the stages stopping lima,
+	// qemu, and the main application respectively.
+	SkipLima bool
+	SkipQemu bool
+	SkipApp  bool
+	// MatchAppByName looks for the app by name if its executable is missing.
+	MatchAppByName bool
+	// Strict makes shutdown fail if any process could not be stopped.
+	Strict bool
+	// PollJitter is the fraction by which poll intervals are randomly varied.
+	PollJitter float64
+	// CleanupSockets removes the sockets forwarded from the VM once it stops.
+	CleanupSockets bool
+	// KillRemaining kills anything still running once shutdown has finished.
+	KillRemaining bool
+	// PreShutdownHook is an executable to run before stopping lima, killed
+	// after PreShutdownHookTimeout (or DefaultPreShutdownHookTimeout, if that
+	// is zero); if PreShutdownHookStrict is set, its failure aborts shutdown.
+	PreShutdownHook        string
+	PreShutdownHookTimeout time.Duration
+	PreShutdownHookStrict  bool
+	// DiagnosticsDir is where to record processes that had to be force-killed.
+	DiagnosticsDir string
+	// LimaLogsDir is where to save the lima logs before factory reset.
+	LimaLogsDir string
+	// LimaSnapshotDir is where to archive the lima instance before factory
+	// reset deletes it; if LimaSnapshotRequired is set, failing to do so
+	// fails the factory reset.
+	LimaSnapshotDir      string
+	LimaSnapshotRequired bool
+	// ForceKills counts stages that had to force-kill.
+	ForceKills *ForceKillCounter
+	// OnComplete is called with the report once shutdown has finished.
+	OnComplete func(*ShutdownReport, error)
+	// Options are applied after all of the above, and take precedence.
+	Options []Option
+}
+
+// options returns the options equivalent to the config.
+func (c Config) options() []Option {
+	opts := []Option{
+		KeepDisk(c.KeepDisk),
+		AskOnly(c.AskOnly),
+		KeepVM(c.KeepVM),
+		LimaHome(c.LimaHome),
+		LimactlArgs(c.LimactlArgs...),
+		GracefulGuestShutdown(c.GracefulGuest),
+		TailLimaLog(c.TailLimaLog),
+		SkipLima(c.SkipLima),
+		SkipQemu(c.SkipQemu),
+		SkipAppTermination(c.SkipApp),
+		MatchAppByName(c.MatchAppByName),
+		StrictErrors(c.Strict),
+		PollJitter(c.PollJitter),
+		CleanupSockets(c.CleanupSockets),
+		KillRemaining(c.KillRemaining),
+		PreShutdownHook(c.PreShutdownHook, c.PreShutdownHookTimeout, c.PreShutdownHookStrict),
+		Diagnostics(c.DiagnosticsDir),
+		SaveLimaLogs(c.LimaLogsDir),
+		SnapshotLima(c.LimaSnapshotDir, c.LimaSnapshotRequired),
+		CountForceKills(c.ForceKills),
+		OnComplete(c.OnComplete),
+	}
+	if c.Limactl != "" {
+		opts = append(opts, Limactl(c.Limactl))
+	}
+	return append(opts, c.Options...)
+}
+
+// FinishShutdownWithConfig is FinishShutdown, configured by a single Config
+// rather than separate arguments and options.
+func FinishShutdownWithConfig(ctx context.Context, config Config) error {
+	_, err := finishShutdownWithConfig(ctx, config)
+	return err
+}
+
+// FinishShutdownWithConfigReport is FinishShutdownWithConfig, but also reports
+// the outcome of each stage of the shutdown, as FinishShutdownWithReport does.
+func FinishShutdownWithConfigReport(ctx context.Context, config Config) (*ShutdownReport, error) {
+	return finishShutdownWithConfig(ctx, config)
+}
+
+// finishShutdownWithConfig runs the shutdown described by the config,
+// returning its report.
+func finishShutdownWithConfig(ctx context.Context, config Config) (*ShutdownReport, error) {
+	s := newShutdownData(config.WaitForShutdown, config.options()...)
+	err := s.finishShutdown(ctx, config.InitiatingCommand)
+	return s.report, err
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+)
+
+// diagnosticsFileName is the file, in the diagnostics directory, that
+// diagnostics are appended to.
+const diagnosticsFileName = "shutdown-diagnostics.log"
+
+// StageDiagnostics describes the processes that were still running when a
+// shutdown stage gave up waiting and was about to force-kill them.
+type StageDiagnostics struct {
+	Time time.Time `json:"time"`
+	// Operation is the thing being stopped, e.g. "lima" or "qemu".
+	Operation string `json:"operation"`
+	// Waited is how long the stage waited before giving up.
+	Waited    string               `json:"waited"`
+	Processes []ProcessDiagnostics `json:"processes"`
+}
+
+// ProcessDiagnostics describes a single process that did not exit in time.
+type ProcessDiagnostics struct {
+	Pid         int      `json:"pid"`
+	Executable  string   `json:"executable"`
+	CommandLine []string `json:"commandLine,omitempty"`
+	// OpenFiles is the number of open files, if available on this platform.
+	OpenFiles *int `json:"openFiles,omitempty"`
+}
+
+// Diagnostics makes shutdown record information about any processes it has to
+// force-kill into a log file in the given directory (normally the application
+// logs directory), to help debug shutdowns that hang.
+func Diagnostics(dir string) Option {
+	return func(s *shutdownData) {
+		s.diagnosticsDir = dir
+	}
+}
+
+// setStageExecutable records the executable of the processes stopped by the
+// given operation, so that diagnostics can find them.
+func (s *shutdownData) setStageExecutable(operation, executable string) {
+	if s.stageExecutables == nil {
+		s.stageExecutables = make(map[string]string)
+	}
+	s.stageExecutables[operation] = executable
+}
+
+// writeDiagnostics appends diagnostics about the processes still running for
+// the given operation to the diagnostics log, if enabled.
+func (s *shutdownData) writeDiagnostics(operation string, waited time.Duration) error {
+	if s.diagnosticsDir == "" {
+		return nil
+	}
+	diagnostics := StageDiagnostics{
+		Time:      s.clock.Now(),
+		Operation: operation,
+		Waited:    waited.String(),
+		Processes: []ProcessDiagnostics{},
+	}
+	if executable := s.stageExecutables[operation]; executable != "" {
+		pids, err := s.processes.FindPids(executable)
+		if err != nil {
+			return fmt.Errorf("failed to find %s processes: %w", operation, err)
+		}
+		for _, pid := range pids {
+			process := ProcessDiagnostics{Pid: pid, Executable: executable}
+			// Collect what we can; the process may be in a bad state.
+			if args, err := s.processes.CommandLine(pid); err == nil {
+				process.CommandLine = args
+			}
+			if count, err := s.processes.OpenFiles(pid); err == nil {
+				process.OpenFiles = &count
+			}
+			diagnostics.Processes = append(diagnostics.Processes, process)
+		}
+	}
+	data, err := json.Marshal(diagnostics)
+	if err != nil {
+		return fmt.Errorf("failed to encode diagnostics: %w", err)
+	}
+	if err = os.MkdirAll(s.diagnosticsDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create diagnostics directory: %w", err)
+	}
+	path := filepath.Join(s.diagnosticsDir, diagnosticsFileName)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open diagnostics file: %w", err)
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write diagnostics to %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// SaveLimaLogs makes factory reset copy the log files of the lima instance into
+// the given directory before deleting the instance, so that whatever made the
+// user reset can still be diagnosed.
+func SaveLimaLogs(dir string) Option {
+	return func(s *shutdownData) {
+		s.limaLogsDir = dir
+	}
+}
+
+// saveLimaLogs copies the log files (e.g. ha.stderr.log, serial.log) of the
+// lima instance in the given LIMA_HOME into the lima logs directory, prefixed
+// with "lima.".  This is best effort; any errors are returned for logging.
+func (s *shutdownData) saveLimaLogs(limaHome string) error {
+	if s.limaLogsDir == "" || limaHome == "" {
+		return nil
+	}
+	logs, err := filepath.Glob(filepath.Join(limaHome, limaInstance, "*.log"))
+	if err != nil || len(logs) == 0 {
+		return err
+	}
+	if err := os.MkdirAll(s.limaLogsDir, 0o755); err != nil {
+		return err
+	}
+	var errs *multierror.Error
+	for _, log := range logs {
+		dest := filepath.Join(s.limaLogsDir, "lima."+filepath.Base(log))
+		logrus.Debugf("Saving %s to %s", log, dest)
+		errs = multierror.Append(errs, copyFile(log, dest))
+	}
+	return errs.ErrorOrNil()
+}
+
+// copyFile copies the contents of the file src to dest, replacing it.
+func copyFile(src, dest string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, input); err != nil {
+		_ = output.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return output.Close()
+}
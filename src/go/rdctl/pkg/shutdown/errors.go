@@ -0,0 +1,36 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"errors"
+)
+
+// Errors returned (wrapped) by FinishShutdown and related functions, so that
+// callers can use errors.Is to tell what went wrong.
+var (
+	ErrQemuNotFound             = errors.New("failed to find qemu executable")
+	ErrAppDirNotFound           = errors.New("failed to find application directory")
+	ErrMainExecutableNotFound   = errors.New("failed to get Rancher Desktop executable")
+	ErrUnknownInitiatingCommand = errors.New("unknown shutdown initiating command")
+	ErrPreShutdownHookFailed    = errors.New("pre-shutdown hook failed")
+	ErrLimaNotSetUp             = errors.New("lima has never been set up")
+	ErrInsufficientPrivileges   = errors.New("insufficient privileges")
+	ErrProcessReplaced          = errors.New("process was replaced")
+	ErrUnsafePid                = errors.New("refusing to signal critical process")
+	ErrInvalidLimactlArgs       = errors.New("invalid extra limactl arguments")
+)
@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPreShutdownHookTimeout is how long a pre-shutdown hook may normally
+// run before it is killed.
+const DefaultPreShutdownHookTimeout = time.Minute
+
+// preShutdownHook is a user-defined command to run before stopping the VM.
+type preShutdownHook struct {
+	path    string
+	timeout time.Duration
+	strict  bool
+}
+
+// PreShutdownHook runs the executable at the given path before stopping lima,
+// for user-defined cleanup.  It is killed if it takes longer than the timeout.
+// If it fails, the error is logged and shutdown continues, unless strict is
+// set, in which case shutdown is aborted.
+func PreShutdownHook(path string, timeout time.Duration, strict bool) Option {
+	return func(s *shutdownData) {
+		s.hook = preShutdownHook{path: path, timeout: timeout, strict: strict}
+	}
+}
+
+// runPreShutdownHook runs the pre-shutdown hook, if there is one.
+func (s *shutdownData) runPreShutdownHook(ctx context.Context) error {
+	if s.hook.path == "" {
+		return nil
+	}
+	s.stage = "the pre-shutdown hook"
+	timeout := s.hook.timeout
+	if timeout <= 0 {
+		timeout = DefaultPreShutdownHookTimeout
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(hookCtx, s.hook.path)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait forever for any children of the hook holding the output open.
+	cmd.WaitDelay = time.Second
+	err := s.runner.Run(cmd)
+	log := logrus.WithField("hook", s.hook.path)
+	if output.Len() > 0 {
+		log.Infof("Pre-shutdown hook output:\n%s", strings.TrimRight(output.String(), "\n"))
+	}
+	if err == nil {
+		return nil
+	}
+	if errors.Is(hookCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	err = fmt.Errorf("%w: %w", ErrPreShutdownHookFailed, err)
+	if s.hook.strict {
+		return err
+	}
+	log.Errorf("Ignoring error: %s", err)
+	return nil
+}
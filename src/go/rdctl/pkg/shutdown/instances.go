@@ -0,0 +1,89 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limaInstances returns the names of all lima instances in LIMA_HOME.  Rancher
+// Desktop normally only has the one named by limaInstance, but others may have
+// been left behind (e.g. by an interrupted upgrade) and would otherwise keep
+// running after shutdown.
+func (s *shutdownData) limaInstances(ctx context.Context) ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := s.limactlCmd(ctx, "ls", "--format", "{{.Name}}")
+	cmd.Stderr = &stderr
+	result, err := s.runner.Output(cmd)
+	if err != nil {
+		return nil, limactlError(cmd, err, &stderr)
+	}
+	return strings.Fields(string(result)), nil
+}
+
+// limaInstanceExists reports whether the lima instance has been created.  If
+// the instances can't be listed, it is assumed to exist, so that stopping it is
+// still attempted.
+func (s *shutdownData) limaInstanceExists(ctx context.Context) bool {
+	instances, err := s.limaInstances(ctx)
+	if err != nil {
+		logrus.Debugf("Assuming lima instance %s exists; failed to list instances: %s", limaInstance, err)
+		return true
+	}
+	return slices.Contains(instances, limaInstance)
+}
+
+// finishOtherLimaInstances stops (or, on factory reset, deletes) every lima
+// instance other than the main one, which the caller handles.  Errors are
+// logged, and only returned in strict mode.
+func (s *shutdownData) finishOtherLimaInstances(ctx context.Context, initiatingCommand InitiatingCommand) {
+	instances, err := s.limaInstances(ctx)
+	if err != nil {
+		logrus.Errorf("Ignoring error trying to list lima instances: %s", err)
+		return
+	}
+	for _, instance := range instances {
+		if instance == limaInstance {
+			continue
+		}
+		args := []string{"stop"}
+		if initiatingCommand == FactoryReset && !s.keepVM {
+			if s.keepDisk {
+				args = []string{"stop", "--force"}
+			} else {
+				args = []string{"delete", "--force"}
+			}
+		}
+		args = s.limactlCommand(instance, args...)
+		check := func() (bool, error) {
+			return s.limaInstanceRunning(ctx, instance)
+		}
+		kill := func(ctx context.Context) error {
+			return s.runLimactl(ctx, args...)
+		}
+		operation := fmt.Sprintf("lima instance %s", instance)
+		if err := s.runStage(ctx, check, kill, 15, 2, operation); err != nil {
+			s.stopFailed(fmt.Sprintf("%s %s", args[0], operation), err)
+		}
+	}
+}
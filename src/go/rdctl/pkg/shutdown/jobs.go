@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jobAPI abstracts Windows job objects, so that tests can use fakes.
+type jobAPI interface {
+	// ProcessTree returns the given process followed by all its descendants.
+	ProcessTree(pid int) ([]int, error)
+	// CreateJob creates a new, empty job object.
+	CreateJob() (jobObject, error)
+}
+
+// jobObject is a set of processes that can be terminated together.
+type jobObject interface {
+	Assign(pid int) error
+	Terminate() error
+	Close() error
+}
+
+// terminateTreesInJob kills the given processes and all of their descendants
+// at once, by assigning them all to a new job object and terminating the job.
+// This way no child process can outlive the app, or be orphaned and keep
+// running because its parent died first.
+func (s *shutdownData) terminateTreesInJob(pids []int) error {
+	job, err := s.jobs.CreateJob()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := job.Close(); err != nil {
+			logrus.Debugf("Ignoring error closing job: %s", err)
+		}
+	}()
+
+	seen := make(map[int]bool)
+	assigned := 0
+	for _, pid := range pids {
+		tree, err := s.jobs.ProcessTree(pid)
+		if err != nil {
+			return fmt.Errorf("failed to list descendants of process %d: %w", pid, err)
+		}
+		for _, member := range tree {
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+			if err := checkSafePid(member); err != nil {
+				// rdctl itself may be a descendant of the app.
+				logrus.Debugf("Not terminating process %d with the app: %s", member, err)
+				continue
+			}
+			if err := job.Assign(member); err != nil {
+				// The process may have exited in the meantime.
+				logrus.Debugf("Failed to add process %d to job: %s", member, err)
+				continue
+			}
+			assigned++
+		}
+	}
+	if assigned == 0 {
+		return errors.New("no processes could be added to the job")
+	}
+	logrus.Infof("Forcibly terminating %d Rancher Desktop processes", assigned)
+	return job.Terminate()
+}
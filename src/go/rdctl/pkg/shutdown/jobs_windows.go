@@ -0,0 +1,32 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/process"
+)
+
+// hostJobAPI is the jobAPI for the real job objects on this machine.
+type hostJobAPI struct{}
+
+func (hostJobAPI) ProcessTree(pid int) ([]int, error) {
+	return process.GetProcessTree(pid)
+}
+
+func (hostJobAPI) CreateJob() (jobObject, error) {
+	return process.CreateJob()
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limaHostAgentLog is the log of the lima host agent, in the instance
+// directory.
+const limaHostAgentLog = "ha.stderr.log"
+
+// logTail follows a log file as it is being written, passing each new line to
+// emit.
+type logTail struct {
+	path string
+	emit func(string)
+	// offset is how much of the file has been read.
+	offset int64
+	// partial is the start of a line that has not been completely written.
+	partial string
+	// stopped is set once the file is no longer followed.
+	stopped bool
+}
+
+// newLogTail starts following the given log file from its current end; what
+// has already been written is skipped.  The file need not exist yet.
+func newLogTail(path string, emit func(string)) *logTail {
+	t := &logTail{path: path, emit: emit}
+	if info, err := os.Stat(path); err == nil {
+		t.offset = info.Size()
+	}
+	return t
+}
+
+// poll emits the lines written since the last poll.  Errors are only logged,
+// as the log is just for troubleshooting.
+func (t *logTail) poll() {
+	if t.stopped {
+		return
+	}
+	file, err := os.Open(t.path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logrus.Debugf("Failed to read %s: %s", t.path, err)
+		}
+		return
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() < t.offset {
+		// The log was truncated or replaced; start from the beginning.
+		t.offset = 0
+		t.partial = ""
+	}
+	if _, err = file.Seek(t.offset, io.SeekStart); err != nil {
+		logrus.Debugf("Failed to read %s: %s", t.path, err)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		logrus.Debugf("Failed to read %s: %s", t.path, err)
+	}
+	t.offset += int64(len(data))
+	lines := strings.Split(t.partial+string(data), "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		t.emit(strings.TrimSuffix(line, "\r"))
+	}
+}
+
+// stop emits the rest of the log, including any incomplete last line, and
+// stops following it.
+func (t *logTail) stop() {
+	t.poll()
+	if !t.stopped && t.partial != "" {
+		t.emit(t.partial)
+	}
+	t.stopped = true
+}
+
+// following wraps a check for whether lima is running, polling the log along
+// with each check until lima is no longer running.
+func (t *logTail) following(check func() (bool, error)) func() (bool, error) {
+	return func() (bool, error) {
+		running, err := check()
+		if err == nil && !running {
+			t.stop()
+		} else {
+			t.poll()
+		}
+		return running, err
+	}
+}
+
+// limaLogTail returns a logTail following the lima host agent log, writing its
+// lines to the debug log; it returns nil if the log is not being tailed.
+func (s *shutdownData) limaLogTail() *logTail {
+	if !s.tailLimaLog {
+		return nil
+	}
+	if s.limaHome == "" {
+		logrus.Debugf("Not following the lima log: LIMA_HOME is not known")
+		return nil
+	}
+	return newLogTail(filepath.Join(s.limaHome, limaInstance, limaHostAgentLog), func(line string) {
+		logrus.Debugf("lima host agent: %s", line)
+	})
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limaSnapshotTag is the tag of the lima snapshot taken before factory reset
+// deletes the VM.
+const limaSnapshotTag = "rancher-desktop-factory-reset"
+
+// SnapshotLima makes factory reset archive the lima instance into the given
+// directory before deleting it, so that it can be recovered if the reset turns
+// out to have been a mistake.  If required is set, failing to do so fails the
+// factory reset (before anything is deleted); otherwise, the error is logged.
+func SnapshotLima(dir string, required bool) Option {
+	return func(s *shutdownData) {
+		s.limaSnapshotDir = dir
+		s.limaSnapshotRequired = required
+	}
+}
+
+// snapshotLima stops the lima VM, and archives the lima instance in the given
+// LIMA_HOME into the lima snapshot directory.  Where the VM supports it, a lima
+// snapshot is taken first, so that the archived disk carries a restore point
+// for `limactl snapshot apply`; this is best effort, as the archive has all the
+// state anyway.
+func (s *shutdownData) snapshotLima(ctx context.Context, limaHome string) error {
+	if limaHome == "" {
+		return errors.New("LIMA_HOME is not set")
+	}
+	// The disk can't be copied consistently while the VM is using it.
+	if err := s.runStage(ctx, s.checkLimaFunc(ctx), s.stopLimaWithForce, 15, 2, "lima"); err != nil {
+		return fmt.Errorf("failed to stop lima: %w", err)
+	}
+	if err := s.runLimactl(ctx, "snapshot", "create", limaInstance, "--tag", limaSnapshotTag); err != nil {
+		logrus.Debugf("Not taking a lima snapshot: %s", err)
+	}
+	if err := os.MkdirAll(s.limaSnapshotDir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("lima-%s-%s.tar", limaInstance, s.clock.Now().Format("20060102-150405"))
+	dest := filepath.Join(s.limaSnapshotDir, name)
+	logrus.Infof("Saving the lima instance to %s", dest)
+	if err := archiveDir(filepath.Join(limaHome, limaInstance), dest); err != nil {
+		_ = os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// archiveDir writes a tar archive of the directory src to the file dest; the
+// entries are named relative to the parent of src.  Sockets and other special
+// files can't be archived, and are skipped.
+func archiveDir(src, dest string) error {
+	output, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	writer := tar.NewWriter(output)
+	err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular() && !info.IsDir():
+			logrus.Debugf("Not archiving %s: not a regular file", path)
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(src), path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err = writer.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		input, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		if _, err = io.Copy(writer, input); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+		return nil
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
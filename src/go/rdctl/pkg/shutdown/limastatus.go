@@ -0,0 +1,103 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limaDetailsFormat asks limactl for the status of the instance, and the pids
+// of its host agent and of the driver running the VM; lima reports a pid of 0
+// for one that is not running.
+const limaDetailsFormat = "{{.Status}}\t{{.HostAgentPID}}\t{{.DriverPID}}"
+
+// LimaStatus is the status of the lima VM, broken down into its parts.  The
+// host agent can outlive the VM (or the other way around), in which case lima
+// can neither start nor stop the VM.
+type LimaStatus struct {
+	// Status is the status reported by limactl, e.g. "Running" or "Stopped".
+	Status string `json:"status"`
+	// HostAgentRunning is whether the lima host agent is running.
+	HostAgentRunning bool `json:"hostAgentRunning"`
+	// VMRunning is whether the driver running the VM is running.
+	VMRunning bool `json:"vmRunning"`
+}
+
+// Stopped reports whether both the VM and the host agent are gone.
+func (status LimaStatus) Stopped() bool {
+	return !status.HostAgentRunning && !status.VMRunning
+}
+
+func (status LimaStatus) String() string {
+	switch {
+	case status.HostAgentRunning && !status.VMRunning:
+		return "VM down but hostagent still running"
+	case !status.HostAgentRunning && status.VMRunning:
+		return "hostagent down but VM still running"
+	}
+	return status.Status
+}
+
+// parseLimaDetails parses the output of `limactl ls` with limaDetailsFormat.
+func parseLimaDetails(output string) (LimaStatus, error) {
+	fields := strings.Split(strings.TrimSpace(output), "\t")
+	if len(fields) != 3 {
+		return LimaStatus{}, fmt.Errorf("expected 3 fields in lima status, got %q", output)
+	}
+	status := LimaStatus{Status: fields[0]}
+	for i, running := range []*bool{&status.HostAgentRunning, &status.VMRunning} {
+		pid, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return LimaStatus{}, fmt.Errorf("failed to parse pid in lima status %q: %w", output, err)
+		}
+		*running = pid > 0
+	}
+	return status, nil
+}
+
+// limaDetails returns the status of the lima VM and its host agent.
+func (s *shutdownData) limaDetails(ctx context.Context) (LimaStatus, error) {
+	var stderr bytes.Buffer
+	cmd := s.limactlCmd(ctx, "ls", "--format", limaDetailsFormat, limaInstance)
+	cmd.Stderr = &stderr
+	output, err := s.runner.Output(cmd)
+	if err != nil {
+		return LimaStatus{}, limactlError(cmd, err, &stderr)
+	}
+	return parseLimaDetails(string(output))
+}
+
+// verifyLimaStopped checks that lima has stopped completely once it reports
+// the VM as stopped, recording what it found in the report.  Anything left
+// running is only logged, as nothing more can be done through limactl.
+func (s *shutdownData) verifyLimaStopped(ctx context.Context) {
+	status, err := s.limaDetails(ctx)
+	if err != nil {
+		logrus.Errorf("Ignoring error checking that lima has stopped: %s", err)
+		return
+	}
+	s.report.LimaAfterStop = &status
+	if !status.Stopped() {
+		logrus.Warnf("Lima did not stop completely: %s", status)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limaStopTimeoutVersion is the oldest limactl known to support
+// `limactl stop --timeout`; older ones reject the flag.
+var limaStopTimeoutVersion = [3]int{2, 0, 0}
+
+// limaVersionPattern extracts the version from `limactl --version`, which
+// prints e.g. "limactl version 1.0.3".
+var limaVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// parseLimaVersion returns the major, minor and patch version numbers in the
+// output of `limactl --version`.
+func parseLimaVersion(output string) ([3]int, error) {
+	var version [3]int
+	match := limaVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return version, fmt.Errorf("failed to find a version in %q", output)
+	}
+	for i := range version {
+		var err error
+		if version[i], err = strconv.Atoi(match[i+1]); err != nil {
+			return version, fmt.Errorf("failed to parse version %q: %w", match[0], err)
+		}
+	}
+	return version, nil
+}
+
+// limaVersionAtLeast checks if the given version is the same as, or newer
+// than, the minimum version.
+func limaVersionAtLeast(version, minimum [3]int) bool {
+	for i := range version {
+		if version[i] != minimum[i] {
+			return version[i] > minimum[i]
+		}
+	}
+	return true
+}
+
+// limaStopSupportsTimeout checks if limactl accepts `stop --timeout`.  If the
+// version of limactl can't be determined, it is assumed not to.
+func (s *shutdownData) limaStopSupportsTimeout() bool {
+	var stderr bytes.Buffer
+	cmd := s.limactlCmd(context.Background(), "--version")
+	cmd.Stderr = &stderr
+	output, err := s.runner.Output(cmd)
+	if err != nil {
+		logrus.Debugf("Not passing a timeout to limactl stop: %s", limactlError(cmd, err, &stderr))
+		return false
+	}
+	version, err := parseLimaVersion(string(output))
+	if err != nil {
+		logrus.Debugf("Not passing a timeout to limactl stop: %s", err)
+		return false
+	}
+	return limaVersionAtLeast(version, limaStopTimeoutVersion)
+}
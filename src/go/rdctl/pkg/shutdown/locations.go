@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
+	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// appLocations looks up where Rancher Desktop is installed.  Successful lookups
+// are cached, so that they are done at most once per shutdown, and every stage
+// sees the same result.
+type appLocations struct {
+	getApplicationDirectory func(context.Context) (string, error)
+	getMainExecutable       func(context.Context) (string, error)
+	applicationDirectory    string
+	mainExecutable          string
+	// mainExecutableMissing is set if the main executable does not exist on
+	// disk, e.g. because an upgrade renamed it while the app was running.
+	mainExecutableMissing bool
+}
+
+func newAppLocations() *appLocations {
+	return &appLocations{
+		getApplicationDirectory: directories.GetApplicationDirectory,
+		getMainExecutable:       p.GetMainExecutable,
+	}
+}
+
+// ApplicationDirectory returns the installation directory of the application.
+func (l *appLocations) ApplicationDirectory(ctx context.Context) (string, error) {
+	if l.applicationDirectory == "" {
+		dir, err := l.getApplicationDirectory(ctx)
+		if err != nil {
+			return "", err
+		}
+		l.applicationDirectory = dir
+	}
+	return l.applicationDirectory, nil
+}
+
+// MainExecutable returns the path to the main Rancher Desktop executable.  If
+// that does not exist, a warning is logged: processes still running it can't
+// be found by its path.
+func (l *appLocations) MainExecutable(ctx context.Context) (string, error) {
+	if l.mainExecutable == "" {
+		exe, err := l.getMainExecutable(ctx)
+		if err != nil {
+			return "", err
+		}
+		l.mainExecutable = exe
+		if _, err = os.Stat(exe); errors.Is(err, fs.ErrNotExist) {
+			logrus.Warnf("The Rancher Desktop executable %s does not exist; if it was moved while running, it may not be stopped", exe)
+			l.mainExecutableMissing = true
+		}
+	}
+	return l.mainExecutable, nil
+}
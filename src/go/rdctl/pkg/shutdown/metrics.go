@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"maps"
+	"sync"
+)
+
+// ForceKillCounter counts how often each shutdown stage had to force-kill what
+// it was stopping, rather than it exiting by itself.  This is purely local; it
+// is up to the caller to do anything with the counts.  A nil counter ignores
+// all increments.
+type ForceKillCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// CountForceKills makes shutdown increment the given counter whenever a stage
+// escalates to force-killing.
+func CountForceKills(counter *ForceKillCounter) Option {
+	return func(s *shutdownData) {
+		s.forceKills = counter
+	}
+}
+
+// Increment records a force-kill for the given operation (e.g. "qemu").
+func (c *ForceKillCounter) Increment(operation string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[operation]++
+}
+
+// Counts returns the number of force-kills for each operation.
+func (c *ForceKillCounter) Counts() map[string]int {
+	result := make(map[string]int)
+	if c == nil {
+		return result
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	maps.Copy(result, c.counts)
+	return result
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+)
+
+// KilledProcesses describes what KillOrphans did.
+type KilledProcesses struct {
+	// LimaStopped is set if lima was running and was force-stopped.
+	LimaStopped bool `json:"limaStopped"`
+	// Qemu lists the pids of the qemu processes that were killed.
+	Qemu []int `json:"qemu"`
+	// App lists the pids of the main application processes that were
+	// terminated; it is empty if terminating the application failed.
+	App []int `json:"app"`
+}
+
+// KillOrphans forcibly stops any Rancher Desktop processes, without waiting for
+// them to exit gracefully.  This is intended to recover from a crash that left
+// processes running with no way to quit them.  Failures in one stage do not
+// prevent later stages from running.
+func KillOrphans(ctx context.Context) (*KilledProcesses, error) {
+	s := newShutdownData(false)
+	if runtime.GOOS == "windows" {
+		return s.killOrphanedApp(ctx)
+	}
+	var errs *multierror.Error
+	limaFound := false
+	if limactl, err := s.findLimactl(); err != nil {
+		errs = multierror.Append(errs, err)
+	} else {
+		s.limactl = limactl
+		limaFound = true
+	}
+	qemuExecutable, err := s.findQemu()
+	if err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("%w: %w", ErrQemuNotFound, err))
+	}
+	result, err := s.killOrphans(ctx, limaFound, qemuExecutable)
+	errs = multierror.Append(errs, err)
+	return result, errs.ErrorOrNil()
+}
+
+// killOrphans implements KillOrphans; lima is skipped if not found, as is qemu
+// if its executable is not known, and the app if it is to be skipped.
+func (s *shutdownData) killOrphans(ctx context.Context, limaFound bool, qemuExecutable string) (*KilledProcesses, error) {
+	var errs *multierror.Error
+	result := &KilledProcesses{Qemu: []int{}, App: []int{}}
+
+	if limaFound {
+		if running, err := s.checkLima(ctx); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to check lima: %w", err))
+		} else if running {
+			if err = s.stopLimaWithForce(ctx); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("failed to force-stop lima: %w", err))
+			} else {
+				result.LimaStopped = true
+			}
+		}
+	}
+
+	if qemuExecutable != "" {
+		pids, err := s.limaQemuPids(qemuExecutable)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to find qemu processes: %w", err))
+		}
+		for _, pid := range pids {
+			logrus.Debugf("Killing qemu process %d", pid)
+			if err = s.signal(pid, syscall.SIGKILL); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("failed to kill qemu process %d: %w", pid, err))
+			} else {
+				result.Qemu = append(result.Qemu, pid)
+			}
+		}
+	}
+
+	if s.skipApp {
+		return result, errs.ErrorOrNil()
+	}
+	appDir, err := s.locations.ApplicationDirectory(ctx)
+	if err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("%w: %w", ErrAppDirNotFound, err))
+		return result, errs.ErrorOrNil()
+	}
+	var appPids []int
+	if mainExecutable, err := s.locations.MainExecutable(ctx); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("%w: %w", ErrMainExecutableNotFound, err))
+	} else if appPids, err = s.processes.FindPids(mainExecutable); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to find application processes: %w", err))
+	}
+	if err = s.terminateRancherDesktopFunc(appDir, true)(ctx); err != nil {
+		errs = multierror.Append(errs, err)
+	} else {
+		result.App = append(result.App, appPids...)
+	}
+
+	return result, errs.ErrorOrNil()
+}
+
+// killOrphanedApp forcibly terminates the application, which is all there is
+// to kill on Windows; only the pids of main processes that were terminated are
+// reported.
+func (s *shutdownData) killOrphanedApp(ctx context.Context) (*KilledProcesses, error) {
+	result := &KilledProcesses{Qemu: []int{}, App: []int{}}
+	if s.skipApp {
+		return result, nil
+	}
+	var errs *multierror.Error
+	pids, err := s.forceKillAppPids(ctx)
+	result.App = append(result.App, pids...)
+	errs = multierror.Append(errs, err)
+	// Helpers left behind once the app itself has gone can't be found from
+	// it; terminate anything else running from the application directory.
+	errs = multierror.Append(errs, s.killWindowsApp(ctx))
+	return result, errs.ErrorOrNil()
+}
+
+// killRemainingProcesses implements KillRemaining: it kills whatever the
+// shutdown that has just finished left running, in the same way KillOrphans
+// does.  Stages that were skipped are left alone.
+func (s *shutdownData) killRemainingProcesses(ctx context.Context) (*KilledProcesses, error) {
+	if runtime.GOOS == "windows" {
+		return s.killOrphanedApp(ctx)
+	}
+	var errs *multierror.Error
+	qemuExecutable := ""
+	if !s.skipQemu {
+		var err error
+		if qemuExecutable, err = s.findQemu(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%w: %w", ErrQemuNotFound, err))
+		}
+	}
+	// On factory reset, the instance has normally been deleted by now.
+	limaFound := s.limactl != "" && !s.skipLima && s.limaInstanceExists(ctx)
+	result, err := s.killOrphans(ctx, limaFound, qemuExecutable)
+	errs = multierror.Append(errs, err)
+	return result, errs.ErrorOrNil()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"runtime"
+	"strings"
+)
+
+// PlanAction is what shutdown would do to a stage.
+type PlanAction string
+
+const (
+	// PlanSkip means the stage has been disabled.
+	PlanSkip PlanAction = "skip"
+	// PlanNothing means there is nothing running to stop.
+	PlanNothing PlanAction = "nothing"
+	// PlanStop means it would only be asked to stop (see AskOnly).
+	PlanStop PlanAction = "graceful stop"
+	// PlanStopOrForce means it would be asked to stop, and force-stopped if
+	// it does not.
+	PlanStopOrForce PlanAction = "graceful stop, then force"
+)
+
+// PlanStatus is the state of a stage when the plan was made.
+type PlanStatus string
+
+const (
+	PlanRunning PlanStatus = "running"
+	PlanStopped PlanStatus = "stopped"
+	// PlanUnknown means the state could not be determined; shutdown would
+	// try to stop it anyway.
+	PlanUnknown PlanStatus = "unknown"
+)
+
+// PlanStep describes what shutdown would do to one stage.
+type PlanStep struct {
+	// Stage is the thing to be stopped, e.g. "lima" or "qemu".
+	Stage  string     `json:"stage"`
+	Status PlanStatus `json:"status"`
+	Action PlanAction `json:"action"`
+}
+
+// PlanShutdown lists, in order, the stages a shutdown with the given config
+// would go through, along with what each would do given what is currently
+// running.  Nothing is changed.
+func PlanShutdown(ctx context.Context, config Config) ([]PlanStep, error) {
+	status, err := GetStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newShutdownData(config.WaitForShutdown, config.options()...).plan(status), nil
+}
+
+// plan implements PlanShutdown, given the current status.
+func (s *shutdownData) plan(status *Status) []PlanStep {
+	var steps []PlanStep
+	if runtime.GOOS != "windows" {
+		limaStatus := PlanUnknown
+		if status.Lima != "" {
+			limaStatus = planStatus(strings.HasPrefix(status.Lima, "Running"))
+		}
+		steps = append(steps,
+			s.planStep("lima", limaStatus, s.skipLima),
+			s.planStep("qemu", planStatus(len(status.Qemu) > 0), s.skipQemu))
+	}
+	return append(steps, s.planStep("the app", planStatus(len(status.App) > 0), s.skipApp))
+}
+
+func (s *shutdownData) planStep(stage string, status PlanStatus, skip bool) PlanStep {
+	step := PlanStep{Stage: stage, Status: status}
+	switch {
+	case skip:
+		step.Action = PlanSkip
+	case status == PlanStopped:
+		step.Action = PlanNothing
+	case s.askOnly:
+		step.Action = PlanStop
+	default:
+		step.Action = PlanStopOrForce
+	}
+	return step
+}
+
+func planStatus(running bool) PlanStatus {
+	if running {
+		return PlanRunning
+	}
+	return PlanStopped
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/process"
+)
+
+// processTable abstracts the host processes, so that tests can use fakes.
+type processTable interface {
+	// FindPid returns the pid of some process running the given executable, or
+	// 0 if there is none.  It gives up once the context is done.
+	FindPid(ctx context.Context, executable string) (int, error)
+	// FindPids returns the pids of all processes running the given executable.
+	FindPids(executable string) ([]int, error)
+	// FindPidsNamed returns the pids of all processes running an executable
+	// with the given file name, wherever it is.
+	FindPidsNamed(name string) ([]int, error)
+	// Executable returns the path to the executable of the given process.
+	Executable(pid int) (string, error)
+	// CommandLine returns the arguments of the given process.
+	CommandLine(pid int) ([]string, error)
+	// Signal sends a signal to the given process.
+	Signal(pid int, signal os.Signal) error
+	// Zombie checks if the given process has exited, but has not been reaped.
+	Zombie(pid int) (bool, error)
+	// OpenFiles returns the number of files the given process has open.
+	OpenFiles(pid int) (int, error)
+	// ProcessGroup returns the process group id of the given process.
+	ProcessGroup(pid int) (int, error)
+	// KillProcessGroup terminates the process group of the given process.
+	KillProcessGroup(pid int) error
+	// FileHolders returns the pids of the processes using files in the given
+	// directory.
+	FileHolders(dir string) ([]int, error)
+	// TerminateInDirectory terminates all processes whose executables are in
+	// the given directory; if force is set, they are killed forcibly.
+	TerminateInDirectory(dir string, force bool) error
+}
+
+// checkSafePid returns ErrUnsafePid if signalling the given process could be
+// catastrophic: pid 1 (init), rdctl itself, or a pid that is not a single
+// process (zero or negative pids signal whole process groups).
+func checkSafePid(pid int) error {
+	if pid <= 1 || pid == os.Getpid() {
+		return fmt.Errorf("%w %d", ErrUnsafePid, pid)
+	}
+	return nil
+}
+
+// signal sends the given signal to the given process, unless checkSafePid
+// refuses to.
+func (s *shutdownData) signal(pid int, signal os.Signal) error {
+	if err := checkSafePid(pid); err != nil {
+		return err
+	}
+	return s.processes.Signal(pid, signal)
+}
+
+// hostProcessTable is the processTable for the real processes on this machine.
+type hostProcessTable struct{}
+
+func (hostProcessTable) FindPid(ctx context.Context, executable string) (int, error) {
+	return process.FindPidOfProcessContext(ctx, executable)
+}
+
+func (hostProcessTable) FindPids(executable string) ([]int, error) {
+	return process.FindPidsOfProcess(executable)
+}
+
+func (hostProcessTable) FindPidsNamed(name string) ([]int, error) {
+	return process.FindPidsByName(name)
+}
+
+func (hostProcessTable) Executable(pid int) (string, error) {
+	return process.GetExecutable(pid)
+}
+
+func (hostProcessTable) CommandLine(pid int) ([]string, error) {
+	return process.GetCommandLine(pid)
+}
+
+func (hostProcessTable) Signal(pid int, signal os.Signal) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process for pid %d: %w", pid, err)
+	}
+	return proc.Signal(signal)
+}
+
+func (hostProcessTable) Zombie(pid int) (bool, error) {
+	return process.IsZombie(pid)
+}
+
+func (hostProcessTable) OpenFiles(pid int) (int, error) {
+	return process.CountOpenFiles(pid)
+}
+
+func (hostProcessTable) ProcessGroup(pid int) (int, error) {
+	return process.GetProcessGroup(pid)
+}
+
+func (hostProcessTable) KillProcessGroup(pid int) error {
+	return process.KillProcessGroup(pid, false)
+}
+
+func (hostProcessTable) FileHolders(dir string) ([]int, error) {
+	holders, err := process.FindFileHolders(dir)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(holders))
+	for _, holder := range holders {
+		pids = append(pids, holder.Pid)
+	}
+	return pids, nil
+}
+
+func (hostProcessTable) TerminateInDirectory(dir string, force bool) error {
+	return process.TerminateProcessInDirectory(dir, force)
+}
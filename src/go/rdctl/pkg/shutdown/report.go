@@ -0,0 +1,154 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"slices"
+	"time"
+)
+
+// StageOutcome describes how a shutdown stage finished.
+type StageOutcome string
+
+const (
+	// OutcomeAlreadyGone means the process was not running to begin with.
+	OutcomeAlreadyGone StageOutcome = "already-gone"
+	// OutcomeExited means the process exited by itself while we waited.
+	OutcomeExited StageOutcome = "exited"
+	// OutcomeForceKilled means the process had to be killed.
+	OutcomeForceKilled StageOutcome = "force-killed"
+	// OutcomeAsked means the process was only asked to stop (see AskOnly);
+	// whether it did was not checked.
+	OutcomeAsked StageOutcome = "asked"
+	// OutcomeError means we failed to check or kill the process.
+	OutcomeError StageOutcome = "error"
+)
+
+// StageReport describes the result of a single shutdown stage.
+type StageReport struct {
+	// Operation is the thing being stopped, e.g. "lima" or "qemu".
+	Operation string
+	Outcome   StageOutcome
+	// Elapsed is how long the stage took.
+	Elapsed time.Duration
+	// Err is the error from the stage, if any; it may have been ignored.
+	Err error
+}
+
+// LimaStopMethod describes how the lima VM was stopped.
+type LimaStopMethod string
+
+const (
+	// LimaAlreadyStopped means the VM was not running to begin with.
+	LimaAlreadyStopped LimaStopMethod = "already-stopped"
+	// LimaStoppedGracefully means `limactl stop` sufficed (or the VM stopped by
+	// itself).  With AskOnly, the VM is only asked to stop, which is also
+	// reported as this.
+	LimaStoppedGracefully LimaStopMethod = "graceful"
+	// LimaStoppedWithForce means `limactl stop --force` had to be used.
+	LimaStoppedWithForce LimaStopMethod = "forced"
+)
+
+// AppStopMethod describes how the main application was stopped.
+type AppStopMethod string
+
+const (
+	// AppAlreadyStopped means the app was not running to begin with.
+	AppAlreadyStopped AppStopMethod = "already-stopped"
+	// AppStoppedGracefully means the app exited by itself.  With AskOnly, the
+	// app is only asked to stop, which is also reported as this.
+	AppStoppedGracefully AppStopMethod = "graceful"
+	// AppStoppedWithForce means the app had to be killed.
+	AppStoppedWithForce AppStopMethod = "forced"
+)
+
+// ShutdownReport describes what FinishShutdown did, in order.
+type ShutdownReport struct {
+	Stages []StageReport
+	// LimaStop is how the lima VM was stopped; it is empty if it was not
+	// stopped by shutdown (e.g. on factory reset, if lima is not set up, or if
+	// force-stopping it failed).
+	LimaStop LimaStopMethod
+	// LimaAfterStop is what lima reported once the VM was stopped; it is nil
+	// if lima was not stopped, or could not be checked.
+	LimaAfterStop *LimaStatus
+	// AppStop is how the main application was stopped; it is empty if it was
+	// not stopped by shutdown (e.g. with SkipAppTermination, or if stopping it
+	// failed).
+	AppStop AppStopMethod
+	// Killed is what was killed after shutdown had finished; it is only set
+	// with KillRemaining.
+	Killed *KilledProcesses
+}
+
+// ForceKilled reports whether any stage had to force-kill what it was
+// stopping.
+func (r *ShutdownReport) ForceKilled() bool {
+	for _, stage := range r.Stages {
+		if stage.Outcome == OutcomeForceKilled {
+			return true
+		}
+	}
+	return false
+}
+
+// OnComplete calls the given function once shutdown has finished, with the
+// final report and the error (if any) that FinishShutdown returns.  This lets
+// a wrapper or the GUI know that teardown is done; a nil function is ignored.
+func OnComplete(callback func(*ShutdownReport, error)) Option {
+	return func(s *shutdownData) {
+		s.onComplete = callback
+	}
+}
+
+// stageResult is the outcome of waitForAppToDieOrKillIt.
+type stageResult struct {
+	outcome StageOutcome
+	elapsed time.Duration
+}
+
+// appStopMethod summarizes the outcomes of the stages stopping the app, in
+// order, as an AppStopMethod.
+func appStopMethod(outcomes ...StageOutcome) AppStopMethod {
+	if len(outcomes) == 0 || outcomes[len(outcomes)-1] == OutcomeError {
+		return ""
+	}
+	switch {
+	case slices.Contains(outcomes, OutcomeForceKilled):
+		return AppStoppedWithForce
+	case slices.Contains(outcomes, OutcomeAsked), slices.Contains(outcomes, OutcomeExited):
+		return AppStoppedGracefully
+	}
+	return AppAlreadyStopped
+}
+
+// lastOutcome returns the outcome of the most recent stage.
+func (r *ShutdownReport) lastOutcome() StageOutcome {
+	if len(r.Stages) == 0 {
+		return ""
+	}
+	return r.Stages[len(r.Stages)-1].Outcome
+}
+
+func (r *ShutdownReport) addStage(operation string, result stageResult, err error) {
+	r.Stages = append(r.Stages, StageReport{
+		Operation: operation,
+		Outcome:   result.outcome,
+		Elapsed:   result.elapsed,
+		Err:       err,
+	})
+}
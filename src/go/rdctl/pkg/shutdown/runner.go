@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"os"
+	"os/exec"
+)
+
+// commandRunner runs external commands (i.e. limactl), so that tests can use
+// fakes.
+type commandRunner interface {
+	// Run runs the command, passing through any input and output streams that
+	// have not already been set on it.
+	Run(cmd *exec.Cmd) error
+	// Output runs the command and returns its standard output.  Standard error
+	// is passed through unless already set on the command.
+	Output(cmd *exec.Cmd) ([]byte, error)
+}
+
+// execRunner is the commandRunner that actually runs commands.
+type execRunner struct{}
+
+func (execRunner) Run(cmd *exec.Cmd) error {
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd.Run()
+}
+
+func (execRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd.Output()
+}
+
+// tailBuffer is an io.Writer that only keeps the last limit bytes written to
+// it, so that the output of a command can be kept for logging without growing
+// without bound.  It is not safe for concurrent use, so the same tailBuffer
+// must be used for both the standard output and error of a command.
+type tailBuffer struct {
+	limit     int
+	data      []byte
+	truncated bool
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit, data: make([]byte, 0, limit)}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if excess := len(b.data) - b.limit; excess > 0 {
+		b.data = b.data[:copy(b.data, b.data[excess:])]
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the output kept, starting with "..." if anything was dropped.
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "..." + string(b.data)
+	}
+	return string(b.data)
+}
@@ -17,30 +17,166 @@ limitations under the License.
 package shutdown
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/factoryreset"
 	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
-	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/process"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
 
 type shutdownData struct {
+	// waitForShutdown makes shutdown wait for each process to exit before
+	// killing it forcibly; otherwise, each is killed without waiting.
 	waitForShutdown bool
+	// askOnly makes shutdown only ask each process to stop, once, without
+	// force-killing anything.
+	askOnly bool
+	// keepDisk causes factory reset to stop lima instead of deleting it.
+	keepDisk bool
+	// keepVM causes factory reset to stop lima gracefully, keeping the whole
+	// instance; it takes precedence over keepDisk.
+	keepVM bool
+	// gracefulGuest causes shutdown to ask the guest to power off before
+	// stopping lima from the host.
+	gracefulGuest bool
+	// cleanupSockets removes the sockets forwarded from the VM once it stops.
+	cleanupSockets bool
+	// killRemaining kills anything still running once shutdown has finished.
+	killRemaining bool
+	// skipLima, skipQemu and skipApp leave out the stages stopping lima, qemu,
+	// and the application itself.
+	skipLima bool
+	skipQemu bool
+	skipApp  bool
+	// strictErrors makes shutdown return errors stopping processes, rather
+	// than only logging them.
+	strictErrors bool
+	// errs collects the errors stopping processes, when strictErrors is set.
+	errs *multierror.Error
+	// hook is run before stopping lima.
+	hook preShutdownHook
+	// diagnosticsDir is where to write diagnostics about force-killed
+	// processes; if empty, none are written.
+	diagnosticsDir string
+	// limaLogsDir is where to save the lima logs before factory reset deletes
+	// the instance; if empty, they are not saved.
+	limaLogsDir string
+	// limaSnapshotDir is where to archive the lima instance before factory
+	// reset deletes it; if empty, it is not archived.
+	limaSnapshotDir string
+	// limaSnapshotRequired makes factory reset fail if the lima instance
+	// could not be archived.
+	limaSnapshotRequired bool
+	// stageExecutables maps each operation to the executable it stops, for
+	// diagnostics.
+	stageExecutables map[string]string
+	// forceKills counts stages that had to force-kill; it may be nil.
+	forceKills *ForceKillCounter
+	// onComplete is called with the report once shutdown has finished; it may
+	// be nil.
+	onComplete func(*ShutdownReport, error)
+	// guestConnectTimeout overrides the constant of the same name, if set.
+	guestConnectTimeout time.Duration
+	// pollJitter is the fraction by which poll intervals are randomly varied.
+	pollJitter float64
+	random     *rand.Rand
+	clock      clock
+	processes  processTable
+	jobs       jobAPI
+	runner     commandRunner
+	locations  *appLocations
+	report     *ShutdownReport
+	// limactl is the path to limactl, once it has been found.
+	limactl string
+	// findLimactl and findQemu locate the limactl and qemu executables.
+	findLimactl func() (string, error)
+	findQemu    func() (string, error)
+	// limaHome is the LIMA_HOME that limactl is run with; if set by LimaHome,
+	// it overrides the one findLimactl would otherwise set up.  It is kept
+	// here, rather than in the environment, so that concurrent shutdowns
+	// don't interfere with each other.
+	limaHome string
+	// limactlArgs are extra arguments for limactl when stopping or deleting
+	// an instance.
+	limactlArgs []string
+	// matchAppByName looks for the app by name if its executable is missing.
+	matchAppByName bool
+	// findInternalDir locates the directory with auxiliary executables.
+	findInternalDir func() (string, error)
+	// findHostSockets lists the sockets forwarded from the VM.
+	findHostSockets func() ([]string, error)
+	// privilegedHelper is the executable of the privileged helper, if any.
+	privilegedHelper string
+	// checkWindowsApp and killWindowsApp check for and stop the app on Windows.
+	checkWindowsApp func() (bool, error)
+	killWindowsApp  func(context.Context) error
+	// quitApp, if set, asks the app to quit before it is sent any signals.
+	quitApp func(context.Context) error
+	// tailLimaLog writes new lines of the lima host agent log to the debug log
+	// while waiting for lima to stop.
+	tailLimaLog bool
+	// stage is the operation currently being stopped, for error messages.
+	stage string
 }
 
+// Option customizes the behaviour of FinishShutdown.
+type Option func(*shutdownData)
+
+// KeepDisk makes a factory reset stop the VM rather than deleting it, leaving
+// the disk image in place.
+func KeepDisk(keep bool) Option {
+	return func(s *shutdownData) {
+		s.keepDisk = keep
+	}
+}
+
+// KeepVM makes a factory reset stop the VM gracefully rather than deleting it,
+// leaving the whole lima instance (not just its disk) in place.
+func KeepVM(keep bool) Option {
+	return func(s *shutdownData) {
+		s.keepVM = keep
+	}
+}
+
+// signalStep is a signal to send to a process, along with how long to wait for
+// it to exit before moving on to the next step.
+type signalStep struct {
+	signal os.Signal
+	wait   time.Duration
+}
+
+// auxiliaryExecutables are the names of helper executables (in the internal
+// resources directory) that may be left running after the app exits.
+var auxiliaryExecutables = []string{"steve", "trivy"}
+
+var (
+	// defaultSignals is the sequence of signals used to terminate a process.
+	defaultSignals = []signalStep{{signal: syscall.SIGTERM}}
+	// qemuSignals is the sequence of signals used to terminate qemu; qemu
+	// treats SIGINT as a request to power down cleanly, so try that first.
+	qemuSignals = []signalStep{
+		{signal: syscall.SIGINT, wait: 5 * time.Second},
+		{signal: syscall.SIGTERM, wait: 5 * time.Second},
+		{signal: syscall.SIGKILL},
+	}
+)
+
 type InitiatingCommand string
 
 const (
@@ -48,136 +184,1084 @@ const (
 	FactoryReset InitiatingCommand = "factory-reset"
 )
 
-var limaCtlPath string
+// ValidInitiatingCommands returns every known InitiatingCommand, e.g. to list
+// the allowed values in a usage message.
+func ValidInitiatingCommands() []InitiatingCommand {
+	return []InitiatingCommand{Shutdown, FactoryReset}
+}
+
+// ParseInitiatingCommand converts a string (such as a command-line argument) to
+// an InitiatingCommand, returning ErrUnknownInitiatingCommand if it is not one
+// of ValidInitiatingCommands.
+func ParseInitiatingCommand(value string) (InitiatingCommand, error) {
+	command := InitiatingCommand(value)
+	if !slices.Contains(ValidInitiatingCommands(), command) {
+		return "", fmt.Errorf("%w of %q", ErrUnknownInitiatingCommand, value)
+	}
+	return command, nil
+}
+
+// Limactl makes shutdown use the given limactl, rather than looking it up; the
+// LIMA_HOME to use should be given with LimaHome (see FindLimactl), or else
+// limactl uses the one in the environment.
+func Limactl(path string) Option {
+	return func(s *shutdownData) {
+		s.findLimactl = func() (string, error) {
+			if s.limaHome != "" {
+				if err := checkLimaHome(s.limaHome); err != nil {
+					return "", err
+				}
+			}
+			return path, nil
+		}
+	}
+}
+
+// MatchAppByName makes shutdown look for the application by the file name of
+// its main executable, rather than by its path, if the main executable does
+// not exist; otherwise, an app whose executable was renamed (e.g. by an
+// upgrade) while it was running is not found.  Any unrelated process with the
+// same name is also stopped.
+func MatchAppByName(match bool) Option {
+	return func(s *shutdownData) {
+		s.matchAppByName = match
+	}
+}
+
+// LimaHome makes shutdown stop the lima instance in the given directory, rather
+// than the one in the application directory; that is, it overrides the
+// LIMA_HOME that would otherwise be set up for limactl.
+func LimaHome(dir string) Option {
+	return func(s *shutdownData) {
+		s.limaHome = dir
+	}
+}
+
+// LimactlArgs passes extra arguments (e.g. `--log-level=debug`) to limactl
+// when stopping or deleting lima instances; they go after the usual arguments,
+// just before the instance name.  The arguments must not name the instance.
+func LimactlArgs(args ...string) Option {
+	return func(s *shutdownData) {
+		s.limactlArgs = args
+	}
+}
+
+// AskOnly makes shutdown only ask each process to stop, once, and return
+// without force-killing anything (as for `rdctl shutdown --no-wait`); this is
+// only useful when not waiting for shutdown.
+func AskOnly(ask bool) Option {
+	return func(s *shutdownData) {
+		s.askOnly = ask
+	}
+}
+
+// TailLimaLog makes shutdown write what the lima host agent logs to the debug
+// log while waiting for lima to stop, to help work out why it is slow.
+func TailLimaLog(tail bool) Option {
+	return func(s *shutdownData) {
+		s.tailLimaLog = tail
+	}
+}
+
+// GracefulGuestShutdown makes shutdown ask the guest to power off (so that it
+// can flush its file systems) before stopping lima from the host.
+func GracefulGuestShutdown(graceful bool) Option {
+	return func(s *shutdownData) {
+		s.gracefulGuest = graceful
+	}
+}
+
+// SkipAppTermination leaves the main application running, only stopping lima
+// and qemu; this is for use from within the application itself, or to restart
+// just the VM.
+func SkipAppTermination(skip bool) Option {
+	return func(s *shutdownData) {
+		s.skipApp = skip
+	}
+}
+
+// SkipLima leaves out the stage stopping (or, for factory reset, deleting)
+// lima, for troubleshooting when that stage is known to be broken.
+func SkipLima(skip bool) Option {
+	return func(s *shutdownData) {
+		s.skipLima = skip
+	}
+}
+
+// SkipQemu leaves out the stage stopping qemu, for troubleshooting when that
+// stage is known to be broken.
+func SkipQemu(skip bool) Option {
+	return func(s *shutdownData) {
+		s.skipQemu = skip
+	}
+}
+
+// KillRemaining makes shutdown, once it has finished, kill anything related to
+// Rancher Desktop that is still running, without any chance to exit cleanly.
+// This is a last resort for systems where shutdown regularly hangs, and risks
+// losing data; what was killed is recorded in ShutdownReport.Killed.
+func KillRemaining(kill bool) Option {
+	return func(s *shutdownData) {
+		s.killRemaining = kill
+	}
+}
+
+// StrictErrors makes shutdown fail if any process could not be stopped; by
+// default, such errors are logged and shutdown carries on regardless.  Either
+// way, all stages are attempted.
+func StrictErrors(strict bool) Option {
+	return func(s *shutdownData) {
+		s.strictErrors = strict
+	}
+}
+
+// PollJitter randomly varies the interval between checks on whether a process
+// has exited by up to the given fraction (e.g. 0.1 for ±10%), so that many
+// simultaneous shutdowns do not check at the same time.
+func PollJitter(fraction float64) Option {
+	return func(s *shutdownData) {
+		s.pollJitter = fraction
+	}
+}
+
+// guestShutdownTimeout is how long to wait for the VM to stop after asking the
+// guest to power off.
+const guestShutdownTimeout = 30 * time.Second
 
-func newShutdownData(waitForShutdown bool) *shutdownData {
-	return &shutdownData{waitForShutdown: waitForShutdown}
+// guestConnectTimeout is how long `limactl shell` may take to ask the guest to
+// power off; an unresponsive guest agent could otherwise hang it forever.
+const guestConnectTimeout = 10 * time.Second
+
+// limaStopTimeout is the total time allowed for lima to stop, shared between
+// stopping it gracefully and forcefully; lima is only force-stopped once this
+// has passed.
+const limaStopTimeout = 60 * time.Second
+
+// limaStopMinTimeout is the least time limactl is given to stop the VM, however
+// little of limaStopTimeout is left.
+const limaStopMinTimeout = 5 * time.Second
+
+// appQuitTimeout is how long the app is given to exit after being asked to
+// quit, before it is sent signals instead.
+const appQuitTimeout = 10 * time.Second
+
+// limaSettleTimeout is how long to wait for lima to finish starting (or
+// otherwise changing state) before stopping it.
+const limaSettleTimeout = 30 * time.Second
+
+// limaInstance is the name of the lima instance Rancher Desktop uses.
+const limaInstance = "0"
+
+// limaUnit is the systemd user unit that manages lima, if it has been set up
+// (by `limactl start-at-login`).
+const limaUnit = "lima-vm@" + limaInstance + ".service"
+
+func newShutdownData(waitForShutdown bool, opts ...Option) *shutdownData {
+	s := &shutdownData{
+		waitForShutdown:  waitForShutdown,
+		clock:            realClock{},
+		processes:        hostProcessTable{},
+		jobs:             hostJobAPI{},
+		runner:           execRunner{},
+		locations:        newAppLocations(),
+		report:           &ShutdownReport{},
+		random:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		findQemu:         getQemuExecutable,
+		findInternalDir:  getInternalDirectory,
+		findHostSockets:  hostSockets,
+		privilegedHelper: p.PrivilegedHelperPath,
+		checkWindowsApp:  factoryreset.CheckProcessWindows,
+		killWindowsApp:   factoryreset.KillRancherDesktop,
+		quitApp:          quitRancherDesktop,
+	}
+	s.findLimactl = func() (string, error) {
+		limactl, limaHome, err := findLimactlIn(s.limaHome)
+		if err != nil {
+			return "", err
+		}
+		s.limaHome = limaHome
+		return limactl, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // FinishShutdown - ensures that none of the Rancher Desktop related processes are around
 // after a graceful shutdown command has been sent as part of either `rdctl shutdown` or
-// `rdctl factory-reset`.
-func FinishShutdown(ctx context.Context, waitForShutdown bool, initiatingCommand InitiatingCommand) error {
-	s := newShutdownData(waitForShutdown)
-	if runtime.GOOS == "windows" {
-		return s.waitForAppToDieOrKillIt(ctx, factoryreset.CheckProcessWindows, factoryreset.KillRancherDesktop, 15, 2, "the app")
+// `rdctl factory-reset`.  If waitForShutdown is false, each process is killed
+// without waiting for it to exit first; see AskOnly to not kill anything.
+func FinishShutdown(ctx context.Context, waitForShutdown bool, initiatingCommand InitiatingCommand, opts ...Option) error {
+	return FinishShutdownWithConfig(ctx, Config{
+		WaitForShutdown:   waitForShutdown,
+		InitiatingCommand: initiatingCommand,
+		Options:           opts,
+	})
+}
+
+// FinishShutdownWithReport is FinishShutdown, but also reports the outcome of
+// each stage of the shutdown.
+func FinishShutdownWithReport(ctx context.Context, waitForShutdown bool, initiatingCommand InitiatingCommand, opts ...Option) (*ShutdownReport, error) {
+	return finishShutdownWithConfig(ctx, Config{
+		WaitForShutdown:   waitForShutdown,
+		InitiatingCommand: initiatingCommand,
+		Options:           opts,
+	})
+}
+
+// stopFailed handles an error trying to stop something: it is logged, and in
+// strict mode also collected to be returned once shutdown has finished.
+func (s *shutdownData) stopFailed(action string, err error) {
+	if !s.strictErrors {
+		logrus.Errorf("Ignoring error trying to %s: %s", action, err)
+		return
 	}
-	paths, err := p.GetPaths()
+	logrus.Errorf("Failed to %s: %s", action, err)
+	s.errs = multierror.Append(s.errs, fmt.Errorf("failed to %s: %w", action, err))
+}
+
+// finishShutdown stops everything, returning any errors collected in strict
+// mode along with whatever error (if any) ended the shutdown.
+func (s *shutdownData) finishShutdown(ctx context.Context, initiatingCommand InitiatingCommand) error {
+	// Check this before stopping anything, rather than part way through.
+	_, err := ParseInitiatingCommand(string(initiatingCommand))
 	if err != nil {
-		logrus.Errorf("Ignoring error trying to get application paths: %s", err)
-	} else if err = directories.SetupLimaHome(paths.AppHome); err != nil {
-		logrus.Errorf("Ignoring error trying to get lima directory: %s", err)
+		err = fmt.Errorf("internal error: %w", err)
+	} else if err = s.checkLimactlArgs(); err != nil {
+		logrus.Errorf("Not shutting down: %s", err)
+	} else if err = ctx.Err(); err != nil {
+		// There would be no time to wait for anything asked to stop, so don't
+		// even ask.
+		logrus.Errorf("Not shutting down: %s", err)
 	} else {
-		limaCtlPath, err = directories.GetLimactlPath()
-		if err != nil {
-			logrus.Errorf("Ignoring error trying to get path to limactl: %s", err)
-		} else {
-			switch initiatingCommand {
-			case Shutdown:
-				err = s.waitForAppToDieOrKillIt(ctx, checkLima, stopLima, 15, 2, "lima")
-				if err != nil {
-					logrus.Errorf("Ignoring error trying to stop lima: %s", err)
-				}
-				// Check once more to see if lima is still running, and if so, run `limactl stop --force 0`
-				err = s.waitForAppToDieOrKillIt(ctx, checkLima, stopLimaWithForce, 1, 0, "lima")
-				if err != nil {
-					logrus.Errorf("Ignoring error trying to force-stop lima: %s", err)
-				}
-			case FactoryReset:
-				err = s.waitForAppToDieOrKillIt(ctx, checkLima, deleteLima, 15, 2, "lima")
-				if err != nil {
-					logrus.Errorf("Ignoring error trying to delete lima subtree: %s", err)
-				}
-			default:
-				return fmt.Errorf("internal error: unknown shutdown initiating command of %q", initiatingCommand)
+		err = s.stopAll(ctx, initiatingCommand)
+		if s.killRemaining {
+			killed, killErr := s.killRemainingProcesses(ctx)
+			s.report.Killed = killed
+			if killErr != nil {
+				s.stopFailed("kill remaining processes", killErr)
 			}
 		}
 	}
-	qemuExecutable, err := getQemuExecutable()
-	if err != nil {
-		return fmt.Errorf("failed to find qemu executable: %w", err)
+	if s.errs != nil {
+		err = multierror.Append(err, s.errs.Errors...)
 	}
-	err = s.waitForAppToDieOrKillIt(
-		ctx,
-		isExecutableRunningFunc(qemuExecutable),
-		terminateExecutableFunc(qemuExecutable),
-		15,
-		2,
-		"qemu")
+	if s.onComplete != nil {
+		s.onComplete(s.report, err)
+	}
+	return err
+}
+
+func (s *shutdownData) stopAll(ctx context.Context, initiatingCommand InitiatingCommand) error {
+	if runtime.GOOS == "windows" {
+		return s.finishWindows(ctx)
+	}
+	if err := s.runPreShutdownHook(ctx); err != nil {
+		return err
+	}
+	limactl, err := s.findLimactl()
+	limaFound := err == nil
+	if s.skipLima {
+		logrus.Infof("Not stopping lima: skipped")
+		limaFound = false
+	} else if errors.Is(err, ErrLimaNotSetUp) {
+		logrus.Infof("Not stopping lima: %s", err)
+	} else if err != nil {
+		logrus.Errorf("Ignoring error trying to set up lima: %s", err)
+	} else {
+		s.limactl = limactl
+		if !s.limaInstanceExists(ctx) {
+			// The VM was never created (e.g. on a fresh install), so there is
+			// nothing to stop or delete, and trying would only produce errors.
+			logrus.Infof("Not stopping lima: instance %s does not exist", limaInstance)
+			s.finishOtherLimaInstances(ctx, initiatingCommand)
+			limaFound = false
+		}
+	}
+	if limaFound {
+		// The lima host agent runs as limactl.
+		s.setStageExecutable("lima", limactl)
+		if err = s.finishLima(ctx, initiatingCommand); err != nil {
+			return err
+		}
+		if err = s.checkContext(ctx); err != nil {
+			return err
+		}
+	}
+	// checkVM checks if the VM is still running, in qemu or the vz helper.
+	var checkVM func() (bool, error)
+	if s.skipQemu {
+		logrus.Infof("Not stopping qemu: skipped")
+	} else if checkVM, err = s.stopQemu(ctx, limaFound); err != nil {
+		return err
+	}
+	checkVZ, err := s.stopVZ(ctx)
 	if err != nil {
-		logrus.Errorf("Ignoring error trying to kill qemu: %s", err)
+		return err
+	}
+	if checkVZ != nil {
+		// With the vz backend, the VM does not run in qemu.
+		checkVM = checkVZ
+	}
+	if err = s.stopPrivilegedHelper(ctx); err != nil {
+		s.stopFailed("stop the privileged helper", err)
+	}
+	if s.cleanupSockets {
+		if checkVM == nil {
+			logrus.Infof("Not removing sockets; the VM may still be running")
+		} else {
+			s.cleanupHostSockets(checkVM)
+		}
+	}
+	if err = s.checkContext(ctx); err != nil {
+		return err
+	}
+	if s.skipApp {
+		return nil
 	}
-	appDir, err := directories.GetApplicationDirectory(ctx)
+	appDir, err := s.locations.ApplicationDirectory(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to find application directory: %w", err)
+		return fmt.Errorf("%w: %w", ErrAppDirNotFound, err)
 	}
-	mainExecutablePath, err := p.GetMainExecutable(ctx)
+	mainExecutablePath, err := s.locations.MainExecutable(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get Rancher Desktop executable: %w", err)
+		return fmt.Errorf("%w: %w", ErrMainExecutableNotFound, err)
 	}
-	return s.waitForAppToDieOrKillIt(
+	s.setStageExecutable("the app", mainExecutablePath)
+	err = s.runStage(
 		ctx,
-		isExecutableRunningFunc(mainExecutablePath),
-		terminateRancherDesktopFunc(appDir),
+		s.isAppRunningFunc(ctx, mainExecutablePath),
+		s.stopRancherDesktopFunc(appDir),
 		5,
 		1,
 		"the app")
+	s.report.AppStop = appStopMethod(s.report.lastOutcome())
+	if ctxErr := s.checkContext(ctx); ctxErr != nil {
+		return ctxErr
+	}
+	if internalDir, err := s.findInternalDir(); err != nil {
+		logrus.Errorf("Ignoring error trying to find auxiliary executables: %s", err)
+	} else if err := s.terminateExecutablesNamed(ctx, internalDir, auxiliaryExecutables); err != nil {
+		s.stopFailed("kill auxiliary executables", err)
+	}
+	return err
 }
 
-func (s *shutdownData) waitForAppToDieOrKillIt(ctx context.Context, checkFunc func() (bool, error), killFunc func(context.Context) error, retryCount int, retryWait int, operation string) error {
+// stopQemu stops any qemu still running the VM, returning a function that checks
+// if it is running.  If lima was found, and qemu has already exited along with
+// it, qemu is not even looked up.
+func (s *shutdownData) stopQemu(ctx context.Context, limaFound bool) (func() (bool, error), error) {
+	if limaFound && s.limaQemuExited() {
+		logrus.Infof("Not stopping qemu: it is not running")
+		return func() (bool, error) { return false, nil }, nil
+	}
+	qemuExecutable, err := s.findQemu()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrQemuNotFound, err)
+	}
+	s.setStageExecutable("qemu", qemuExecutable)
+	if limaFound {
+		// If lima thinks the VM is stopped, any qemu still running for it has
+		// been orphaned.
+		if running, err := s.checkLima(ctx); err != nil {
+			logrus.Errorf("Ignoring error checking lima before looking for orphaned qemu: %s", err)
+		} else if !running {
+			s.stage = "orphaned qemu"
+			if err = s.terminateOrphanedQemu(ctx, qemuExecutable); err != nil {
+				s.stopFailed("kill orphaned qemu", err)
+			}
+			if err = s.checkContext(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	checkQemu := s.isLimaQemuRunningFunc(qemuExecutable)
+	err = s.runStage(ctx, checkQemu, s.terminateLimaQemuFunc(qemuExecutable, qemuSignals), 15, 2, "qemu")
+	if err != nil {
+		s.stopFailed("kill qemu", err)
+	}
+	if err = s.checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return checkQemu, nil
+}
+
+// limaQemuExited checks if the qemu running the lima VM has certainly exited:
+// qemu removes its pid file in the instance directory when it exits.  If
+// LIMA_HOME is not known, this always returns false.
+func (s *shutdownData) limaQemuExited() bool {
+	if s.limaHome == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.limaHome, limaInstance, "qemu.pid"))
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// finishWindows ensures that the app is no longer running on Windows.  The app
+// is first asked to exit, and then terminated forcibly if it's still running
+// (e.g. because the GUI is hung).
+func (s *shutdownData) finishWindows(ctx context.Context) error {
+	if s.skipApp {
+		return nil
+	}
+	err := s.runStage(ctx, s.checkWindowsApp, s.killWindowsApp, 15, 2, "the app")
+	outcome := s.report.lastOutcome()
+	s.report.AppStop = appStopMethod(outcome)
+	if ctxErr := s.checkContext(ctx); ctxErr != nil {
+		return ctxErr
+	}
+	if s.askOnly {
+		// The app was asked to exit; it is not force-killed.
+		return err
+	}
+	if err != nil {
+		// The app is force-killed next, so this is not fatal even in strict
+		// mode.
+		logrus.Errorf("Ignoring error trying to stop the app: %s", err)
+	}
+	// Check once more to see if the app is still running, and if so, terminate it.
+	err = s.runStage(ctx, s.checkWindowsApp, s.forceKillApp, 1, 0, "the app")
+	s.report.AppStop = appStopMethod(outcome, s.report.lastOutcome())
+	if ctxErr := s.checkContext(ctx); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// forceKillApp forcibly terminates all processes running the main executable,
+// along with their descendants.  If that can't be done with a job object, each
+// process running the main executable is terminated individually instead.
+func (s *shutdownData) forceKillApp(ctx context.Context) error {
+	_, err := s.forceKillAppPids(ctx)
+	return err
+}
+
+// forceKillAppPids implements forceKillApp, returning the pids of the processes
+// running the main executable that were terminated.
+func (s *shutdownData) forceKillAppPids(ctx context.Context) ([]int, error) {
+	mainExecutable, err := s.locations.MainExecutable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMainExecutableNotFound, err)
+	}
+	pids, err := s.findAppPids(mainExecutable)
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return pids, nil
+	}
+	if err = s.terminateTreesInJob(pids); err == nil {
+		return pids, nil
+	}
+	logrus.Debugf("Failed to terminate the app with a job object, terminating each process instead: %s", err)
+	var errs *multierror.Error
+	killed := []int{}
+	for _, pid := range pids {
+		logrus.Infof("Forcibly terminating Rancher Desktop process %d", pid)
+		err = s.signal(pid, os.Kill)
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			errs = multierror.Append(errs, fmt.Errorf("failed to terminate process %d: %w", pid, err))
+		} else {
+			killed = append(killed, pid)
+		}
+	}
+	return killed, errs.ErrorOrNil()
+}
+
+// checkContext returns an error naming the stage in progress if the context
+// is done, so that shutdown stops instead of moving on to the next stage.
+func (s *shutdownData) checkContext(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out while stopping %s: %w", s.stage, err)
+	}
+	return fmt.Errorf("interrupted while stopping %s: %w", s.stage, err)
+}
+
+// finishLima ensures that lima is no longer running.  Errors stopping lima are
+// logged, and only returned (once shutdown has finished) in strict mode.
+func (s *shutdownData) finishLima(ctx context.Context, initiatingCommand InitiatingCommand) error {
+	switch initiatingCommand {
+	case Shutdown:
+		s.prepareLimaStop(ctx)
+		if s.gracefulGuest {
+			if err := s.gracefulGuestShutdown(ctx); err != nil {
+				logrus.Errorf("Ignoring error trying to shut down the guest: %s", err)
+			}
+		}
+		method, err := s.stopLimaVM(ctx)
+		s.report.LimaStop = method
+		if err != nil {
+			s.stopFailed("force-stop lima", err)
+		} else if s.waitForShutdown {
+			s.verifyLimaStopped(ctx)
+		}
+		s.finishOtherLimaInstances(ctx, initiatingCommand)
+	case FactoryReset:
+		s.prepareLimaStop(ctx)
+		// Other instances must go before the lima files are cleaned up.
+		s.finishOtherLimaInstances(ctx, initiatingCommand)
+		if s.keepVM {
+			err := s.runStage(ctx, s.checkLimaFunc(ctx), s.stopLima, 15, 2, "lima")
+			if err != nil {
+				s.stopFailed("stop lima", err)
+			}
+		} else if s.keepDisk {
+			err := s.runStage(ctx, s.checkLimaFunc(ctx), s.stopLimaWithForce, 15, 2, "lima")
+			if err != nil {
+				s.stopFailed("force-stop lima", err)
+			}
+		} else {
+			if s.limaSnapshotDir != "" {
+				if err := s.snapshotLima(ctx, s.limaHome); err != nil {
+					if s.limaSnapshotRequired {
+						return fmt.Errorf("not deleting lima: failed to save it: %w", err)
+					}
+					logrus.Errorf("Ignoring error trying to save lima: %s", err)
+				}
+			}
+			if err := s.saveLimaLogs(s.limaHome); err != nil {
+				logrus.Errorf("Ignoring error trying to save lima logs: %s", err)
+			}
+			if err := s.stopLimaBeforeDelete(ctx); err != nil {
+				s.stopFailed("stop lima before deleting it", err)
+				if s.strictErrors {
+					logrus.Errorf("Not deleting lima, as it may still be running")
+					return nil
+				}
+			}
+			if err := s.deleteLima(ctx); err != nil {
+				s.stopFailed("delete lima subtree", err)
+			}
+			if err := cleanupLimaArtifacts(s.limaHome); err != nil {
+				logrus.Errorf("Ignoring error trying to clean up lima files: %s", err)
+			}
+		}
+	default:
+		return fmt.Errorf("internal error: %w of %q", ErrUnknownInitiatingCommand, initiatingCommand)
+	}
+	return nil
+}
+
+// stopLimaVM stops the lima VM, gracefully if possible, and reports whether
+// force was needed.  Lima is first asked to stop; if it is still stopping once
+// limaStopTimeout has passed, it is force-stopped.  The returned error is from
+// force-stopping lima (in which case the method is empty); errors stopping it
+// gracefully are only logged, as lima is force-stopped next.
+func (s *shutdownData) stopLimaVM(ctx context.Context) (LimaStopMethod, error) {
+	deadline := s.clock.Now().Add(limaStopTimeout)
+	checkLima := s.checkLimaFunc(ctx)
+	if tail := s.limaLogTail(); tail != nil {
+		checkLima = tail.following(checkLima)
+		defer tail.stop()
+	}
+	err := s.runStage(ctx, checkLima, s.stopLimaBeforeFunc(deadline), 15, 2, "lima")
+	if err != nil {
+		logrus.Errorf("Ignoring error trying to stop lima: %s", err)
+	}
+	if s.askOnly {
+		// Lima was asked to stop; it is not forced to.
+		return LimaStoppedGracefully, nil
+	}
+	if err == nil && s.report.lastOutcome() == OutcomeAlreadyGone {
+		return LimaAlreadyStopped, nil
+	}
+	// Lima may still be stopping; give it the rest of the time before
+	// running `limactl stop --force 0`.
+	err = s.runStage(ctx, checkLima, s.stopLimaWithForce, s.retriesBefore(deadline, 2), 2, "lima")
+	switch s.report.lastOutcome() {
+	case OutcomeAlreadyGone, OutcomeExited:
+		return LimaStoppedGracefully, nil
+	case OutcomeForceKilled:
+		return LimaStoppedWithForce, nil
+	default:
+		return "", err
+	}
+}
+
+// stopLimaBeforeDelete stops the lima VM (with force if needed) and, unless
+// only asking it to stop, checks that it has stopped; deleting a VM that is
+// still running can leave its processes and host state behind, even with
+// --force.
+func (s *shutdownData) stopLimaBeforeDelete(ctx context.Context) error {
+	method, err := s.stopLimaVM(ctx)
+	s.report.LimaStop = method
+	if err != nil || s.askOnly {
+		return err
+	}
+	running, err := s.checkLima(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check lima: %w", err)
+	}
+	if running {
+		return errors.New("lima is still running")
+	}
+	return nil
+}
+
+// prepareLimaStop gets lima ready to be stopped: it waits for lima to settle,
+// and stops the systemd unit managing it (if any) so that it is not restarted.
+// Errors are logged and otherwise ignored.
+func (s *shutdownData) prepareLimaStop(ctx context.Context) {
+	if err := s.waitForStableLima(ctx); err != nil {
+		logrus.Errorf("Ignoring error waiting for lima to settle: %s", err)
+	}
+	if err := s.stopLimaUnit(ctx); err != nil {
+		logrus.Errorf("Ignoring error trying to stop the lima systemd unit: %s", err)
+	}
+}
+
+// stopLimaUnit stops the systemd user unit running lima, if there is one.
+// Otherwise, systemd may restart lima after we stop it.
+func (s *shutdownData) stopLimaUnit(ctx context.Context) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	// `systemctl is-active` fails if the unit is not active (or does not exist,
+	// or systemd is not in use), in which case we have nothing to do.
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "systemctl", "--user", "is-active", limaUnit)
+	cmd.Stderr = &stderr
+	if _, err := s.runner.Output(cmd); err != nil {
+		logrus.Debugf("Not stopping lima via systemd: %s", strings.TrimSpace(stderr.String()))
+		return nil
+	}
+	logrus.Infof("Stopping systemd unit %s", limaUnit)
+	stderr.Reset()
+	cmd = exec.CommandContext(ctx, "systemctl", "--user", "stop", limaUnit)
+	cmd.Stderr = &stderr
+	if err := s.runner.Run(cmd); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("systemctl stop %s failed: %w: %s", limaUnit, err, message)
+		}
+		return fmt.Errorf("systemctl stop %s failed: %w", limaUnit, err)
+	}
+	return nil
+}
+
+// waitForStableLima waits for lima to be running or stopped, so that it is not
+// stopped while it is still starting up; doing so can leave it in a broken
+// state.
+func (s *shutdownData) waitForStableLima(ctx context.Context) error {
+	deadline := s.clock.Now().Add(limaSettleTimeout)
+	for {
+		status, err := s.limaStatus(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check lima: %w", err)
+		}
+		if isStableLimaStatus(status) {
+			return nil
+		}
+		if !s.clock.Now().Before(deadline) {
+			return fmt.Errorf("lima is still %q after %s", status, limaSettleTimeout)
+		}
+		logrus.Debugf("lima is %q; waiting for it to settle before stopping it", status)
+		if err = s.clock.Sleep(ctx, exitPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// isStableLimaStatus reports whether the given lima status is one that lima
+// will stay in until asked to change.
+func isStableLimaStatus(status string) bool {
+	for _, stable := range []string{"Running", "Stopped", "Broken"} {
+		if strings.HasPrefix(status, stable) {
+			return true
+		}
+	}
+	return false
+}
+
+// gracefulGuestShutdown asks the guest to power off, and waits for lima to
+// report that the VM has stopped.
+func (s *shutdownData) gracefulGuestShutdown(ctx context.Context) error {
+	if err := s.requestGuestPoweroff(ctx); err != nil {
+		return err
+	}
+	deadline := s.clock.Now().Add(guestShutdownTimeout)
+	for {
+		running, err := s.checkLima(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check lima: %w", err)
+		}
+		if !running {
+			return nil
+		}
+		if !s.clock.Now().Before(deadline) {
+			return fmt.Errorf("guest did not shut down within %s", guestShutdownTimeout)
+		}
+		if err = s.clock.Sleep(ctx, exitPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// requestGuestPoweroff runs `sudo poweroff` in the guest.  An error is only
+// returned if the guest does not respond within guestConnectTimeout, in which
+// case there is no point waiting for it to power off.
+func (s *shutdownData) requestGuestPoweroff(ctx context.Context) error {
+	timeout := s.guestConnectTimeout
+	if timeout <= 0 {
+		timeout = guestConnectTimeout
+	}
+	shellCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// Don't rely on the runner to return once the context is done.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.runLimactl(shellCtx, "shell", limaInstance, "sudo", "poweroff")
+	}()
+	select {
+	case err := <-done:
+		// The connection may be dropped as the guest goes down, so the command
+		// can fail even if the shutdown worked; the caller checks the status
+		// instead.
+		if err != nil {
+			logrus.Debugf("Ignoring error asking the guest to power off: %s", err)
+		}
+		return nil
+	case <-shellCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("guest did not respond within %s", timeout)
+	}
+}
+
+// runStage runs waitForAppToDieOrKillIt, recording the outcome in the report.
+func (s *shutdownData) runStage(ctx context.Context, checkFunc func() (bool, error), killFunc func(context.Context) error, retryCount int, retryWait int, operation string) error {
+	s.stage = operation
+	retryCount = s.stageRetries(ctx, retryCount, retryWait)
+	result, err := s.waitForAppToDieOrKillIt(ctx, checkFunc, killFunc, retryCount, retryWait, operation)
+	s.report.addStage(operation, result, err)
+	return err
+}
+
+func (s *shutdownData) waitForAppToDieOrKillIt(ctx context.Context, checkFunc func() (bool, error), killFunc func(context.Context) error, retryCount int, retryWait int, operation string) (result stageResult, err error) {
+	start := s.clock.Now()
+	defer func() {
+		result.elapsed = s.clock.Now().Sub(start)
+		if err != nil {
+			result.outcome = OutcomeError
+		}
+		logrus.WithField("operation", operation).Infof("Finished stopping %s after %s", operation, result.elapsed)
+	}()
+	running := false
 	for iter := 0; s.waitForShutdown && iter < retryCount; iter++ {
 		if iter > 0 {
 			logrus.Debugf("checking %s showed it's still running; sleeping %d seconds\n", operation, retryWait)
-			time.Sleep(time.Duration(retryWait) * time.Second)
+			if err := s.clock.Sleep(ctx, s.jitter(time.Duration(retryWait)*time.Second)); err != nil {
+				return result, err
+			}
 		}
 		status, err := checkFunc()
 		if err != nil {
-			return fmt.Errorf("while checking %s, found error: %w", operation, err)
+			return result, fmt.Errorf("while checking %s, found error: %w", operation, err)
 		}
 		if !status {
 			logrus.Debugf("%s is no longer running\n", operation)
-			return nil
+			if iter == 0 {
+				result.outcome = OutcomeAlreadyGone
+			} else {
+				result.outcome = OutcomeExited
+			}
+			return result, nil
+		}
+		running = true
+	}
+	if s.askOnly {
+		// Asking is not force-killing, and is not counted as such.
+		result.outcome = OutcomeAsked
+		return result, s.killWithRetries(ctx, killFunc, retryWait, operation)
+	}
+	if !running {
+		// Nothing was checked while waiting (or we did not wait); check once,
+		// so that only processes that were running count as force-killed.
+		status, err := checkFunc()
+		switch {
+		case err != nil:
+			logrus.Debugf("Killing %s without knowing whether it is running: %s", operation, err)
+			result.outcome = OutcomeForceKilled
+			return result, s.killWithRetries(ctx, killFunc, retryWait, operation)
+		case !status:
+			logrus.Debugf("%s is not running\n", operation)
+			result.outcome = OutcomeAlreadyGone
+			return result, nil
+		}
+	}
+	waited := s.clock.Now().Sub(start)
+	logrus.WithField("operation", operation).Infof("Waited %s for %s to exit; about to force-kill it", waited, operation)
+	if s.waitForShutdown {
+		if err := s.writeDiagnostics(operation, waited); err != nil {
+			logrus.Errorf("Ignoring error writing shutdown diagnostics: %s", err)
+		}
+	}
+	result.outcome = OutcomeForceKilled
+	s.forceKills.Increment(operation)
+	return result, s.killWithRetries(ctx, killFunc, retryWait, operation)
+}
+
+// killAttempts is how many times a kill function is run while it keeps failing
+// with recoverable errors.
+const killAttempts = 3
+
+// killWithRetries runs the kill function, and runs it again (after retryWait
+// seconds, up to killAttempts times in total) if it fails with a recoverable
+// error.
+func (s *shutdownData) killWithRetries(ctx context.Context, killFunc func(context.Context) error, retryWait int, operation string) error {
+	for attempt := 1; ; attempt++ {
+		err := killFunc(ctx)
+		if err == nil || attempt >= killAttempts || !isRecoverableKillError(err) {
+			return err
+		}
+		logrus.WithField("operation", operation).Infof("Retrying to stop %s after error: %s", operation, err)
+		if sleepErr := s.clock.Sleep(ctx, s.jitter(time.Duration(retryWait)*time.Second)); sleepErr != nil {
+			return err
 		}
 	}
-	logrus.Debugf("About to force-kill %s\n", operation)
-	return killFunc(ctx)
+}
+
+// isRecoverableKillError checks if an error stopping something is transient,
+// so that it is worth trying again: failing to start limactl while the system
+// is short of resources, or limactl exiting with an error (e.g. while the VM is
+// still changing state).  Errors that would recur, such as lacking permission
+// to signal a process or limactl not existing, are not.
+func isRecoverableKillError(err error) bool {
+	for _, fatal := range []error{
+		os.ErrPermission,
+		ErrInsufficientPrivileges,
+		ErrUnsafePid,
+		ErrProcessReplaced,
+		context.Canceled,
+		context.DeadlineExceeded,
+		exec.ErrNotFound,
+		exec.ErrDot,
+		fs.ErrNotExist,
+	} {
+		if errors.Is(err, fatal) {
+			return false
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return true
+	}
+	for _, transient := range []error{syscall.EAGAIN, syscall.EINTR, syscall.ETXTBSY} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageRetries returns how many times a stage checks whether it is still
+// running before killing it.  If the context has a deadline, this is as many
+// checks as fit before it, leaving one poll interval for the kill itself; the
+// given retryCount is then only an upper limit.  That way, a short timeout
+// still leaves time to force-kill each stage, rather than cancelling it while
+// it waits.
+func (s *shutdownData) stageRetries(ctx context.Context, retryCount int, retryWait int) int {
+	deadline, ok := ctx.Deadline()
+	if !ok || retryWait <= 0 {
+		return retryCount
+	}
+	wait := time.Duration(retryWait) * time.Second
+	return min(retryCount, s.retriesBefore(deadline.Add(-wait), retryWait))
+}
+
+// retriesBefore returns how many checks can be made, waiting retryWait seconds
+// between them, before the given deadline passes.  This is always at least one.
+func (s *shutdownData) retriesBefore(deadline time.Time, retryWait int) int {
+	remaining := deadline.Sub(s.clock.Now())
+	return 1 + max(0, int(remaining/(time.Duration(retryWait)*time.Second)))
+}
+
+// jitter randomly varies the given poll interval by up to pollJitter.
+func (s *shutdownData) jitter(d time.Duration) time.Duration {
+	if s.pollJitter == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + s.pollJitter*(2*s.random.Float64()-1)))
 }
 
 func getQemuExecutable() (string, error) {
 	if runtime.GOOS == "windows" {
 		return "", fmt.Errorf("qemu not installed on Windows")
 	}
-	resourcesDir, err := p.GetResourcesPath()
+	return qemuExecutableIn(p.GetResourcesPath, qemuArchName(runtime.GOARCH))
+}
+
+// qemuExecutableIn looks for qemu in the resources directory returned by
+// getResourcesPath (see qemuSubdir).  If that fails (say, in a broken install), qemu is looked
+// up in $PATH instead, so that a running qemu can still be stopped.
+func qemuExecutableIn(getResourcesPath func() (string, error), arch string) (string, error) {
+	resourcesDir, err := getResourcesPath()
 	if err != nil {
-		return "", fmt.Errorf("failed to get resources directory: %w", err)
-	}
-	var arch string
-	switch runtime.GOARCH {
-	case "amd64":
-		arch = "x86_64"
-	case "arm64":
-		arch = "aarch64"
-	default:
-		arch = runtime.GOARCH
-	}
-	qemuName := fmt.Sprintf("qemu-system-%s", arch)
-	candidates := []string{
-		filepath.Join(resourcesDir, runtime.GOOS, "lima", "bin", qemuName),
+		qemu, pathErr := exec.LookPath(fmt.Sprintf("qemu-system-%s", arch))
+		if pathErr != nil {
+			return "", fmt.Errorf("failed to get resources directory: %w", err)
+		}
+		logrus.Warnf("Failed to get resources directory, using %s: %s", qemu, err)
+		return qemu, nil
 	}
+	dirs := []string{filepath.Join(resourcesDir, qemuSubdir())}
 	if runtime.GOOS == "linux" {
 		// On Linux, we may be running in AppImage; in that case, we need to check
 		// the bundled qemu.
-		candidates = append(
-			candidates,
-			filepath.Join(utils.GetParentDir(resourcesDir, 4), "usr", "bin", qemuName),
-		)
+		dirs = append(dirs, filepath.Join(utils.GetParentDir(resourcesDir, 4), "usr", "bin"))
+	}
+	return findQemuExecutable(dirs, arch)
+}
+
+// qemuSubdirEnv names an environment variable that overrides where qemu is in
+// the resources directory, for repackaged builds with a different layout.
+const qemuSubdirEnv = "RD_QEMU_SUBDIR"
+
+// qemuSubdir returns the directory, relative to the resources directory, that
+// contains qemu: normally <os>/lima/bin.
+func qemuSubdir() string {
+	if subdir := os.Getenv(qemuSubdirEnv); subdir != "" {
+		return filepath.FromSlash(subdir)
+	}
+	return filepath.Join(runtime.GOOS, "lima", "bin")
+}
+
+// qemuArchEnv names an environment variable that overrides the architecture
+// in the name of the qemu executable (qemu-system-<arch>), for custom builds.
+const qemuArchEnv = "RD_QEMU_ARCH"
+
+// qemuArchNames maps Go architecture names to the ones qemu uses, where they
+// differ.
+var qemuArchNames = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"ppc64le": "ppc64",
+}
+
+// qemuArchName returns the architecture in the name of the qemu executable for
+// the given Go architecture.
+func qemuArchName(goarch string) string {
+	if arch := os.Getenv(qemuArchEnv); arch != "" {
+		return arch
+	}
+	if arch, ok := qemuArchNames[goarch]; ok {
+		return arch
+	}
+	return goarch
+}
+
+// findQemuExecutable looks for qemu-system-<arch> in each of the given
+// directories.  If there is none, but the first directory (the lima bin
+// directory) has exactly one other qemu-system-* executable, that is used
+// instead, to cope with builds that name qemu differently.
+func findQemuExecutable(dirs []string, arch string) (string, error) {
+	qemuName := fmt.Sprintf("qemu-system-%s", arch)
+	candidates := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		candidates = append(candidates, filepath.Join(dir, qemuName))
+	}
+	qemu, err := p.FindFirstExecutable(candidates...)
+	if err == nil || len(dirs) == 0 {
+		return qemu, err
+	}
+	matches, globErr := filepath.Glob(filepath.Join(dirs[0], "qemu-system-*"))
+	if globErr != nil {
+		return "", globErr
+	}
+	var usable []string
+	for _, match := range matches {
+		if _, matchErr := p.FindFirstExecutable(match); matchErr == nil {
+			usable = append(usable, match)
+		}
+	}
+	switch len(usable) {
+	case 0:
+		return "", err
+	case 1:
+		logrus.Infof("%s not found; using %s", qemuName, usable[0])
+		return usable[0], nil
+	default:
+		return "", fmt.Errorf("%s not found, and cannot choose between %s: %w", qemuName, strings.Join(usable, ", "), err)
 	}
-	return p.FindFirstExecutable(candidates...)
 }
 
-func isExecutableRunningFunc(executablePath string) func() (bool, error) {
+// stopPrivilegedHelper stops the privileged helper if it is still running;
+// stopping lima normally stops it, so it is only given a short time to exit.
+// Since it runs as root, signalling it may fail with ErrInsufficientPrivileges.
+func (s *shutdownData) stopPrivilegedHelper(ctx context.Context) error {
+	if s.privilegedHelper == "" {
+		return nil
+	}
+	if _, err := os.Stat(s.privilegedHelper); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	const operation = "the privileged helper"
+	s.setStageExecutable(operation, s.privilegedHelper)
+	kill := func(ctx context.Context) error {
+		err := s.signalUntilExit(ctx, operation, s.privilegedHelper, defaultSignals, func() (int, error) {
+			return s.processes.FindPid(ctx, s.privilegedHelper)
+		})
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w to stop %s: %w", ErrInsufficientPrivileges, s.privilegedHelper, err)
+		}
+		return err
+	}
+	return s.runStage(ctx, s.isExecutableRunningFunc(ctx, s.privilegedHelper), kill, 5, 1, operation)
+}
+
+// getInternalDirectory returns the directory holding the auxiliary executables.
+func getInternalDirectory() (string, error) {
+	resourcesDir, err := p.GetResourcesPath()
+	if err != nil {
+		return "", fmt.Errorf("failed to get resources directory: %w", err)
+	}
+	return filepath.Join(resourcesDir, runtime.GOOS, "internal"), nil
+}
+
+// terminateExecutablesNamed terminates all processes running any of the named
+// executables in the given directory.  Executables that do not exist are
+// skipped.
+func (s *shutdownData) terminateExecutablesNamed(ctx context.Context, dir string, names []string) error {
+	var errs *multierror.Error
+	for _, name := range names {
+		executable := filepath.Join(dir, name)
+		if _, err := os.Stat(executable); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = multierror.Append(errs, err)
+			}
+			continue
+		}
+		pids, err := s.processes.FindPids(executable)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to find %s processes: %w", name, err))
+			continue
+		}
+		for _, pid := range pids {
+			logrus.Infof("Terminating leftover %s process %d", name, pid)
+			errs = multierror.Append(errs, s.signalUntilExit(ctx, name, executable, defaultSignals, func() (int, error) {
+				pids, err := s.processes.FindPids(executable)
+				if err != nil || !slices.Contains(pids, pid) {
+					return 0, err
+				}
+				return pid, nil
+			}))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (s *shutdownData) isExecutableRunningFunc(ctx context.Context, executablePath string) func() (bool, error) {
 	return func() (bool, error) {
-		pid, err := process.FindPidOfProcess(executablePath)
+		pid, err := s.processes.FindPid(ctx, executablePath)
 		if err != nil {
 			return false, err
 		}
@@ -185,76 +1269,485 @@ func isExecutableRunningFunc(executablePath string) func() (bool, error) {
 	}
 }
 
-func terminateExecutableFunc(executablePath string) func(context.Context) error {
+// matchingAppByName checks if the app has to be found by name; see
+// MatchAppByName.
+func (s *shutdownData) matchingAppByName() bool {
+	return s.matchAppByName && s.locations.mainExecutableMissing
+}
+
+// isAppRunningFunc is isExecutableRunningFunc for the main executable, which
+// may have to be matched by name.
+func (s *shutdownData) isAppRunningFunc(ctx context.Context, mainExecutable string) func() (bool, error) {
+	return func() (bool, error) {
+		pid, err := s.findAppPid(ctx, mainExecutable)
+		return pid != 0, err
+	}
+}
+
+// findAppPid returns the pid of some process running the main executable, or
+// 0 if there is none.
+func (s *shutdownData) findAppPid(ctx context.Context, mainExecutable string) (int, error) {
+	if !s.matchingAppByName() {
+		return s.processes.FindPid(ctx, mainExecutable)
+	}
+	pids, err := s.findAppPids(mainExecutable)
+	if err != nil || len(pids) == 0 {
+		return 0, err
+	}
+	return pids[0], nil
+}
+
+// findAppPids returns the pids of all processes running the main executable.
+func (s *shutdownData) findAppPids(mainExecutable string) ([]int, error) {
+	if s.matchingAppByName() {
+		return s.processes.FindPidsNamed(filepath.Base(mainExecutable))
+	}
+	return s.processes.FindPids(mainExecutable)
+}
+
+// limaQemuPids returns the pids of the processes running the given qemu
+// executable for the lima instance.  Someone could run an unrelated VM with the
+// same qemu, so processes whose command lines do not refer to the instance are
+// skipped; if the command line can't be read, the process is assumed to be
+// lima's.  Zombie processes have already exited, and signalling them does
+// nothing, so they are skipped too.
+func (s *shutdownData) limaQemuPids(qemuExecutable string) ([]int, error) {
+	pids, err := s.processes.FindPids(qemuExecutable)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(pids, func(pid int) bool {
+		if s.isZombie(pid) {
+			return true
+		}
+		args, err := s.processes.CommandLine(pid)
+		if err != nil || len(args) == 0 {
+			logrus.Debugf("Assuming qemu process %d belongs to lima; failed to get its command line: %v", pid, err)
+			return false
+		}
+		if referencesLimaInstance(args, s.limaHome, limaInstance) {
+			return false
+		}
+		logrus.Debugf("Leaving qemu process %d alone; it is not running the lima VM", pid)
+		return true
+	}), nil
+}
+
+// isZombie checks if the given (qemu) process has exited, and is only waiting
+// to be reaped by its parent; there is nothing left to stop.  If that can't be
+// determined, the process is assumed to be alive.
+func (s *shutdownData) isZombie(pid int) bool {
+	zombie, err := s.processes.Zombie(pid)
+	if err != nil {
+		logrus.Debugf("Failed to check if process %d is a zombie: %s", pid, err)
+		return false
+	}
+	if zombie {
+		logrus.Debugf("Ignoring process %d; it has already exited", pid)
+	}
+	return zombie
+}
+
+func (s *shutdownData) isLimaQemuRunningFunc(qemuExecutable string) func() (bool, error) {
+	return func() (bool, error) {
+		pids, err := s.limaQemuPids(qemuExecutable)
+		return len(pids) > 0, err
+	}
+}
+
+// terminateLimaQemuFunc returns a function that terminates the qemu process
+// running the lima VM by sending it each of the given signals in turn, until
+// the process exits.
+func (s *shutdownData) terminateLimaQemuFunc(qemuExecutable string, steps []signalStep) func(context.Context) error {
 	return func(ctx context.Context) error {
-		pid, err := process.FindPidOfProcess(executablePath)
+		return s.signalUntilExit(ctx, qemuExecutable, qemuExecutable, steps, func() (int, error) {
+			pids, err := s.limaQemuPids(qemuExecutable)
+			if err != nil || len(pids) == 0 {
+				return 0, err
+			}
+			return pids[0], nil
+		})
+	}
+}
+
+// signalUntilExit sends each of the given signals in turn to the process found
+// by findPid, until findPid no longer finds a process.  If only asking
+// processes to stop, only the first signal is sent.  The process is expected to
+// be running the given executable.
+func (s *shutdownData) signalUntilExit(ctx context.Context, description, executable string, steps []signalStep, findPid func() (int, error)) error {
+	if s.askOnly {
+		steps = steps[:min(1, len(steps))]
+	}
+	for i, step := range steps {
+		pid, err := findPid()
 		if err != nil || pid == 0 {
 			return err
 		}
-		proc, err := os.FindProcess(pid)
-		if err != nil {
-			return fmt.Errorf("failed to find process for pid %d: %w", pid, err)
+		// The process may have exited since it was found, and the pid reused by
+		// some unrelated process; check again right before signalling it.
+		if err = s.checkExecutable(pid, executable); err != nil {
+			return err
 		}
 		// The pid might not exist even if we did not receive an error.
-		err = proc.Signal(syscall.SIGTERM)
+		err = s.signal(pid, step.signal)
 		if err != nil && !errors.Is(err, os.ErrProcessDone) {
-			return fmt.Errorf("failed to terminate process %d: %w", pid, err)
+			return fmt.Errorf("failed to send %s to process %d: %w", step.signal, pid, err)
+		}
+		if i < len(steps)-1 {
+			logrus.Debugf("sent %s to %s (pid %d); waiting %s", step.signal, description, pid, step.wait)
+			if err = s.clock.Sleep(ctx, step.wait); err != nil {
+				return err
+			}
 		}
+	}
+	return nil
+}
+
+// checkExecutable returns ErrProcessReplaced if the given process is no longer
+// running the given executable.  If the executable of the process can't be
+// determined (for example, on Windows), it is assumed to be unchanged.
+func (s *shutdownData) checkExecutable(pid int, executable string) error {
+	actual, err := s.processes.Executable(pid)
+	if err != nil {
+		logrus.Debugf("Failed to get executable of process %d, assuming it is %s: %s", pid, executable, err)
 		return nil
 	}
+	if actual == executable {
+		return nil
+	}
+	expectedInfo, err := os.Stat(executable)
+	if err == nil {
+		var actualInfo fs.FileInfo
+		actualInfo, err = os.Stat(actual)
+		if err == nil && os.SameFile(expectedInfo, actualInfo) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: process %d is running %s instead of %s", ErrProcessReplaced, pid, actual, executable)
+}
+
+// terminateOrphanedQemu terminates any qemu processes that belong to the lima
+// instance; this should only be called once lima reports the VM as stopped.
+func (s *shutdownData) terminateOrphanedQemu(ctx context.Context, qemuExecutable string) error {
+	pids, err := s.processes.FindPids(qemuExecutable)
+	if err != nil {
+		return err
+	}
+	var errs *multierror.Error
+	for _, pid := range pids {
+		if s.isZombie(pid) {
+			continue
+		}
+		args, err := s.processes.CommandLine(pid)
+		if err != nil {
+			logrus.Debugf("Failed to get command line of qemu process %d: %s", pid, err)
+			continue
+		}
+		if !referencesLimaInstance(args, s.limaHome, limaInstance) {
+			continue
+		}
+		logrus.Infof("Terminating orphaned qemu process %d", pid)
+		errs = multierror.Append(errs, s.signalUntilExit(ctx, qemuExecutable, qemuExecutable, qemuSignals, func() (int, error) {
+			pids, err := s.processes.FindPids(qemuExecutable)
+			if err != nil || !slices.Contains(pids, pid) {
+				return 0, err
+			}
+			return pid, nil
+		}))
+	}
+	return errs.ErrorOrNil()
+}
+
+// referencesLimaInstance checks if the given command line arguments (of a qemu
+// process) refer to the given lima instance.
+func referencesLimaInstance(args []string, limaHome, instance string) bool {
+	instanceDir := ""
+	if limaHome != "" {
+		instanceDir = filepath.Join(limaHome, instance) + string(filepath.Separator)
+	}
+	for _, arg := range args {
+		if arg == "lima-"+instance {
+			return true
+		}
+		if instanceDir != "" && strings.Contains(arg, instanceDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *shutdownData) checkLima(ctx context.Context) (bool, error) {
+	return s.limaInstanceRunning(ctx, limaInstance)
+}
+
+// checkLimaFunc returns checkLima as a check function, as runStage takes.
+func (s *shutdownData) checkLimaFunc(ctx context.Context) func() (bool, error) {
+	return func() (bool, error) {
+		return s.checkLima(ctx)
+	}
 }
 
-func checkLima() (bool, error) {
-	cmd := exec.Command(limaCtlPath, "ls", "--format", "{{.Status}}", "0")
-	cmd.Stderr = os.Stderr
-	result, err := cmd.Output()
+// limaInstanceRunning reports whether the named lima instance is running.
+func (s *shutdownData) limaInstanceRunning(ctx context.Context, instance string) (bool, error) {
+	status, err := s.limaInstanceStatus(ctx, instance)
 	if err != nil {
 		return false, err
 	}
-	return strings.HasPrefix(string(result), "Running"), nil
+	return strings.HasPrefix(status, "Running"), nil
+}
+
+// limaStatus returns the status of the lima VM, e.g. "Running" or "Stopped".
+func (s *shutdownData) limaStatus(ctx context.Context) (string, error) {
+	return s.limaInstanceStatus(ctx, limaInstance)
+}
+
+// limaInstanceStatus returns the status of the named lima instance.
+func (s *shutdownData) limaInstanceStatus(ctx context.Context, instance string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := s.limactlCmd(ctx, "ls", "--format", "{{.Status}}", instance)
+	cmd.Stderr = &stderr
+	result, err := s.runner.Output(cmd)
+	if err != nil {
+		return "", limactlError(cmd, err, &stderr)
+	}
+	return strings.TrimSpace(string(result)), nil
+}
+
+// stopLima asks lima to stop the VM, allowing it the whole of limaStopTimeout.
+func (s *shutdownData) stopLima(ctx context.Context) error {
+	return s.stopLimaBeforeFunc(s.clock.Now().Add(limaStopTimeout))(ctx)
+}
+
+// stopLimaBeforeFunc returns a function that asks lima to stop the VM.  Where
+// limactl supports it, it is given the time left until the deadline (but at
+// least limaStopMinTimeout) rather than its own default; that way limactl does
+// not give up on a guest that would have stopped cleanly before rdctl resorts
+// to force, nor keep going once rdctl has.
+func (s *shutdownData) stopLimaBeforeFunc(deadline time.Time) func(context.Context) error {
+	return func(ctx context.Context) error {
+		args := []string{"stop"}
+		if s.limaStopSupportsTimeout() {
+			timeout := max(deadline.Sub(s.clock.Now()).Truncate(time.Second), limaStopMinTimeout)
+			args = append(args, "--timeout", timeout.String())
+		}
+		return s.runLimactl(ctx, s.limactlCommand(limaInstance, args...)...)
+	}
 }
 
-func runCommandIgnoreOutput(cmd *exec.Cmd) error {
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func (s *shutdownData) stopLimaWithForce(ctx context.Context) error {
+	return s.runLimactl(ctx, s.limactlCommand(limaInstance, "stop", "--force")...)
 }
 
-func stopLima(ctx context.Context) error {
-	return runCommandIgnoreOutput(exec.CommandContext(ctx, limaCtlPath, "stop", "0"))
+func (s *shutdownData) deleteLima(ctx context.Context) error {
+	return s.runLimactl(ctx, s.limactlCommand(limaInstance, "delete", "--force")...)
 }
 
-func stopLimaWithForce(ctx context.Context) error {
-	return runCommandIgnoreOutput(exec.CommandContext(ctx, limaCtlPath, "stop", "--force", "0"))
+// limactlCommand returns the arguments to run limactl with to act on the given
+// instance: the given arguments, then any extra ones from LimactlArgs, and
+// finally the instance.
+func (s *shutdownData) limactlCommand(instance string, args ...string) []string {
+	result := slices.Concat(args, s.limactlArgs)
+	return append(result, instance)
 }
 
-func deleteLima(ctx context.Context) error {
-	return runCommandIgnoreOutput(exec.CommandContext(ctx, limaCtlPath, "delete", "--force", "0"))
+// checkLimactlArgs makes sure that the extra limactl arguments don't name the
+// lima instance, which would then be given twice.
+func (s *shutdownData) checkLimactlArgs() error {
+	for _, arg := range s.limactlArgs {
+		if arg == limaInstance {
+			return fmt.Errorf("%w: %q is the lima instance", ErrInvalidLimactlArgs, arg)
+		}
+	}
+	return nil
 }
 
-func terminateRancherDesktopFunc(appDir string) func(context.Context) error {
+// limactlOutputLimit is how much of the output of limactl is kept to include in
+// errors.
+const limactlOutputLimit = 4096
+
+// limactlWaitDelay is how long to wait for the output of limactl to be closed
+// once it has been killed because the context is done.
+const limactlWaitDelay = time.Second
+
+// runLimactl runs limactl with the given arguments.  The end of its output is
+// captured, so that it can be included in the error if the command fails; it is
+// also passed through when debug logging is enabled.
+func (s *shutdownData) runLimactl(ctx context.Context, args ...string) error {
+	output := newTailBuffer(limactlOutputLimit)
+	cmd := s.limactlCmd(ctx, args...)
+	cmd.Stdout = output
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		cmd.Stdout = io.MultiWriter(output, os.Stderr)
+	}
+	cmd.Stderr = cmd.Stdout
+	// limactl is killed if the context is done; don't then wait for anything
+	// it started that still has its output open, or a canceled shutdown could
+	// hang on (or leave behind) a stray limactl.
+	cmd.WaitDelay = limactlWaitDelay
+	if err := s.runner.Run(cmd); err != nil {
+		return limactlError(cmd, err, output)
+	}
+	return nil
+}
+
+// limactlCmd returns the command to run limactl with the given arguments,
+// using the LIMA_HOME that shutdown is working with (if known).
+func (s *shutdownData) limactlCmd(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.limactl, args...)
+	if s.limaHome != "" {
+		cmd.Env = append(os.Environ(), "LIMA_HOME="+s.limaHome)
+	}
+	return cmd
+}
+
+// limactlError wraps an error from running limactl with the command arguments
+// and whatever it wrote to standard error.
+func limactlError(cmd *exec.Cmd, err error, stderr fmt.Stringer) error {
+	args := strings.Join(cmd.Args[1:], " ")
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("limactl %s failed: %w: %s", args, err, message)
+	}
+	return fmt.Errorf("limactl %s failed: %w", args, err)
+}
+
+// cleanupLimaArtifacts removes stale lima runtime files (sockets and pid files)
+// from the given LIMA_HOME, which may otherwise prevent the next start.  The
+// lima configuration directory is left alone.
+func cleanupLimaArtifacts(limaHome string) error {
+	if limaHome == "" {
+		return nil
+	}
+	var errs *multierror.Error
+	err := filepath.WalkDir(limaHome, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == "_config" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isLimaRuntimeArtifact(entry) {
+			return nil
+		}
+		logrus.Infof("Removing stale lima file %s", path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = multierror.Append(errs, err)
+		}
+		return nil
+	})
+	errs = multierror.Append(errs, err)
+	return errs.ErrorOrNil()
+}
+
+// isLimaRuntimeArtifact checks if the given file is one that lima creates while
+// an instance is running, i.e. a socket or a pid file.
+func isLimaRuntimeArtifact(entry fs.DirEntry) bool {
+	return entry.Type()&fs.ModeSocket != 0 ||
+		strings.HasSuffix(entry.Name(), ".sock") ||
+		strings.HasSuffix(entry.Name(), ".pid")
+}
+
+// stopRancherDesktopFunc returns the function stopping the app in the app
+// stage.  When waiting for shutdown, the app is first asked to quit (once), and
+// is only terminated if it does not; otherwise it is terminated directly, as
+// when killing orphans or remaining processes.
+func (s *shutdownData) stopRancherDesktopFunc(appDir string) func(context.Context) error {
+	terminate := s.terminateRancherDesktopFunc(appDir, !s.askOnly)
+	if !s.waitForShutdown || s.quitApp == nil {
+		return terminate
+	}
+	asked := false
+	return func(ctx context.Context) error {
+		if !asked {
+			asked = true
+			quit, err := s.quitAppGracefully(ctx)
+			if err != nil {
+				logrus.Errorf("Ignoring error asking Rancher Desktop to quit: %s", err)
+			} else if quit {
+				return nil
+			}
+		}
+		return terminate(ctx)
+	}
+}
+
+func (s *shutdownData) terminateRancherDesktopFunc(appDir string, force bool) func(context.Context) error {
 	return func(ctx context.Context) error {
 		var errors *multierror.Error
 
-		// TODO: We can't use the process group on Linux, because Electron does
-		// not always create a new one.
-		if runtime.GOOS != "linux" {
-			errors = multierror.Append(errors, (func() error {
-				mainExe, err := p.GetMainExecutable(ctx)
-				if err != nil {
-					return err
-				}
-				pid, err := process.FindPidOfProcess(mainExe)
-				if err != nil {
-					return err
-				}
-				return process.KillProcessGroup(pid, false)
-			})())
-		}
+		killedGroup, err := s.killAppProcessGroup(ctx)
+		errors = multierror.Append(errors, err)
 
-		errors = multierror.Append(errors, process.TerminateProcessInDirectory(appDir, true))
+		// On Linux, the process group is only used if it belongs to the app,
+		// and then scanning the directory is unnecessary.
+		if runtime.GOOS != "linux" || !killedGroup {
+			errors = multierror.Append(errors, s.processes.TerminateInDirectory(appDir, force))
+		}
 
 		return errors.ErrorOrNil()
 	}
 }
+
+// quitAppGracefully asks the app to quit, and waits up to appQuitTimeout for it
+// to exit, returning whether it did.
+func (s *shutdownData) quitAppGracefully(ctx context.Context) (bool, error) {
+	mainExe, err := s.locations.MainExecutable(ctx)
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("Asking Rancher Desktop to quit")
+	if err = s.quitApp(ctx); err != nil {
+		return false, err
+	}
+	checkApp := s.isAppRunningFunc(ctx, mainExe)
+	deadline := s.clock.Now().Add(appQuitTimeout)
+	for {
+		running, err := checkApp()
+		if err != nil {
+			return false, err
+		}
+		if !running {
+			return true, nil
+		}
+		if !s.clock.Now().Before(deadline) {
+			logrus.Infof("Rancher Desktop is still running %s after being asked to quit", appQuitTimeout)
+			return false, nil
+		}
+		if err = s.clock.Sleep(ctx, exitPollInterval); err != nil {
+			return false, err
+		}
+	}
+}
+
+// killAppProcessGroup kills the process group of the main application process,
+// returning whether it did so.  On Linux, Electron does not always create a new
+// process group, so this is only done if the main process is the group leader.
+func (s *shutdownData) killAppProcessGroup(ctx context.Context) (bool, error) {
+	mainExe, err := s.locations.MainExecutable(ctx)
+	if err != nil {
+		return false, err
+	}
+	pid, err := s.findAppPid(ctx, mainExe)
+	if err != nil || pid == 0 {
+		return false, err
+	}
+	if runtime.GOOS == "linux" {
+		pgid, err := s.processes.ProcessGroup(pid)
+		if err != nil {
+			return false, err
+		}
+		if pgid != pid {
+			logrus.Debugf("Rancher Desktop (pid %d) is not a process group leader; not killing its group", pid)
+			return false, nil
+		}
+	}
+	if err = checkSafePid(pid); err != nil {
+		return false, err
+	}
+	return true, s.processes.KillProcessGroup(pid)
+}
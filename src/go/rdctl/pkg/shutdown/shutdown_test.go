@@ -0,0 +1,3575 @@
+package shutdown
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock where sleeping advances time instantly.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+	// onSleep, if set, is called at the start of each sleep.
+	onSleep func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if c.onSleep != nil {
+		c.onSleep()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// fakeProcess is a process in a fakeProcessTable.
+type fakeProcess struct {
+	executable string
+	args       []string
+	// exitOn lists the signals that cause the process to exit.
+	exitOn []os.Signal
+	// received records the signals sent to the process.
+	received []os.Signal
+	exited   bool
+	// pgid is the process group id; if unset, the process is in group 1.
+	pgid int
+	// groupKilled records whether the process group was killed.
+	groupKilled bool
+	// openFiles is the number of open files.
+	openFiles int
+	// signalError, if set, is returned when signalling the process (which then
+	// does not receive the signal), as if it were owned by another user.
+	signalError error
+	// zombie marks a process that has exited, but has not been reaped.
+	zombie bool
+	// parent is the pid of the parent process, for fakeJobAPI.
+	parent int
+	// jobKilled records whether the process was terminated through a job.
+	jobKilled bool
+	// openDir is a directory the process has files open in, for FileHolders.
+	openDir string
+}
+
+// fakeProcessTable is a processTable with fake processes, keyed by pid.
+type fakeProcessTable map[int]*fakeProcess
+
+func (table fakeProcessTable) FindPid(_ context.Context, executable string) (int, error) {
+	for pid, proc := range table {
+		if proc.executable == executable && !proc.exited {
+			return pid, nil
+		}
+	}
+	return 0, nil
+}
+
+func (table fakeProcessTable) FindPids(executable string) ([]int, error) {
+	var pids []int
+	for pid, proc := range table {
+		if proc.executable == executable && !proc.exited {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+	return pids, nil
+}
+
+func (table fakeProcessTable) FindPidsNamed(name string) ([]int, error) {
+	var pids []int
+	for pid, proc := range table {
+		if filepath.Base(proc.executable) == name && !proc.exited {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+	return pids, nil
+}
+
+func (table fakeProcessTable) Executable(pid int) (string, error) {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return "", os.ErrProcessDone
+	}
+	return proc.executable, nil
+}
+
+func (table fakeProcessTable) CommandLine(pid int) ([]string, error) {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return nil, os.ErrProcessDone
+	}
+	return proc.args, nil
+}
+
+func (table fakeProcessTable) OpenFiles(pid int) (int, error) {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return 0, os.ErrProcessDone
+	}
+	return proc.openFiles, nil
+}
+
+func (table fakeProcessTable) Zombie(pid int) (bool, error) {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return false, os.ErrProcessDone
+	}
+	return proc.zombie, nil
+}
+
+func (table fakeProcessTable) Signal(pid int, signal os.Signal) error {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return os.ErrProcessDone
+	}
+	if proc.signalError != nil {
+		return proc.signalError
+	}
+	proc.received = append(proc.received, signal)
+	for _, exitSignal := range proc.exitOn {
+		if signal == exitSignal {
+			proc.exited = true
+		}
+	}
+	return nil
+}
+
+// fakeJobAPI is a jobAPI for a fakeProcessTable; without a table, it fails as
+// if job objects were not available.
+type fakeJobAPI struct {
+	table fakeProcessTable
+}
+
+func (api fakeJobAPI) ProcessTree(pid int) ([]int, error) {
+	if api.table == nil {
+		return nil, errors.New("no job objects")
+	}
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		for child, proc := range api.table {
+			if proc.parent == tree[i] && !proc.exited {
+				tree = append(tree, child)
+			}
+		}
+	}
+	return tree, nil
+}
+
+func (api fakeJobAPI) CreateJob() (jobObject, error) {
+	if api.table == nil {
+		return nil, errors.New("no job objects")
+	}
+	return &fakeJob{table: api.table}, nil
+}
+
+// fakeJob is a jobObject for processes in a fakeProcessTable.
+type fakeJob struct {
+	table   fakeProcessTable
+	members []int
+	closed  bool
+}
+
+func (job *fakeJob) Assign(pid int) error {
+	proc, ok := job.table[pid]
+	if !ok || proc.exited {
+		return os.ErrProcessDone
+	}
+	job.members = append(job.members, pid)
+	return nil
+}
+
+func (job *fakeJob) Terminate() error {
+	for _, pid := range job.members {
+		job.table[pid].exited = true
+		job.table[pid].jobKilled = true
+	}
+	return nil
+}
+
+func (job *fakeJob) Close() error {
+	job.closed = true
+	return nil
+}
+
+// fakeLimactl is a commandRunner that pretends to be limactl; the VM is running
+// until it is stopped or deleted.
+type fakeLimactl struct {
+	stopped bool
+	// ignorePoweroff causes powering off from inside the guest to not work.
+	ignorePoweroff bool
+	// slowStop is the number of status checks that still report the VM as
+	// running after it has been (non-forcefully) stopped.
+	slowStop int
+	// commands records the arguments (excluding the executable) of each
+	// command that changed state.
+	commands [][]string
+	// stopping counts down the remaining checks for slowStop.
+	stopping int
+	// executable is the limactl that was last run.
+	executable string
+	// systemdUnit causes lima to appear to be managed by a systemd unit.
+	systemdUnit bool
+	// statuses, if set, are reported by status checks (one per check) before
+	// falling back to the actual state.
+	statuses []string
+	// stopError, if set, is returned by commands to stop or delete the VM,
+	// which then keeps running.
+	stopError error
+	// others lists additional lima instances, mapped to whether they have
+	// been stopped; they are listed after limaInstance.
+	others map[string]bool
+	// absent causes limaInstance to not exist, as on a fresh install; any
+	// command naming it fails.
+	absent bool
+	// version is reported by `limactl --version`; if empty, that fails.
+	version string
+	// details, if set, are the outputs (one per check) of status checks
+	// using limaDetailsFormat, before falling back to the actual state.
+	details []string
+}
+
+func (l *fakeLimactl) Run(cmd *exec.Cmd) error {
+	l.executable = cmd.Args[0]
+	args := cmd.Args[1:]
+	l.commands = append(l.commands, args)
+	if l.executable == "systemctl" && slices.Equal(args, []string{"--user", "stop", limaUnit}) {
+		l.stopped = true
+	}
+	if l.absent && len(args) > 0 && args[len(args)-1] == limaInstance {
+		return fmt.Errorf("instance %q does not exist", limaInstance)
+	}
+	if len(args) > 0 && (args[0] == "stop" || args[0] == "delete") {
+		if l.stopError != nil {
+			return l.stopError
+		}
+		if instance := args[len(args)-1]; instance != limaInstance {
+			l.others[instance] = true
+			return nil
+		}
+		l.stopped = true
+		if !slices.Contains(args, "--force") {
+			l.stopping = l.slowStop
+		}
+	}
+	if len(args) > 0 && args[0] == "shell" && !l.ignorePoweroff {
+		l.stopped = true
+	}
+	return nil
+}
+
+func (l *fakeLimactl) Output(cmd *exec.Cmd) ([]byte, error) {
+	if cmd.Args[0] == "systemctl" {
+		if l.systemdUnit && !l.stopped {
+			return []byte("active\n"), nil
+		}
+		return []byte("inactive\n"), errors.New("exit status 3")
+	}
+	if slices.Equal(cmd.Args[1:], []string{"--version"}) {
+		if l.version == "" {
+			return nil, errors.New("unknown flag: --version")
+		}
+		return []byte("limactl version " + l.version + "\n"), nil
+	}
+	if slices.Contains(cmd.Args, "{{.Name}}") {
+		var names []string
+		for name := range l.others {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		if !l.absent {
+			names = append([]string{limaInstance}, names...)
+		}
+		return []byte(strings.Join(names, "\n") + "\n"), nil
+	}
+	if l.absent && cmd.Args[len(cmd.Args)-1] == limaInstance {
+		return nil, fmt.Errorf("instance %q does not exist", limaInstance)
+	}
+	if slices.Contains(cmd.Args, limaDetailsFormat) {
+		if len(l.details) > 0 {
+			details := l.details[0]
+			l.details = l.details[1:]
+			return []byte(details + "\n"), nil
+		}
+		if l.stopped {
+			return []byte("Stopped\t0\t0\n"), nil
+		}
+		return []byte("Running\t1234\t1235\n"), nil
+	}
+	if instance := cmd.Args[len(cmd.Args)-1]; instance != limaInstance {
+		if l.others[instance] {
+			return []byte("Stopped\n"), nil
+		}
+		return []byte("Running\n"), nil
+	}
+	if len(l.statuses) > 0 {
+		status := l.statuses[0]
+		l.statuses = l.statuses[1:]
+		return []byte(status + "\n"), nil
+	}
+	if l.stopping > 0 {
+		l.stopping--
+		return []byte("Running\n"), nil
+	}
+	if l.stopped {
+		return []byte("Stopped\n"), nil
+	}
+	return []byte("Running\n"), nil
+}
+
+func (table fakeProcessTable) ProcessGroup(pid int) (int, error) {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return 0, os.ErrProcessDone
+	}
+	if proc.pgid == 0 {
+		return 1, nil
+	}
+	return proc.pgid, nil
+}
+
+func (table fakeProcessTable) KillProcessGroup(pid int) error {
+	proc, ok := table[pid]
+	if !ok || proc.exited {
+		return os.ErrProcessDone
+	}
+	proc.groupKilled = true
+	return nil
+}
+
+func (table fakeProcessTable) FileHolders(dir string) ([]int, error) {
+	var pids []int
+	for pid, proc := range table {
+		if proc.openDir != "" && !proc.exited && (proc.openDir == dir || strings.HasPrefix(proc.openDir, dir+"/")) {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+	return pids, nil
+}
+
+func (table fakeProcessTable) TerminateInDirectory(dir string, force bool) error {
+	for _, proc := range table {
+		if strings.HasPrefix(proc.executable, dir+"/") && !proc.exited {
+			signal := os.Signal(syscall.SIGTERM)
+			if force {
+				signal = os.Kill
+			}
+			proc.received = append(proc.received, signal)
+			// Processes without exitOn exit on any signal.
+			proc.exited = len(proc.exitOn) == 0 || slices.Contains(proc.exitOn, signal)
+		}
+	}
+	return nil
+}
+
+func newTestShutdownData(waitForShutdown bool) (*shutdownData, *fakeClock) {
+	clock := newFakeClock()
+	s := &shutdownData{
+		waitForShutdown: waitForShutdown,
+		clock:           clock,
+		processes:       fakeProcessTable{},
+		jobs:            fakeJobAPI{},
+		runner:          &fakeLimactl{},
+		report:          &ShutdownReport{},
+		locations: &appLocations{
+			getApplicationDirectory: func(context.Context) (string, error) { return "/app", nil },
+			getMainExecutable:       func(context.Context) (string, error) { return "/app/rancher-desktop", nil },
+		},
+	}
+	return s, clock
+}
+
+// runningFor returns a check function that reports running for the given
+// number of calls.
+func runningFor(calls int) func() (bool, error) {
+	return func() (bool, error) {
+		calls--
+		return calls >= 0, nil
+	}
+}
+
+func TestWaitForExit(t *testing.T) {
+	t.Run("everything exits", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		err := s.waitForExit(context.Background(), time.Minute, []namedCheck{
+			{"lima", runningFor(0)},
+			{"qemu", runningFor(2)},
+			{"the app", runningFor(3)},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []time.Duration{exitPollInterval, exitPollInterval, exitPollInterval}, clock.sleeps)
+	})
+	t.Run("timeout with survivors", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		err := s.waitForExit(context.Background(), 5*time.Second, []namedCheck{
+			{"lima", runningFor(1)},
+			{"qemu", runningFor(100)},
+			{"the app", runningFor(100)},
+		})
+		assert.EqualError(t, err, "timed out waiting for exit; still running: qemu, the app")
+		assert.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second, time.Second}, clock.sleeps)
+	})
+	t.Run("context canceled", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := s.waitForExit(ctx, time.Minute, []namedCheck{{"lima", runningFor(100)}})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestLimaSocketCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	limaHome := t.TempDir()
+	socket := filepath.Join(limaHome, limaInstance, "ha.sock")
+	require.NoError(t, os.MkdirAll(filepath.Dir(socket), 0o755))
+	require.NoError(t, os.WriteFile(socket, nil, 0o644))
+
+	s, clock, limactl := newTestFinishShutdown(fakeProcessTable{})
+	s.limaHome = limaHome
+	limactl.stopped = true
+	checks, err := s.exitChecks(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "lima, the lima host agent, qemu, the app", describeChecks(checks))
+
+	t.Run("socket lingers", func(t *testing.T) {
+		err := s.waitForExit(context.Background(), 5*time.Second, checks)
+		assert.EqualError(t, err, "timed out waiting for exit; still running: the lima host agent")
+	})
+	t.Run("socket disappears", func(t *testing.T) {
+		sleeps := 0
+		clock.onSleep = func() {
+			sleeps++
+			if sleeps == 2 {
+				require.NoError(t, os.Remove(socket))
+			}
+		}
+		require.NoError(t, s.waitForExit(context.Background(), time.Minute, checks))
+		assert.Equal(t, 2, sleeps)
+	})
+	t.Run("no LIMA_HOME", func(t *testing.T) {
+		running, err := limaSocketCheck("")()
+		require.NoError(t, err)
+		assert.False(t, running)
+	})
+}
+
+func TestTerminateLimaQemuFunc(t *testing.T) {
+	testCases := []struct {
+		name     string
+		steps    []signalStep
+		exitOn   []os.Signal
+		expected []os.Signal
+	}{
+		{
+			name:     "default signals",
+			steps:    defaultSignals,
+			exitOn:   []os.Signal{syscall.SIGTERM},
+			expected: []os.Signal{syscall.SIGTERM},
+		},
+		{
+			name:     "qemu exits on SIGINT",
+			steps:    qemuSignals,
+			exitOn:   []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL},
+			expected: []os.Signal{syscall.SIGINT},
+		},
+		{
+			name:     "qemu ignores SIGINT",
+			steps:    qemuSignals,
+			exitOn:   []os.Signal{syscall.SIGTERM, syscall.SIGKILL},
+			expected: []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+		},
+		{
+			name:     "qemu needs SIGKILL",
+			steps:    qemuSignals,
+			exitOn:   []os.Signal{syscall.SIGKILL},
+			expected: []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(true)
+			proc := &fakeProcess{executable: "/qemu", exitOn: testCase.exitOn}
+			s.processes = fakeProcessTable{100: proc}
+			err := s.terminateLimaQemuFunc("/qemu", testCase.steps)(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, proc.received)
+		})
+	}
+}
+
+func TestSignalUntilExitPidReused(t *testing.T) {
+	s, _ := newTestShutdownData(true)
+	proc := &fakeProcess{executable: "/qemu", exitOn: []os.Signal{syscall.SIGKILL}}
+	s.processes = fakeProcessTable{100: proc}
+	// The process is replaced by an unrelated one after it was looked up, but
+	// before it is signalled.
+	findPid := func() (int, error) {
+		pids, err := s.processes.FindPids("/qemu")
+		if err != nil || len(pids) == 0 {
+			return 0, err
+		}
+		proc.executable = "/usr/bin/unrelated"
+		return pids[0], nil
+	}
+	err := s.signalUntilExit(context.Background(), "qemu", "/qemu", qemuSignals, findPid)
+	assert.ErrorIs(t, err, ErrProcessReplaced)
+	assert.Empty(t, proc.received)
+}
+
+func TestForceKillAppJob(t *testing.T) {
+	t.Run("whole tree", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		table := fakeProcessTable{
+			100: {executable: "/app/rancher-desktop"},
+			101: {executable: "/app/rancher-desktop", parent: 100},
+			102: {executable: "/app/resources/helper", parent: 101},
+			103: {executable: "/usr/bin/child", parent: 102},
+			200: {executable: "/usr/bin/unrelated"},
+			// rdctl itself was launched by the app.
+			os.Getpid(): {executable: "/app/resources/rdctl", parent: 100},
+		}
+		s.processes = table
+		s.jobs = fakeJobAPI{table: table}
+		require.NoError(t, s.forceKillApp(context.Background()))
+		for _, pid := range []int{100, 101, 102, 103} {
+			assert.True(t, table[pid].jobKilled, "process %d should have been terminated", pid)
+			assert.Empty(t, table[pid].received, "process %d should not have been signalled", pid)
+		}
+		assert.False(t, table[200].exited)
+		assert.False(t, table[os.Getpid()].exited)
+	})
+	t.Run("falls back to each process", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		table := fakeProcessTable{
+			100: {executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}},
+			101: {executable: "/app/rancher-desktop", parent: 100, exitOn: []os.Signal{os.Kill}},
+		}
+		s.processes = table
+		require.NoError(t, s.forceKillApp(context.Background()))
+		for _, pid := range []int{100, 101} {
+			assert.True(t, table[pid].exited)
+			assert.False(t, table[pid].jobKilled)
+			assert.Equal(t, []os.Signal{os.Kill}, table[pid].received)
+		}
+	})
+}
+
+func TestMissingMainExecutable(t *testing.T) {
+	t.Run("warns", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		t.Cleanup(hook.Reset)
+		s, _ := newTestShutdownData(true)
+		for range 2 {
+			_, err := s.locations.MainExecutable(context.Background())
+			require.NoError(t, err)
+		}
+		require.Len(t, hook.AllEntries(), 1)
+		assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+		assert.Contains(t, hook.LastEntry().Message, "/app/rancher-desktop does not exist")
+		assert.True(t, s.locations.mainExecutableMissing)
+	})
+	t.Run("exists", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		t.Cleanup(hook.Reset)
+		exe := filepath.Join(t.TempDir(), "rancher-desktop")
+		require.NoError(t, os.WriteFile(exe, nil, 0o755))
+		s, _ := newTestShutdownData(true)
+		s.locations.getMainExecutable = func(context.Context) (string, error) { return exe, nil }
+		_, err := s.locations.MainExecutable(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, hook.AllEntries())
+		assert.False(t, s.locations.mainExecutableMissing)
+	})
+	// setup returns shutdown data where the app is still running from where
+	// it was before an upgrade moved it.
+	setup := func(t *testing.T, opts ...Option) (*shutdownData, fakeProcessTable) {
+		s, _ := newTestShutdownData(true)
+		table := fakeProcessTable{
+			100: {executable: "/old/app/rancher-desktop", exitOn: []os.Signal{os.Kill}},
+			200: {executable: "/usr/bin/unrelated", exitOn: []os.Signal{os.Kill}},
+		}
+		s.processes = table
+		for _, opt := range opts {
+			opt(s)
+		}
+		_, err := s.locations.MainExecutable(context.Background())
+		require.NoError(t, err)
+		return s, table
+	}
+	t.Run("not matched by name by default", func(t *testing.T) {
+		s, table := setup(t)
+		running, err := s.isAppRunningFunc(context.Background(), "/app/rancher-desktop")()
+		require.NoError(t, err)
+		assert.False(t, running)
+		require.NoError(t, s.forceKillApp(context.Background()))
+		assert.Empty(t, table[100].received)
+	})
+	t.Run("matched by name", func(t *testing.T) {
+		s, table := setup(t, MatchAppByName(true))
+		running, err := s.isAppRunningFunc(context.Background(), "/app/rancher-desktop")()
+		require.NoError(t, err)
+		assert.True(t, running)
+		require.NoError(t, s.forceKillApp(context.Background()))
+		assert.Equal(t, []os.Signal{os.Kill}, table[100].received)
+		assert.True(t, table[100].exited)
+		assert.Empty(t, table[200].received)
+	})
+	t.Run("not matched by name while the executable exists", func(t *testing.T) {
+		s, table := setup(t, MatchAppByName(true))
+		s.locations.mainExecutableMissing = false
+		require.NoError(t, s.forceKillApp(context.Background()))
+		assert.Empty(t, table[100].received)
+	})
+}
+
+func TestUnsafePids(t *testing.T) {
+	for _, pid := range []int{1, os.Getpid()} {
+		t.Run(fmt.Sprintf("qemu at pid %d", pid), func(t *testing.T) {
+			s, _ := newTestShutdownData(true)
+			proc := &fakeProcess{executable: "/qemu", exitOn: []os.Signal{syscall.SIGKILL}}
+			s.processes = fakeProcessTable{pid: proc}
+			err := s.terminateLimaQemuFunc("/qemu", qemuSignals)(context.Background())
+			assert.ErrorIs(t, err, ErrUnsafePid)
+			assert.Empty(t, proc.received)
+		})
+		t.Run(fmt.Sprintf("app at pid %d", pid), func(t *testing.T) {
+			s, _ := newTestShutdownData(true)
+			proc := &fakeProcess{executable: "/app/rancher-desktop", pgid: pid, exitOn: []os.Signal{os.Kill}}
+			s.processes = fakeProcessTable{pid: proc}
+			_, err := s.killAppProcessGroup(context.Background())
+			assert.ErrorIs(t, err, ErrUnsafePid)
+			assert.False(t, proc.groupKilled)
+			assert.ErrorIs(t, s.forceKillApp(context.Background()), ErrUnsafePid)
+			assert.Empty(t, proc.received)
+		})
+	}
+	t.Run("pid 0", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		proc := &fakeProcess{executable: "/qemu"}
+		s.processes = fakeProcessTable{0: proc}
+		assert.ErrorIs(t, s.signal(0, syscall.SIGKILL), ErrUnsafePid)
+		assert.Empty(t, proc.received)
+	})
+}
+
+func TestTerminateOrphanedQemu(t *testing.T) {
+	limaHome := t.TempDir()
+	instanceDir := filepath.Join(limaHome, limaInstance)
+	orphan := &fakeProcess{
+		executable: "/qemu",
+		args:       []string{"/qemu", "-name", "lima-0", "-pidfile", filepath.Join(instanceDir, "qemu.pid")},
+		exitOn:     []os.Signal{syscall.SIGINT},
+	}
+	byPath := &fakeProcess{
+		executable: "/qemu",
+		args:       []string{"/qemu", "-drive", "file=" + filepath.Join(instanceDir, "diffdisk")},
+		exitOn:     []os.Signal{syscall.SIGTERM},
+	}
+	unrelated := &fakeProcess{
+		executable: "/qemu",
+		args:       []string{"/qemu", "-name", "my-other-vm"},
+		exitOn:     []os.Signal{syscall.SIGINT},
+	}
+	s, _ := newTestShutdownData(true)
+	s.limaHome = limaHome
+	s.processes = fakeProcessTable{100: orphan, 101: byPath, 102: unrelated}
+	require.NoError(t, s.terminateOrphanedQemu(context.Background(), "/qemu"))
+	assert.True(t, orphan.exited)
+	assert.Equal(t, []os.Signal{syscall.SIGINT}, orphan.received)
+	assert.True(t, byPath.exited)
+	assert.Equal(t, []os.Signal{syscall.SIGINT, syscall.SIGTERM}, byPath.received)
+	assert.False(t, unrelated.exited)
+	assert.Empty(t, unrelated.received)
+}
+
+func TestUnrelatedQemuIsSpared(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	newTable := func() (fakeProcessTable, *fakeProcess, *fakeProcess, *fakeProcess) {
+		lima := &fakeProcess{executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, exitOn: []os.Signal{syscall.SIGINT}}
+		unrelated := &fakeProcess{executable: "/qemu", args: []string{"/qemu", "-name", "my-vm"}, exitOn: []os.Signal{syscall.SIGINT}}
+		// Without a command line, the process is assumed to be lima's.
+		unknown := &fakeProcess{executable: "/qemu", exitOn: []os.Signal{syscall.SIGINT}}
+		return fakeProcessTable{100: lima, 101: unrelated, 102: unknown}, lima, unrelated, unknown
+	}
+	t.Run("shutdown", func(t *testing.T) {
+		table, lima, unrelated, unknown := newTable()
+		s, _, _ := newTestFinishShutdown(table)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.True(t, lima.exited)
+		assert.True(t, unknown.exited)
+		assert.False(t, unrelated.exited)
+		assert.Empty(t, unrelated.received)
+	})
+	t.Run("kill orphans", func(t *testing.T) {
+		table, lima, unrelated, unknown := newTable()
+		s, _, _ := newTestFinishShutdown(table)
+		result, err := s.killOrphans(context.Background(), true, "/qemu")
+		require.NoError(t, err)
+		assert.Equal(t, []int{100, 102}, result.Qemu)
+		assert.Equal(t, []os.Signal{syscall.SIGKILL}, lima.received)
+		assert.Equal(t, []os.Signal{syscall.SIGKILL}, unknown.received)
+		assert.Empty(t, unrelated.received)
+	})
+}
+
+func TestZombieQemuIsNotKilled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	newZombie := func() *fakeProcess {
+		// Signals have no effect on a zombie.
+		return &fakeProcess{executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, zombie: true}
+	}
+	t.Run("shutdown", func(t *testing.T) {
+		zombie := newZombie()
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{100: zombie})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Empty(t, zombie.received)
+	})
+	t.Run("orphaned", func(t *testing.T) {
+		zombie := newZombie()
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{100: zombie})
+		require.NoError(t, s.terminateOrphanedQemu(context.Background(), "/qemu"))
+		assert.Empty(t, zombie.received)
+	})
+}
+
+func TestFindQemuExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("qemu is not used on Windows")
+	}
+	makeBinDir := func(t *testing.T, names ...string) string {
+		dir := t.TempDir()
+		for _, name := range names {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o755))
+		}
+		return dir
+	}
+	t.Run("arch names", func(t *testing.T) {
+		assert.Equal(t, "x86_64", qemuArchName("amd64"))
+		assert.Equal(t, "aarch64", qemuArchName("arm64"))
+		assert.Equal(t, "riscv64", qemuArchName("riscv64"))
+		t.Setenv(qemuArchEnv, "custom")
+		assert.Equal(t, "custom", qemuArchName("amd64"))
+	})
+	t.Run("riscv64", func(t *testing.T) {
+		dir := makeBinDir(t, "qemu-system-riscv64", "qemu-system-x86_64")
+		qemu, err := findQemuExecutable([]string{dir}, qemuArchName("riscv64"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "qemu-system-riscv64"), qemu)
+	})
+	t.Run("second directory", func(t *testing.T) {
+		appImageDir := makeBinDir(t, "qemu-system-aarch64")
+		qemu, err := findQemuExecutable([]string{makeBinDir(t), appImageDir}, "aarch64")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(appImageDir, "qemu-system-aarch64"), qemu)
+	})
+	t.Run("resources path unavailable", func(t *testing.T) {
+		noResources := func() (string, error) {
+			return "", errors.New("resources directory is gone")
+		}
+		dir := makeBinDir(t, "qemu-system-aarch64")
+		t.Setenv("PATH", dir)
+		qemu, err := qemuExecutableIn(noResources, "aarch64")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "qemu-system-aarch64"), qemu)
+
+		t.Setenv("PATH", makeBinDir(t))
+		_, err = qemuExecutableIn(noResources, "aarch64")
+		assert.EqualError(t, err, "failed to get resources directory: resources directory is gone")
+	})
+	t.Run("custom layout", func(t *testing.T) {
+		// Deep enough that the AppImage location is also in the temporary
+		// directory.
+		resourcesDir := filepath.Join(t.TempDir(), "opt", "rd", "app", "resources")
+		qemuDir := filepath.Join(resourcesDir, "vendor", "qemu", "bin")
+		require.NoError(t, os.MkdirAll(qemuDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(qemuDir, "qemu-system-aarch64"), nil, 0o755))
+		resources := func() (string, error) {
+			return resourcesDir, nil
+		}
+		t.Setenv("PATH", makeBinDir(t))
+		_, err := qemuExecutableIn(resources, "aarch64")
+		assert.Error(t, err, "qemu should not be found in the default layout")
+
+		t.Setenv(qemuSubdirEnv, "vendor/qemu/bin")
+		qemu, err := qemuExecutableIn(resources, "aarch64")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(qemuDir, "qemu-system-aarch64"), qemu)
+	})
+	t.Run("unknown arch falls back to the only qemu", func(t *testing.T) {
+		dir := makeBinDir(t, "qemu-system-custom", "qemu-img")
+		qemu, err := findQemuExecutable([]string{dir}, qemuArchName("unknown"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "qemu-system-custom"), qemu)
+	})
+	t.Run("unknown arch with several qemus", func(t *testing.T) {
+		dir := makeBinDir(t, "qemu-system-riscv64", "qemu-system-x86_64")
+		_, err := findQemuExecutable([]string{dir}, "unknown")
+		assert.ErrorContains(t, err, "qemu-system-unknown not found, and cannot choose between")
+	})
+	t.Run("no qemu", func(t *testing.T) {
+		dirs := []string{makeBinDir(t, "qemu-img"), makeBinDir(t)}
+		_, err := findQemuExecutable(dirs, "unknown")
+		assert.ErrorContains(t, err, "search location exhausted")
+		for _, dir := range dirs {
+			assert.ErrorContains(t, err, filepath.Join(dir, "qemu-system-unknown"))
+		}
+		var notFound *p.ExecutableNotFoundError
+		require.ErrorAs(t, err, &notFound)
+		assert.Len(t, notFound.Candidates, len(dirs))
+	})
+}
+
+func TestAppLocations(t *testing.T) {
+	var appDirCalls, mainExeCalls int
+	failMainExe := true
+	locations := &appLocations{
+		getApplicationDirectory: func(context.Context) (string, error) {
+			appDirCalls++
+			return "/app", nil
+		},
+		getMainExecutable: func(context.Context) (string, error) {
+			mainExeCalls++
+			if failMainExe {
+				return "", errors.New("not found")
+			}
+			return "/app/rancher-desktop", nil
+		},
+	}
+	ctx := context.Background()
+	for range 3 {
+		dir, err := locations.ApplicationDirectory(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "/app", dir)
+	}
+	assert.Equal(t, 1, appDirCalls)
+
+	// Failures are not cached.
+	_, err := locations.MainExecutable(ctx)
+	assert.Error(t, err)
+	failMainExe = false
+	for range 3 {
+		exe, err := locations.MainExecutable(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "/app/rancher-desktop", exe)
+	}
+	assert.Equal(t, 2, mainExeCalls)
+}
+
+func TestStatus(t *testing.T) {
+	s, _ := newTestShutdownData(false)
+	s.processes = fakeProcessTable{
+		100: {executable: "/qemu"},
+		200: {executable: "/app/rancher-desktop"},
+		201: {executable: "/app/rancher-desktop"},
+		300: {executable: "/unrelated"},
+	}
+	statusFunc := func(context.Context) (string, error) { return "Running", nil }
+	status, err := s.status(context.Background(), statusFunc, "/qemu")
+	require.NoError(t, err)
+	assert.Equal(t, &Status{
+		Lima: "Running",
+		Qemu: []ProcessInfo{{Pid: 100, Executable: "/qemu"}},
+		App: []ProcessInfo{
+			{Pid: 200, Executable: "/app/rancher-desktop"},
+			{Pid: 201, Executable: "/app/rancher-desktop"},
+		},
+	}, status)
+
+	t.Run("without lima or qemu", func(t *testing.T) {
+		status, err := s.status(context.Background(), nil, "")
+		require.NoError(t, err)
+		assert.Empty(t, status.Lima)
+		assert.Empty(t, status.Qemu)
+		assert.Len(t, status.App, 2)
+	})
+}
+
+func TestFinishLima(t *testing.T) {
+	testCases := []struct {
+		name              string
+		initiatingCommand InitiatingCommand
+		keepDisk          bool
+		keepVM            bool
+		expected          [][]string
+	}{
+		{
+			// Without waiting, lima is stopped straight away; as it then
+			// has stopped, it is not force-stopped.
+			name:              "shutdown",
+			initiatingCommand: Shutdown,
+			expected:          [][]string{{"stop", limaInstance}},
+		},
+		{
+			// Lima is stopped before it is deleted.
+			name:              "factory reset",
+			initiatingCommand: FactoryReset,
+			expected:          [][]string{{"stop", limaInstance}, {"delete", "--force", limaInstance}},
+		},
+		{
+			name:              "factory reset keeping disk",
+			initiatingCommand: FactoryReset,
+			keepDisk:          true,
+			expected:          [][]string{{"stop", "--force", limaInstance}},
+		},
+		{
+			name:              "factory reset keeping VM",
+			initiatingCommand: FactoryReset,
+			keepDisk:          true,
+			keepVM:            true,
+			expected:          [][]string{{"stop", limaInstance}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(false)
+			KeepDisk(tc.keepDisk)(s)
+			KeepVM(tc.keepVM)(s)
+			limactl := &fakeLimactl{}
+			s.runner = limactl
+			require.NoError(t, s.finishLima(context.Background(), tc.initiatingCommand))
+			assert.Equal(t, tc.expected, limactl.commands)
+		})
+	}
+	t.Run("unknown command", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		err := s.finishLima(context.Background(), "unknown")
+		assert.EqualError(t, err, `internal error: unknown shutdown initiating command of "unknown"`)
+	})
+}
+
+func TestStopLimaBeforeDelete(t *testing.T) {
+	deleteCommand := []string{"delete", "--force", limaInstance}
+	t.Run("stopped before delete", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{slowStop: 100}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.Equal(t, [][]string{
+			{"stop", limaInstance},
+			{"stop", "--force", limaInstance},
+			deleteCommand,
+		}, limactl.commands)
+		assert.Equal(t, LimaStoppedWithForce, s.report.LimaStop)
+	})
+	t.Run("already stopped", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{stopped: true}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.Equal(t, [][]string{deleteCommand}, limactl.commands)
+	})
+	t.Run("still running", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		StrictErrors(true)(s)
+		// The VM reports as stopped for the stop stages, but is then found
+		// running again.
+		limactl := &fakeLimactl{statuses: []string{"Stopped", "Stopped", "Running"}}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.ErrorContains(t, s.errs, "failed to stop lima before deleting it: lima is still running")
+		assert.NotContains(t, limactl.commands, deleteCommand)
+	})
+	t.Run("stop fails in strict mode", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		StrictErrors(true)(s)
+		limactl := &fakeLimactl{stopError: errors.New("failed to stop")}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.ErrorContains(t, s.errs, "failed to stop lima before deleting it: limactl stop --force 0 failed: failed to stop")
+		assert.NotContains(t, limactl.commands, deleteCommand)
+	})
+	t.Run("stop fails otherwise", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{stopError: errors.New("failed to stop")}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.Nil(t, s.errs)
+		assert.Equal(t, deleteCommand, limactl.commands[len(limactl.commands)-1])
+	})
+}
+
+func TestLimactlArgs(t *testing.T) {
+	extra := []string{"--log-level=debug", "--tty=false"}
+	testCases := []struct {
+		name              string
+		initiatingCommand InitiatingCommand
+		keepDisk          bool
+		expected          [][]string
+	}{
+		{
+			name:              "shutdown",
+			initiatingCommand: Shutdown,
+			expected: [][]string{
+				{"stop", "--log-level=debug", "--tty=false", limaInstance},
+				{"stop", "--log-level=debug", "--tty=false", "1"},
+			},
+		},
+		{
+			name:              "factory reset keeping disk",
+			initiatingCommand: FactoryReset,
+			keepDisk:          true,
+			expected: [][]string{
+				{"stop", "--force", "--log-level=debug", "--tty=false", "1"},
+				{"stop", "--force", "--log-level=debug", "--tty=false", limaInstance},
+			},
+		},
+		{
+			name:              "factory reset",
+			initiatingCommand: FactoryReset,
+			expected: [][]string{
+				{"delete", "--force", "--log-level=debug", "--tty=false", "1"},
+				{"stop", "--log-level=debug", "--tty=false", limaInstance},
+				{"delete", "--force", "--log-level=debug", "--tty=false", limaInstance},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(false)
+			KeepDisk(tc.keepDisk)(s)
+			LimactlArgs(extra...)(s)
+			limactl := &fakeLimactl{others: map[string]bool{"1": false}}
+			s.runner = limactl
+			require.NoError(t, s.finishLima(context.Background(), tc.initiatingCommand))
+			assert.Equal(t, tc.expected, limactl.commands)
+		})
+	}
+	t.Run("naming the instance", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		LimactlArgs("--log-level=debug", limaInstance)(s)
+		err := s.finishShutdown(context.Background(), Shutdown)
+		assert.ErrorIs(t, err, ErrInvalidLimactlArgs)
+		assert.ErrorContains(t, err, `"0" is the lima instance`)
+		assert.Empty(t, limactl.commands)
+	})
+}
+
+// failingLimactl is a commandRunner where every command fails after writing
+// the given message to standard error.
+type failingLimactl struct {
+	stderr string
+}
+
+func (l failingLimactl) Run(cmd *exec.Cmd) error {
+	_, _ = io.WriteString(cmd.Stderr, l.stderr)
+	return errors.New("exit status 1")
+}
+
+func (l failingLimactl) Output(cmd *exec.Cmd) ([]byte, error) {
+	_, _ = io.WriteString(cmd.Stderr, l.stderr)
+	return nil, errors.New("exit status 1")
+}
+
+func TestLimactlListContext(t *testing.T) {
+	// Listing lima instances gives up with the context, instead of waiting for
+	// a limactl that may hang; the command is never started here.
+	s, _ := newTestShutdownData(true)
+	s.runner = execRunner{}
+	s.limactl = os.Args[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.limaInstanceStatus(ctx, limaInstance)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = s.limaInstances(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestLimactlStderr(t *testing.T) {
+	const message = `level=fatal msg="instance \"0\" is in a broken state"`
+	s, _ := newTestShutdownData(true)
+	s.runner = failingLimactl{stderr: message + "\n"}
+	testCases := []struct {
+		args string
+		run  func() error
+	}{
+		{"stop 0", func() error { return s.stopLima(context.Background()) }},
+		{"stop --force 0", func() error { return s.stopLimaWithForce(context.Background()) }},
+		{"delete --force 0", func() error { return s.deleteLima(context.Background()) }},
+		{"ls --format {{.Status}} 0", func() error { _, err := s.checkLima(context.Background()); return err }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.args, func(t *testing.T) {
+			assert.EqualError(t, tc.run(), "limactl "+tc.args+" failed: exit status 1: "+message)
+		})
+	}
+	t.Run("no output", func(t *testing.T) {
+		s.runner = failingLimactl{}
+		assert.EqualError(t, s.stopLima(context.Background()), "limactl stop 0 failed: exit status 1")
+	})
+}
+
+func TestFinishOtherLimaInstances(t *testing.T) {
+	testCases := []struct {
+		name              string
+		initiatingCommand InitiatingCommand
+		keepDisk          bool
+		keepVM            bool
+		expected          [][]string
+	}{
+		{
+			name:              "shutdown",
+			initiatingCommand: Shutdown,
+			expected:          [][]string{{"stop", limaInstance}, {"stop", "1"}, {"stop", "old"}},
+		},
+		{
+			// The other instances go first, before the lima files are removed.
+			name:              "factory reset",
+			initiatingCommand: FactoryReset,
+			expected:          [][]string{{"delete", "--force", "1"}, {"delete", "--force", "old"}, {"stop", limaInstance}, {"delete", "--force", limaInstance}},
+		},
+		{
+			name:              "factory reset keeping disk",
+			initiatingCommand: FactoryReset,
+			keepDisk:          true,
+			expected:          [][]string{{"stop", "--force", "1"}, {"stop", "--force", "old"}, {"stop", "--force", limaInstance}},
+		},
+		{
+			name:              "factory reset keeping VM",
+			initiatingCommand: FactoryReset,
+			keepVM:            true,
+			expected:          [][]string{{"stop", "1"}, {"stop", "old"}, {"stop", limaInstance}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(false)
+			KeepDisk(tc.keepDisk)(s)
+			KeepVM(tc.keepVM)(s)
+			limactl := &fakeLimactl{others: map[string]bool{"old": false, "1": false}}
+			s.runner = limactl
+			require.NoError(t, s.finishLima(context.Background(), tc.initiatingCommand))
+			assert.Equal(t, tc.expected, limactl.commands)
+			assert.Equal(t, map[string]bool{"old": true, "1": true}, limactl.others)
+		})
+	}
+	t.Run("already stopped", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{others: map[string]bool{"1": true}}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+		assert.Contains(t, reportedStages(s), "lima instance 1")
+	})
+	t.Run("listing fails", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		s.runner = failingLimactl{}
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+	})
+}
+
+func TestLimaNeverStarted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	hook := logrustest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	for _, initiatingCommand := range ValidInitiatingCommands() {
+		t.Run(string(initiatingCommand), func(t *testing.T) {
+			hook.Reset()
+			s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+			limactl.absent = true
+			require.NoError(t, s.finishShutdown(context.Background(), initiatingCommand))
+			assert.Empty(t, limactl.commands)
+			assert.NotContains(t, reportedStages(s), "lima")
+			for _, entry := range hook.AllEntries() {
+				assert.Greater(t, entry.Level, logrus.ErrorLevel, "unexpected error logged: %s", entry.Message)
+			}
+		})
+	}
+	t.Run("other instances are still stopped", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		limactl.absent = true
+		limactl.others = map[string]bool{"1": false}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{{"stop", "1"}}, limactl.commands)
+	})
+}
+
+func TestQemuAlreadyExited(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	limaHome := t.TempDir()
+	instanceDir := filepath.Join(limaHome, limaInstance)
+	require.NoError(t, os.Mkdir(instanceDir, 0o755))
+	t.Run("no pid file", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		s.limaHome = limaHome
+		s.findQemu = func() (string, error) {
+			t.Error("qemu should not be looked up")
+			return "", errors.New("qemu should not be looked up")
+		}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.NotContains(t, reportedStages(s), "qemu")
+	})
+	t.Run("pid file exists", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "qemu.pid"), []byte("100\n"), 0o644))
+		t.Cleanup(func() { _ = os.Remove(filepath.Join(instanceDir, "qemu.pid")) })
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		s.limaHome = limaHome
+		var lookedUp bool
+		s.findQemu = func() (string, error) {
+			lookedUp = true
+			return "/qemu", nil
+		}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.True(t, lookedUp)
+		assert.Contains(t, reportedStages(s), "qemu")
+	})
+}
+
+func TestLimaVMType(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{"vz", "vmType: vz\n", "vz"},
+		{"quoted", "arch: aarch64\nvmType: \"vz\" # for rosetta\n", "vz"},
+		{"qemu", "vmType: qemu\n", "qemu"},
+		{"nested", "vmOpts:\n  vmType: vz\n", ""},
+		{"unset", "arch: aarch64\n", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limaHome := t.TempDir()
+			require.NoError(t, os.Mkdir(filepath.Join(limaHome, limaInstance), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(limaHome, limaInstance, "lima.yaml"), []byte(tc.config), 0o644))
+			s := &shutdownData{limaHome: limaHome}
+			assert.Equal(t, tc.expected, s.limaVMType())
+		})
+	}
+	t.Run("missing", func(t *testing.T) {
+		s := &shutdownData{limaHome: t.TempDir()}
+		assert.Equal(t, "", s.limaVMType())
+	})
+	t.Run("LIMA_HOME not known", func(t *testing.T) {
+		s := &shutdownData{}
+		assert.Equal(t, "", s.limaVMType())
+	})
+}
+
+func TestStopVZ(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	setup := func(t *testing.T, vmType string) (fakeProcessTable, string) {
+		limaHome := t.TempDir()
+		instanceDir := filepath.Join(limaHome, limaInstance)
+		require.NoError(t, os.Mkdir(instanceDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "lima.yaml"), []byte("vmType: "+vmType+"\n"), 0o644))
+		return fakeProcessTable{
+			100: {executable: vzExecutable, openDir: instanceDir, exitOn: []os.Signal{syscall.SIGTERM}},
+			// Another application's VM.
+			101: {executable: vzExecutable, openDir: "/Users/me/VMs/other"},
+		}, limaHome
+	}
+	t.Run("vz backend", func(t *testing.T) {
+		table, limaHome := setup(t, "vz")
+		s, _, _ := newTestFinishShutdown(table)
+		s.limaHome = limaHome
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []os.Signal{syscall.SIGTERM}, table[100].received)
+		assert.True(t, table[100].exited)
+		assert.Empty(t, table[101].received)
+		assert.Contains(t, reportedStages(s), "vz")
+	})
+	t.Run("vz helper ignores SIGTERM", func(t *testing.T) {
+		table, limaHome := setup(t, "vz")
+		table[100].exitOn = []os.Signal{syscall.SIGKILL}
+		s, _, _ := newTestFinishShutdown(table)
+		s.limaHome = limaHome
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []os.Signal{syscall.SIGTERM, syscall.SIGKILL}, table[100].received)
+		assert.True(t, table[100].exited)
+		assert.Empty(t, table[101].received)
+	})
+	t.Run("qemu backend", func(t *testing.T) {
+		table, limaHome := setup(t, "qemu")
+		s, _, _ := newTestFinishShutdown(table)
+		s.limaHome = limaHome
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Empty(t, table[100].received)
+		assert.NotContains(t, reportedStages(s), "vz")
+	})
+}
+
+func TestLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), limaHostAgentLog)
+	require.NoError(t, os.WriteFile(path, []byte("already written\n"), 0o644))
+	appendLog := func(text string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = file.WriteString(text)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	var lines []string
+	tail := newLogTail(path, func(line string) { lines = append(lines, line) })
+	tail.poll()
+	assert.Empty(t, lines)
+	appendLog("one\ntw")
+	tail.poll()
+	assert.Equal(t, []string{"one"}, lines)
+	appendLog("o\r\nthree")
+	tail.poll()
+	assert.Equal(t, []string{"one", "two"}, lines)
+	tail.stop()
+	assert.Equal(t, []string{"one", "two", "three"}, lines)
+	appendLog("\nafter stopping\n")
+	tail.poll()
+	tail.stop()
+	assert.Equal(t, []string{"one", "two", "three"}, lines)
+
+	t.Run("truncated", func(t *testing.T) {
+		var lines []string
+		tail := newLogTail(path, func(line string) { lines = append(lines, line) })
+		require.NoError(t, os.WriteFile(path, []byte("new\n"), 0o644))
+		tail.poll()
+		assert.Equal(t, []string{"new"}, lines)
+	})
+	t.Run("missing", func(t *testing.T) {
+		var lines []string
+		missing := filepath.Join(t.TempDir(), limaHostAgentLog)
+		tail := newLogTail(missing, func(line string) { lines = append(lines, line) })
+		tail.poll()
+		require.NoError(t, os.WriteFile(missing, []byte("created\n"), 0o644))
+		tail.stop()
+		assert.Equal(t, []string{"created"}, lines)
+	})
+}
+
+func TestTailLimaLog(t *testing.T) {
+	limaHome := t.TempDir()
+	instanceDir := filepath.Join(limaHome, limaInstance)
+	require.NoError(t, os.Mkdir(instanceDir, 0o755))
+	logPath := filepath.Join(instanceDir, limaHostAgentLog)
+	setup := func(t *testing.T, tail bool) (*shutdownData, *logrustest.Hook, *[]string) {
+		require.NoError(t, os.WriteFile(logPath, []byte("before shutdown\n"), 0o644))
+		hook := logrustest.NewGlobal()
+		logrus.SetLevel(logrus.DebugLevel)
+		t.Cleanup(func() { logrus.SetLevel(logrus.InfoLevel) })
+		s, clock := newTestShutdownData(true)
+		s.limaHome = limaHome
+		s.runner = &fakeLimactl{slowStop: 3}
+		TailLimaLog(tail)(s)
+		var written []string
+		// The host agent logs something while it is being waited for.
+		clock.onSleep = func() {
+			line := fmt.Sprintf("hostagent line %d", len(written))
+			written = append(written, line)
+			file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+			require.NoError(t, err)
+			_, err = fmt.Fprintln(file, line)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+		}
+		return s, hook, &written
+	}
+	// emitted returns the lines of the log that were logged.
+	emitted := func(hook *logrustest.Hook) []string {
+		var result []string
+		for _, entry := range hook.AllEntries() {
+			if line, ok := strings.CutPrefix(entry.Message, "lima host agent: "); ok {
+				assert.Equal(t, logrus.DebugLevel, entry.Level)
+				result = append(result, line)
+			}
+		}
+		return result
+	}
+	t.Run("enabled", func(t *testing.T) {
+		s, hook, written := setup(t, true)
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaStoppedGracefully, method)
+		require.NotEmpty(t, *written)
+		assert.Equal(t, *written, emitted(hook))
+	})
+	t.Run("disabled", func(t *testing.T) {
+		s, hook, written := setup(t, false)
+		_, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		require.NotEmpty(t, *written)
+		assert.Empty(t, emitted(hook))
+	})
+}
+
+func TestTailBuffer(t *testing.T) {
+	t.Run("within the limit", func(t *testing.T) {
+		b := newTailBuffer(8)
+		_, _ = io.WriteString(b, "abc")
+		_, _ = io.WriteString(b, "defgh")
+		assert.Equal(t, "abcdefgh", b.String())
+	})
+	t.Run("truncated", func(t *testing.T) {
+		b := newTailBuffer(8)
+		_, _ = io.WriteString(b, "abcdef")
+		n, err := io.WriteString(b, "ghijk")
+		require.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, "...defghijk", b.String())
+	})
+	t.Run("single large write", func(t *testing.T) {
+		b := newTailBuffer(4)
+		_, _ = io.WriteString(b, "abcdefgh")
+		assert.Equal(t, "...efgh", b.String())
+	})
+	t.Run("limactl error", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		s.runner = failingLimactl{stderr: strings.Repeat("x", limactlOutputLimit) + "the actual error\n"}
+		err := s.stopLima(context.Background())
+		require.Error(t, err)
+		assert.True(t, strings.HasSuffix(err.Error(), "exit status 1: ..."+strings.Repeat("x", limactlOutputLimit-17)+"the actual error"))
+	})
+}
+
+func TestFinishLimaSharedDeadline(t *testing.T) {
+	stop := []string{"stop", limaInstance}
+	forceStop := []string{"stop", "--force", limaInstance}
+	t.Run("stops just after graceful checks", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		// The VM is still reported as running for the first few checks after
+		// the graceful stop, which would previously have been force-stopped.
+		limactl := &fakeLimactl{slowStop: 3}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{stop}, limactl.commands)
+		if assert.Len(t, s.report.Stages, 2) {
+			assert.Equal(t, OutcomeForceKilled, s.report.Stages[0].Outcome, "graceful stop should be issued")
+			assert.Equal(t, OutcomeExited, s.report.Stages[1].Outcome)
+		}
+		assert.Equal(t, LimaStoppedGracefully, s.report.LimaStop)
+		assert.Less(t, clock.now.Sub(newFakeClock().now), limaStopTimeout)
+	})
+	t.Run("force-stops after the shared deadline", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		limactl := &fakeLimactl{slowStop: 1000}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{stop, forceStop}, limactl.commands)
+		assert.Equal(t, LimaStoppedWithForce, s.report.LimaStop)
+		assert.Equal(t, limaStopTimeout, clock.now.Sub(newFakeClock().now))
+	})
+}
+
+func TestStopLimaVM(t *testing.T) {
+	t.Run("already stopped", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{stopped: true}
+		s.runner = limactl
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaAlreadyStopped, method)
+		assert.Empty(t, limactl.commands)
+		assert.Len(t, s.report.Stages, 1)
+	})
+	t.Run("graceful stop suffices", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaStoppedGracefully, method)
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+	})
+	t.Run("force required", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{slowStop: 1000}
+		s.runner = limactl
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaStoppedWithForce, method)
+		assert.Equal(t, [][]string{{"stop", limaInstance}, {"stop", "--force", limaInstance}}, limactl.commands)
+	})
+	t.Run("force fails", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		s.runner = &fakeLimactl{stopError: errors.New("stop failed")}
+		method, err := s.stopLimaVM(context.Background())
+		assert.ErrorContains(t, err, "stop failed")
+		assert.Empty(t, method)
+	})
+	t.Run("not waiting", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		limactl := &fakeLimactl{slowStop: 1000}
+		s.runner = limactl
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaStoppedWithForce, method)
+		assert.Equal(t, [][]string{{"stop", limaInstance}, {"stop", "--force", limaInstance}}, limactl.commands)
+	})
+	t.Run("asking only", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		AskOnly(true)(s)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		method, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, LimaStoppedGracefully, method)
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+	})
+}
+
+func TestWaitForStableLima(t *testing.T) {
+	stop := []string{"stop", limaInstance}
+	t.Run("waits for start to finish", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		limactl := &fakeLimactl{statuses: []string{"Starting", "Starting", "Running"}}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, []time.Duration{exitPollInterval, exitPollInterval}, clock.sleeps)
+		if assert.NotEmpty(t, limactl.commands) {
+			assert.Equal(t, stop, limactl.commands[0])
+		}
+		assert.Empty(t, limactl.statuses, "all statuses should have been checked")
+	})
+	t.Run("stable immediately", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		limactl := &fakeLimactl{statuses: []string{"Running"}}
+		s.runner = limactl
+		require.NoError(t, s.waitForStableLima(context.Background()))
+		assert.Empty(t, clock.sleeps)
+	})
+	t.Run("gives up after timeout", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		statuses := make([]string, 100)
+		for i := range statuses {
+			statuses[i] = "Installing"
+		}
+		s.runner = &fakeLimactl{statuses: statuses}
+		err := s.waitForStableLima(context.Background())
+		assert.EqualError(t, err, fmt.Sprintf(`lima is still "Installing" after %s`, limaSettleTimeout))
+		assert.Equal(t, limaSettleTimeout, clock.now.Sub(newFakeClock().now))
+	})
+	t.Run("factory reset", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		limactl := &fakeLimactl{statuses: []string{"Starting", "Stopped"}}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.Equal(t, []time.Duration{exitPollInterval}, clock.sleeps)
+		assert.Equal(t, [][]string{{"stop", limaInstance}, {"delete", "--force", limaInstance}}, limactl.commands)
+	})
+}
+
+func TestGracefulGuestShutdown(t *testing.T) {
+	poweroff := []string{"shell", limaInstance, "sudo", "poweroff"}
+	t.Run("guest powers off", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		GracefulGuestShutdown(true)(s)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{poweroff}, limactl.commands)
+		assert.Empty(t, clock.sleeps)
+	})
+	t.Run("escalates to host stop", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		GracefulGuestShutdown(true)(s)
+		limactl := &fakeLimactl{ignorePoweroff: true}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{poweroff, {"stop", limaInstance}}, limactl.commands)
+		assert.Equal(t, guestShutdownTimeout, clock.now.Sub(newFakeClock().now))
+	})
+	t.Run("disabled by default", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.NotContains(t, limactl.commands, poweroff)
+	})
+	t.Run("guest agent unresponsive", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		GracefulGuestShutdown(true)(s)
+		s.guestConnectTimeout = 10 * time.Millisecond
+		limactl := &fakeLimactl{}
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		s.runner = hangingShell{fakeLimactl: limactl, release: release}
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		// The guest is not waited for; lima is stopped from the host.
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+		assert.Empty(t, clock.sleeps)
+	})
+}
+
+// hangingShell is a commandRunner where `limactl shell` does not return until
+// released, as if the guest agent were unresponsive; other commands are passed
+// to the fakeLimactl.
+type hangingShell struct {
+	*fakeLimactl
+	release chan struct{}
+}
+
+func (h hangingShell) Run(cmd *exec.Cmd) error {
+	if len(cmd.Args) > 1 && cmd.Args[1] == "shell" {
+		<-h.release
+		return errors.New("signal: killed")
+	}
+	return h.fakeLimactl.Run(cmd)
+}
+
+// deletingLimactl is a fakeLimactl that removes the instance directory when the
+// instance is deleted.
+type deletingLimactl struct {
+	*fakeLimactl
+	instanceDir string
+}
+
+func (d deletingLimactl) Run(cmd *exec.Cmd) error {
+	if len(cmd.Args) > 1 && cmd.Args[1] == "delete" {
+		if err := os.RemoveAll(d.instanceDir); err != nil {
+			return err
+		}
+	}
+	return d.fakeLimactl.Run(cmd)
+}
+
+func TestSaveLimaLogs(t *testing.T) {
+	limaHome := t.TempDir()
+	setup := func(t *testing.T) (*shutdownData, string) {
+		instanceDir := filepath.Join(limaHome, limaInstance)
+		require.NoError(t, os.MkdirAll(instanceDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "ha.stderr.log"), []byte("hostagent failed"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "serial.log"), []byte("kernel panic"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "lima.yaml"), nil, 0o644))
+		s, _ := newTestShutdownData(false)
+		s.limaHome = limaHome
+		s.runner = deletingLimactl{fakeLimactl: &fakeLimactl{}, instanceDir: instanceDir}
+		return s, instanceDir
+	}
+	t.Run("copied before delete", func(t *testing.T) {
+		s, instanceDir := setup(t)
+		logsDir := filepath.Join(t.TempDir(), "logs")
+		SaveLimaLogs(logsDir)(s)
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.NoDirExists(t, instanceDir)
+		contents, err := os.ReadFile(filepath.Join(logsDir, "lima.ha.stderr.log"))
+		require.NoError(t, err)
+		assert.Equal(t, "hostagent failed", string(contents))
+		contents, err = os.ReadFile(filepath.Join(logsDir, "lima.serial.log"))
+		require.NoError(t, err)
+		assert.Equal(t, "kernel panic", string(contents))
+		assert.NoFileExists(t, filepath.Join(logsDir, "lima.lima.yaml"))
+	})
+	t.Run("not saved by default", func(t *testing.T) {
+		s, instanceDir := setup(t)
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.NoDirExists(t, instanceDir)
+	})
+	t.Run("failure is not fatal", func(t *testing.T) {
+		s, instanceDir := setup(t)
+		logsFile := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(logsFile, nil, 0o644))
+		SaveLimaLogs(logsFile)(s)
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.NoDirExists(t, instanceDir)
+	})
+}
+
+func TestSnapshotLima(t *testing.T) {
+	limaHome := t.TempDir()
+	setup := func(t *testing.T) (*shutdownData, *fakeLimactl, string) {
+		instanceDir := filepath.Join(limaHome, limaInstance)
+		require.NoError(t, os.MkdirAll(instanceDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "lima.yaml"), []byte("vmType: qemu"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(instanceDir, "diffdisk"), []byte("disk"), 0o644))
+		s, _ := newTestShutdownData(true)
+		s.limaHome = limaHome
+		limactl := &fakeLimactl{}
+		s.runner = deletingLimactl{fakeLimactl: limactl, instanceDir: instanceDir}
+		return s, limactl, instanceDir
+	}
+	t.Run("saved before delete", func(t *testing.T) {
+		s, limactl, _ := setup(t)
+		snapshotDir := filepath.Join(t.TempDir(), "snapshots")
+		SnapshotLima(snapshotDir, false)(s)
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.Equal(t, [][]string{
+			{"stop", "--force", limaInstance},
+			{"snapshot", "create", limaInstance, "--tag", limaSnapshotTag},
+			{"delete", "--force", limaInstance},
+		}, limactl.commands)
+		archives, err := filepath.Glob(filepath.Join(snapshotDir, "lima-0-*.tar"))
+		require.NoError(t, err)
+		require.Len(t, archives, 1)
+		input, err := os.Open(archives[0])
+		require.NoError(t, err)
+		defer input.Close()
+		contents := map[string]string{}
+		reader := tar.NewReader(input)
+		for {
+			header, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			contents[header.Name] = string(data)
+		}
+		assert.Equal(t, map[string]string{
+			limaInstance:                "",
+			limaInstance + "/lima.yaml": "vmType: qemu",
+			limaInstance + "/diffdisk":  "disk",
+		}, contents)
+	})
+	t.Run("failure is not fatal", func(t *testing.T) {
+		s, _, instanceDir := setup(t)
+		snapshotFile := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(snapshotFile, nil, 0o644))
+		SnapshotLima(snapshotFile, false)(s)
+		assert.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		assert.NoDirExists(t, instanceDir)
+	})
+	t.Run("required", func(t *testing.T) {
+		s, limactl, instanceDir := setup(t)
+		snapshotFile := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(snapshotFile, nil, 0o644))
+		SnapshotLima(snapshotFile, true)(s)
+		assert.ErrorContains(t, s.finishLima(context.Background(), FactoryReset), "not deleting lima")
+		assert.DirExists(t, instanceDir)
+		assert.NotContains(t, limactl.commands, []string{"delete", "--force", limaInstance})
+	})
+	t.Run("required, lima can't be stopped", func(t *testing.T) {
+		s, limactl, instanceDir := setup(t)
+		limactl.stopError = errors.New("failed to stop")
+		snapshotDir := t.TempDir()
+		SnapshotLima(snapshotDir, true)(s)
+		assert.ErrorContains(t, s.finishLima(context.Background(), FactoryReset), "failed to stop lima")
+		assert.DirExists(t, instanceDir)
+		archives, err := filepath.Glob(filepath.Join(snapshotDir, "*"))
+		require.NoError(t, err)
+		assert.Empty(t, archives)
+	})
+}
+
+func TestWaitForAppToDieOrKillItTiming(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	t.Cleanup(hook.Reset)
+	infoMessages := func() []string {
+		var messages []string
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.InfoLevel {
+				assert.Contains(t, entry.Data, "operation")
+				messages = append(messages, entry.Message)
+			}
+		}
+		return messages
+	}
+	killFunc := func(context.Context) error { return nil }
+
+	t.Run("exits while waiting", func(t *testing.T) {
+		hook.Reset()
+		s, _ := newTestShutdownData(true)
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(3), killFunc, 15, 2, "lima")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Finished stopping lima after 6s"}, infoMessages())
+	})
+	t.Run("force killed", func(t *testing.T) {
+		hook.Reset()
+		s, clock := newTestShutdownData(true)
+		slowKill := func(ctx context.Context) error {
+			return clock.Sleep(ctx, 500*time.Millisecond)
+		}
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), slowKill, 5, 1, "the app")
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Waited 4s for the app to exit; about to force-kill it",
+			"Finished stopping the app after 4.5s",
+		}, infoMessages())
+	})
+}
+
+func TestTerminateRancherDesktopFunc(t *testing.T) {
+	testCases := []struct {
+		name  string
+		pgid  int
+		group bool
+	}{
+		{name: "group leader", pgid: 200, group: true},
+		{name: "not group leader", pgid: 100, group: runtime.GOOS != "linux"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(false)
+			table := fakeProcessTable{200: {executable: "/app/rancher-desktop", pgid: tc.pgid}}
+			s.processes = table
+			require.NoError(t, s.terminateRancherDesktopFunc("/app", true)(context.Background()))
+			assert.Equal(t, tc.group, table[200].groupKilled, "process group killed")
+			assert.Equal(t, runtime.GOOS != "linux" || !tc.group, table[200].exited, "directory scanned")
+		})
+	}
+}
+
+func TestQuitAppGracefully(t *testing.T) {
+	setup := func(t *testing.T, quitApp func(context.Context) error) (*shutdownData, *fakeClock, fakeProcessTable) {
+		s, clock := newTestShutdownData(true)
+		table := fakeProcessTable{200: {executable: "/app/rancher-desktop", pgid: 200}}
+		s.processes = table
+		s.quitApp = quitApp
+		return s, clock, table
+	}
+	t.Run("app quits", func(t *testing.T) {
+		var table fakeProcessTable
+		s, clock, table := setup(t, func(context.Context) error {
+			table[200].exited = true
+			return nil
+		})
+		require.NoError(t, s.stopRancherDesktopFunc("/app")(context.Background()))
+		assert.False(t, table[200].groupKilled, "the app should not be killed")
+		assert.Empty(t, table[200].received)
+		assert.Empty(t, clock.sleeps)
+	})
+	t.Run("app exits slowly", func(t *testing.T) {
+		s, clock, table := setup(t, func(context.Context) error { return nil })
+		sleeps := 0
+		clock.onSleep = func() {
+			if sleeps++; sleeps == 2 {
+				table[200].exited = true
+			}
+		}
+		require.NoError(t, s.stopRancherDesktopFunc("/app")(context.Background()))
+		assert.False(t, table[200].groupKilled, "the app should not be killed")
+		assert.Equal(t, []time.Duration{exitPollInterval, exitPollInterval}, clock.sleeps)
+	})
+	t.Run("app does not quit in time", func(t *testing.T) {
+		s, clock, table := setup(t, func(context.Context) error { return nil })
+		require.NoError(t, s.stopRancherDesktopFunc("/app")(context.Background()))
+		assert.True(t, table[200].groupKilled, "the app should be killed after the grace period")
+		assert.Equal(t, appQuitTimeout, clock.now.Sub(newFakeClock().now))
+	})
+	t.Run("asking the app to quit fails", func(t *testing.T) {
+		s, clock, table := setup(t, func(context.Context) error {
+			return errors.New("osascript failed: exit status 1")
+		})
+		require.NoError(t, s.stopRancherDesktopFunc("/app")(context.Background()))
+		assert.True(t, table[200].groupKilled, "the app should be killed")
+		assert.Empty(t, clock.sleeps)
+	})
+}
+
+func TestQuitAppOnlyWhenGraceful(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	setup := func(t *testing.T, wait bool) (*shutdownData, *fakeLimactl, fakeProcessTable) {
+		table := fakeProcessTable{
+			100: {executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, exitOn: []os.Signal{syscall.SIGKILL}},
+			200: {executable: "/app/rancher-desktop", pgid: 200, exitOn: []os.Signal{syscall.SIGKILL}},
+		}
+		s, _, limactl := newTestFinishShutdown(table)
+		s.waitForShutdown = wait
+		s.quitApp = func(context.Context) error {
+			t.Error("the app should not be asked to quit")
+			return nil
+		}
+		return s, limactl, table
+	}
+	t.Run("orphans", func(t *testing.T) {
+		s, _, table := setup(t, true)
+		_, err := s.killOrphans(context.Background(), true, "/qemu")
+		require.NoError(t, err)
+		assert.True(t, table[200].groupKilled, "the app should be killed")
+	})
+	t.Run("not waiting", func(t *testing.T) {
+		s, _, table := setup(t, false)
+		require.NoError(t, s.stopRancherDesktopFunc("/app")(context.Background()))
+		assert.True(t, table[200].groupKilled, "the app should be killed")
+	})
+	t.Run("remaining processes", func(t *testing.T) {
+		s, limactl, table := setup(t, false)
+		AskOnly(true)(s)
+		limactl.slowStop = 1000
+		KillRemaining(true)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.True(t, table[200].groupKilled, "the app should be killed")
+	})
+}
+
+func TestKillOrphans(t *testing.T) {
+	t.Run("kills everything", func(t *testing.T) {
+		// KillOrphans does not wait for anything.
+		s, clock := newTestShutdownData(false)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		table := fakeProcessTable{
+			100: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGKILL}},
+			101: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGKILL}},
+			// The app is not a process group leader, so the app directory is
+			// scanned for processes.
+			200: {executable: "/app/rancher-desktop", pgid: 1},
+			201: {executable: "/app/helper", pgid: 1},
+		}
+		s.processes = table
+		result, err := s.killOrphans(context.Background(), true, "/qemu")
+		require.NoError(t, err)
+		assert.Equal(t, &KilledProcesses{LimaStopped: true, Qemu: []int{100, 101}, App: []int{200}}, result)
+		assert.Equal(t, [][]string{{"stop", "--force", limaInstance}}, limactl.commands)
+		assert.Equal(t, []os.Signal{syscall.SIGKILL}, table[100].received)
+		assert.Equal(t, []os.Signal{syscall.SIGKILL}, table[101].received)
+		assert.True(t, table[200].groupKilled || table[200].exited, "app should be terminated")
+		assert.Equal(t, []os.Signal{os.Kill}, table[201].received, "app processes should be killed forcibly")
+		assert.Empty(t, clock.sleeps, "should not wait for graceful exit")
+	})
+	t.Run("nothing running", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{stopped: true}
+		s.runner = limactl
+		result, err := s.killOrphans(context.Background(), true, "/qemu")
+		require.NoError(t, err)
+		assert.Equal(t, &KilledProcesses{Qemu: []int{}, App: []int{}}, result)
+		assert.Empty(t, limactl.commands)
+	})
+	t.Run("app not terminated", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		s.runner = &fakeLimactl{stopped: true}
+		proc := &fakeProcess{executable: "/app/rancher-desktop", pgid: 1, exitOn: []os.Signal{os.Kill}}
+		s.processes = fakeProcessTable{1: proc}
+		result, err := s.killOrphans(context.Background(), true, "/qemu")
+		assert.ErrorIs(t, err, ErrUnsafePid)
+		assert.Empty(t, result.App, "the app should only be reported once it has been terminated")
+	})
+}
+
+func TestKillOrphanedApp(t *testing.T) {
+	// This is what KillOrphans (and KillRemaining) do on Windows.
+	t.Run("kills the app", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		table := fakeProcessTable{
+			100: {executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}},
+			101: {executable: "/app/resources/helper", parent: 100},
+		}
+		s.processes = table
+		s.jobs = fakeJobAPI{table: table}
+		killedDirectory := false
+		s.killWindowsApp = func(context.Context) error {
+			killedDirectory = true
+			return nil
+		}
+		result, err := s.killOrphanedApp(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, &KilledProcesses{Qemu: []int{}, App: []int{100}}, result)
+		assert.True(t, table[100].jobKilled)
+		assert.True(t, table[101].jobKilled)
+		assert.True(t, killedDirectory, "helpers left in the app directory should be killed")
+	})
+	t.Run("not terminated", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		proc := &fakeProcess{executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}}
+		s.processes = fakeProcessTable{1: proc}
+		s.killWindowsApp = func(context.Context) error { return nil }
+		result, err := s.killOrphanedApp(context.Background())
+		assert.ErrorIs(t, err, ErrUnsafePid)
+		assert.Empty(t, result.App)
+		assert.Empty(t, proc.received)
+	})
+	t.Run("skipped", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		SkipAppTermination(true)(s)
+		s.killWindowsApp = func(context.Context) error { return errors.New("should not be called") }
+		result, err := s.killOrphanedApp(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, &KilledProcesses{Qemu: []int{}, App: []int{}}, result)
+	})
+}
+
+func TestKillRemaining(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	newTable := func() fakeProcessTable {
+		// Nothing exits unless it is killed.
+		return fakeProcessTable{
+			100: {executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, exitOn: []os.Signal{syscall.SIGKILL}},
+			200: {executable: "/app/rancher-desktop", pgid: 1, exitOn: []os.Signal{syscall.SIGKILL}},
+			201: {executable: "/app/helper", pgid: 1, exitOn: []os.Signal{syscall.SIGKILL}},
+		}
+	}
+	t.Run("kills everything left", func(t *testing.T) {
+		table := newTable()
+		s, _, limactl := newTestFinishShutdown(table)
+		// Shutdown only asks everything to stop once.
+		s.waitForShutdown = false
+		AskOnly(true)(s)
+		// Lima never gets around to stopping.
+		limactl.slowStop = 1000
+		KillRemaining(true)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, &KilledProcesses{LimaStopped: true, Qemu: []int{100}, App: []int{200}}, s.report.Killed)
+		assert.Equal(t, []string{"stop", "--force", limaInstance}, limactl.commands[len(limactl.commands)-1])
+		for pid, proc := range table {
+			assert.True(t, proc.exited, "process %d should have been killed", pid)
+			assert.Contains(t, proc.received, syscall.SIGKILL, "process %d should have been killed", pid)
+		}
+	})
+	t.Run("skipped stages", func(t *testing.T) {
+		table := newTable()
+		s, _, limactl := newTestFinishShutdown(table)
+		s.waitForShutdown = false
+		AskOnly(true)(s)
+		limactl.slowStop = 1000
+		KillRemaining(true)(s)
+		SkipLima(true)(s)
+		SkipAppTermination(true)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, &KilledProcesses{Qemu: []int{100}, App: []int{}}, s.report.Killed)
+		assert.Empty(t, limactl.commands)
+		assert.Empty(t, table[200].received)
+		assert.Empty(t, table[201].received)
+	})
+	t.Run("not requested", func(t *testing.T) {
+		table := newTable()
+		s, _, _ := newTestFinishShutdown(table)
+		s.waitForShutdown = false
+		AskOnly(true)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Nil(t, s.report.Killed)
+		assert.False(t, table[100].exited)
+	})
+}
+
+func TestWaitForAppToDieOrKillItOutcome(t *testing.T) {
+	errCheck := errors.New("check failed")
+	errKill := errors.New("kill failed")
+	killOK := func(context.Context) error { return nil }
+	testCases := []struct {
+		name            string
+		waitForShutdown bool
+		checkFunc       func() (bool, error)
+		killFunc        func(context.Context) error
+		outcome         StageOutcome
+		elapsed         time.Duration
+		err             error
+	}{
+		{
+			name:            "already gone",
+			waitForShutdown: true,
+			checkFunc:       runningFor(0),
+			killFunc:        killOK,
+			outcome:         OutcomeAlreadyGone,
+		},
+		{
+			name:            "exited during wait",
+			waitForShutdown: true,
+			checkFunc:       runningFor(2),
+			killFunc:        killOK,
+			outcome:         OutcomeExited,
+			elapsed:         4 * time.Second,
+		},
+		{
+			name:            "force killed",
+			waitForShutdown: true,
+			checkFunc:       runningFor(100),
+			killFunc:        killOK,
+			outcome:         OutcomeForceKilled,
+			elapsed:         8 * time.Second,
+		},
+		{
+			name:      "not waiting",
+			checkFunc: runningFor(100),
+			killFunc:  killOK,
+			outcome:   OutcomeForceKilled,
+		},
+		{
+			name:      "not waiting, not running",
+			checkFunc: runningFor(0),
+			killFunc:  killOK,
+			outcome:   OutcomeAlreadyGone,
+		},
+		{
+			// Without waiting, a failed check does not stop the kill.
+			name:      "not waiting, check error",
+			checkFunc: func() (bool, error) { return false, errCheck },
+			killFunc:  killOK,
+			outcome:   OutcomeForceKilled,
+		},
+		{
+			name:            "check error",
+			waitForShutdown: true,
+			checkFunc:       func() (bool, error) { return false, errCheck },
+			killFunc:        killOK,
+			outcome:         OutcomeError,
+			err:             errCheck,
+		},
+		{
+			name:      "kill error",
+			checkFunc: runningFor(100),
+			killFunc:  func(context.Context) error { return errKill },
+			outcome:   OutcomeError,
+			err:       errKill,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestShutdownData(tc.waitForShutdown)
+			err := s.runStage(context.Background(), tc.checkFunc, tc.killFunc, 5, 2, "qemu")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			require.Len(t, s.report.Stages, 1)
+			stage := s.report.Stages[0]
+			assert.Equal(t, "qemu", stage.Operation)
+			assert.Equal(t, tc.outcome, stage.Outcome)
+			assert.Equal(t, tc.elapsed, stage.Elapsed)
+			assert.Equal(t, err, stage.Err)
+		})
+	}
+}
+
+// deadlineContext is a context with a deadline on a fakeClock; the deadline
+// only affects how long shutdown plans to wait, as the context never expires.
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func TestStageRetries(t *testing.T) {
+	testCases := []struct {
+		name     string
+		timeout  time.Duration
+		retries  int
+		expected int
+	}{
+		{name: "short deadline", timeout: 10 * time.Second, retries: 15, expected: 5},
+		{name: "odd deadline", timeout: 11 * time.Second, retries: 15, expected: 5},
+		{name: "long deadline", timeout: time.Minute, retries: 15, expected: 15},
+		{name: "longer deadline", timeout: 20 * time.Second, retries: 15, expected: 10},
+		{name: "deadline shorter than the poll interval", timeout: time.Second, retries: 15, expected: 1},
+		{name: "deadline passed", timeout: -time.Second, retries: 15, expected: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, clock := newTestShutdownData(true)
+			ctx := deadlineContext{Context: context.Background(), deadline: clock.now.Add(tc.timeout)}
+			assert.Equal(t, tc.expected, s.stageRetries(ctx, tc.retries, 2))
+		})
+	}
+	t.Run("no deadline", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		assert.Equal(t, 15, s.stageRetries(context.Background(), 15, 2))
+	})
+	t.Run("no poll interval", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		ctx := deadlineContext{Context: context.Background(), deadline: clock.now}
+		assert.Equal(t, 1, s.stageRetries(ctx, 1, 0))
+	})
+	t.Run("stage is killed before the deadline", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		start := clock.now
+		ctx := deadlineContext{Context: context.Background(), deadline: clock.now.Add(10 * time.Second)}
+		killed := false
+		kill := func(context.Context) error {
+			killed = true
+			return nil
+		}
+		require.NoError(t, s.runStage(ctx, runningFor(100), kill, 15, 2, "qemu"))
+		assert.True(t, killed)
+		assert.Len(t, clock.sleeps, 4)
+		assert.Equal(t, 8*time.Second, clock.now.Sub(start))
+		assert.Equal(t, OutcomeForceKilled, s.report.lastOutcome())
+	})
+}
+
+func TestKillRetries(t *testing.T) {
+	transient := &os.PathError{Op: "fork/exec", Path: "/limactl", Err: syscall.EAGAIN}
+	// failingKill returns a kill function that fails with the given errors, one
+	// per call, before succeeding.
+	failingKill := func(calls *int, errs ...error) func(context.Context) error {
+		return func(context.Context) error {
+			*calls++
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+	}
+	t.Run("transient error is retried", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		calls := 0
+		err := s.runStage(context.Background(), runningFor(100), failingKill(&calls, transient), 1, 2, "lima")
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, []time.Duration{2 * time.Second}, clock.sleeps)
+		assert.Equal(t, OutcomeForceKilled, s.report.lastOutcome())
+	})
+	t.Run("retries are bounded", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		calls := 0
+		kill := failingKill(&calls, transient, transient, transient, transient)
+		err := s.runStage(context.Background(), runningFor(100), kill, 1, 2, "lima")
+		assert.ErrorIs(t, err, syscall.EAGAIN)
+		assert.Equal(t, killAttempts, calls)
+		assert.Len(t, clock.sleeps, killAttempts-1)
+		assert.Equal(t, OutcomeError, s.report.lastOutcome())
+	})
+	t.Run("permission error is not retried", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		calls := 0
+		errPermission := fmt.Errorf("failed to kill process 100: %w", syscall.EPERM)
+		err := s.runStage(context.Background(), runningFor(100), failingKill(&calls, errPermission), 1, 2, "qemu")
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, clock.sleeps)
+	})
+	t.Run("fatal errors take precedence", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		calls := 0
+		errs := multierror.Append(nil, transient, fmt.Errorf("%w to stop the helper", ErrInsufficientPrivileges))
+		err := s.runStage(context.Background(), runningFor(100), failingKill(&calls, errs), 1, 2, "qemu")
+		assert.ErrorIs(t, err, ErrInsufficientPrivileges)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("retried without waiting too", func(t *testing.T) {
+		s, clock := newTestShutdownData(false)
+		calls := 0
+		err := s.runStage(context.Background(), runningFor(100), failingKill(&calls, transient), 1, 2, "lima")
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, []time.Duration{2 * time.Second}, clock.sleeps)
+	})
+	t.Run("limactl failing is retried", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("needs a shell")
+		}
+		exitErr := exec.Command("/bin/sh", "-c", "exit 1").Run()
+		require.IsType(t, &exec.ExitError{}, exitErr)
+		s, clock := newTestShutdownData(true)
+		calls := 0
+		limactlErr := limactlError(exec.Command("/limactl", "stop", limaInstance), exitErr, &strings.Builder{})
+		err := s.runStage(context.Background(), runningFor(100), failingKill(&calls, limactlErr), 1, 2, "lima")
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, []time.Duration{2 * time.Second}, clock.sleeps)
+	})
+}
+
+func TestIsRecoverableKillError(t *testing.T) {
+	testCases := []struct {
+		name        string
+		err         error
+		recoverable bool
+	}{
+		{"fork failed", &os.PathError{Op: "fork/exec", Path: "/limactl", Err: syscall.EAGAIN}, true},
+		{"limactl exited", fmt.Errorf("limactl stop 0 failed: %w", &exec.ExitError{}), true},
+		{"limactl not found", &exec.Error{Name: "limactl", Err: exec.ErrNotFound}, false},
+		{"limactl missing", &os.PathError{Op: "fork/exec", Path: "/limactl", Err: syscall.ENOENT}, false},
+		{"permission denied", fmt.Errorf("failed to kill process 100: %w", syscall.EPERM), false},
+		{"canceled", fmt.Errorf("limactl stop 0 failed: %w", context.Canceled), false},
+		{"unknown", errors.New("something else"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.recoverable, isRecoverableKillError(tc.err))
+		})
+	}
+}
+
+func TestPollJitter(t *testing.T) {
+	t.Run("no jitter by default", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), killNothing, 5, 2, "qemu")
+		require.NoError(t, err)
+		assert.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second}, clock.sleeps)
+	})
+	t.Run("within bounds", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		PollJitter(0.25)(s)
+		s.random = rand.New(rand.NewSource(1))
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(1000), killNothing, 100, 2, "qemu")
+		require.NoError(t, err)
+		require.Len(t, clock.sleeps, 99)
+		for _, sleep := range clock.sleeps {
+			assert.GreaterOrEqual(t, sleep, 1500*time.Millisecond)
+			assert.LessOrEqual(t, sleep, 2500*time.Millisecond)
+		}
+		assert.NotEqual(t, clock.sleeps[0], clock.sleeps[1], "sleeps should vary")
+	})
+}
+
+func killNothing(context.Context) error {
+	return nil
+}
+
+// newTestFinishShutdown returns shutdown data set up for testing
+// finishShutdown, with the given fake processes.
+func newTestFinishShutdown(table fakeProcessTable) (*shutdownData, *fakeClock, *fakeLimactl) {
+	s, clock := newTestShutdownData(true)
+	limactl := &fakeLimactl{}
+	s.runner = limactl
+	s.processes = table
+	s.findLimactl = func() (string, error) { return "/limactl", nil }
+	s.findQemu = func() (string, error) { return "/qemu", nil }
+	s.findInternalDir = func() (string, error) { return "/missing", nil }
+	return s, clock, limactl
+}
+
+// reportedStages returns the operations in the report.
+func reportedStages(s *shutdownData) []string {
+	var result []string
+	for _, stage := range s.report.Stages {
+		result = append(result, stage.Operation)
+	}
+	return result
+}
+
+func TestStopLimaTimeout(t *testing.T) {
+	testCases := []struct {
+		version  string
+		expected []string
+	}{
+		{"", []string{"stop", limaInstance}},
+		{"1.0.3", []string{"stop", limaInstance}},
+		{"2.0.0-beta.0", []string{"stop", "--timeout", "1m0s", limaInstance}},
+		{"2.1.0", []string{"stop", "--timeout", "1m0s", limaInstance}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("version %q", tc.version), func(t *testing.T) {
+			s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+			s.limactl = "/limactl"
+			limactl.version = tc.version
+			require.NoError(t, s.stopLima(context.Background()))
+			assert.Equal(t, [][]string{tc.expected}, limactl.commands)
+		})
+	}
+	t.Run("rest of the deadline", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		limactl := &fakeLimactl{version: "2.1.0", slowStop: 1000}
+		s.runner = limactl
+		_, err := s.stopLimaVM(context.Background())
+		require.NoError(t, err)
+		// The graceful checks have used up some of limaStopTimeout already.
+		assert.Equal(t, []string{"stop", "--timeout", "32s", limaInstance}, limactl.commands[0])
+		assert.Equal(t, limaStopTimeout, clock.now.Sub(newFakeClock().now))
+	})
+	t.Run("minimum", func(t *testing.T) {
+		s, clock := newTestShutdownData(true)
+		limactl := &fakeLimactl{version: "2.1.0"}
+		s.runner = limactl
+		require.NoError(t, s.stopLimaBeforeFunc(clock.now.Add(time.Second))(context.Background()))
+		assert.Equal(t, [][]string{{"stop", "--timeout", limaStopMinTimeout.String(), limaInstance}}, limactl.commands)
+	})
+}
+
+func TestLimaVersionAtLeast(t *testing.T) {
+	minimum := [3]int{2, 0, 0}
+	assert.True(t, limaVersionAtLeast([3]int{2, 0, 0}, minimum))
+	assert.True(t, limaVersionAtLeast([3]int{2, 0, 1}, minimum))
+	assert.True(t, limaVersionAtLeast([3]int{10, 0, 0}, minimum))
+	assert.False(t, limaVersionAtLeast([3]int{1, 99, 99}, minimum))
+	_, err := parseLimaVersion("limactl version HEAD")
+	assert.Error(t, err)
+}
+
+func TestParseLimaDetails(t *testing.T) {
+	testCases := []struct {
+		output      string
+		expected    LimaStatus
+		description string
+	}{
+		{"Running\t1234\t1235\n", LimaStatus{"Running", true, true}, "Running"},
+		{"Stopped\t0\t0\n", LimaStatus{"Stopped", false, false}, "Stopped"},
+		{"Broken\t1234\t0\n", LimaStatus{"Broken", true, false}, "VM down but hostagent still running"},
+		{"Broken\t0\t1235\n", LimaStatus{"Broken", false, true}, "hostagent down but VM still running"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			status, err := parseLimaDetails(tc.output)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, status)
+			assert.Equal(t, tc.description, status.String())
+		})
+	}
+	for _, output := range []string{"Running\n", "Running\t1234\n", "Running\tnone\t0\n"} {
+		_, err := parseLimaDetails(output)
+		assert.Error(t, err, "output %q", output)
+	}
+}
+
+func TestVerifyLimaStopped(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	t.Run("stopped", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, &LimaStatus{"Stopped", false, false}, s.report.LimaAfterStop)
+	})
+	t.Run("host agent lingers", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		limactl.details = []string{"Stopped\t1234\t0"}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		require.NotNil(t, s.report.LimaAfterStop)
+		assert.Equal(t, "VM down but hostagent still running", s.report.LimaAfterStop.String())
+	})
+	t.Run("unparseable", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		limactl.details = []string{"Stopped"}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Nil(t, s.report.LimaAfterStop)
+	})
+}
+
+func TestPlan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	status := &Status{
+		Lima: "Running",
+		Qemu: []ProcessInfo{},
+		App:  []ProcessInfo{{Pid: 200, Executable: "/app/rancher-desktop"}},
+	}
+	t.Run("wait", func(t *testing.T) {
+		s := newShutdownData(true)
+		assert.Equal(t, []PlanStep{
+			{Stage: "lima", Status: PlanRunning, Action: PlanStopOrForce},
+			{Stage: "qemu", Status: PlanStopped, Action: PlanNothing},
+			{Stage: "the app", Status: PlanRunning, Action: PlanStopOrForce},
+		}, s.plan(status))
+	})
+	t.Run("no wait, skipping the app", func(t *testing.T) {
+		s := newShutdownData(false, AskOnly(true), SkipAppTermination(true))
+		assert.Equal(t, []PlanStep{
+			{Stage: "lima", Status: PlanRunning, Action: PlanStop},
+			{Stage: "qemu", Status: PlanStopped, Action: PlanNothing},
+			{Stage: "the app", Status: PlanRunning, Action: PlanSkip},
+		}, s.plan(status))
+	})
+	t.Run("unknown lima status", func(t *testing.T) {
+		s := newShutdownData(true)
+		steps := s.plan(&Status{})
+		assert.Equal(t, PlanStep{Stage: "lima", Status: PlanUnknown, Action: PlanStopOrForce}, steps[0])
+	})
+}
+
+func TestSkipStages(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	testCases := []struct {
+		option   Option
+		expected []string
+		limactl  [][]string
+	}{
+		{nil, []string{"lima", "qemu", "the app"}, [][]string{{"stop", limaInstance}}},
+		{SkipLima(true), []string{"qemu", "the app"}, nil},
+		{SkipQemu(true), []string{"lima", "the app"}, [][]string{{"stop", limaInstance}}},
+		{SkipAppTermination(true), []string{"lima", "qemu"}, [][]string{{"stop", limaInstance}}},
+	}
+	for i, tc := range testCases {
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			qemu := &fakeProcess{executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, exitOn: []os.Signal{syscall.SIGINT}}
+			app := &fakeProcess{executable: "/app/rancher-desktop"}
+			s, _, limactl := newTestFinishShutdown(fakeProcessTable{100: qemu, 200: app})
+			if tc.option != nil {
+				tc.option(s)
+			}
+			require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+			// Stopping lima is reported once for each phase.
+			assert.Equal(t, tc.expected, slices.Compact(reportedStages(s)))
+			assert.Equal(t, tc.limactl, limactl.commands)
+			assert.Equal(t, slices.Contains(tc.expected, "qemu"), qemu.exited)
+			assert.Equal(t, slices.Contains(tc.expected, "the app"), app.exited)
+		})
+	}
+}
+
+func TestFinishShutdownContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	t.Run("canceled during qemu stage", func(t *testing.T) {
+		s, clock, limactl := newTestFinishShutdown(fakeProcessTable{
+			100: {executable: "/qemu"},
+			200: {executable: "/app/rancher-desktop"},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		clock.onSleep = func() {
+			if limactl.stopped {
+				cancel()
+			}
+		}
+		err := s.finishShutdown(ctx, Shutdown)
+		assert.EqualError(t, err, "interrupted while stopping qemu: context canceled")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, []string{"lima", "lima", "qemu"}, reportedStages(s))
+	})
+	t.Run("deadline exceeded", func(t *testing.T) {
+		s, clock, _ := newTestFinishShutdown(fakeProcessTable{})
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+		defer cancel()
+		clock.onSleep = func() {
+			// Simulate the deadline passing while waiting for lima.
+			cancel()
+		}
+		err := s.finishShutdown(ctx, Shutdown)
+		assert.EqualError(t, err, "interrupted while stopping lima: context canceled")
+	})
+	t.Run("already done", func(t *testing.T) {
+		for _, makeContext := range []func() (context.Context, context.CancelFunc){
+			func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			func() (context.Context, context.CancelFunc) {
+				return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			},
+		} {
+			table := fakeProcessTable{
+				100: {executable: "/qemu"},
+				200: {executable: "/app/rancher-desktop"},
+			}
+			s, clock, limactl := newTestFinishShutdown(table)
+			ctx, cancel := makeContext()
+			defer cancel()
+			err := s.finishShutdown(ctx, Shutdown)
+			assert.Equal(t, ctx.Err(), err)
+			assert.Empty(t, limactl.commands)
+			assert.Empty(t, reportedStages(s))
+			assert.Empty(t, clock.sleeps)
+			for pid, proc := range table {
+				assert.Empty(t, proc.received, "process %d should not have been signalled", pid)
+			}
+		}
+	})
+	t.Run("completes", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []string{"lima", "lima", "qemu", "the app"}, reportedStages(s))
+	})
+}
+
+func TestFinishShutdownErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	errProvider := errors.New("provider failed")
+	failing := func(context.Context) (string, error) { return "", errProvider }
+	testCases := []struct {
+		name              string
+		setup             func(*shutdownData)
+		initiatingCommand InitiatingCommand
+		expected          error
+		message           string
+	}{
+		{
+			name:     "qemu not found",
+			setup:    func(s *shutdownData) { s.findQemu = func() (string, error) { return "", errProvider } },
+			expected: ErrQemuNotFound,
+			message:  "failed to find qemu executable: provider failed",
+		},
+		{
+			name:     "application directory not found",
+			setup:    func(s *shutdownData) { s.locations.getApplicationDirectory = failing },
+			expected: ErrAppDirNotFound,
+			message:  "failed to find application directory: provider failed",
+		},
+		{
+			name:     "main executable not found",
+			setup:    func(s *shutdownData) { s.locations.getMainExecutable = failing },
+			expected: ErrMainExecutableNotFound,
+			message:  "failed to get Rancher Desktop executable: provider failed",
+		},
+		{
+			name:              "unknown initiating command",
+			setup:             func(*shutdownData) {},
+			initiatingCommand: "unknown",
+			expected:          ErrUnknownInitiatingCommand,
+			message:           `internal error: unknown shutdown initiating command of "unknown"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+			tc.setup(s)
+			initiatingCommand := tc.initiatingCommand
+			if initiatingCommand == "" {
+				initiatingCommand = Shutdown
+			}
+			err := s.finishShutdown(context.Background(), initiatingCommand)
+			assert.ErrorIs(t, err, tc.expected)
+			assert.EqualError(t, err, tc.message)
+			if tc.expected != ErrUnknownInitiatingCommand {
+				assert.ErrorIs(t, err, errProvider)
+			}
+		})
+	}
+}
+
+func TestStopPrivilegedHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there is no privileged helper process on Windows")
+	}
+	helper := filepath.Join(t.TempDir(), "socket_vmnet")
+	require.NoError(t, os.WriteFile(helper, nil, 0o755))
+	t.Run("running", func(t *testing.T) {
+		proc := &fakeProcess{executable: helper, exitOn: []os.Signal{syscall.SIGTERM}}
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{100: proc})
+		s.privilegedHelper = helper
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.True(t, proc.exited)
+		assert.Equal(t, []os.Signal{syscall.SIGTERM}, proc.received)
+		assert.Contains(t, reportedStages(s), "the privileged helper")
+	})
+	t.Run("not running", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		s.privilegedHelper = helper
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		require.Len(t, s.report.Stages, 5)
+		assert.Equal(t, "the privileged helper", s.report.Stages[3].Operation)
+		assert.Equal(t, OutcomeAlreadyGone, s.report.Stages[3].Outcome)
+	})
+	t.Run("not installed", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		s.privilegedHelper = filepath.Join(t.TempDir(), "socket_vmnet")
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.NotContains(t, reportedStages(s), "the privileged helper")
+	})
+	t.Run("insufficient privileges", func(t *testing.T) {
+		proc := &fakeProcess{executable: helper, signalError: syscall.EPERM}
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{100: proc})
+		s.privilegedHelper = helper
+		StrictErrors(true)(s)
+		err := s.finishShutdown(context.Background(), Shutdown)
+		assert.ErrorIs(t, err, ErrInsufficientPrivileges)
+		assert.ErrorContains(t, err, "failed to stop the privileged helper: insufficient privileges to stop "+helper)
+		assert.False(t, proc.exited)
+	})
+}
+
+func TestParseInitiatingCommand(t *testing.T) {
+	for _, valid := range ValidInitiatingCommands() {
+		command, err := ParseInitiatingCommand(string(valid))
+		require.NoError(t, err)
+		assert.Equal(t, valid, command)
+	}
+	assert.Equal(t, []InitiatingCommand{Shutdown, FactoryReset}, ValidInitiatingCommands())
+	_, err := ParseInitiatingCommand("reboot")
+	assert.ErrorIs(t, err, ErrUnknownInitiatingCommand)
+	assert.EqualError(t, err, `unknown shutdown initiating command of "reboot"`)
+	t.Run("checked before stopping anything", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		err := s.finishShutdown(context.Background(), "reboot")
+		assert.ErrorIs(t, err, ErrUnknownInitiatingCommand)
+		assert.Empty(t, limactl.commands)
+		assert.Empty(t, s.report.Stages)
+	})
+}
+
+func TestCleanupLimaArtifacts(t *testing.T) {
+	setup := func(t *testing.T) string {
+		limaHome := t.TempDir()
+		for _, name := range []string{
+			"0/ha.pid",
+			"0/ha.sock",
+			"0/ssh.sock",
+			"0/serial.log",
+			"_config/user.pub",
+			"_config/override.yaml",
+			"_config/agent.sock",
+		} {
+			path := filepath.Join(limaHome, filepath.FromSlash(name))
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			require.NoError(t, os.WriteFile(path, []byte(name), 0o644))
+		}
+		return limaHome
+	}
+	check := func(t *testing.T, limaHome string) {
+		for _, name := range []string{"0/ha.pid", "0/ha.sock", "0/ssh.sock"} {
+			assert.NoFileExists(t, filepath.Join(limaHome, filepath.FromSlash(name)))
+		}
+		for _, name := range []string{"0/serial.log", "_config/user.pub", "_config/override.yaml", "_config/agent.sock"} {
+			assert.FileExists(t, filepath.Join(limaHome, filepath.FromSlash(name)))
+		}
+	}
+
+	t.Run("removes artifacts", func(t *testing.T) {
+		limaHome := setup(t)
+		require.NoError(t, cleanupLimaArtifacts(limaHome))
+		check(t, limaHome)
+	})
+	t.Run("missing LIMA_HOME", func(t *testing.T) {
+		assert.NoError(t, cleanupLimaArtifacts(filepath.Join(t.TempDir(), "missing")))
+	})
+	t.Run("after factory reset", func(t *testing.T) {
+		limaHome := setup(t)
+		s, _ := newTestShutdownData(false)
+		s.limaHome = limaHome
+		require.NoError(t, s.finishLima(context.Background(), FactoryReset))
+		check(t, limaHome)
+	})
+	t.Run("not on shutdown", func(t *testing.T) {
+		limaHome := setup(t)
+		s, _ := newTestShutdownData(false)
+		s.limaHome = limaHome
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.FileExists(t, filepath.Join(limaHome, "0", "ha.pid"))
+	})
+}
+
+func TestTerminateExecutablesNamed(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"steve", "trivy", "helper"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o755))
+	}
+	sigterm := []os.Signal{syscall.SIGTERM}
+	table := fakeProcessTable{
+		100: {executable: filepath.Join(dir, "steve"), exitOn: sigterm},
+		101: {executable: filepath.Join(dir, "steve"), exitOn: sigterm},
+		200: {executable: filepath.Join(dir, "helper"), exitOn: sigterm},
+		300: {executable: "/elsewhere/steve", exitOn: sigterm},
+	}
+	s, _ := newTestShutdownData(false)
+	s.processes = table
+	err := s.terminateExecutablesNamed(context.Background(), dir, []string{"steve", "trivy", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, sigterm, table[100].received)
+	assert.Equal(t, sigterm, table[101].received)
+	assert.Empty(t, table[200].received, "unlisted executable should not be killed")
+	assert.Empty(t, table[300].received, "executable in other directory should not be killed")
+}
+
+func TestSkipAppTermination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	for _, waitForShutdown := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wait=%t", waitForShutdown), func(t *testing.T) {
+			sigterm := []os.Signal{syscall.SIGTERM}
+			table := fakeProcessTable{
+				100: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGINT}},
+				200: {executable: "/app/rancher-desktop", exitOn: sigterm},
+				300: {executable: "/missing/steve", exitOn: sigterm},
+			}
+			s, _, limactl := newTestFinishShutdown(table)
+			s.waitForShutdown = waitForShutdown
+			SkipAppTermination(true)(s)
+			s.locations.getApplicationDirectory = func(context.Context) (string, error) {
+				t.Error("application directory should not be needed")
+				return "", errors.New("unexpected")
+			}
+			require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+			assert.Equal(t, []string{"lima", "lima", "qemu"}, reportedStages(s))
+			assert.NotEmpty(t, limactl.commands, "lima should be stopped")
+			assert.True(t, table[100].exited, "qemu should be stopped")
+			assert.False(t, table[200].exited, "the app should be left running")
+			assert.Empty(t, table[200].received, "the app should not be signalled")
+			assert.False(t, table[200].groupKilled, "the app should be left running")
+			assert.Empty(t, table[300].received, "auxiliary executables should be left running")
+		})
+	}
+}
+
+func TestFinishWindows(t *testing.T) {
+	// This uses fakes, so it does not need to run on Windows.
+	setup := func(exitsOnRequest bool) (*shutdownData, fakeProcessTable, *int) {
+		s, _ := newTestShutdownData(true)
+		table := fakeProcessTable{
+			200: {executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}},
+			201: {executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}},
+		}
+		s.processes = table
+		softKills := 0
+		s.checkWindowsApp = s.isExecutableRunningFunc(context.Background(), "/app/rancher-desktop")
+		s.killWindowsApp = func(context.Context) error {
+			softKills++
+			if exitsOnRequest {
+				for _, proc := range table {
+					proc.exited = true
+				}
+			}
+			return nil
+		}
+		return s, table, &softKills
+	}
+	t.Run("soft phase suffices", func(t *testing.T) {
+		s, table, softKills := setup(true)
+		require.NoError(t, s.finishWindows(context.Background()))
+		assert.Equal(t, 1, *softKills)
+		assert.Empty(t, table[200].received, "should not force kill")
+		require.Len(t, s.report.Stages, 2)
+		assert.Equal(t, OutcomeForceKilled, s.report.Stages[0].Outcome)
+		assert.Equal(t, OutcomeAlreadyGone, s.report.Stages[1].Outcome)
+		assert.Equal(t, AppStoppedWithForce, s.report.AppStop)
+	})
+	t.Run("force phase after hung app", func(t *testing.T) {
+		s, table, softKills := setup(false)
+		require.NoError(t, s.finishWindows(context.Background()))
+		assert.Equal(t, 1, *softKills)
+		assert.Equal(t, []os.Signal{os.Kill}, table[200].received)
+		assert.Equal(t, []os.Signal{os.Kill}, table[201].received)
+		require.Len(t, s.report.Stages, 2)
+		assert.Equal(t, OutcomeForceKilled, s.report.Stages[1].Outcome)
+		assert.Equal(t, AppStoppedWithForce, s.report.AppStop)
+	})
+	t.Run("asking only", func(t *testing.T) {
+		s, table, softKills := setup(false)
+		s.waitForShutdown = false
+		AskOnly(true)(s)
+		require.NoError(t, s.finishWindows(context.Background()))
+		assert.Equal(t, 1, *softKills)
+		assert.Empty(t, table[200].received, "should not force kill")
+		require.Len(t, s.report.Stages, 1)
+		assert.Equal(t, AppStoppedGracefully, s.report.AppStop)
+	})
+}
+
+func TestAppStopReport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("see TestFinishShutdownWindowsReport")
+	}
+	t.Run("graceful", func(t *testing.T) {
+		app := &fakeProcess{executable: "/app/rancher-desktop"}
+		s, clock, _ := newTestFinishShutdown(fakeProcessTable{200: app})
+		clock.onSleep = func() {
+			// The app exits while it is being waited for.
+			app.exited = app.exited || s.stage == "the app"
+		}
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Empty(t, app.received)
+		assert.Equal(t, AppStoppedGracefully, s.report.AppStop)
+	})
+	t.Run("forced", func(t *testing.T) {
+		app := &fakeProcess{executable: "/app/rancher-desktop", exitOn: []os.Signal{syscall.SIGTERM, os.Kill}}
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{200: app})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.True(t, app.exited)
+		assert.Equal(t, AppStoppedWithForce, s.report.AppStop)
+	})
+	t.Run("skipped", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		s.skipApp = true
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Empty(t, s.report.AppStop)
+	})
+}
+
+func TestAppStopMethod(t *testing.T) {
+	testCases := []struct {
+		name     string
+		outcomes []StageOutcome
+		expected AppStopMethod
+	}{
+		{"not stopped", nil, ""},
+		{"already gone", []StageOutcome{OutcomeAlreadyGone}, AppAlreadyStopped},
+		{"exited", []StageOutcome{OutcomeExited, OutcomeAlreadyGone}, AppStoppedGracefully},
+		{"killed", []StageOutcome{OutcomeForceKilled}, AppStoppedWithForce},
+		{"killed later", []StageOutcome{OutcomeError, OutcomeForceKilled}, AppStoppedWithForce},
+		{"asked only", []StageOutcome{OutcomeAsked}, AppStoppedGracefully},
+		{"failed", []StageOutcome{OutcomeForceKilled, OutcomeError}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, appStopMethod(tc.outcomes...))
+		})
+	}
+}
+
+func TestPreShutdownHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are not run on Windows")
+	}
+	// writeHook writes a shell script to use as the hook.
+	writeHook := func(t *testing.T, script string) string {
+		path := filepath.Join(t.TempDir(), "hook")
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755))
+		return path
+	}
+	t.Run("succeeds", func(t *testing.T) {
+		hook := logrustest.NewGlobal()
+		t.Cleanup(hook.Reset)
+		s, _ := newTestShutdownData(true)
+		s.runner = execRunner{}
+		PreShutdownHook(writeHook(t, "echo flushed mirror\n"), time.Minute, true)(s)
+		require.NoError(t, s.runPreShutdownHook(context.Background()))
+		if assert.NotNil(t, hook.LastEntry()) {
+			assert.Equal(t, "Pre-shutdown hook output:\nflushed mirror", hook.LastEntry().Message)
+		}
+	})
+	t.Run("fails", func(t *testing.T) {
+		path := writeHook(t, "echo no snapshot >&2\nexit 3\n")
+		s, _ := newTestShutdownData(true)
+		s.runner = execRunner{}
+		PreShutdownHook(path, time.Minute, false)(s)
+		assert.NoError(t, s.runPreShutdownHook(context.Background()), "failure should be ignored unless strict")
+
+		PreShutdownHook(path, time.Minute, true)(s)
+		err := s.runPreShutdownHook(context.Background())
+		assert.ErrorIs(t, err, ErrPreShutdownHookFailed)
+		assert.ErrorContains(t, err, "exit status 3")
+	})
+	t.Run("times out", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		s.runner = execRunner{}
+		PreShutdownHook(writeHook(t, "exec sleep 60\n"), 100*time.Millisecond, true)(s)
+		start := time.Now()
+		err := s.runPreShutdownHook(context.Background())
+		assert.ErrorIs(t, err, ErrPreShutdownHookFailed)
+		assert.ErrorContains(t, err, "timed out after 100ms")
+		assert.Less(t, time.Since(start), 30*time.Second)
+	})
+	t.Run("runs before lima stops", func(t *testing.T) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		PreShutdownHook("/hook", time.Minute, false)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		// The fake records the arguments of each command; the hook has none.
+		if assert.GreaterOrEqual(t, len(limactl.commands), 2) {
+			assert.Empty(t, limactl.commands[0])
+			assert.Equal(t, []string{"stop", limaInstance}, limactl.commands[1])
+		}
+	})
+}
+
+func TestRunLimactlCanceled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	dir := t.TempDir()
+	limactl := filepath.Join(dir, "limactl")
+	// The background child keeps the output open after limactl is killed.
+	script := "#!/bin/sh\nsleep 60 &\necho $! > \"$0.child\"\necho $$ > \"$0.pid\"\nexec sleep 60\n"
+	require.NoError(t, os.WriteFile(limactl, []byte(script), 0o755))
+	readPid := func(path string) int {
+		var pid int
+		contents, err := os.ReadFile(path)
+		if err == nil {
+			_, err = fmt.Sscan(string(contents), &pid)
+		}
+		if err != nil {
+			return 0
+		}
+		return pid
+	}
+	t.Cleanup(func() {
+		if pid := readPid(limactl + ".child"); pid > 0 {
+			if proc, err := os.FindProcess(pid); err == nil {
+				_ = proc.Kill()
+			}
+		}
+	})
+
+	s, _ := newTestShutdownData(true)
+	s.runner = execRunner{}
+	s.limactl = limactl
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.runLimactl(ctx, "stop", limaInstance)
+	}()
+	require.Eventually(t, func() bool {
+		return readPid(limactl+".pid") > 0
+	}, 10*time.Second, 10*time.Millisecond, "limactl should have started")
+	pid := readPid(limactl + ".pid")
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "limactl stop 0 failed")
+	case <-time.After(30 * time.Second):
+		require.FailNow(t, "limactl was not stopped when the context was canceled")
+	}
+	proc, err := os.FindProcess(pid)
+	require.NoError(t, err)
+	assert.Error(t, proc.Signal(syscall.Signal(0)), "limactl should have been killed")
+}
+
+func TestLimaHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	t.Setenv("LIMA_HOME", "/default/lima")
+	limaHome := t.TempDir()
+	t.Run("runs limactl with the override", func(t *testing.T) {
+		dir := t.TempDir()
+		limactl := filepath.Join(dir, "limactl")
+		script := "#!/bin/sh\necho \"$LIMA_HOME\" > \"$0.env\"\n"
+		require.NoError(t, os.WriteFile(limactl, []byte(script), 0o755))
+		s := newShutdownData(true, LimaHome(limaHome), Limactl(limactl))
+		path, err := s.findLimactl()
+		require.NoError(t, err)
+		s.limactl = path
+		require.NoError(t, s.runLimactl(context.Background(), "stop", limaInstance))
+		contents, err := os.ReadFile(limactl + ".env")
+		require.NoError(t, err)
+		assert.Equal(t, limaHome+"\n", string(contents))
+		assert.Equal(t, "/default/lima", os.Getenv("LIMA_HOME"), "the environment should be left alone")
+	})
+	t.Run("overrides setting up lima", func(t *testing.T) {
+		s := newShutdownData(true, LimaHome(limaHome))
+		_, err := s.findLimactl()
+		require.NoError(t, err)
+		assert.Equal(t, limaHome, s.limaHome)
+		assert.Equal(t, "/default/lima", os.Getenv("LIMA_HOME"))
+	})
+	t.Run("must exist", func(t *testing.T) {
+		for _, opts := range [][]Option{
+			{LimaHome(filepath.Join(limaHome, "missing"))},
+			{LimaHome(filepath.Join(limaHome, "missing")), Limactl("/limactl")},
+		} {
+			s := newShutdownData(true, opts...)
+			_, err := s.findLimactl()
+			assert.ErrorContains(t, err, "invalid lima home")
+		}
+	})
+	t.Run("not shared between shutdowns", func(t *testing.T) {
+		otherHome := t.TempDir()
+		first := newShutdownData(true, LimaHome(limaHome), Limactl("/limactl"))
+		second := newShutdownData(true, LimaHome(otherHome), Limactl("/limactl"))
+		for _, s := range []*shutdownData{first, second} {
+			path, err := s.findLimactl()
+			require.NoError(t, err)
+			s.limactl = path
+		}
+		assert.Contains(t, first.limactlCmd(context.Background(), "ls").Env, "LIMA_HOME="+limaHome)
+		assert.Contains(t, second.limactlCmd(context.Background(), "ls").Env, "LIMA_HOME="+otherHome)
+	})
+	t.Run("limactl inherits the environment if not known", func(t *testing.T) {
+		s := newShutdownData(true, Limactl("/limactl"))
+		assert.Nil(t, s.limactlCmd(context.Background(), "ls").Env)
+	})
+}
+
+func TestSetupLimaHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	// setup returns the shutdown data using the given paths to find lima.
+	setup := func(t *testing.T, paths p.Paths) (*shutdownData, *fakeLimactl) {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		s.findLimactl = func() (string, error) {
+			limaHome, err := setupLimaHome(paths)
+			if err != nil {
+				return "", err
+			}
+			s.limaHome = limaHome
+			return "/limactl", nil
+		}
+		return s, limactl
+	}
+	t.Run("never started", func(t *testing.T) {
+		appHome := t.TempDir()
+		paths := p.Paths{AppHome: appHome, Lima: filepath.Join(appHome, "lima")}
+		_, err := setupLimaHome(paths)
+		assert.ErrorIs(t, err, ErrLimaNotSetUp)
+		s, limactl := setup(t, paths)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []string{"qemu", "the app"}, reportedStages(s))
+		assert.Empty(t, limactl.commands)
+	})
+	t.Run("setup failed", func(t *testing.T) {
+		appHome := t.TempDir()
+		paths := p.Paths{AppHome: appHome, Lima: filepath.Join(appHome, "lima")}
+		// A file where the directory should be can't be used.
+		require.NoError(t, os.WriteFile(paths.Lima, nil, 0o644))
+		_, err := setupLimaHome(paths)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrLimaNotSetUp)
+		s, limactl := setup(t, paths)
+		// The VM is still stopped, by killing qemu.
+		table := fakeProcessTable{100: {executable: "/qemu", args: []string{"/qemu", "-name", "lima-0"}, exitOn: []os.Signal{syscall.SIGKILL}}}
+		s.processes = table
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []string{"qemu", "the app"}, reportedStages(s))
+		assert.Empty(t, limactl.commands)
+		assert.True(t, table[100].exited, "qemu should have been killed")
+		assert.Empty(t, s.limaHome)
+	})
+	t.Run("set up", func(t *testing.T) {
+		appHome := t.TempDir()
+		paths := p.Paths{AppHome: appHome, Lima: filepath.Join(appHome, "lima")}
+		require.NoError(t, os.Mkdir(paths.Lima, 0o755))
+		limaHome, err := setupLimaHome(paths)
+		require.NoError(t, err)
+		assert.Equal(t, paths.Lima, limaHome)
+	})
+}
+
+func TestDiagnostics(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	// readDiagnostics returns the diagnostics written to the given directory.
+	readDiagnostics := func(t *testing.T, dir string) []StageDiagnostics {
+		data, err := os.ReadFile(filepath.Join(dir, diagnosticsFileName))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		require.NoError(t, err)
+		var result []StageDiagnostics
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry StageDiagnostics
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			result = append(result, entry)
+		}
+		return result
+	}
+	t.Run("surviving process", func(t *testing.T) {
+		dir := t.TempDir()
+		table := fakeProcessTable{
+			200: {
+				executable: "/app/rancher-desktop",
+				args:       []string{"/app/rancher-desktop", "--no-sandbox"},
+				openFiles:  12,
+			},
+		}
+		s, _, _ := newTestFinishShutdown(table)
+		Diagnostics(dir)(s)
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		var app *StageDiagnostics
+		for _, entry := range readDiagnostics(t, dir) {
+			if entry.Operation == "the app" {
+				app = &entry
+			}
+		}
+		require.NotNil(t, app, "diagnostics should be written for the app")
+		assert.Equal(t, "4s", app.Waited)
+		openFiles := 12
+		assert.Equal(t, []ProcessDiagnostics{{
+			Pid:         200,
+			Executable:  "/app/rancher-desktop",
+			CommandLine: []string{"/app/rancher-desktop", "--no-sandbox"},
+			OpenFiles:   &openFiles,
+		}}, app.Processes)
+		assert.True(t, table[200].exited, "the app should be killed after writing diagnostics")
+	})
+	t.Run("graceful exit", func(t *testing.T) {
+		dir := t.TempDir()
+		s, _ := newTestShutdownData(true)
+		Diagnostics(dir)(s)
+		s.setStageExecutable("qemu", "/qemu")
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(2), killNothing, 15, 2, "qemu")
+		require.NoError(t, err)
+		assert.Empty(t, readDiagnostics(t, dir))
+	})
+}
+
+func TestLimactlOption(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+	// Simulate limactl having been removed after its path was cached.
+	s.findLimactl = func() (string, error) {
+		return "", errors.New("limactl has been removed")
+	}
+	Limactl("/cached/limactl")(s)
+	require.NoError(t, s.finishShutdown(context.Background(), FactoryReset))
+	assert.Equal(t, [][]string{{"stop", limaInstance}, {"delete", "--force", limaInstance}}, limactl.commands)
+	assert.Equal(t, "/cached/limactl", limactl.executable)
+}
+
+func TestLimactlPathWithSpaces(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima is not used on Windows")
+	}
+	// The path is passed to limactl as a single argument, without involving
+	// a shell, so spaces don't need any special handling.
+	path := "/Applications/Rancher Desktop.app/Contents/Resources/resources/darwin/lima/bin/limactl"
+	s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+	Limactl(path)(s)
+	require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+	assert.Equal(t, path, limactl.executable)
+	assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+	status, err := s.limaStatus(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Stopped", status)
+}
+
+// comparableShutdownData returns a copy of s without the fields that can't be
+// compared: functions, and the random source.
+func comparableShutdownData(s *shutdownData) shutdownData {
+	result := *s
+	result.random = nil
+	result.locations = nil
+	result.findLimactl = nil
+	result.findQemu = nil
+	result.findInternalDir = nil
+	result.findHostSockets = nil
+	result.checkWindowsApp = nil
+	result.killWindowsApp = nil
+	result.quitApp = nil
+	return result
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		for _, wait := range []bool{false, true} {
+			expected := newShutdownData(wait)
+			actual := newShutdownData(wait, Config{WaitForShutdown: wait}.options()...)
+			assert.Equal(t, comparableShutdownData(expected), comparableShutdownData(actual))
+		}
+	})
+	t.Run("options", func(t *testing.T) {
+		counter := &ForceKillCounter{}
+		config := Config{
+			WaitForShutdown:        true,
+			KeepDisk:               true,
+			SkipApp:                true,
+			Strict:                 true,
+			PollJitter:             0.1,
+			PreShutdownHook:        "/hook",
+			PreShutdownHookTimeout: time.Second,
+			DiagnosticsDir:         "/logs",
+			ForceKills:             counter,
+			Limactl:                "/cached/limactl",
+			Options:                []Option{StrictErrors(false)},
+		}
+		expected := newShutdownData(true,
+			KeepDisk(true),
+			SkipAppTermination(true),
+			PollJitter(0.1),
+			PreShutdownHook("/hook", time.Second, false),
+			Diagnostics("/logs"),
+			CountForceKills(counter))
+		actual := newShutdownData(true, config.options()...)
+		// Options in the config take precedence over its fields.
+		assert.False(t, actual.strictErrors)
+		assert.Equal(t, comparableShutdownData(expected), comparableShutdownData(actual))
+		limactl, err := actual.findLimactl()
+		require.NoError(t, err)
+		assert.Equal(t, "/cached/limactl", limactl)
+	})
+	t.Run("entry points", func(t *testing.T) {
+		// An unknown command is rejected before anything is stopped.
+		var called []error
+		onComplete := OnComplete(func(_ *ShutdownReport, err error) {
+			called = append(called, err)
+		})
+		err := FinishShutdown(context.Background(), true, "bogus", onComplete)
+		assert.ErrorIs(t, err, ErrUnknownInitiatingCommand)
+		configErr := FinishShutdownWithConfig(context.Background(), Config{
+			WaitForShutdown:   true,
+			InitiatingCommand: "bogus",
+			Options:           []Option{onComplete},
+		})
+		assert.Equal(t, err, configErr)
+		assert.Equal(t, []error{err, configErr}, called)
+	})
+}
+
+func TestForceKillCounter(t *testing.T) {
+	t.Run("counts force-kills only", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		counter := &ForceKillCounter{}
+		CountForceKills(counter)(s)
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(0), killNothing, 5, 1, "lima")
+		require.NoError(t, err)
+		_, err = s.waitForAppToDieOrKillIt(context.Background(), runningFor(2), killNothing, 5, 1, "qemu")
+		require.NoError(t, err)
+		assert.Empty(t, counter.Counts(), "graceful exits should not be counted")
+
+		_, err = s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), killNothing, 5, 1, "qemu")
+		require.NoError(t, err)
+		_, err = s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), killNothing, 5, 1, "qemu")
+		require.NoError(t, err)
+		_, err = s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), killNothing, 5, 1, "the app")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"qemu": 2, "the app": 1}, counter.Counts())
+	})
+	t.Run("nil counter", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		_, err := s.waitForAppToDieOrKillIt(context.Background(), runningFor(100), killNothing, 5, 1, "qemu")
+		require.NoError(t, err)
+		var counter *ForceKillCounter
+		assert.NotPanics(t, func() { counter.Increment("qemu") })
+		assert.Empty(t, counter.Counts())
+	})
+}
+
+func TestStopLimaUnit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd is only used on Linux")
+	}
+	t.Run("managed", func(t *testing.T) {
+		s, _ := newTestShutdownData(true)
+		limactl := &fakeLimactl{systemdUnit: true}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		// Stopping the unit stops the VM, so limactl is not needed.
+		assert.Equal(t, [][]string{{"--user", "stop", limaUnit}}, limactl.commands)
+		assert.True(t, limactl.stopped)
+	})
+	t.Run("unmanaged", func(t *testing.T) {
+		s, _ := newTestShutdownData(false)
+		limactl := &fakeLimactl{}
+		s.runner = limactl
+		require.NoError(t, s.finishLima(context.Background(), Shutdown))
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands)
+		assert.NotEqual(t, "systemctl", limactl.executable)
+	})
+}
+
+func TestStrictErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	errStop := errors.New("stop failed")
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			sigterm := []os.Signal{syscall.SIGTERM}
+			s, _, limactl := newTestFinishShutdown(fakeProcessTable{
+				100: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGINT}},
+				200: {executable: "/app/rancher-desktop", exitOn: sigterm},
+			})
+			limactl.stopError = errStop
+			StrictErrors(strict)(s)
+			err := s.finishShutdown(context.Background(), Shutdown)
+			// Every stage is attempted either way.
+			assert.Equal(t, []string{"lima", "lima", "qemu", "the app"}, reportedStages(s))
+			if !strict {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.ErrorIs(t, err, errStop)
+			assert.ErrorContains(t, err, "failed to force-stop lima: limactl stop --force 0 failed: stop failed")
+			var merr *multierror.Error
+			require.ErrorAs(t, err, &merr)
+			assert.Len(t, merr.Errors, 1, "only the final attempt to stop lima should be reported")
+		})
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	t.Run("force-killed", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{
+			// qemu ignores SIGINT, so it has to be killed.
+			100: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGKILL}},
+		})
+		var reports []*ShutdownReport
+		var errs []error
+		OnComplete(func(report *ShutdownReport, err error) {
+			reports = append(reports, report)
+			errs = append(errs, err)
+		})(s)
+		err := s.finishShutdown(context.Background(), Shutdown)
+		require.NoError(t, err)
+		require.Len(t, reports, 1)
+		assert.Same(t, s.report, reports[0])
+		assert.True(t, reports[0].ForceKilled())
+		assert.Equal(t, []error{nil}, errs)
+	})
+	t.Run("error", func(t *testing.T) {
+		errStop := errors.New("stop failed")
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+		limactl.stopError = errStop
+		StrictErrors(true)(s)
+		var errs []error
+		OnComplete(func(report *ShutdownReport, err error) {
+			assert.False(t, report.ForceKilled())
+			errs = append(errs, err)
+		})(s)
+		err := s.finishShutdown(context.Background(), Shutdown)
+		require.ErrorIs(t, err, errStop)
+		assert.Equal(t, []error{err}, errs)
+	})
+	t.Run("nil", func(t *testing.T) {
+		s, _, _ := newTestFinishShutdown(fakeProcessTable{})
+		OnComplete(nil)(s)
+		assert.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+	})
+}
+
+func TestNoWait(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	table := fakeProcessTable{
+		// Neither process exits when asked to.
+		100: {executable: "/qemu"},
+		200: {executable: "/app/rancher-desktop", pgid: 1},
+	}
+	s, clock, limactl := newTestFinishShutdown(table)
+	s.waitForShutdown = false
+	AskOnly(true)(s)
+	counter := &ForceKillCounter{}
+	CountForceKills(counter)(s)
+	require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+	assert.False(t, s.report.ForceKilled(), "asking is not force-killing")
+	assert.Empty(t, counter.Counts())
+	for _, stage := range s.report.Stages {
+		assert.Equal(t, OutcomeAsked, stage.Outcome, "stage %s", stage.Operation)
+	}
+	assert.Equal(t, LimaStoppedGracefully, s.report.LimaStop)
+	assert.Equal(t, AppStoppedGracefully, s.report.AppStop)
+	assert.Empty(t, clock.sleeps, "should not poll")
+	assert.Equal(t, [][]string{{"stop", limaInstance}}, limactl.commands, "lima should be stopped, but not forcibly")
+	assert.Equal(t, []os.Signal{syscall.SIGINT}, table[100].received, "qemu should be asked to stop once")
+	assert.Equal(t, []os.Signal{syscall.SIGTERM}, table[200].received, "the app should be asked to stop once")
+	assert.Equal(t, []string{"lima", "qemu", "the app"}, reportedStages(s))
+}
+
+func TestNotWaitingStillForces(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	// Without AskOnly (as for factory reset), not waiting means killing
+	// everything straight away.
+	table := fakeProcessTable{
+		100: {executable: "/qemu"},
+		200: {executable: "/app/rancher-desktop", pgid: 1},
+	}
+	s, _, limactl := newTestFinishShutdown(table)
+	s.waitForShutdown = false
+	limactl.slowStop = 1000
+	require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+	assert.Equal(t, [][]string{{"stop", limaInstance}, {"stop", "--force", limaInstance}}, limactl.commands)
+	assert.Equal(t, []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL}, table[100].received)
+	assert.Equal(t, []os.Signal{os.Kill}, table[200].received)
+}
+
+func TestNotWaitingNothingRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	// Without waiting, each stage still checks once before killing, so that
+	// nothing is reported (or counted) as force-killed when nothing ran.
+	s, _, limactl := newTestFinishShutdown(fakeProcessTable{})
+	s.waitForShutdown = false
+	limactl.stopped = true
+	counter := &ForceKillCounter{}
+	CountForceKills(counter)(s)
+	require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+	assert.Empty(t, limactl.commands)
+	assert.False(t, s.report.ForceKilled())
+	assert.Empty(t, counter.Counts())
+	assert.Equal(t, LimaAlreadyStopped, s.report.LimaStop)
+	assert.Equal(t, AppAlreadyStopped, s.report.AppStop)
+}
+
+func TestConcurrentFinishShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("lima and qemu are not used on Windows")
+	}
+	// Each shutdown must use its own limactl; run with -race to check for
+	// shared state.
+	paths := []string{"/first/limactl", "/second/limactl"}
+	limactls := make([]*fakeLimactl, len(paths))
+	var wg sync.WaitGroup
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		s, _, limactl := newTestFinishShutdown(fakeProcessTable{
+			100: {executable: "/qemu", exitOn: []os.Signal{syscall.SIGINT}},
+		})
+		s.findLimactl = func() (string, error) { return path, nil }
+		limactls[i] = limactl
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.finishShutdown(context.Background(), Shutdown)
+		}()
+	}
+	wg.Wait()
+	for i, path := range paths {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, path, limactls[i].executable)
+		assert.Equal(t, [][]string{{"stop", limaInstance}}, limactls[i].commands)
+	}
+}
+
+func TestCleanupHostSockets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets are not forwarded on Windows")
+	}
+	makeSocket := func(t *testing.T, path string) {
+		listener, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, listener.Close())
+	}
+	setup := func(t *testing.T) (*shutdownData, string) {
+		dir := t.TempDir()
+		s, _ := newTestShutdownData(true)
+		CleanupSockets(true)(s)
+		s.findHostSockets = func() ([]string, error) {
+			var sockets []string
+			for _, name := range hostSocketNames {
+				sockets = append(sockets, filepath.Join(dir, name))
+			}
+			return sockets, nil
+		}
+		makeSocket(t, filepath.Join(dir, "docker.sock"))
+		makeSocket(t, filepath.Join(dir, "containerd.sock"))
+		// A regular file, which Rancher Desktop would not have created.
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "buildkitd.sock"), nil, 0o644))
+		// A socket that Rancher Desktop does not know about.
+		makeSocket(t, filepath.Join(dir, "other.sock"))
+		return s, dir
+	}
+	t.Run("VM stopped", func(t *testing.T) {
+		s, dir := setup(t)
+		s.cleanupHostSockets(s.isLimaQemuRunningFunc("/qemu"))
+		assert.NoFileExists(t, filepath.Join(dir, "docker.sock"))
+		assert.NoFileExists(t, filepath.Join(dir, "containerd.sock"))
+		assert.FileExists(t, filepath.Join(dir, "buildkitd.sock"))
+		assert.FileExists(t, filepath.Join(dir, "other.sock"))
+	})
+	t.Run("VM still running", func(t *testing.T) {
+		s, dir := setup(t)
+		s.processes = fakeProcessTable{100: {executable: "/qemu"}}
+		s.cleanupHostSockets(s.isLimaQemuRunningFunc("/qemu"))
+		assert.FileExists(t, filepath.Join(dir, "docker.sock"))
+		assert.FileExists(t, filepath.Join(dir, "containerd.sock"))
+	})
+	t.Run("sockets are left alone by default", func(t *testing.T) {
+		s, dir := setup(t)
+		s.cleanupSockets = false
+		s.findQemu = func() (string, error) { return "/qemu", nil }
+		s.findLimactl = func() (string, error) { return "", ErrLimaNotSetUp }
+		s.skipApp = true
+		require.NoError(t, s.stopAll(context.Background(), Shutdown))
+		assert.FileExists(t, filepath.Join(dir, "docker.sock"))
+	})
+}
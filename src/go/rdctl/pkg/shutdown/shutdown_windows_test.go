@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFinishShutdownWindowsReport checks the report from the Windows branch of
+// FinishShutdown; see TestFinishWindows for the details of stopping the app.
+func TestFinishShutdownWindowsReport(t *testing.T) {
+	setup := func(table fakeProcessTable) (*shutdownData, *fakeClock) {
+		s, clock := newTestShutdownData(true)
+		s.processes = table
+		s.checkWindowsApp = s.isExecutableRunningFunc(context.Background(), "/app/rancher-desktop")
+		// The app is hung, and ignores being asked to exit.
+		s.killWindowsApp = func(context.Context) error { return nil }
+		return s, clock
+	}
+	t.Run("graceful", func(t *testing.T) {
+		app := &fakeProcess{executable: "/app/rancher-desktop"}
+		s, clock := setup(fakeProcessTable{200: app})
+		clock.onSleep = func() { app.exited = true }
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Empty(t, app.received)
+		assert.Equal(t, []string{"the app", "the app"}, reportedStages(s))
+		assert.Equal(t, OutcomeExited, s.report.Stages[0].Outcome)
+		assert.Equal(t, OutcomeAlreadyGone, s.report.Stages[1].Outcome)
+		assert.Equal(t, AppStoppedGracefully, s.report.AppStop)
+		assert.False(t, s.report.ForceKilled())
+	})
+	t.Run("forced", func(t *testing.T) {
+		app := &fakeProcess{executable: "/app/rancher-desktop", exitOn: []os.Signal{os.Kill}}
+		s, _ := setup(fakeProcessTable{200: app})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, []os.Signal{os.Kill}, app.received)
+		assert.Equal(t, []string{"the app", "the app"}, reportedStages(s))
+		assert.Equal(t, OutcomeForceKilled, s.report.Stages[0].Outcome)
+		assert.Equal(t, OutcomeForceKilled, s.report.Stages[1].Outcome)
+		assert.Equal(t, AppStoppedWithForce, s.report.AppStop)
+		assert.True(t, s.report.ForceKilled())
+	})
+	t.Run("already stopped", func(t *testing.T) {
+		s, _ := setup(fakeProcessTable{})
+		require.NoError(t, s.finishShutdown(context.Background(), Shutdown))
+		assert.Equal(t, AppAlreadyStopped, s.report.AppStop)
+		assert.False(t, s.report.ForceKilled())
+	})
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// hostSocketNames are the sockets that Rancher Desktop forwards from the VM
+// into the secondary application data directory.
+var hostSocketNames = []string{"docker.sock", "containerd.sock", "buildkitd.sock"}
+
+// CleanupSockets makes shutdown remove the sockets forwarded from the VM to the
+// host, once the VM has stopped; otherwise, they are left behind (stale).
+func CleanupSockets(cleanup bool) Option {
+	return func(s *shutdownData) {
+		s.cleanupSockets = cleanup
+	}
+}
+
+// hostSockets returns the paths of the sockets forwarded from the VM.
+func hostSockets() ([]string, error) {
+	appPaths, err := p.GetPaths()
+	if err != nil {
+		return nil, err
+	}
+	sockets := make([]string, 0, len(hostSocketNames))
+	for _, name := range hostSocketNames {
+		sockets = append(sockets, filepath.Join(appPaths.AltAppHome, name))
+	}
+	return sockets, nil
+}
+
+// cleanupHostSockets removes the stale sockets forwarded from the VM.  This is
+// skipped unless checkQemu confirms the VM is down, as the sockets are in use
+// otherwise.  Errors are logged and otherwise ignored.
+func (s *shutdownData) cleanupHostSockets(checkQemu func() (bool, error)) {
+	running, err := checkQemu()
+	if err != nil {
+		logrus.Errorf("Not removing sockets; failed to check if the VM is running: %s", err)
+		return
+	} else if running {
+		logrus.Infof("Not removing sockets; the VM is still running")
+		return
+	}
+	sockets, err := s.findHostSockets()
+	if err != nil {
+		logrus.Errorf("Not removing sockets; failed to find them: %s", err)
+		return
+	}
+	for _, socket := range sockets {
+		if err := removeStaleSocket(socket); err != nil {
+			logrus.Errorf("Ignoring error trying to remove %s: %s", socket, err)
+		}
+	}
+}
+
+// removeStaleSocket removes the given file, as long as it is a socket owned by
+// the current user; anything else there was not created by Rancher Desktop.
+func removeStaleSocket(socket string) error {
+	info, err := os.Lstat(socket)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("not a socket")
+	}
+	if !ownedByCurrentUser(info) {
+		return fmt.Errorf("not owned by the current user")
+	}
+	logrus.Infof("Removing stale socket %s", socket)
+	return os.Remove(socket)
+}
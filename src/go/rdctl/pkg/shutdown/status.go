@@ -0,0 +1,103 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Status describes the Rancher Desktop processes that are currently running.
+type Status struct {
+	// Lima is the state of the VM as reported by limactl (e.g. "Running"); it is
+	// empty if lima could not be queried.
+	Lima string `json:"lima"`
+	// Qemu lists the running qemu processes.
+	Qemu []ProcessInfo `json:"qemu"`
+	// App lists the running main application processes.
+	App []ProcessInfo `json:"app"`
+}
+
+// ProcessInfo describes a single running process.
+type ProcessInfo struct {
+	Pid        int    `json:"pid"`
+	Executable string `json:"executable"`
+}
+
+// GetStatus reports on the Rancher Desktop processes that are currently
+// running, without changing anything.
+func GetStatus(ctx context.Context) (*Status, error) {
+	s := newShutdownData(false)
+	var statusFunc func(context.Context) (string, error)
+	var qemuExecutable string
+	if runtime.GOOS != "windows" {
+		if limactl, err := s.findLimactl(); err != nil {
+			logrus.Debugf("Ignoring error trying to set up lima: %s", err)
+		} else {
+			s.limactl = limactl
+			statusFunc = s.limaStatus
+		}
+		var err error
+		if qemuExecutable, err = s.findQemu(); err != nil {
+			logrus.Debugf("Ignoring error trying to find qemu: %s", err)
+		}
+	}
+	return s.status(ctx, statusFunc, qemuExecutable)
+}
+
+// status implements GetStatus; the lima status function and qemu executable
+// are skipped if not set.
+func (s *shutdownData) status(ctx context.Context, statusFunc func(context.Context) (string, error), qemuExecutable string) (*Status, error) {
+	result := &Status{Qemu: []ProcessInfo{}, App: []ProcessInfo{}}
+	if statusFunc != nil {
+		limaStatus, err := statusFunc(ctx)
+		if err != nil {
+			logrus.Debugf("Ignoring error getting lima status: %s", err)
+		} else {
+			result.Lima = limaStatus
+		}
+	}
+	var err error
+	if qemuExecutable != "" {
+		if result.Qemu, err = s.findProcesses(qemuExecutable); err != nil {
+			return nil, fmt.Errorf("failed to find qemu processes: %w", err)
+		}
+	}
+	mainExecutable, err := s.locations.MainExecutable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMainExecutableNotFound, err)
+	}
+	if result.App, err = s.findProcesses(mainExecutable); err != nil {
+		return nil, fmt.Errorf("failed to find application processes: %w", err)
+	}
+	return result, nil
+}
+
+func (s *shutdownData) findProcesses(executable string) ([]ProcessInfo, error) {
+	pids, err := s.processes.FindPids(executable)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ProcessInfo, 0, len(pids))
+	for _, pid := range pids {
+		result = append(result, ProcessInfo{Pid: pid, Executable: executable})
+	}
+	return result, nil
+}
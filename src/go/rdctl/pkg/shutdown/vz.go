@@ -0,0 +1,122 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// vzExecutable is the helper that runs virtual machines for
+// Virtualization.framework on macOS; with the vz backend, lima's VM runs in
+// one of these (rather than in qemu).
+const vzExecutable = "/System/Library/Frameworks/Virtualization.framework/Versions/A/XPCServices/com.apple.Virtualization.VirtualMachine.xpc/Contents/MacOS/com.apple.Virtualization.VirtualMachine"
+
+// vzSignals is the sequence of signals used to terminate the vz helper.
+var vzSignals = []signalStep{
+	{signal: syscall.SIGTERM, wait: 5 * time.Second},
+	{signal: syscall.SIGKILL},
+}
+
+// limaVMType returns the vmType (e.g. "qemu" or "vz") set in the
+// configuration of the lima instance, or an empty string if it is not known.
+func (s *shutdownData) limaVMType() string {
+	if s.limaHome == "" {
+		return ""
+	}
+	file, err := os.Open(filepath.Join(s.limaHome, limaInstance, "lima.yaml"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logrus.Debugf("Failed to read the lima configuration: %s", err)
+		}
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Only top-level keys count; nested ones are indented.
+		value, found := strings.CutPrefix(scanner.Text(), "vmType:")
+		if !found {
+			continue
+		}
+		value, _, _ = strings.Cut(value, "#")
+		return strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return ""
+}
+
+// limaVZPids returns the pids of the vz helpers running the lima VM.  Other
+// applications may run VMs with the same helper, whose command line does not
+// say which VM it is running; the one running lima's has the disks in the
+// instance directory open.  If LIMA_HOME is not known, none are found.
+func (s *shutdownData) limaVZPids() ([]int, error) {
+	if s.limaHome == "" {
+		return nil, nil
+	}
+	pids, err := s.processes.FindPids(vzExecutable)
+	if err != nil || len(pids) == 0 {
+		return nil, err
+	}
+	holders, err := s.processes.FileHolders(filepath.Join(s.limaHome, limaInstance))
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(pids, func(pid int) bool {
+		return !slices.Contains(holders, pid) || s.isZombie(pid)
+	}), nil
+}
+
+// stopVZ stops the vz helper running the VM, if lima uses the vz backend,
+// returning a function that checks if it is running; if lima does not use vz,
+// nothing is done, and the function is nil.
+func (s *shutdownData) stopVZ(ctx context.Context) (func() (bool, error), error) {
+	if vmType := s.limaVMType(); vmType != "vz" {
+		logrus.Debugf("Not stopping the vz helper: lima uses %q", vmType)
+		return nil, nil
+	}
+	s.setStageExecutable("vz", vzExecutable)
+	checkVZ := func() (bool, error) {
+		pids, err := s.limaVZPids()
+		return len(pids) > 0, err
+	}
+	terminateVZ := func(ctx context.Context) error {
+		return s.signalUntilExit(ctx, "the vz helper", vzExecutable, vzSignals, func() (int, error) {
+			pids, err := s.limaVZPids()
+			if err != nil || len(pids) == 0 {
+				return 0, err
+			}
+			return pids[0], nil
+		})
+	}
+	if err := s.runStage(ctx, checkVZ, terminateVZ, 15, 2, "vz"); err != nil {
+		s.stopFailed("kill the vz helper", err)
+	}
+	if err := s.checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return checkVZ, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/directories"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/factoryreset"
+	p "github.com/rancher-sandbox/rancher-desktop/src/go/rdctl/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// exitPollInterval is how often WaitForExit checks on the processes.
+const exitPollInterval = 2 * time.Second
+
+// namedCheck is a check function, plus a description of what it checks for.
+type namedCheck struct {
+	name  string
+	check func() (bool, error)
+}
+
+// WaitForExit waits for Rancher Desktop (the VM, qemu, and the application) to
+// exit on its own, without killing anything.  This is meant for use after the
+// application has been asked to quit by other means.  If anything is still
+// running once the timeout elapses, an error naming the survivors is returned.
+func WaitForExit(ctx context.Context, timeout time.Duration) error {
+	s := newShutdownData(true)
+	checks, err := s.exitChecks(ctx)
+	if err != nil {
+		return err
+	}
+	return s.waitForExit(ctx, timeout, checks)
+}
+
+// exitChecks returns the checks needed to determine if Rancher Desktop is
+// still running.
+func (s *shutdownData) exitChecks(ctx context.Context) ([]namedCheck, error) {
+	if runtime.GOOS == "windows" {
+		return []namedCheck{{"the app", factoryreset.CheckProcessWindows}}, nil
+	}
+	var checks []namedCheck
+	if limactl, err := s.findLimactl(); err != nil {
+		logrus.Errorf("Ignoring error trying to set up lima: %s", err)
+	} else {
+		s.limactl = limactl
+		checks = append(checks,
+			namedCheck{"lima", s.checkLimaFunc(ctx)},
+			namedCheck{"the lima host agent", limaSocketCheck(s.limaHome)})
+	}
+	qemuExecutable, err := s.findQemu()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrQemuNotFound, err)
+	}
+	checks = append(checks, namedCheck{"qemu", s.isLimaQemuRunningFunc(qemuExecutable)})
+	mainExecutablePath, err := s.locations.MainExecutable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMainExecutableNotFound, err)
+	}
+	checks = append(checks, namedCheck{"the app", s.isExecutableRunningFunc(ctx, mainExecutablePath)})
+	return checks, nil
+}
+
+// waitForExit polls the given checks until none of them report running, or
+// the timeout elapses.
+func (s *shutdownData) waitForExit(ctx context.Context, timeout time.Duration, checks []namedCheck) error {
+	deadline := s.clock.Now().Add(timeout)
+	for {
+		var survivors []namedCheck
+		for _, check := range checks {
+			running, err := check.check()
+			if err != nil {
+				return fmt.Errorf("while checking %s, found error: %w", check.name, err)
+			}
+			if running {
+				survivors = append(survivors, check)
+			} else {
+				logrus.Debugf("%s is no longer running\n", check.name)
+			}
+		}
+		if len(survivors) == 0 {
+			return nil
+		}
+		// Once something has exited, there's no need to check it again.
+		checks = survivors
+		remaining := deadline.Sub(s.clock.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("timed out waiting for exit; still running: %s", describeChecks(survivors))
+		}
+		if err := s.clock.Sleep(ctx, min(exitPollInterval, remaining)); err != nil {
+			return fmt.Errorf("stopped waiting for exit; still running: %s: %w", describeChecks(survivors), err)
+		}
+	}
+}
+
+// limaSocketCheck returns a check for whether the lima host agent socket in the
+// given LIMA_HOME still exists.  Lima may report the VM as stopped before the
+// host agent has exited, and starting the VM again then fails.
+func limaSocketCheck(limaHome string) func() (bool, error) {
+	return func() (bool, error) {
+		if limaHome == "" {
+			return false, nil
+		}
+		_, err := os.Lstat(filepath.Join(limaHome, limaInstance, "ha.sock"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+func describeChecks(checks []namedCheck) string {
+	names := make([]string, 0, len(checks))
+	for _, check := range checks {
+		names = append(names, check.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// FindLimactl returns the path to limactl, and the LIMA_HOME of the
+// application directory.  This can be used to look up limactl before doing
+// anything that might remove it, and then passed to FinishShutdown via the
+// Limactl and LimaHome options.
+func FindLimactl() (limactl, limaHome string, err error) {
+	return findLimactlIn("")
+}
+
+// findLimactlIn returns the path to limactl, and the LIMA_HOME to use: the given
+// directory or, if that is empty, the one in the application directory.
+func findLimactlIn(limaHome string) (string, string, error) {
+	if limaHome != "" {
+		if err := checkLimaHome(limaHome); err != nil {
+			return "", "", err
+		}
+	} else {
+		paths, err := p.GetPaths()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get application paths: %w", err)
+		}
+		if limaHome, err = setupLimaHome(paths); err != nil {
+			return "", "", err
+		}
+	}
+	limactl, err := directories.GetLimactlPath()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get path to limactl: %w", err)
+	}
+	return limactl, limaHome, nil
+}
+
+// checkLimaHome makes sure that the given LIMA_HOME is a directory.
+func checkLimaHome(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid lima home: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid lima home: %s is not a directory", dir)
+	}
+	return nil
+}
+
+// setupLimaHome returns the LIMA_HOME in the application directory.  If the
+// lima directory does not exist, nothing can have been started, so
+// ErrLimaNotSetUp is returned.  Otherwise, if it can't be used, that error is
+// returned: there is no other directory the VM could be in, and lima's own
+// default might hold unrelated instances.  The qemu stage still kills the VM in
+// that case.
+func setupLimaHome(paths p.Paths) (string, error) {
+	if _, err := os.Stat(paths.Lima); errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s does not exist", ErrLimaNotSetUp, paths.Lima)
+	}
+	if err := checkLimaHome(paths.Lima); err != nil {
+		return "", fmt.Errorf("failed to set up lima directory: %w", err)
+	}
+	return paths.Lima, nil
+}
@@ -13,3 +13,11 @@ func (wsl MockWSL) ExportDistro(distroName, fileName string) error {
 func (wsl MockWSL) ImportDistro(distroName, installLocation, fileName string) error {
 	return nil
 }
+
+func (wsl MockWSL) TerminateDistro(distroName string) error {
+	return nil
+}
+
+func (wsl MockWSL) UnmountDisk(diskPath string) error {
+	return nil
+}
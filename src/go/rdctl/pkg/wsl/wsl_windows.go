@@ -20,6 +20,10 @@ type WSL interface {
 	// and names it distroName. Installs the distro in the directory
 	// given by installLocation.
 	ImportDistro(distroName, installLocation, fileName string) error
+	// Terminates the given distro, if it is running.
+	TerminateDistro(distroName string) error
+	// Detaches the given disk image from WSL, if it is attached.
+	UnmountDisk(diskPath string) error
 }
 
 type WSLImpl struct{}
@@ -75,6 +79,26 @@ func (wsl WSLImpl) ImportDistro(distroName, installLocation, fileName string) er
 	return nil
 }
 
+func (wsl WSLImpl) TerminateDistro(distroName string) error {
+	cmd := exec.Command("wsl.exe", "--terminate", distroName)
+	// Prevents "signals" (think ctrl+C) from affecting called subprocess
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: windows.CREATE_NO_WINDOW}
+	if output, err := cmd.Output(); err != nil {
+		return fmt.Errorf("failed to terminate WSL distro %q: %w", distroName, wrapWSLError(output, err))
+	}
+	return nil
+}
+
+func (wsl WSLImpl) UnmountDisk(diskPath string) error {
+	cmd := exec.Command("wsl.exe", "--unmount", diskPath)
+	// Prevents "signals" (think ctrl+C) from affecting called subprocess
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: windows.CREATE_NO_WINDOW}
+	if output, err := cmd.Output(); err != nil {
+		return fmt.Errorf("failed to unmount WSL disk %q: %w", diskPath, wrapWSLError(output, err))
+	}
+	return nil
+}
+
 // wrapWSLError is used to make errors returned from
 // *exec.Cmd.Output() more helpful. It combines the string from the
 // returned error, any data written to stdout, and any data written